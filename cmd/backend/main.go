@@ -12,21 +12,33 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 
+	"github.com/r7rainz/auramail/internal/account"
+	"github.com/r7rainz/auramail/internal/admin"
 	"github.com/r7rainz/auramail/internal/auth"
 	"github.com/r7rainz/auramail/internal/gmail"
+	"github.com/r7rainz/auramail/internal/secrets"
 	"github.com/r7rainz/auramail/internal/user"
 
 	authgoogle "github.com/r7rainz/auramail/internal/auth/google"
+	"github.com/r7rainz/auramail/internal/auth/microsoft"
+	"github.com/r7rainz/auramail/internal/auth/provider"
 )
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		// Credentialed (cookie) requests need the exact origin echoed back,
+		// browsers refuse "*" for them.
+		if origin := r.Header.Get("Origin"); provider.TrustedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+auth.CSRFHeaderName)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-		if r.Method == "OPTION" {
+		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -61,11 +73,52 @@ func main() {
 	mux := http.NewServeMux()
 	googleCfg := authgoogle.NewOAuthConfig()
 
-	userRepo := user.NewPostgresRepository(db)
-	googleHandler := authgoogle.NewHandler(googleCfg, userRepo)
-	authHandler := auth.NewHandler(googleCfg, userRepo)
+	keys, err := secrets.LoadKeyRing()
+	if err != nil {
+		log.Fatalf("Unable to load credential keys: %v", err)
+	}
 
-	gmailHandler := gmail.NewHandler(userRepo)
+	if _, err := auth.LoadKeySet(); err != nil {
+		log.Fatalf("Unable to load JWT signing keys: %v", err)
+	}
+
+	userRepo := user.NewPostgresRepository(db, keys)
+	refreshStore := auth.NewPostgresRefreshTokenStore(db)
+	sessionStore := auth.NewPostgresSessionStore(db)
+	revocations := auth.NewPersistentRevocationList(auth.NewPostgresRevocationStore(db))
+	defer revocations.Close()
+	if err := revocations.Start(ctx, 15*time.Second); err != nil {
+		log.Fatalf("Unable to load revoked tokens: %v", err)
+	}
+	patStore := auth.NewPostgresPersonalAccessTokenStore(db)
+	inviteStore := user.NewPostgresInviteStore(db)
+	authCodeStore := auth.NewPostgresAuthCodeStore(db)
+	authService := auth.NewService(userRepo, refreshStore, sessionStore, revocations, patStore, authCodeStore)
+	authenticator := auth.NewAuthenticator(revocations, patStore, sessionStore, userRepo)
+	googleHandler := authgoogle.NewHandler(googleCfg, userRepo, authService)
+	providers := provider.NewRegistry(googleHandler)
+	if microsoftCfg := microsoft.NewOAuthConfig(); microsoftCfg != nil {
+		microsoftHandler := microsoft.NewHandler(microsoftCfg, userRepo, authService)
+		microsoftHandler.RegisterRoutes(mux)
+		providers[microsoftHandler.Name()] = microsoftHandler
+	}
+	authHandler := auth.NewHandler(googleCfg, userRepo, authService)
+
+	attachmentStore := gmail.NewPostgresAttachmentStore(db)
+	threadStore := gmail.NewPostgresThreadStore(db)
+	backfiller := gmail.NewBackfiller(gmail.NewPostgresBackfillStore(db), attachmentStore, threadStore, userRepo, providers)
+	if err := backfiller.Start(ctx); err != nil {
+		log.Fatalf("Unable to resume backfills: %v", err)
+	}
+	syncCursors := gmail.NewPostgresSyncCursorStore(db)
+	watchStore := gmail.NewPostgresWatchStore(db)
+	watchManager := gmail.NewWatchManager(watchStore, userRepo, providers)
+	watchManager.Start(ctx, time.Hour)
+	ingester := gmail.NewIngester(userRepo, providers, syncCursors, attachmentStore, threadStore)
+	ingester.Start(ctx, 2)
+	gmailHandler := gmail.NewHandler(userRepo, providers, backfiller, syncCursors, watchManager, attachmentStore, threadStore)
+	adminHandler := admin.NewHandler(userRepo, inviteStore, authService)
+	accountHandler := account.NewHandler(userRepo, authService, providers, backfiller)
 
 	log.Printf("Google OAuth RedirectURL: %s", googleCfg.RedirectURL)
 
@@ -73,12 +126,43 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
-	mux.HandleFunc("/auth/google", googleHandler.GoogleAuth)
-	mux.HandleFunc("/auth/google/callback", googleHandler.GoogleCallback)
+	googleHandler.RegisterRoutes(mux)
+	mux.HandleFunc("POST /auth/token", authHandler.ExchangeToken)
 	mux.HandleFunc("POST /auth/refresh", authHandler.Refresh)
-	mux.Handle("POST /auth/logout", auth.AuthMiddleware(http.HandlerFunc(authHandler.Logout)))
-	mux.Handle("GET /emails/sync", auth.AuthMiddleware(http.HandlerFunc(gmailHandler.SyncPlacementEmails)))
-	mux.Handle("GET /emails/stream", auth.AuthMiddleware((http.HandlerFunc(gmailHandler.StreamPlacementEmails))))
+	mux.HandleFunc("GET /.well-known/jwks.json", authHandler.JWKS)
+	mux.Handle("POST /auth/logout", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.Logout)))
+	mux.Handle("GET /auth/sessions", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.ListSessions)))
+	mux.Handle("DELETE /auth/sessions", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.RevokeAllSessions)))
+	mux.Handle("DELETE /auth/sessions/{id}", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.RevokeSession)))
+	mux.Handle("POST /auth/personal-tokens", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.CreatePersonalAccessToken)))
+	mux.Handle("GET /auth/personal-tokens", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.ListPersonalAccessTokens)))
+	mux.Handle("DELETE /auth/personal-tokens/{id}", authenticator.AuthMiddleware(http.HandlerFunc(authHandler.RevokePersonalAccessToken)))
+	mux.Handle("DELETE /me", authenticator.AuthMiddleware(http.HandlerFunc(accountHandler.DeleteMe)))
+	mux.Handle("GET /me/scopes", authenticator.AuthMiddleware(http.HandlerFunc(accountHandler.Scopes)))
+	mux.Handle("GET /me/mailbox", authenticator.AuthMiddleware(http.HandlerFunc(accountHandler.Mailbox)))
+	mux.Handle("PUT /me/mailbox/imap", authenticator.AuthMiddleware(http.HandlerFunc(accountHandler.LinkIMAP)))
+	mux.Handle("DELETE /me/mailbox/imap", authenticator.AuthMiddleware(http.HandlerFunc(accountHandler.UnlinkIMAP)))
+	mux.Handle("GET /admin/users", authenticator.RequireRole(user.RoleAdmin, http.HandlerFunc(adminHandler.ListUsers)))
+	mux.Handle("PUT /admin/users/{id}/role", authenticator.RequireRole(user.RoleAdmin, http.HandlerFunc(adminHandler.UpdateRole)))
+	mux.Handle("PUT /admin/users/{id}/status", authenticator.RequireRole(user.RoleAdmin, http.HandlerFunc(adminHandler.UpdateStatus)))
+	mux.Handle("POST /admin/invites", authenticator.RequireRole(user.RoleAdmin, http.HandlerFunc(adminHandler.CreateInvite)))
+	mux.Handle("GET /admin/invites", authenticator.RequireRole(user.RoleAdmin, http.HandlerFunc(adminHandler.ListInvites)))
+	mux.Handle("DELETE /admin/invites/{id}", authenticator.RequireRole(user.RoleAdmin, http.HandlerFunc(adminHandler.RevokeInvite)))
+	mux.Handle("GET /emails/sync", authenticator.RequireScope(auth.ScopeEmailsSync, http.HandlerFunc(gmailHandler.SyncPlacementEmails)))
+	mux.Handle("POST /emails/backfill", authenticator.RequireScope(auth.ScopeEmailsSync, http.HandlerFunc(gmailHandler.StartBackfill)))
+	mux.Handle("GET /emails/backfill", authenticator.RequireScope(auth.ScopeEmailsSync, http.HandlerFunc(gmailHandler.BackfillStatus)))
+	mux.Handle("DELETE /emails/backfill", authenticator.RequireScope(auth.ScopeEmailsSync, http.HandlerFunc(gmailHandler.CancelBackfill)))
+	if pushCfg := gmail.LoadPushConfig(); pushCfg.Enabled() {
+		pushVerifier, err := gmail.NewPushVerifier(ctx, pushCfg)
+		if err != nil {
+			log.Fatalf("Unable to set up gmail push: %v", err)
+		}
+		pushHandler := gmail.NewPushHandler(pushVerifier, watchStore, syncCursors, ingester)
+		mux.HandleFunc("POST /gmail/push", pushHandler.Push)
+	}
+	mux.Handle("GET /emails/stream", authenticator.RequireScope(auth.ScopeSummariesRead, http.HandlerFunc(gmailHandler.StreamPlacementEmails)))
+	mux.Handle("GET /emails/threads", authenticator.RequireScope(auth.ScopeSummariesRead, http.HandlerFunc(gmailHandler.ListThreads)))
+	mux.Handle("GET /emails/threads/{threadId}", authenticator.RequireScope(auth.ScopeSummariesRead, http.HandlerFunc(gmailHandler.GetThread)))
 
 	handlerWithCORS := corsMiddleware(mux)
 	srv  := &http.Server{
@@ -111,5 +195,13 @@ func main() {
 		log.Fatalf("GraceFul shutdown failed: %v", err)
 	}
 
+	// The push endpoint is closed, so no new syncs come in; finish the
+	// queued ones, whose notifications Pub/Sub will not deliver again.
+	ingester.Close()
+
+	// Running backfills stay marked as running and resume on the next start.
+	cancel()
+	backfiller.Wait()
+
 	log.Println("Server exited cleanly")
 }
@@ -0,0 +1,69 @@
+// Command promote sets the role of an existing account by email. It is how
+// the first admin is made, since /admin only takes requests from admins:
+//
+//	go run ./cmd/promote you@vitbhopal.ac.in
+//	go run ./cmd/promote -role coordinator someone@vitbhopal.ac.in
+//
+// The account must have logged in once. The new role reaches its access
+// token at the next refresh.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+func main() {
+	roleFlag := flag.String("role", string(user.RoleAdmin), "student, coordinator or admin")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: promote [-role admin] email\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	email := flag.Arg(0)
+	role, err := user.ParseRole(*roleFlag)
+	if err != nil {
+		log.Fatalf("Unknown role %q: must be student, coordinator or admin", *roleFlag)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_ = godotenv.Load()
+
+	dsn := os.Getenv("GOOSE_DBSTRING")
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URL")
+	}
+	db, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		log.Fatalf("Unable to connect to database : %v", err)
+	}
+	defer db.Close()
+
+	// Roles are not encrypted, so no credential keys are needed.
+	userRepo := user.NewPostgresRepository(db, nil)
+	id, err := userRepo.UpdateRoleByEmail(ctx, email, role)
+	if errors.Is(err, user.ErrUserNotFound) {
+		log.Fatalf("No account for %s; log in with it once first", email)
+	}
+	if err != nil {
+		log.Fatalf("Promotion failed: %v", err)
+	}
+
+	log.Printf("User %d (%s) is now %s", id, email, role)
+}
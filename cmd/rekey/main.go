@@ -0,0 +1,48 @@
+// Command rekey re-encrypts every stored provider credential with the active
+// key from CREDENTIAL_KEYS. Run it after adding a new key version and pointing
+// CREDENTIAL_ACTIVE_KEY at it; old versions can be dropped from the ring once
+// it reports success.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+
+	"github.com/r7rainz/auramail/internal/secrets"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	_ = godotenv.Load()
+
+	dsn := os.Getenv("GOOSE_DBSTRING")
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URL")
+	}
+	db, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		log.Fatalf("Unable to connect to database : %v", err)
+	}
+	defer db.Close()
+
+	keys, err := secrets.LoadKeyRing()
+	if err != nil {
+		log.Fatalf("Unable to load credential keys: %v", err)
+	}
+
+	userRepo := user.NewPostgresRepository(db, keys)
+	count, err := userRepo.RotateCredentialKeys(ctx)
+	if err != nil {
+		log.Fatalf("Key rotation failed: %v", err)
+	}
+
+	log.Printf("Re-encrypted %d credentials with key version %d", count, keys.ActiveVersion())
+}
@@ -0,0 +1,305 @@
+package account
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/mailbox/imap"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// Handler serves /me. Routes must be wrapped with Authenticator.AuthMiddleware,
+// which keeps personal access tokens away from account management.
+type Handler struct {
+	users       user.Repository
+	authService *auth.Service
+	providers   provider.Registry
+	jobs        BackgroundJobs
+}
+
+// BackgroundJobs stops work running on a user's behalf, so nothing writes
+// their data back after it is purged.
+type BackgroundJobs interface {
+	Stop(ctx context.Context, userID int) error
+}
+
+func NewHandler(users user.Repository, authService *auth.Service, providers provider.Registry, jobs BackgroundJobs) *Handler {
+	return &Handler{users: users, authService: authService, providers: providers, jobs: jobs}
+}
+
+// DeleteMe deletes the caller's account. The provider grant is revoked first,
+// while the refresh token is still at hand; if that fails the deletion goes
+// ahead anyway and the tombstone records that the grant may still be live.
+// Sessions are revoked before the data is purged so access tokens already
+// handed out stop working immediately. Once started, the deletion finishes
+// even if the client goes away.
+func (h *Handler) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+
+	u, err := h.users.FindByID(ctx, strconv.Itoa(userID))
+	if err != nil {
+		log.Printf("account deletion: failed to load user %d: %v", userID, err)
+		http.Error(w, "failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	grantRevoked := true
+	if err := h.providers.RevokeGrant(ctx, u); err != nil {
+		log.Printf("account deletion: failed to revoke provider grant of user %d: %v", userID, err)
+		grantRevoked = false
+	}
+
+	// A half-done purge would leave the account neither usable nor gone.
+	ctx = context.WithoutCancel(ctx)
+
+	if err := h.authService.RevokeAllSessions(ctx, userID); err != nil {
+		log.Printf("account deletion: failed to revoke sessions of user %d: %v", userID, err)
+		http.Error(w, "failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.jobs.Stop(ctx, userID); err != nil {
+		log.Printf("account deletion: failed to stop background jobs of user %d: %v", userID, err)
+		http.Error(w, "failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.users.DeleteAccount(ctx, u, grantRevoked)
+	if err != nil && !errors.Is(err, user.ErrUserNotFound) {
+		log.Printf("account deletion: failed to purge user %d: %v", userID, err)
+		http.Error(w, "failed to delete account", http.StatusInternalServerError)
+		return
+	}
+	ai.ForgetUser(userID)
+
+	log.Printf("deleted account of user %d (grant revoked: %t)", userID, grantRevoked)
+	if cookies := auth.LoadCookieConfig(); cookies.Enabled {
+		cookies.ClearAuthCookies(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type scopesResponse struct {
+	Granted   []string `json:"granted"`
+	Available []string `json:"available"`
+}
+
+// Scopes lists the optional features the caller's provider offers and which
+// of them the user has already granted.
+func (h *Handler) Scopes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := h.users.FindByID(r.Context(), strconv.Itoa(userID))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	resp := scopesResponse{Granted: []string{}, Available: h.providers.OptionalScopes(u)}
+	missing := h.providers.MissingScopes(u, resp.Available...)
+	for _, feature := range resp.Available {
+		if !slices.Contains(missing, feature) {
+			resp.Granted = append(resp.Granted, feature)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type imapAccountRequest struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+type imapAccountResponse struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Auth     string `json:"auth"`
+}
+
+type mailboxResponse struct {
+	Provider string               `json:"provider"`
+	IMAP     *imapAccountResponse `json:"imap"`
+}
+
+// Mailbox shows where the caller's mail is read from: their login provider,
+// or an IMAP account if one is linked.
+func (h *Handler) Mailbox(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	writeMailbox(w, u)
+}
+
+// LinkIMAP reads the caller's mail from an IMAP server from now on. The
+// settings are tried out before they are saved, so a typo is reported here
+// rather than by the next sync.
+func (h *Handler) LinkIMAP(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	var req imapAccountRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	account, msg := req.account()
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if account.Auth == user.IMAPAuthXOAuth2 {
+		feature := h.providers.IMAPScope(u)
+		if feature == "" {
+			http.Error(w, "your login provider cannot sign in to imap, use an app password", http.StatusBadRequest)
+			return
+		}
+		if !h.providers.RequireScopes(w, u, feature) {
+			return
+		}
+	}
+
+	cfg, err := h.providers.IMAPConfig(u, account)
+	if err == nil {
+		checkCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = imap.Check(checkCtx, cfg)
+		cancel()
+	}
+	switch {
+	case errors.Is(err, mailbox.ErrReauthRequired):
+		http.Error(w, "imap login failed, check the username and app password", http.StatusBadRequest)
+		return
+	case errors.Is(err, imap.ErrPrivateAddress):
+		http.Error(w, "imap host must be a public address", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("imap check for user %d failed: %v", u.ID, err)
+		http.Error(w, "could not connect to the imap server", http.StatusBadGateway)
+		return
+	}
+
+	// A backfill of the old mailbox would go on with page tokens the new
+	// one does not understand.
+	if err := h.jobs.Stop(ctx, u.ID); err != nil {
+		log.Printf("failed to stop background jobs of user %d: %v", u.ID, err)
+		http.Error(w, "failed to link imap account", http.StatusInternalServerError)
+		return
+	}
+	if err := h.users.SaveIMAPAccount(ctx, u.ID, account); err != nil {
+		log.Printf("failed to link imap account of user %d: %v", u.ID, err)
+		http.Error(w, "failed to link imap account", http.StatusInternalServerError)
+		return
+	}
+
+	u.IMAP = account
+	writeMailbox(w, u)
+}
+
+// UnlinkIMAP goes back to reading mail through the login provider.
+func (h *Handler) UnlinkIMAP(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if err := h.jobs.Stop(r.Context(), u.ID); err != nil {
+		log.Printf("failed to stop background jobs of user %d: %v", u.ID, err)
+		http.Error(w, "failed to unlink imap account", http.StatusInternalServerError)
+		return
+	}
+	if err := h.users.DeleteIMAPAccount(r.Context(), u.ID); err != nil {
+		log.Printf("failed to unlink imap account of user %d: %v", u.ID, err)
+		http.Error(w, "failed to unlink imap account", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) currentUser(w http.ResponseWriter, r *http.Request) (*user.User, bool) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	u, err := h.users.FindByID(r.Context(), strconv.Itoa(userID))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return nil, false
+	}
+	if u.Provider == "" {
+		u.Provider = provider.DefaultProvider
+	}
+	return u, true
+}
+
+// account validates the request. Only the standard IMAP ports are accepted:
+// 993 with TLS and 143 with STARTTLS.
+func (req imapAccountRequest) account() (*user.IMAPAccount, string) {
+	account := &user.IMAPAccount{
+		Host:     strings.ToLower(strings.TrimSpace(req.Host)),
+		Port:     req.Port,
+		Username: strings.TrimSpace(req.Username),
+		Auth:     req.Auth,
+		Password: req.Password,
+	}
+	if account.Port == 0 {
+		account.Port = 993
+	}
+	if account.Auth == "" {
+		account.Auth = user.IMAPAuthPassword
+	}
+
+	switch {
+	case account.Host == "" || strings.ContainsAny(account.Host, " /:@[]"):
+		return nil, "host must be a host name such as imap.college.edu"
+	case account.Port != 993 && account.Port != 143:
+		return nil, "port must be 993 or 143"
+	case account.Username == "":
+		return nil, "username is required"
+	case account.Auth == user.IMAPAuthPassword && account.Password == "":
+		return nil, "password is required"
+	case account.Auth == user.IMAPAuthXOAuth2:
+		account.Password = ""
+	case account.Auth != user.IMAPAuthPassword:
+		return nil, `auth must be "password" or "xoauth2"`
+	}
+	return account, ""
+}
+
+func writeMailbox(w http.ResponseWriter, u *user.User) {
+	resp := mailboxResponse{Provider: u.Provider}
+	if a := u.IMAP; a != nil {
+		resp.IMAP = &imapAccountResponse{Host: a.Host, Port: a.Port, Username: a.Username, Auth: a.Auth}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
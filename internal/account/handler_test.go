@@ -0,0 +1,140 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/auth/authtest"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+type fakeProvider struct {
+	provider.IdentityProvider
+	revoked  []string
+	err      error
+	onRevoke func() // runs during RevokeGrant when set
+}
+
+func (p *fakeProvider) Name() string { return "google" }
+
+func (p *fakeProvider) RevokeGrant(ctx context.Context, refreshToken string) error {
+	p.revoked = append(p.revoked, refreshToken)
+	if p.onRevoke != nil {
+		p.onRevoke()
+	}
+	return p.err
+}
+
+type fakeJobs struct {
+	stopped []int
+}
+
+func (j *fakeJobs) Stop(ctx context.Context, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	j.stopped = append(j.stopped, userID)
+	return nil
+}
+
+func TestDeleteMe(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	tests := []struct {
+		name       string
+		revokeErr  error
+		disconnect bool // the client goes away while the grant is revoked
+		want       bool
+	}{
+		{"grant revoked", nil, false, true},
+		{"revocation fails", errors.New("google unavailable"), false, false},
+		{"client disconnects", nil, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &user.User{ID: 7, Email: "student@vitbhopal.ac.in", Provider: "google", RefreshToken: "google-refresh"}
+			repo := &authtest.UserRepo{Users: map[string]*user.User{u.Email: u}}
+			revocations := auth.NewMemoryRevocationList()
+			sessions := &authtest.SessionStore{}
+			svc := auth.NewService(repo, authtest.RefreshStore{}, sessions, revocations, nil, nil)
+			authn := auth.NewAuthenticator(revocations, nil, sessions, repo)
+			google := &fakeProvider{err: tt.revokeErr}
+			jobs := &fakeJobs{}
+			h := NewHandler(repo, svc, provider.NewRegistry(google), jobs)
+
+			pair, err := svc.IssueTokens(context.Background(), u, auth.ClientInfo{})
+			if err != nil {
+				t.Fatalf("IssueTokens: %v", err)
+			}
+			call := func() int {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				if tt.disconnect {
+					google.onRevoke = cancel
+				}
+				req := httptest.NewRequestWithContext(ctx, http.MethodDelete, "/me", nil)
+				req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+				rec := httptest.NewRecorder()
+				authn.AuthMiddleware(http.HandlerFunc(h.DeleteMe)).ServeHTTP(rec, req)
+				return rec.Code
+			}
+
+			if code := call(); code != http.StatusNoContent {
+				t.Fatalf("DELETE /me = %d, want 204", code)
+			}
+			if len(google.revoked) != 1 || google.revoked[0] != "google-refresh" {
+				t.Errorf("revoked grants = %v", google.revoked)
+			}
+			if _, ok := repo.Users[u.Email]; ok || repo.GrantRevoked != tt.want {
+				t.Errorf("deleted = %t, grantRevoked = %t, want true, %t", !ok, repo.GrantRevoked, tt.want)
+			}
+			if len(jobs.stopped) != 1 || jobs.stopped[0] != 7 {
+				t.Errorf("background jobs stopped for %v, want [7]", jobs.stopped)
+			}
+			if code := call(); code != http.StatusUnauthorized {
+				t.Errorf("access token still accepted after deletion: %d", code)
+			}
+		})
+	}
+}
+
+func TestLinkIMAPRejectsBadSettings(t *testing.T) {
+	u := &user.User{ID: 7, Email: "student@college.edu", Provider: "google", RefreshToken: "google-refresh"}
+	repo := &authtest.UserRepo{Users: map[string]*user.User{u.Email: u}}
+	jobs := &fakeJobs{}
+	h := NewHandler(repo, nil, provider.NewRegistry(&fakeProvider{}), jobs)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `host=imap.college.edu`},
+		{"missing host", `{"username": "student", "password": "secret"}`},
+		{"url as host", `{"host": "imap.college.edu/x", "username": "student", "password": "secret"}`},
+		{"non-imap port", `{"host": "imap.college.edu", "port": 6379, "username": "student", "password": "secret"}`},
+		{"missing password", `{"host": "imap.college.edu", "username": "student"}`},
+		{"unknown auth", `{"host": "imap.college.edu", "username": "student", "auth": "plain"}`},
+		{"xoauth2 without provider support", `{"host": "imap.college.edu", "username": "student", "auth": "xoauth2"}`},
+		{"loopback host", `{"host": "127.0.0.1", "username": "student", "password": "secret"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/me/mailbox/imap", strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), auth.UserIDContextKey, 7))
+			rec := httptest.NewRecorder()
+			h.LinkIMAP(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("PUT /me/mailbox/imap = %d, want 400 (%s)", rec.Code, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+	if u.IMAP != nil || len(jobs.stopped) != 0 {
+		t.Errorf("rejected settings were saved: %+v, stopped jobs %v", u.IMAP, jobs.stopped)
+	}
+}
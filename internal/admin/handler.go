@@ -0,0 +1,253 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// Handler serves /admin endpoints. Every route must be wrapped with
+// Authenticator.RequireRole(user.RoleAdmin, ...).
+type Handler struct {
+	users       user.Repository
+	invites     user.InviteStore
+	authService *auth.Service
+}
+
+func NewHandler(users user.Repository, invites user.InviteStore, authService *auth.Service) *Handler {
+	return &Handler{users: users, invites: invites, authService: authService}
+}
+
+type userResponse struct {
+	ID       int         `json:"id"`
+	Email    string      `json:"email"`
+	Name     string      `json:"name"`
+	Provider string      `json:"provider"`
+	Role     user.Role   `json:"role"`
+	Status   user.Status `json:"status"`
+}
+
+type updateRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type updateStatusRequest struct {
+	Status string `json:"status"`
+}
+
+type createInviteRequest struct {
+	Email         string `json:"email"`
+	MaxUses       int    `json:"maxUses"`
+	ExpiresInDays int    `json:"expiresInDays"`
+}
+
+type createInviteResponse struct {
+	*user.Invite
+	Code string `json:"code"`
+}
+
+// ListUsers optionally filters by ?status=, e.g. status=pending for the
+// approval queue.
+func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	var status user.Status
+	if s := r.URL.Query().Get("status"); s != "" {
+		var err error
+		if status, err = user.ParseStatus(s); err != nil {
+			http.Error(w, "status must be active, pending or rejected", http.StatusBadRequest)
+			return
+		}
+	}
+
+	users, err := h.users.List(r.Context())
+	if err != nil {
+		log.Printf("failed to list users: %v", err)
+		http.Error(w, "failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]userResponse, 0, len(users))
+	for _, u := range users {
+		if status != "" && u.Status != status {
+			continue
+		}
+		resp = append(resp, userResponse{ID: u.ID, Email: u.Email, Name: u.Name, Provider: u.Provider, Role: u.Role, Status: u.Status})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := r.Context().Value(auth.UserIDContextKey).(int)
+
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	var req updateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	role, err := user.ParseRole(req.Role)
+	if err != nil {
+		http.Error(w, "role must be student, coordinator or admin", http.StatusBadRequest)
+		return
+	}
+
+	// Keeps the last admin from locking everyone out by accident.
+	if userID == adminID {
+		http.Error(w, "cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	err = h.users.UpdateRole(r.Context(), userID, role)
+	if errors.Is(err, user.ErrUserNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to update role of user %d: %v", userID, err)
+		http.Error(w, "failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("admin %d set role of user %d to %s", adminID, userID, role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateStatus approves or rejects a user. Anyone no longer active is logged
+// out everywhere and loses their personal access tokens.
+func (h *Handler) UpdateStatus(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := r.Context().Value(auth.UserIDContextKey).(int)
+
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	var req updateStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	status, err := user.ParseStatus(req.Status)
+	if err != nil {
+		http.Error(w, "status must be active, pending or rejected", http.StatusBadRequest)
+		return
+	}
+
+	if userID == adminID {
+		http.Error(w, "cannot change your own status", http.StatusBadRequest)
+		return
+	}
+
+	err = h.users.UpdateStatus(r.Context(), userID, status)
+	if errors.Is(err, user.ErrUserNotFound) {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to update status of user %d: %v", userID, err)
+		http.Error(w, "failed to update status", http.StatusInternalServerError)
+		return
+	}
+
+	if status != user.StatusActive {
+		if err := h.authService.RevokeAllAccess(r.Context(), userID); err != nil {
+			log.Printf("failed to revoke access of user %d: %v", userID, err)
+			http.Error(w, "failed to update status", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("admin %d set status of user %d to %s", adminID, userID, status)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateInvite returns the plaintext code, which is never stored and cannot
+// be shown again.
+func (h *Handler) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := r.Context().Value(auth.UserIDContextKey).(int)
+
+	var req createInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 || req.ExpiresInDays < 0 {
+		http.Error(w, "maxUses and expiresInDays must be positive", http.StatusBadRequest)
+		return
+	}
+
+	code, hash, err := user.NewInviteCode()
+	if err != nil {
+		http.Error(w, "failed to create invite", http.StatusInternalServerError)
+		return
+	}
+	invite := &user.Invite{
+		CodeHash:  hash,
+		Email:     strings.TrimSpace(req.Email),
+		MaxUses:   req.MaxUses,
+		CreatedBy: adminID,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	if err := h.invites.Create(r.Context(), invite); err != nil {
+		log.Printf("failed to create invite for admin %d: %v", adminID, err)
+		http.Error(w, "failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createInviteResponse{Invite: invite, Code: code})
+}
+
+func (h *Handler) ListInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := h.invites.ListActive(r.Context())
+	if err != nil {
+		log.Printf("failed to list invites: %v", err)
+		http.Error(w, "failed to list invites", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+func (h *Handler) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.invites.Revoke(r.Context(), id)
+	if errors.Is(err, user.ErrInviteNotFound) {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to revoke invite %d: %v", id, err)
+		http.Error(w, "failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,14 +2,19 @@ package ai
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
+
+	"github.com/r7rainz/auramail/internal/utils"
 )
 
 type AIResult struct {
@@ -28,8 +33,29 @@ type AIResult struct {
 	Requirements      any      `json:"requirements"`
 	Description       *string  `json:"description"`
 	AttachmentSummary *string  `json:"attachmentSummary"`
+
+	// Attachments lists the files that were read for the summary, with the
+	// reason for any that could not be. It is filled in here, not by the model.
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// ThreadID is the conversation the email belongs to. The pipeline sets
+	// it, and on a thread's merged summary it names the thread.
+	ThreadID string `json:"threadId,omitempty"`
 }
 
+// Attachment is the text of a file attached to an email, or the reason no
+// text could be read from it.
+type Attachment struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"-"`
+	Error    string `json:"error,omitempty"`
+}
+
+// maxAttachmentPrompt is the share of the prompt all attachments of an email
+// get together; each gets an equal part of it.
+const maxAttachmentPrompt = 6000
+
 type cacheItem struct {
 	data      *AIResult
 	timestamp time.Time
@@ -44,6 +70,20 @@ var (
 
 const CacheTTL = 1 * time.Hour
 
+// ForgetUser drops every cached analysis for userID. The cache lives in this
+// process only; other instances age their copies out after CacheTTL.
+func ForgetUser(userID int) {
+	prefix := fmt.Sprintf("user:%d:", userID)
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for key := range aiCache {
+		if strings.HasPrefix(key, prefix) {
+			delete(aiCache, key)
+		}
+	}
+}
+
 func getClient() *openai.Client {
 	once.Do(func() {
 		apiKey := os.Getenv("OPENAI_API_KEY")
@@ -54,22 +94,22 @@ func getClient() *openai.Client {
 	return client
 }
 
-func AnalyzeEmail(ctx context.Context,userID int, subject, snippet, body string) (*AIResult, error) {
-	cacheKey := fmt.Sprintf("user:%d:%s:%s", userID, subject, snippet)
-	if len(cacheKey) > 100 {
-		cacheKey = cacheKey[:100]
-	}
+func AnalyzeEmail(ctx context.Context,userID int, subject, snippet, body string, attachments []Attachment) (*AIResult, error) {
+	cacheKey := analysisKey(userID, subject, snippet, body, attachments)
 
 	cacheMu.RLock()
 	cached, exists := aiCache[cacheKey]
 	cacheMu.RUnlock()
 	if exists && time.Since(cached.timestamp) < CacheTTL {
-		return cached.data, nil
+		// Callers may set fields on what they get back; the cached copy
+		// stays as the model returned it.
+		result := *cached.data
+		return &result, nil
 	}
 
 	truncatedBody := body
 	if len(body) > 4000 { // Reduced slightly to leave room for the heavy prompt
-		truncatedBody = body[:4000] + "..."
+		truncatedBody = utils.TruncateRunes(body, 4000) + "..."
 	}
 
 	systemPrompt := `You are a highly specialized AI assistant for academic and recruitment analysis. 
@@ -79,13 +119,14 @@ RULES:
 - otherLinks: Must be an array of strings [].
 - eligibility, timings, salary, location, eventDetails, requirements: Must be a single string with \n• bullet points.
 - company, role, applyLink, description, attachmentSummary: Use a string or null.
+- attachmentSummary: What the attachments add (job description, eligibility, shortlisted names, schedule), or null if there are none.
 - If data is missing, use null (not empty string).`
 
-	userPrompt := fmt.Sprintf("Subject: %s\nSnippet: %s\nBody: %s", subject, snippet, truncatedBody)
+	userPrompt := fmt.Sprintf("Subject: %s\nSnippet: %s\nBody: %s", subject, snippet, truncatedBody) + attachmentPrompt(attachments)
 
 	c := getClient()
 	if c == nil {
-		return &AIResult{Summary: subject, Category: "misc"}, nil
+		return &AIResult{Summary: subject, Category: "misc", Attachments: attachments}, nil
 	}
 
 	resp, err := c.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
@@ -114,9 +155,51 @@ RULES:
 		return nil, err
 	}
 
+	result.Attachments = attachments
+
 	cacheMu.Lock()
 	aiCache[cacheKey] = cacheItem{data: &result, timestamp: time.Now()}
 	cacheMu.Unlock()
 
-	return &result, nil
+	out := result
+	return &out, nil
+}
+
+// analysisKey hashes everything the prompt is built from, so a follow-up mail
+// that only changes the body (a new deadline, a venue) is analysed afresh.
+// The user prefix is kept readable for ForgetUser.
+func analysisKey(userID int, subject, snippet, body string, attachments []Attachment) string {
+	h := sha256.New()
+	for _, part := range []string{subject, snippet, body} {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+	for _, a := range attachments {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(a.Filename), a.Filename, len(a.Text), a.Text)
+	}
+	return fmt.Sprintf("user:%d:%s", userID, hex.EncodeToString(h.Sum(nil)))
+}
+
+// attachmentPrompt lists the text of the attachments that have any, each cut
+// to its share of maxAttachmentPrompt.
+func attachmentPrompt(attachments []Attachment) string {
+	var readable []Attachment
+	for _, a := range attachments {
+		if a.Text != "" {
+			readable = append(readable, a)
+		}
+	}
+	if len(readable) == 0 {
+		return ""
+	}
+
+	share := maxAttachmentPrompt / len(readable)
+	var b strings.Builder
+	for _, a := range readable {
+		text := a.Text
+		if len(text) > share {
+			text = utils.TruncateRunes(text, share) + "..."
+		}
+		fmt.Fprintf(&b, "\nAttachment %s:\n%s", a.Filename, text)
+	}
+	return b.String()
 }
@@ -0,0 +1,58 @@
+package attachment
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/r7rainz/auramail/internal/utils"
+)
+
+// extractCSV writes one line per record with " | " between the fields that
+// have content. Exports from Excel in many locales use semicolons and the
+// Windows code page, so the delimiter is taken from the first line and text
+// that is not UTF-8 is read as Windows-1252.
+func extractCSV(data []byte, w *textWriter) error {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	text := utils.DecodeCharset(data, "", "text/csv")
+
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+	r.Comma = delimiter(text)
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		w.newline()
+		for i, field := range record {
+			if i > 0 {
+				w.sep = " | "
+			}
+			if err := w.text(field); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// delimiter picks whichever of comma, semicolon and tab is most common on
+// the first line.
+func delimiter(text string) rune {
+	first, _, _ := strings.Cut(text, "\n")
+	best, count := ',', strings.Count(first, ",")
+	for _, c := range []rune{';', '\t'} {
+		if n := strings.Count(first, string(c)); n > count {
+			best, count = c, n
+		}
+	}
+	return best
+}
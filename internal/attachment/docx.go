@@ -0,0 +1,89 @@
+package attachment
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// extractDOCX writes the paragraphs of the main document part one per line
+// and table rows one per line with " | " between cells, the way HTML bodies
+// are rendered for the summarizer.
+func extractDOCX(data []byte, w *textWriter) error {
+	zr, err := openPackage(data)
+	if err != nil {
+		return err
+	}
+	dec, rc, err := openPart(zr, "word/document.xml")
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var (
+		inText bool
+		cells  []int // cells seen in each open table row
+		inCell int
+	)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read document: %w", err)
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				w.space = true
+			case "br", "cr":
+				w.newline()
+			case "tr":
+				cells = append(cells, 0)
+				w.newline()
+			case "tc":
+				inCell++
+				if k := len(cells) - 1; k >= 0 {
+					if cells[k] > 0 {
+						w.sep = " | "
+					}
+					cells[k]++
+				}
+			}
+		case xml.EndElement:
+			switch el.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				// Paragraphs within a cell stay on the row's line.
+				if inCell > 0 {
+					w.space = true
+				} else {
+					w.newline()
+				}
+			case "tc":
+				inCell--
+			case "tr":
+				if len(cells) > 0 {
+					cells = cells[:len(cells)-1]
+				}
+				w.newline()
+			case "tbl":
+				w.paragraph()
+			}
+		case xml.CharData:
+			if !inText {
+				continue
+			}
+			if err := w.text(string(el)); err != nil {
+				return err
+			}
+		}
+	}
+}
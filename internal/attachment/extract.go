@@ -0,0 +1,196 @@
+// Package attachment reads the text out of the files placement offices attach
+// to their mail: PDFs, Word documents, Excel workbooks and CSV exports. It is
+// pure Go and every format is read within fixed limits, since the files come
+// from outside and may be broken or hostile.
+package attachment
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxSize is the largest attachment that is downloaded at all.
+	MaxSize = 10 << 20
+
+	// MaxText bounds the text kept from one attachment.
+	MaxText = 32 << 10
+
+	// maxUnpacked bounds what a single compressed zip entry or PDF stream
+	// may inflate to.
+	maxUnpacked = 32 << 20
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported attachment type")
+	ErrTooLarge    = errors.New("attachment too large")
+	ErrEncrypted   = errors.New("attachment is encrypted")
+	ErrNoText      = errors.New("no text found")
+)
+
+// Kind is a format text can be extracted from.
+type Kind string
+
+const (
+	PDF  Kind = "pdf"
+	DOCX Kind = "docx"
+	XLSX Kind = "xlsx"
+	CSV  Kind = "csv"
+)
+
+var kindByMimeType = map[string]Kind{
+	"application/pdf": PDF,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": DOCX,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       XLSX,
+	"text/csv":                    CSV,
+	"text/comma-separated-values": CSV,
+	"application/csv":             CSV,
+}
+
+var kindByExtension = map[string]Kind{
+	".pdf":  PDF,
+	".docx": DOCX,
+	".xlsx": XLSX,
+	".csv":  CSV,
+}
+
+// KindOf tells the format of an attachment from its MIME type, or from the
+// file name when the sender labelled it generically, as many clients do with
+// application/octet-stream. It returns "" for formats Extract cannot read.
+func KindOf(filename, mimeType string) Kind {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = strings.TrimSpace(mimeType[:i])
+	}
+	if kind, ok := kindByMimeType[mimeType]; ok {
+		return kind
+	}
+	return kindByExtension[strings.ToLower(path.Ext(filename))]
+}
+
+// Extract returns the text of data, a file of the given kind, cut to MaxText.
+// Errors name the kind and wrap ErrUnsupported, ErrTooLarge, ErrEncrypted or
+// ErrNoText where one of those is the reason.
+func Extract(kind Kind, data []byte) (string, error) {
+	if len(data) > MaxSize {
+		return "", fmt.Errorf("%s: %w", kind, ErrTooLarge)
+	}
+
+	var w textWriter
+	var err error
+	switch kind {
+	case PDF:
+		err = extractPDF(data, &w)
+	case DOCX:
+		err = extractDOCX(data, &w)
+	case XLSX:
+		err = extractXLSX(data, &w)
+	case CSV:
+		err = extractCSV(data, &w)
+	default:
+		return "", fmt.Errorf("%q: %w", kind, ErrUnsupported)
+	}
+	if errors.Is(err, errTextFull) {
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", kind, err)
+	}
+
+	text := w.String()
+	if text == "" {
+		return "", fmt.Errorf("%s: %w", kind, ErrNoText)
+	}
+	return text, nil
+}
+
+// errTextFull stops an extractor once MaxText has been written.
+var errTextFull = errors.New("text limit reached")
+
+// textWriter collects extracted text one word at a time. Separators are held
+// back until the next word, so no line starts or ends with one and runs of
+// line breaks collapse into a single blank line.
+type textWriter struct {
+	b     strings.Builder
+	space bool
+	sep   string
+	lines int // line breaks pending before the next word
+}
+
+// word writes s after whatever separator is pending. Once MaxText is reached
+// it returns errTextFull and writes nothing more.
+func (w *textWriter) word(s string) error {
+	if s == "" {
+		return nil
+	}
+	if w.b.Len() >= MaxText {
+		return errTextFull
+	}
+	switch {
+	case w.b.Len() == 0:
+	case w.lines > 1:
+		w.b.WriteString("\n\n")
+	case w.lines == 1:
+		w.b.WriteByte('\n')
+	case w.sep != "":
+		w.b.WriteString(w.sep)
+	case w.space:
+		w.b.WriteByte(' ')
+	}
+	w.space, w.sep, w.lines = false, "", 0
+
+	if rest := MaxText - w.b.Len(); len(s) > rest {
+		for rest > 0 && !utf8.RuneStart(s[rest]) {
+			rest--
+		}
+		w.b.WriteString(s[:rest])
+		return errTextFull
+	}
+	w.b.WriteString(s)
+	return nil
+}
+
+// text writes s, splitting it into words on white space.
+func (w *textWriter) text(s string) error {
+	s = strings.ToValidUTF8(s, "�")
+	if s != "" && isSpace(s[0]) {
+		w.space = true
+	}
+	for i, f := range strings.Fields(s) {
+		if i > 0 {
+			w.space = true
+		}
+		if err := w.word(f); err != nil {
+			return err
+		}
+	}
+	if s != "" && isSpace(s[len(s)-1]) {
+		w.space = true
+	}
+	return nil
+}
+
+func (w *textWriter) newline() {
+	if w.lines < 1 {
+		w.lines = 1
+	}
+}
+
+func (w *textWriter) paragraph() {
+	w.lines = 2
+}
+
+func (w *textWriter) String() string {
+	return w.b.String()
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package attachment
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		filename, mimeType string
+		want               Kind
+	}{
+		{"JD.pdf", "application/pdf", PDF},
+		{"Eligibility.XLSX", "application/octet-stream", XLSX},
+		{"shortlist.csv", "text/csv; charset=utf-8", CSV},
+		{"notice", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", DOCX},
+		{"poster.png", "image/png", ""},
+		{"old.doc", "application/msword", ""},
+	}
+	for _, tt := range tests {
+		if got := KindOf(tt.filename, tt.mimeType); got != tt.want {
+			t.Errorf("KindOf(%q, %q) = %q, want %q", tt.filename, tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestExtractCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"commas", "Name,Branch,CGPA\r\n\"Rao, Asha\",CSE,8.1\r\nVikram,,7.4\r\n", "Name | Branch | CGPA\nRao, Asha | CSE | 8.1\nVikram | 7.4"},
+		{"semicolons and BOM", "\xef\xbb\xbfName;Venue\nAsha;Hall 2\n", "Name | Venue\nAsha | Hall 2"},
+		{"windows-1252", "Company,CTC\nContoso,\x80 12L\n", "Company | CTC\nContoso | € 12L"},
+		{"ragged rows", "Round,Date,Time\nOnline test,5 March\n\nInterview,6 March,10 AM,Room 4\n", "Round | Date | Time\nOnline test | 5 March\nInterview | 6 March | 10 AM | Room 4"},
+	}
+	for _, tt := range tests {
+		got, err := Extract(CSV, []byte(tt.input))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Extract = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	long := strings.Repeat("Eligibility criteria €,", MaxText)
+	got, err := Extract(CSV, []byte(long))
+	if err != nil || len(got) > MaxText || len(got) < MaxText-4 || !utf8.ValidString(got) {
+		t.Errorf("Extract of a long file returned %d bytes, %v", len(got), err)
+	}
+
+	if _, err := Extract(CSV, make([]byte, MaxSize+1)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Extract of an oversized file = %v, want ErrTooLarge", err)
+	}
+	if _, err := Extract("png", []byte("\x89PNG")); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Extract of an image = %v, want ErrUnsupported", err)
+	}
+	if _, err := Extract(CSV, []byte(" , ,\n")); !errors.Is(err, ErrNoText) {
+		t.Errorf("Extract of an empty sheet = %v, want ErrNoText", err)
+	}
+}
+
+// FuzzExtract checks that no input makes an extractor panic, hang or
+// return more than MaxText of invalid UTF-8.
+func FuzzExtract(f *testing.F) {
+	f.Add("pdf", buildPDF("",
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		stream("/Filter /FlateDecode", deflate("BT (Drive) Tj [(on) -300 (Friday)] TJ ET")),
+	))
+	f.Add("pdf", []byte("%PDF-1.4\n1 0 obj << /Type /ObjStm /N 9 /First 3 >> stream\n1 0 [1 0 R] endstream"))
+	f.Add("docx", buildZip(map[string]string{"word/document.xml": "<document><body><p><t>JD</t></p></body></document>"}))
+	f.Add("xlsx", buildZip(map[string]string{
+		"xl/workbook.xml":          `<workbook><sheets><sheet name="S"/></sheets></workbook>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row><c r="XFD1" t="s"><v>7</v></c></row></sheetData></worksheet>`,
+	}))
+	f.Add("csv", []byte("a;\"b\nc\";d"))
+
+	f.Fuzz(func(t *testing.T, kind string, data []byte) {
+		text, err := Extract(Kind(kind), data)
+		if err != nil {
+			return
+		}
+		if len(text) > MaxText || !utf8.ValidString(text) {
+			t.Errorf("Extract returned %d bytes, valid UTF-8: %v", len(text), utf8.ValidString(text))
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package attachment
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// oleMagic starts a Compound File, the container of the legacy .doc and .xls
+// formats and of password-protected Office files of any version.
+var oleMagic = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// openPackage opens an Office Open XML file, which is a zip of XML parts.
+func openPackage(data []byte) (*zip.Reader, error) {
+	if bytes.HasPrefix(data, oleMagic) {
+		return nil, fmt.Errorf("%w: password-protected or legacy Office file", ErrEncrypted)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package: %w", err)
+	}
+	return zr, nil
+}
+
+// errMissingPart is returned by openPart for a part the package lacks.
+var errMissingPart = errors.New("missing part")
+
+// openPart returns a decoder for the named part, reading at most
+// maxUnpacked bytes of it so a zip bomb cannot exhaust memory.
+func openPart(zr *zip.Reader, name string) (*xml.Decoder, io.Closer, error) {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		dec := xml.NewDecoder(io.LimitReader(rc, maxUnpacked))
+		dec.Strict = false
+		return dec, rc, nil
+	}
+	return nil, nil, fmt.Errorf("%s: %w", name, errMissingPart)
+}
+
+// attrValue returns the attribute of el with the given local name.
+func attrValue(el xml.StartElement, local string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package attachment
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func buildZip(files map[string]string) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range files {
+		f, _ := zw.Create(name)
+		f.Write([]byte(content))
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+const wordNS = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"`
+
+func TestExtractDOCX(t *testing.T) {
+	document := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document ` + wordNS + `><w:body>
+<w:p><w:r><w:t>Job Description:</w:t></w:r><w:r><w:t xml:space="preserve"> Software </w:t></w:r><w:r><w:t>Engi</w:t></w:r><w:r><w:t>neer</w:t></w:r></w:p>
+<w:p><w:r><w:t>Location</w:t><w:tab/><w:t>Pune</w:t><w:br/><w:t>Bond: none</w:t></w:r></w:p>
+<w:tbl>
+  <w:tr><w:tc><w:p><w:r><w:t>Branch</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>CGPA</w:t></w:r></w:p></w:tc></w:tr>
+  <w:tr><w:tc><w:p><w:r><w:t>CSE</w:t></w:r></w:p><w:p><w:r><w:t>IT</w:t></w:r></w:p></w:tc><w:tc><w:p/></w:tc><w:tc><w:p><w:r><w:t>7.0</w:t></w:r></w:p></w:tc></w:tr>
+</w:tbl>
+<w:p><w:r><w:instrText>HYPERLINK "x"</w:instrText><w:t>Apply by 5 March</w:t></w:r></w:p>
+</w:body></w:document>`
+
+	got, err := Extract(DOCX, buildZip(map[string]string{"word/document.xml": document}))
+	want := "Job Description: Software Engineer\nLocation Pune\nBond: none\nBranch | CGPA\nCSE IT | 7.0\n\nApply by 5 March"
+	if err != nil || got != want {
+		t.Errorf("Extract = %q, %v\nwant %q", got, err, want)
+	}
+
+	if _, err := Extract(DOCX, append(oleMagic, make([]byte, 512)...)); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Extract of an OLE file = %v, want ErrEncrypted", err)
+	}
+	if _, err := Extract(DOCX, buildZip(map[string]string{"word/other.xml": "<x/>"})); err == nil {
+		t.Error("Extract of a package without a document succeeded")
+	}
+}
+
+func TestExtractXLSX(t *testing.T) {
+	files := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>
+			<sheet name="Shortlist" sheetId="1" r:id="rId2"/><sheet name="Schedule" sheetId="2" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships>
+			<Relationship Id="rId1" Target="worksheets/sheet2.xml"/><Relationship Id="rId2" Target="/xl/worksheets/sheet1.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>Roll No</t></si><si><t>Name</t></si><si><r><t>Asha </t></r><r><t>Rao</t></r><rPh><t>ア</t></rPh></si></sst>`,
+		"xl/styles.xml": `<styleSheet><numFmts><numFmt numFmtId="164" formatCode="dd/mm/yyyy"/><numFmt numFmtId="165" formatCode="&quot;Rs&quot; 0.00"/></numFmts>
+			<cellXfs><xf numFmtId="0"/><xf numFmtId="164"/><xf numFmtId="165"/><xf numFmtId="22"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>
+			<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>
+			<row r="2"><c r="A2"><v>2101</v></c><c r="C2" t="s"><v>2</v></c><c r="D2" t="b"><v>1</v></c></row>
+			</sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData>
+			<row><c t="inlineStr"><is><t>Test</t></is></c><c s="1"><v>46086</v></c><c s="3"><v>46086.4375</v></c><c s="2"><v>12.5</v></c></row>
+			</sheetData></worksheet>`,
+	}
+	got, err := Extract(XLSX, buildZip(files))
+	want := "Sheet: Shortlist\nRoll No | Name\n2101 | Asha Rao | TRUE\n\nSheet: Schedule\nTest | 2026-03-05 | 2026-03-05 10:30 | 12.5"
+	if err != nil || got != want {
+		t.Errorf("Extract = %q, %v\nwant %q", got, err, want)
+	}
+}
+
+func TestExcelDate(t *testing.T) {
+	for serial, want := range map[float64]string{
+		1:     "1900-01-01",
+		59:    "1900-02-28",
+		61:    "1900-03-01",
+		45658: "2025-01-01",
+		0.5:   "1899-12-31 12:00",
+	} {
+		if got := excelDate(serial); got != want {
+			t.Errorf("excelDate(%v) = %s, want %s", serial, got, want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package attachment
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// The PDF reader below covers what text extraction needs and no more: it
+// finds objects by scanning for "N G obj" rather than trusting the
+// cross-reference table, which mail gateways and broken generators often get
+// wrong, and it only decodes the filters text and object streams use.
+
+const (
+	// maxPages bounds the pages read from one document.
+	maxPages = 200
+
+	// maxDepth bounds reference chains and nesting, which a hostile file
+	// can make circular.
+	maxDepth = 32
+)
+
+var (
+	errNotPDF = errors.New("not a PDF document")
+
+	objectHeader = regexp.MustCompile(`(\d+)[ \t\r\n\f\x00]+(\d+)[ \t\r\n\f\x00]+obj\b`)
+)
+
+type (
+	pdfName    string
+	pdfString  string
+	pdfKeyword string
+	pdfArray   []any
+	pdfDict    map[pdfName]any
+	pdfRef     struct{ num, gen int }
+	pdfStream  struct {
+		dict pdfDict
+		raw  []byte
+	}
+)
+
+type pdfDoc struct {
+	objects  map[int]any
+	trailers []pdfDict
+	fonts    map[pdfRef]*pdfFont
+	unpacked int // bytes inflated so far, bounded by maxUnpacked
+}
+
+func parsePDF(data []byte) (*pdfDoc, error) {
+	start := bytes.Index(data, []byte("%PDF-"))
+	if start < 0 || start > 1024 {
+		return nil, errNotPDF
+	}
+
+	d := &pdfDoc{objects: map[int]any{}}
+	var objStreams []*pdfStream
+	for _, m := range objectHeader.FindAllSubmatchIndex(data, -1) {
+		num, err := strconv.Atoi(string(data[m[2]:m[3]]))
+		if err != nil {
+			continue
+		}
+		l := &pdfLexer{data: data, pos: m[1]}
+		v, err := l.object(0)
+		if err != nil {
+			continue
+		}
+		if dict, ok := v.(pdfDict); ok {
+			if s := l.stream(dict); s != nil {
+				v = s
+				switch dict["Type"] {
+				case pdfName("ObjStm"):
+					objStreams = append(objStreams, s)
+				case pdfName("XRef"):
+					d.trailers = append(d.trailers, dict)
+				}
+			}
+		}
+		// A later definition is an incremental update and replaces the
+		// earlier one.
+		d.objects[num] = v
+	}
+
+	for _, i := range trailerPattern.FindAllIndex(data, -1) {
+		l := &pdfLexer{data: data, pos: i[1]}
+		if v, err := l.object(0); err == nil {
+			if dict, ok := v.(pdfDict); ok {
+				d.trailers = append(d.trailers, dict)
+			}
+		}
+	}
+	for _, t := range d.trailers {
+		if _, ok := t["Encrypt"]; ok {
+			return nil, ErrEncrypted
+		}
+	}
+
+	for _, s := range objStreams {
+		d.unpackObjects(s)
+	}
+	return d, nil
+}
+
+var trailerPattern = regexp.MustCompile(`\btrailer\b`)
+
+// unpackObjects adds the objects compressed into an object stream, unless a
+// plain definition of the same number was already found.
+func (d *pdfDoc) unpackObjects(s *pdfStream) {
+	data, err := d.decode(s)
+	if err != nil {
+		return
+	}
+	n, _ := d.resolve(s.dict["N"]).(int)
+	first, _ := d.resolve(s.dict["First"]).(int)
+	if first <= 0 || first > len(data) {
+		return
+	}
+
+	header := &pdfLexer{data: data[:first]}
+	for range min(n, 1<<16) {
+		num, ok1 := header.next().(int)
+		offset, ok2 := header.next().(int)
+		if !ok1 || !ok2 || offset < 0 || first+offset >= len(data) {
+			return
+		}
+		if _, ok := d.objects[num]; ok {
+			continue
+		}
+		l := &pdfLexer{data: data, pos: first + offset}
+		if v, err := l.object(0); err == nil {
+			d.objects[num] = v
+		}
+	}
+}
+
+// resolve follows references to the object they name; a missing object is
+// nil, as the specification has it.
+func (d *pdfDoc) resolve(v any) any {
+	for range maxDepth {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = d.objects[ref.num]
+	}
+	return nil
+}
+
+func (d *pdfDoc) dict(v any) pdfDict {
+	switch v := d.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+// decode applies the filters of a stream. Image filters are not supported;
+// nothing text extraction reads uses them.
+func (d *pdfDoc) decode(s *pdfStream) ([]byte, error) {
+	var filters []any
+	switch f := d.resolve(s.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []any{f}
+	case pdfArray:
+		filters = f
+	}
+
+	data := s.raw
+	for _, f := range filters {
+		name, _ := d.resolve(f).(pdfName)
+		var err error
+		switch name {
+		case "FlateDecode", "Fl":
+			data, err = d.inflate(data)
+		case "ASCIIHexDecode", "AHx":
+			data, err = asciiHex(data)
+		case "ASCII85Decode", "A85":
+			data, err = ascii85Decode(data)
+		default:
+			return nil, fmt.Errorf("%w: filter %s", ErrUnsupported, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// inflate decompresses zlib data within what is left of maxUnpacked. A
+// truncated stream, which some generators write, yields what was decoded.
+func (d *pdfDoc) inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate stream: %w", err)
+	}
+	defer zr.Close()
+
+	left := maxUnpacked - d.unpacked
+	out, err := io.ReadAll(io.LimitReader(zr, int64(left)+1))
+	if len(out) > left {
+		return nil, fmt.Errorf("%w: streams inflate past %d bytes", ErrTooLarge, maxUnpacked)
+	}
+	d.unpacked += len(out)
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("failed to inflate stream: %w", err)
+	}
+	return out, nil
+}
+
+func asciiHex(data []byte) ([]byte, error) {
+	if i := bytes.IndexByte(data, '>'); i >= 0 {
+		data = data[:i]
+	}
+	digits := bytes.Map(func(r rune) rune {
+		if isSpace(byte(r)) {
+			return -1
+		}
+		return r
+	}, data)
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	if _, err := hex.Decode(out, digits); err != nil {
+		return nil, fmt.Errorf("failed to decode hex stream: %w", err)
+	}
+	return out, nil
+}
+
+func ascii85Decode(data []byte) ([]byte, error) {
+	data = bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+	if i := bytes.Index(data, []byte("~>")); i >= 0 {
+		data = data[:i]
+	}
+	// "z" stands for four zero bytes, so that is the most a byte decodes to.
+	out := make([]byte, 4*len(data))
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ASCII85 stream: %w", err)
+	}
+	return out[:n], nil
+}
+
+// pages returns the page dictionaries in order, each with the resources it
+// inherits from the page tree. Without a usable page tree, every object of
+// type Page is taken in object number order.
+func (d *pdfDoc) pages() []pdfDict {
+	var root pdfDict
+	for i := len(d.trailers) - 1; i >= 0 && root == nil; i-- {
+		root = d.dict(d.trailers[i]["Root"])
+	}
+	if root == nil {
+		for _, v := range d.objects {
+			if dict, ok := v.(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+				root = dict
+				break
+			}
+		}
+	}
+
+	var pages []pdfDict
+	seen := map[pdfRef]bool{}
+	var walk func(node any, resources any, depth int)
+	walk = func(node any, resources any, depth int) {
+		if ref, ok := node.(pdfRef); ok {
+			if seen[ref] {
+				return
+			}
+			seen[ref] = true
+		}
+		dict := d.dict(node)
+		if dict == nil || depth > maxDepth || len(pages) >= maxPages {
+			return
+		}
+		if r, ok := dict["Resources"]; ok {
+			resources = r
+		}
+		kids, isTree := d.resolve(dict["Kids"]).(pdfArray)
+		if !isTree {
+			page := pdfDict{"Resources": resources}
+			for k, v := range dict {
+				if k != "Resources" {
+					page[k] = v
+				}
+			}
+			pages = append(pages, page)
+			return
+		}
+		for _, kid := range kids {
+			walk(kid, resources, depth+1)
+		}
+	}
+	if root != nil {
+		walk(root["Pages"], nil, 0)
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	var nums []int
+	for num, v := range d.objects {
+		if dict, ok := v.(pdfDict); ok && dict["Type"] == pdfName("Page") {
+			nums = append(nums, num)
+		}
+	}
+	slices.Sort(nums)
+	for _, num := range nums[:min(len(nums), maxPages)] {
+		pages = append(pages, d.objects[num].(pdfDict))
+	}
+	return pages
+}
+
+// contents returns the content of a page or form, with the streams of an
+// array of them joined.
+func (d *pdfDoc) contents(v any) []byte {
+	switch v := d.resolve(v).(type) {
+	case *pdfStream:
+		data, err := d.decode(v)
+		if err != nil {
+			return nil
+		}
+		return data
+	case pdfArray:
+		var all []byte
+		for _, part := range v {
+			if s, ok := d.resolve(part).(*pdfStream); ok {
+				data, err := d.decode(s)
+				if err != nil {
+					continue
+				}
+				all = append(all, data...)
+				all = append(all, '\n')
+			}
+		}
+		return all
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package attachment
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildPDF writes a document whose objects are numbered from 1 in the order
+// given, with a cross-reference table and a trailer naming object 1 as the
+// catalog.
+func buildPDF(trailerExtra string, objects ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailerExtra, xref)
+	return b.Bytes()
+}
+
+func stream(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+func deflate(data string) []byte {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write([]byte(data))
+	zw.Close()
+	return b.Bytes()
+}
+
+func TestExtractPDF(t *testing.T) {
+	t.Run("simple font", func(t *testing.T) {
+		content := `BT /F1 12 Tf 72 720 Td (Campus Drive: Contoso) Tj
+			0 -14 Td [(Eligi) 20 (bility:) -300 (CGPA) -250 (7.5)] TJ
+			T* (CTC \225 12 LPA \(fixed\)) Tj ET`
+		pdf := buildPDF("",
+			"<< /Type /Catalog /Pages 2 0 R >>",
+			"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+			"<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+			stream("", []byte(content)),
+			"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		)
+		got, err := Extract(PDF, pdf)
+		want := "Campus Drive: Contoso\nEligibility: CGPA 7.5\nCTC • 12 LPA (fixed)"
+		if err != nil || got != want {
+			t.Errorf("Extract = %q, %v, want %q", got, err, want)
+		}
+	})
+
+	t.Run("composite font in object stream", func(t *testing.T) {
+		// Two pages inherit their resources from the page tree. The font
+		// and its ToUnicode map live in a compressed object stream, and
+		// the text is glyph IDs only the map can turn back into letters.
+		cmap := `/CIDInit /ProcSet findresource begin
+			begincmap
+			1 begincodespacerange <0000> <FFFF> endcodespacerange
+			2 beginbfchar <0003> <0020> <0010> <20B9> endbfchar
+			2 beginbfrange <0024> <003D> <0041> <0044> <0046> [<0053> <0074> <0061>] endbfrange
+			endcmap`
+		font := "<< /Type /Font /Subtype /Type0 /BaseFont /ABCDEF+Arial /Encoding /Identity-H /ToUnicode 7 0 R >>"
+		objStm := "9 0 " + font
+		page1 := deflate("BT /F1 10 Tf 1 0 0 1 72 700 Tm <0026002C0027> Tj 1 0 0 1 72 680 Tm <00100003> Tj ET")
+		page2 := deflate("BT /F1 10 Tf 72 700 Td <004400450046> Tj ET")
+
+		pdf := buildPDF("",
+			"<< /Type /Catalog /Pages 2 0 R >>",
+			"<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 /Resources << /Font << /F1 9 0 R >> >> >>",
+			"<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>",
+			"<< /Type /Page /Parent 2 0 R /Contents [6 0 R] >>",
+			stream("/Filter /FlateDecode", page1),
+			stream("/Filter [/FlateDecode]", page2),
+			stream("", []byte(cmap)),
+			stream(fmt.Sprintf("/Type /ObjStm /N 1 /First %d /Filter /FlateDecode", len("9 0 ")), deflate(objStm)),
+		)
+		got, err := Extract(PDF, pdf)
+		want := "CID\n₹\n\nSta"
+		if err != nil || got != want {
+			t.Errorf("Extract = %q, %v, want %q", got, err, want)
+		}
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		pdf := buildPDF("/Encrypt 3 0 R",
+			"<< /Type /Catalog /Pages 2 0 R >>",
+			"<< /Type /Pages /Kids [] /Count 0 >>",
+			"<< /Filter /Standard /V 2 /R 3 >>",
+		)
+		if _, err := Extract(PDF, pdf); !errors.Is(err, ErrEncrypted) {
+			t.Errorf("Extract = %v, want ErrEncrypted", err)
+		}
+	})
+
+	t.Run("scanned", func(t *testing.T) {
+		pdf := buildPDF("",
+			"<< /Type /Catalog /Pages 2 0 R >>",
+			"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+			"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+			stream("", []byte("q 612 0 0 792 0 0 cm /Im1 Do Q")),
+		)
+		if _, err := Extract(PDF, pdf); !errors.Is(err, ErrNoText) {
+			t.Errorf("Extract = %v, want ErrNoText", err)
+		}
+	})
+
+	t.Run("not a pdf", func(t *testing.T) {
+		if _, err := Extract(PDF, []byte("<html>Download failed</html>")); err == nil || !strings.HasPrefix(err.Error(), "pdf: ") {
+			t.Errorf("Extract = %v, want a pdf error", err)
+		}
+	})
+}
+
+func TestPDFLexer(t *testing.T) {
+	l := &pdfLexer{data: []byte(`<< /Name#20Two (a\(b\)\101\
+c) /Flag true >>`)}
+	v, err := l.object(0)
+	if err != nil {
+		t.Fatalf("object: %v", err)
+	}
+	dict := v.(pdfDict)
+	if dict["Name Two"] != pdfString("a(b)Ac") {
+		t.Errorf("literal string = %q", dict["Name Two"])
+	}
+	if flag, _ := dict["Flag"].(bool); !flag {
+		t.Errorf("Flag = %v", dict["Flag"])
+	}
+	l = &pdfLexer{data: []byte("<48 65 6C6C6F> [1 2.5 -3 4 0 R]")}
+	if s, _ := l.object(0); s != pdfString("Hello") {
+		t.Errorf("hex string = %q", s)
+	}
+	got, _ := l.object(0)
+	want := pdfArray{1, 2.5, -3, pdfRef{num: 4}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("array = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,342 @@
+package attachment
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+var errBadObject = errors.New("malformed PDF object")
+
+// pdfLexer reads PDF tokens and objects, both in the file body and in
+// content streams, which share the syntax.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func isRegular(c byte) bool {
+	return c != 0 && !isSpace(c) && !isDelimiter(c)
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		switch c := l.data[l.pos]; {
+		case c == 0 || isSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// next returns the next token: an int, float64, pdfName, pdfString or
+// pdfKeyword, the last including the delimiters "<<", ">>", "[", "]", "{"
+// and "}". It returns nil at the end of the data.
+func (l *pdfLexer) next() any {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil
+	}
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		l.pos++
+		return pdfName(unescapeName(l.regular()))
+	case c == '(':
+		l.pos++
+		return l.literal()
+	case c == '<' && l.peek(1) == '<':
+		l.pos += 2
+		return pdfKeyword("<<")
+	case c == '>' && l.peek(1) == '>':
+		l.pos += 2
+		return pdfKeyword(">>")
+	case c == '<':
+		l.pos++
+		return l.hexString()
+	case isDelimiter(c):
+		l.pos++
+		return pdfKeyword(l.data[l.pos-1 : l.pos])
+	}
+
+	word := l.regular()
+	if c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9') {
+		if n, err := strconv.Atoi(string(word)); err == nil {
+			return n
+		}
+		if f, err := strconv.ParseFloat(string(word), 64); err == nil {
+			return f
+		}
+	}
+	return pdfKeyword(word)
+}
+
+func (l *pdfLexer) peek(offset int) byte {
+	if l.pos+offset < len(l.data) {
+		return l.data[l.pos+offset]
+	}
+	return 0
+}
+
+func (l *pdfLexer) regular() []byte {
+	start := l.pos
+	for l.pos < len(l.data) && isRegular(l.data[l.pos]) {
+		l.pos++
+	}
+	if l.pos == start && l.pos < len(l.data) {
+		// A stray byte no token starts with; skip it.
+		l.pos++
+	}
+	return l.data[start:l.pos]
+}
+
+// unescapeName decodes the #xx escapes of a name.
+func unescapeName(b []byte) string {
+	if bytes.IndexByte(b, '#') < 0 {
+		return string(b)
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '#' && i+2 < len(b) {
+			if v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+// literal reads a (string) after its opening parenthesis.
+func (l *pdfLexer) literal() pdfString {
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(out)
+			}
+		case '\r':
+			// An end of line in a string is a line feed however it is
+			// written.
+			if l.peek(0) == '\n' {
+				l.pos++
+			}
+			c = '\n'
+		case '\\':
+			if l.pos >= len(l.data) {
+				return pdfString(out)
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.peek(0) == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for range 2 {
+						if d := l.peek(0); d >= '0' && d <= '7' {
+							v = v*8 + int(d-'0')
+							l.pos++
+						}
+					}
+					c = byte(v)
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return pdfString(out)
+}
+
+// hexString reads a <hex string> after its opening angle bracket.
+func (l *pdfLexer) hexString() pdfString {
+	var out []byte
+	var hi byte
+	half := false
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		var v byte
+		switch {
+		case c == '>':
+			if half {
+				out = append(out, hi<<4)
+			}
+			return pdfString(out)
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			out = append(out, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	return pdfString(out)
+}
+
+// object reads one complete object: a dictionary, array or reference is
+// read to its end.
+func (l *pdfLexer) object(depth int) (any, error) {
+	return l.value(l.next(), depth)
+}
+
+// value completes the object tok starts.
+func (l *pdfLexer) value(tok any, depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errBadObject
+	}
+	switch t := tok.(type) {
+	case nil:
+		return nil, errBadObject
+	case int:
+		// "num gen R" is a reference.
+		save := l.pos
+		if gen, ok := l.next().(int); ok && l.next() == pdfKeyword("R") {
+			return pdfRef{num: t, gen: gen}, nil
+		}
+		l.pos = save
+		return t, nil
+	case pdfKeyword:
+		switch t {
+		case "<<":
+			dict := pdfDict{}
+			for {
+				key := l.next()
+				if key == nil {
+					return nil, errBadObject
+				}
+				if key == pdfKeyword(">>") {
+					return dict, nil
+				}
+				name, ok := key.(pdfName)
+				if !ok {
+					continue
+				}
+				v, err := l.object(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				if v == pdfKeyword(">>") {
+					return dict, nil
+				}
+				dict[name] = v
+			}
+		case "[":
+			var arr pdfArray
+			for {
+				tok := l.next()
+				if tok == nil {
+					return nil, errBadObject
+				}
+				if tok == pdfKeyword("]") {
+					return arr, nil
+				}
+				v, err := l.value(tok, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, v)
+			}
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return tok, nil
+}
+
+// stream reads the data of a stream object whose dictionary was just read,
+// or returns nil if no stream follows. The /Length is used when it is direct
+// and lands on "endstream"; otherwise the data runs to the next "endstream".
+func (l *pdfLexer) stream(dict pdfDict) *pdfStream {
+	l.skipSpace()
+	if !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		return nil
+	}
+	l.pos += len("stream")
+	if l.peek(0) == '\r' {
+		l.pos++
+	}
+	if l.peek(0) == '\n' {
+		l.pos++
+	}
+	rest := l.data[l.pos:]
+
+	if n, ok := dict["Length"].(int); ok && n >= 0 && n <= len(rest) {
+		if bytes.HasPrefix(bytes.TrimLeft(rest[n:], "\r\n\t \x00"), []byte("endstream")) {
+			return &pdfStream{dict: dict, raw: rest[:n]}
+		}
+	}
+	end := bytes.Index(rest, []byte("endstream"))
+	if end < 0 {
+		return &pdfStream{dict: dict, raw: rest}
+	}
+	raw := rest[:end]
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	raw = bytes.TrimSuffix(raw, []byte("\r"))
+	return &pdfStream{dict: dict, raw: raw}
+}
+
+// inlineImageEnd finds the "EI" that ends inline image data.
+var inlineImageEnd = regexp.MustCompile(`[ \t\r\n\f\x00]EI([ \t\r\n\f\x00]|$)`)
+
+// skipInlineImage moves past the data of an inline image, just after its
+// ID operator.
+func (l *pdfLexer) skipInlineImage() {
+	loc := inlineImageEnd.FindIndex(l.data[l.pos:])
+	if loc == nil {
+		l.pos = len(l.data)
+		return
+	}
+	l.pos += loc[1]
+}
@@ -0,0 +1,517 @@
+package attachment
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// kerningSpace is how far back, in thousandths of an em, a TJ
+	// adjustment has to move for the gap to read as a space.
+	kerningSpace = -200
+
+	// maxFormDepth bounds form XObjects drawn within each other.
+	maxFormDepth = 8
+
+	// maxRangeSize bounds one bfrange of a ToUnicode CMap.
+	maxRangeSize = 1 << 16
+)
+
+// extractPDF writes the text each page shows, in the order it is drawn,
+// with a line break wherever the text moves to another line.
+func extractPDF(data []byte, w *textWriter) error {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return err
+	}
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return fmt.Errorf("failed to find pages: %w", errBadObject)
+	}
+	for _, page := range pages {
+		w.paragraph()
+		t := &pdfText{doc: doc, w: w}
+		if err := t.run(doc.contents(page["Contents"]), doc.dict(page["Resources"]), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pdfText interprets the text operators of a content stream.
+type pdfText struct {
+	doc  *pdfDoc
+	w    *textWriter
+	font *pdfFont
+	y    float64 // the line the last text was drawn on
+	hasY bool
+}
+
+func (t *pdfText) run(content []byte, resources pdfDict, depth int) error {
+	l := &pdfLexer{data: content}
+	var operands []any
+	for {
+		tok := l.next()
+		if tok == nil {
+			return nil
+		}
+		op, ok := tok.(pdfKeyword)
+		if !ok || op == "<<" || op == "[" || op == "true" || op == "false" || op == "null" {
+			v, err := l.value(tok, 0)
+			if err != nil {
+				// Truncated content; keep what was drawn.
+				return nil
+			}
+			if len(operands) < 16 {
+				operands = append(operands, v)
+			}
+			continue
+		}
+		if err := t.operator(op, operands, resources, l, depth); err != nil {
+			return err
+		}
+		operands = operands[:0]
+	}
+}
+
+func (t *pdfText) operator(op pdfKeyword, operands []any, resources pdfDict, l *pdfLexer, depth int) error {
+	switch op {
+	case "BT", "ET":
+		t.w.space = true
+	case "Tf":
+		if name, ok := operand(operands, 0).(pdfName); ok {
+			t.font = t.doc.font(resources, name)
+		}
+	case "Td", "TD":
+		t.move(number(operand(operands, 0)), number(operand(operands, 1)))
+	case "Tm":
+		y := number(operand(operands, 5))
+		if t.hasY && math.Abs(y-t.y) > 0.5 {
+			t.w.newline()
+		} else {
+			t.w.space = true
+		}
+		t.y, t.hasY = y, true
+	case "T*":
+		t.w.newline()
+	case "Tj":
+		return t.show(operand(operands, 0))
+	case "'":
+		t.w.newline()
+		return t.show(operand(operands, 0))
+	case `"`:
+		t.w.newline()
+		return t.show(operand(operands, 2))
+	case "TJ":
+		parts, _ := operand(operands, 0).(pdfArray)
+		for _, part := range parts {
+			if _, ok := part.(pdfString); ok {
+				if err := t.show(part); err != nil {
+					return err
+				}
+			} else if number(part) < kerningSpace {
+				t.w.space = true
+			}
+		}
+	case "Do":
+		name, _ := operand(operands, 0).(pdfName)
+		form, ok := t.doc.resolve(t.doc.dict(resources["XObject"])[name]).(*pdfStream)
+		if !ok || form.dict["Subtype"] != pdfName("Form") || depth >= maxFormDepth {
+			return nil
+		}
+		formResources := t.doc.dict(form.dict["Resources"])
+		if formResources == nil {
+			formResources = resources
+		}
+		data, err := t.doc.decode(form)
+		if err != nil {
+			return nil
+		}
+		return t.run(data, formResources, depth+1)
+	case "ID":
+		l.skipInlineImage()
+	}
+	return nil
+}
+
+// move handles Td: text moved up or down starts a new line, text moved
+// along the line is a new word.
+func (t *pdfText) move(tx, ty float64) {
+	switch {
+	case math.Abs(ty) > 0.5:
+		t.w.newline()
+	case tx != 0:
+		t.w.space = true
+	}
+	t.y += ty
+}
+
+func (t *pdfText) show(s any) error {
+	str, ok := s.(pdfString)
+	if !ok {
+		return nil
+	}
+	font := t.font
+	if font == nil {
+		font = standardFont
+	}
+	return t.w.text(font.decode(str))
+}
+
+func operand(operands []any, i int) any {
+	if i < len(operands) {
+		return operands[i]
+	}
+	return nil
+}
+
+func number(v any) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// pdfFont turns the codes a font draws back into text.
+type pdfFont struct {
+	cmap    *cmap      // from the font's ToUnicode stream, if any
+	twoByte bool       // composite fonts use two-byte codes
+	table   *[256]rune // single-byte encoding of a simple font
+}
+
+var standardFont = &pdfFont{table: encodingTable("WinAnsiEncoding")}
+
+func (d *pdfDoc) font(resources pdfDict, name pdfName) *pdfFont {
+	entry := d.dict(resources["Font"])[name]
+	ref, isRef := entry.(pdfRef)
+	if isRef {
+		if f, ok := d.fonts[ref]; ok {
+			return f
+		}
+	}
+	f := d.loadFont(d.dict(entry))
+	if isRef {
+		if d.fonts == nil {
+			d.fonts = map[pdfRef]*pdfFont{}
+		}
+		d.fonts[ref] = f
+	}
+	return f
+}
+
+func (d *pdfDoc) loadFont(dict pdfDict) *pdfFont {
+	if dict == nil {
+		return standardFont
+	}
+	f := &pdfFont{twoByte: dict["Subtype"] == pdfName("Type0")}
+	if s, ok := d.resolve(dict["ToUnicode"]).(*pdfStream); ok {
+		if data, err := d.decode(s); err == nil {
+			f.cmap = parseCMap(data)
+		}
+	}
+	if f.twoByte {
+		return f
+	}
+
+	var differences pdfArray
+	base := "WinAnsiEncoding"
+	switch enc := d.resolve(dict["Encoding"]).(type) {
+	case pdfName:
+		base = string(enc)
+	case pdfDict:
+		if name, ok := d.resolve(enc["BaseEncoding"]).(pdfName); ok {
+			base = string(name)
+		}
+		differences, _ = d.resolve(enc["Differences"]).(pdfArray)
+	}
+	f.table = encodingTable(base)
+	if len(differences) > 0 {
+		table := *f.table
+		code := 0
+		for _, v := range differences {
+			switch v := d.resolve(v).(type) {
+			case int:
+				code = v
+			case pdfName:
+				if code >= 0 && code < 256 {
+					if r, ok := glyphRune(string(v)); ok {
+						table[code] = r
+					}
+				}
+				code++
+			}
+		}
+		f.table = &table
+	}
+	return f
+}
+
+func (f *pdfFont) decode(s pdfString) string {
+	var b strings.Builder
+	switch {
+	case f.cmap != nil:
+		width := 1
+		if f.twoByte {
+			width = 2
+		}
+		for i := 0; i < len(s); {
+			text, n := f.cmap.lookup(s[i:], width)
+			b.WriteString(text)
+			i += n
+		}
+	case f.twoByte:
+		// Without a ToUnicode map the codes of a composite font are glyph
+		// numbers, which say nothing about the text.
+		return ""
+	default:
+		for i := 0; i < len(s); i++ {
+			b.WriteRune(f.table[s[i]])
+		}
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, b.String())
+}
+
+var encodingTables = simpleEncodings()
+
+// simpleEncodings builds the byte to rune tables of the simple font
+// encodings that text uses.
+func simpleEncodings() map[string]*[256]rune {
+	tables := map[string]*[256]rune{}
+	for name, label := range map[string]string{
+		"WinAnsiEncoding":  "windows-1252",
+		"MacRomanEncoding": "macintosh",
+	} {
+		var table [256]rune
+		enc, _ := charset.Lookup(label)
+		for i := range table {
+			table[i] = rune(i)
+			if enc == nil {
+				continue
+			}
+			if out, err := enc.NewDecoder().Bytes([]byte{byte(i)}); err == nil {
+				if r := []rune(string(out)); len(r) == 1 {
+					table[i] = r[0]
+				}
+			}
+		}
+		tables[name] = &table
+	}
+	return tables
+}
+
+// encodingTable returns the named simple font encoding, falling back to
+// WinAnsi, which StandardEncoding matches for the letters and digits.
+func encodingTable(name string) *[256]rune {
+	if table, ok := encodingTables[name]; ok {
+		return table
+	}
+	return encodingTables["WinAnsiEncoding"]
+}
+
+// glyphNames covers the glyph names that Differences arrays use for
+// punctuation; letters and digits are handled by glyphRune.
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$',
+	"percent": '%', "ampersand": '&', "quotesingle": '\'', "parenleft": '(',
+	"parenright": ')', "asterisk": '*', "plus": '+', "comma": ',', "hyphen": '-',
+	"period": '.', "slash": '/', "colon": ':', "semicolon": ';', "less": '<',
+	"equal": '=', "greater": '>', "question": '?', "at": '@', "bracketleft": '[',
+	"backslash": '\\', "bracketright": ']', "underscore": '_', "bar": '|',
+	"quoteleft": '‘', "quoteright": '’', "quotedblleft": '“', "quotedblright": '”',
+	"endash": '–', "emdash": '—', "bullet": '•', "ellipsis": '…', "fi": 'ﬁ',
+	"fl": 'ﬂ', "Euro": '€', "rupee": '₹', "zero": '0', "one": '1', "two": '2',
+	"three": '3', "four": '4', "five": '5', "six": '6', "seven": '7', "eight": '8',
+	"nine": '9',
+}
+
+func glyphRune(name string) (rune, bool) {
+	if r, ok := glyphNames[name]; ok {
+		return r, true
+	}
+	if len(name) == 1 && (name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		return rune(name[0]), true
+	}
+	for _, prefix := range []string{"uni", "u"} {
+		if hex, ok := strings.CutPrefix(name, prefix); ok && len(hex) >= 4 && len(hex) <= 6 {
+			if v, err := strconv.ParseUint(hex, 16, 32); err == nil && v <= unicode.MaxRune {
+				return rune(v), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// cmap is the part of a ToUnicode CMap that maps codes to text.
+type cmap struct {
+	widths []int // code lengths the codespace ranges allow, shortest first
+	chars  map[string]string
+	ranges []cmapRange
+}
+
+type cmapRange struct {
+	lo, hi uint32
+	width  int
+	start  []uint16 // UTF-16 of the first code; later codes count up
+	each   []string // or the text of every code, from an array
+}
+
+func parseCMap(data []byte) *cmap {
+	c := &cmap{chars: map[string]string{}}
+	l := &pdfLexer{data: data}
+	var operands []any
+	for {
+		tok := l.next()
+		if tok == nil {
+			break
+		}
+		kw, ok := tok.(pdfKeyword)
+		if !ok || kw == "[" || kw == "<<" {
+			v, err := l.value(tok, 0)
+			if err != nil {
+				break
+			}
+			operands = append(operands, v)
+			continue
+		}
+		switch kw {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				if lo, ok := operands[i].(pdfString); ok && len(lo) > 0 && len(lo) <= 4 {
+					c.addWidth(len(lo))
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(pdfString)
+				dst, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 {
+					c.chars[string(src)] = utf16Text(dst)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				c.addRange(operands[i], operands[i+1], operands[i+2])
+			}
+		}
+		operands = operands[:0]
+	}
+	return c
+}
+
+func (c *cmap) addWidth(n int) {
+	for i, w := range c.widths {
+		if w == n {
+			return
+		}
+		if w > n {
+			c.widths = append(c.widths[:i], append([]int{n}, c.widths[i:]...)...)
+			return
+		}
+	}
+	c.widths = append(c.widths, n)
+}
+
+func (c *cmap) addRange(loV, hiV, dst any) {
+	lo, ok1 := loV.(pdfString)
+	hi, ok2 := hiV.(pdfString)
+	if !ok1 || !ok2 || len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+		return
+	}
+	r := cmapRange{lo: codeValue(lo), hi: codeValue(hi), width: len(lo)}
+	if r.hi < r.lo || r.hi-r.lo >= maxRangeSize {
+		return
+	}
+	switch dst := dst.(type) {
+	case pdfString:
+		r.start = utf16Units(dst)
+		if len(r.start) == 0 {
+			return
+		}
+	case pdfArray:
+		for _, v := range dst {
+			s, _ := v.(pdfString)
+			r.each = append(r.each, utf16Text(s))
+		}
+	default:
+		return
+	}
+	c.ranges = append(c.ranges, r)
+}
+
+// lookup maps the code at the start of s and returns its text and length.
+// A code the map does not know advances by the font's code width and
+// yields nothing.
+func (c *cmap) lookup(s pdfString, width int) (string, int) {
+	widths := c.widths
+	if len(widths) == 0 {
+		widths = []int{width}
+	}
+	for _, n := range widths {
+		if n > len(s) {
+			break
+		}
+		code := s[:n]
+		if text, ok := c.chars[string(code)]; ok {
+			return text, n
+		}
+		v := codeValue(code)
+		for _, r := range c.ranges {
+			if r.width != n || v < r.lo || v > r.hi {
+				continue
+			}
+			offset := v - r.lo
+			if r.each != nil {
+				if int(offset) < len(r.each) {
+					return r.each[offset], n
+				}
+				continue
+			}
+			units := append([]uint16(nil), r.start...)
+			units[len(units)-1] += uint16(offset)
+			return string(utf16.Decode(units)), n
+		}
+	}
+	return "", min(widths[0], len(s))
+}
+
+func codeValue(code pdfString) uint32 {
+	var v uint32
+	for i := 0; i < len(code); i++ {
+		v = v<<8 | uint32(code[i])
+	}
+	return v
+}
+
+func utf16Units(s pdfString) []uint16 {
+	if len(s)%2 == 1 {
+		// Some producers write single bytes; take them as Latin-1.
+		units := make([]uint16, len(s))
+		for i := 0; i < len(s); i++ {
+			units[i] = uint16(s[i])
+		}
+		return units
+	}
+	units := make([]uint16, len(s)/2)
+	for i := range units {
+		units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return units
+}
+
+func utf16Text(s pdfString) string {
+	return string(utf16.Decode(utf16Units(s)))
+}
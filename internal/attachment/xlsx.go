@@ -0,0 +1,390 @@
+package attachment
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxColumns bounds the cells read from a row. Placement sheets are
+	// far narrower; what lies beyond is usually scratch work.
+	maxColumns = 64
+
+	// maxSharedStrings bounds the shared string table.
+	maxSharedStrings = 1 << 20
+)
+
+// builtinDateFormats are the number format IDs Excel reserves for dates and
+// times.
+var builtinDateFormats = map[int]bool{
+	14: true, 15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, 22: true,
+	45: true, 46: true, 47: true,
+}
+
+type workbook struct {
+	zr      *zip.Reader
+	strings []string
+	dates   []bool // per cell style index, whether it formats a date
+}
+
+type sheet struct {
+	name string
+	part string
+}
+
+// extractXLSX writes each sheet under a "Sheet: name" line, one row per line
+// with " | " between cells. Cells formatted as dates are written as
+// YYYY-MM-DD rather than Excel's day numbers, since deadlines and drive
+// dates are what students look for in these sheets.
+func extractXLSX(data []byte, w *textWriter) error {
+	zr, err := openPackage(data)
+	if err != nil {
+		return err
+	}
+	wb := &workbook{zr: zr}
+	if err := wb.readStrings(); err != nil && !errors.Is(err, errMissingPart) {
+		return err
+	}
+	if err := wb.readStyles(); err != nil && !errors.Is(err, errMissingPart) {
+		return err
+	}
+	sheets, err := wb.sheets()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sheets {
+		w.paragraph()
+		if err := w.text("Sheet: " + s.name); err != nil {
+			return err
+		}
+		if err := wb.writeSheet(s.part, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStrings loads the shared string table cells of type "s" index into.
+// Rich text runs are joined and phonetic guides left out.
+func (wb *workbook) readStrings() error {
+	dec, rc, err := openPart(wb.zr, "xl/sharedStrings.xml")
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var (
+		current  strings.Builder
+		inText   bool
+		phonetic int
+	)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read shared strings: %w", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "si":
+				current.Reset()
+			case "t":
+				inText = true
+			case "rPh":
+				phonetic++
+			}
+		case xml.EndElement:
+			switch el.Name.Local {
+			case "si":
+				if len(wb.strings) >= maxSharedStrings {
+					return fmt.Errorf("%w: more than %d shared strings", ErrTooLarge, maxSharedStrings)
+				}
+				wb.strings = append(wb.strings, current.String())
+			case "t":
+				inText = false
+			case "rPh":
+				phonetic--
+			}
+		case xml.CharData:
+			if inText && phonetic == 0 && current.Len() < MaxText {
+				current.Write(el)
+			}
+		}
+	}
+}
+
+// readStyles works out which cell styles format a date, from the number
+// format each one uses.
+func (wb *workbook) readStyles() error {
+	dec, rc, err := openPart(wb.zr, "xl/styles.xml")
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	custom := map[int]bool{}
+	var formats []int
+	inCellXfs := false
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read styles: %w", err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "numFmt":
+				id, err := strconv.Atoi(attrValue(el, "numFmtId"))
+				if err == nil {
+					custom[id] = isDateFormat(attrValue(el, "formatCode"))
+				}
+			case "cellXfs":
+				inCellXfs = true
+			case "xf":
+				if inCellXfs {
+					id, _ := strconv.Atoi(attrValue(el, "numFmtId"))
+					formats = append(formats, id)
+				}
+			}
+		case xml.EndElement:
+			if el.Name.Local == "cellXfs" {
+				inCellXfs = false
+			}
+		}
+	}
+
+	wb.dates = make([]bool, len(formats))
+	for i, id := range formats {
+		if date, ok := custom[id]; ok {
+			wb.dates[i] = date
+		} else {
+			wb.dates[i] = builtinDateFormats[id]
+		}
+	}
+	return nil
+}
+
+// isDateFormat reports whether a custom number format code shows a date:
+// whether it has a day, month or year placeholder outside quoted text and
+// bracketed colours or locales.
+func isDateFormat(code string) bool {
+	quoted, bracket := false, false
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case c == '\\' && !quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			bracket = true
+		case c == ']':
+			bracket = false
+		case bracket:
+		case c == 'd' || c == 'D' || c == 'y' || c == 'Y' || c == 'm' || c == 'M':
+			return true
+		}
+	}
+	return false
+}
+
+// sheets lists the worksheets in workbook order with the parts holding them.
+func (wb *workbook) sheets() ([]sheet, error) {
+	targets := map[string]string{}
+	if dec, rc, err := openPart(wb.zr, "xl/_rels/workbook.xml.rels"); err == nil {
+		defer rc.Close()
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				break
+			}
+			if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "Relationship" {
+				targets[attrValue(el, "Id")] = attrValue(el, "Target")
+			}
+		}
+	}
+
+	dec, rc, err := openPart(wb.zr, "xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var sheets []sheet
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read workbook: %w", err)
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok || el.Name.Local != "sheet" {
+			continue
+		}
+		target, ok := targets[attrValue(el, "id")]
+		if !ok {
+			target = fmt.Sprintf("worksheets/sheet%d.xml", len(sheets)+1)
+		}
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		sheets = append(sheets, sheet{name: attrValue(el, "name"), part: target})
+	}
+	return sheets, nil
+}
+
+// writeSheet writes the rows of one worksheet. Like table cells in HTML
+// bodies, only cells with content are separated.
+func (wb *workbook) writeSheet(part string, w *textWriter) error {
+	dec, rc, err := openPart(wb.zr, part)
+	if errors.Is(err, errMissingPart) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var (
+		column  int // column of the next cell in the row
+		written int // cells with content in the row so far
+		cell    xml.StartElement
+		value   strings.Builder
+		inValue bool
+	)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", part, err)
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "row":
+				column, written = 0, 0
+				w.newline()
+			case "c":
+				cell = el
+				value.Reset()
+			case "v", "t":
+				inValue = true
+			}
+		case xml.EndElement:
+			switch el.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "c":
+				col := column
+				if ref := attrValue(cell, "r"); ref != "" {
+					if c, ok := columnIndex(ref); ok {
+						col = c
+					}
+				}
+				column = col + 1
+				if col >= maxColumns {
+					continue
+				}
+				text := wb.cellText(cell, value.String())
+				if text == "" {
+					continue
+				}
+				if written > 0 {
+					w.sep = " | "
+				}
+				written++
+				if err := w.text(text); err != nil {
+					return err
+				}
+			}
+		case xml.CharData:
+			if inValue && value.Len() < MaxText {
+				value.Write(el)
+			}
+		}
+	}
+}
+
+// cellText formats the raw value of a cell by its type and style.
+func (wb *workbook) cellText(cell xml.StartElement, raw string) string {
+	switch attrValue(cell, "t") {
+	case "s":
+		i, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || i < 0 || i >= len(wb.strings) {
+			return ""
+		}
+		return wb.strings[i]
+	case "b":
+		if strings.TrimSpace(raw) == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "inlineStr", "str", "e":
+		return raw
+	}
+
+	style, err := strconv.Atoi(attrValue(cell, "s"))
+	if err != nil || style < 0 || style >= len(wb.dates) || !wb.dates[style] {
+		return raw
+	}
+	serial, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || serial < 0 || serial > 2958465 {
+		return raw
+	}
+	return excelDate(serial)
+}
+
+// excelDate turns a day number of the 1900 date system into a date, with the
+// time of day if it has one.
+func excelDate(serial float64) string {
+	days, frac := math.Modf(serial)
+	// Excel counts a 29 February 1900 that never was, so day numbers from
+	// 61 on are one ahead of the calendar and 30 December 1899 is day 0.
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if days < 61 {
+		epoch = epoch.AddDate(0, 0, 1)
+	}
+	t := epoch.AddDate(0, 0, int(days))
+	if seconds := math.Round(frac * 86400); seconds > 0 {
+		return t.Add(time.Duration(seconds) * time.Second).Format("2006-01-02 15:04")
+	}
+	return t.Format("2006-01-02")
+}
+
+// columnIndex returns the zero-based column of a cell reference like "C7".
+func columnIndex(ref string) (int, bool) {
+	col := 0
+	i := 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		col = col*26 + int(ref[i]-'A') + 1
+		if col > 1<<14 {
+			return 0, false
+		}
+	}
+	if i == 0 {
+		return 0, false
+	}
+	return col - 1, true
+}
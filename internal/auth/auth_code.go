@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// AuthCodeTTL is how long the frontend has to exchange the code it received
+// on the login redirect.
+const AuthCodeTTL = time.Minute
+
+var (
+	ErrAuthCodeNotFound = errors.New("authorization code not found")
+	ErrInvalidAuthCode  = errors.New("invalid authorization code")
+)
+
+// AuthCode hands a finished login from the OAuth callback to the frontend
+// without putting tokens in a URL. It records who logged in, not the tokens:
+// the session is only created when the code is exchanged.
+type AuthCode struct {
+	CodeHash string
+	UserID   int
+	Client   ClientInfo
+
+	// CodeChallenge is the S256 PKCE challenge the app sent when starting
+	// the login, if any. Mobile apps must use one because another app can
+	// register the same custom URL scheme and receive the code.
+	CodeChallenge string
+
+	ExpiresAt time.Time
+}
+
+type AuthCodeStore interface {
+	Create(ctx context.Context, code *AuthCode) error
+
+	// Consume marks the code as used and returns it. It returns
+	// ErrAuthCodeNotFound if the code is unknown, expired or already used,
+	// so a code works at most once even with concurrent exchanges.
+	Consume(ctx context.Context, codeHash string) (*AuthCode, error)
+}
+
+// verifyCodeChallenge checks an RFC 7636 S256 code verifier.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if challenge == "" {
+		return true
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// MemoryAuthCodeStore keeps codes in process memory. It only works when the
+// callback and the exchange hit the same instance.
+type MemoryAuthCodeStore struct {
+	mu    sync.Mutex
+	codes map[string]*AuthCode
+}
+
+func NewMemoryAuthCodeStore() *MemoryAuthCodeStore {
+	return &MemoryAuthCodeStore{codes: make(map[string]*AuthCode)}
+}
+
+func (m *MemoryAuthCodeStore) Create(ctx context.Context, code *AuthCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, c := range m.codes {
+		if time.Now().After(c.ExpiresAt) {
+			delete(m.codes, hash)
+		}
+	}
+	stored := *code
+	m.codes[code.CodeHash] = &stored
+	return nil
+}
+
+func (m *MemoryAuthCodeStore) Consume(ctx context.Context, codeHash string) (*AuthCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code, ok := m.codes[codeHash]
+	delete(m.codes, codeHash)
+	if !ok || time.Now().After(code.ExpiresAt) {
+		return nil, ErrAuthCodeNotFound
+	}
+	return code, nil
+}
@@ -0,0 +1,123 @@
+// Package authtest provides in-memory stand-ins for the stores auth.Service
+// needs, for tests of the packages built on it.
+package authtest
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// RefreshStore keeps nothing: issued refresh tokens are never found again.
+type RefreshStore struct{}
+
+func (RefreshStore) Create(ctx context.Context, token *auth.RefreshToken) error { return nil }
+func (RefreshStore) FindByHash(ctx context.Context, hash string) (*auth.RefreshToken, error) {
+	return nil, auth.ErrRefreshTokenNotFound
+}
+func (RefreshStore) Rotate(ctx context.Context, id int, next *auth.RefreshToken) error { return nil }
+func (RefreshStore) RevokeFamily(ctx context.Context, familyID string) error           { return nil }
+
+// SessionStore keeps just enough state for RevokeAll to report the sessions
+// it ended.
+type SessionStore struct {
+	ids []string
+}
+
+func (s *SessionStore) Create(ctx context.Context, session *auth.Session) error {
+	s.ids = append(s.ids, session.ID)
+	return nil
+}
+func (s *SessionStore) FindByID(ctx context.Context, id string) (*auth.Session, error) {
+	return nil, auth.ErrSessionNotFound
+}
+func (s *SessionStore) ListActive(ctx context.Context, userID int) ([]*auth.Session, error) {
+	return nil, nil
+}
+func (s *SessionStore) Touch(ctx context.Context, id string) error              { return nil }
+func (s *SessionStore) Revoke(ctx context.Context, userID int, id string) error { return nil }
+func (s *SessionStore) RevokeAll(ctx context.Context, userID int) ([]string, error) {
+	ids := s.ids
+	s.ids = nil
+	return ids, nil
+}
+
+// UserRepo holds users by email. It implements what the login flow and
+// account deletion use; the rest of user.Repository panics.
+type UserRepo struct {
+	user.Repository
+
+	Users  map[string]*user.User
+	Invite string // hash of the one unused invite code
+
+	Created      *user.User // the last account created
+	Saved        string     // the last refresh token stored
+	SavedID      int        // and whose it was
+	GrantRevoked bool       // what the last DeleteAccount was told
+}
+
+func (f *UserRepo) FindOrCreateProviderUser(ctx context.Context, provider, email, name, sub string, signup user.Signup) (*user.User, error) {
+	if u, ok := f.Users[email]; ok {
+		if u.Provider != provider || u.ProviderID != sub {
+			return nil, user.ErrProviderMismatch
+		}
+		return u, nil
+	}
+	if signup.Status == "" {
+		return nil, user.ErrUserNotFound
+	}
+	if signup.InviteHash != "" {
+		if signup.InviteHash != f.Invite {
+			return nil, user.ErrInvalidInvite
+		}
+		f.Invite = ""
+	}
+	if f.Users == nil {
+		f.Users = map[string]*user.User{}
+	}
+	u := &user.User{ID: len(f.Users) + 1, Email: email, Name: name, Provider: provider, ProviderID: sub, Status: signup.Status}
+	f.Users[email] = u
+	f.Created = u
+	return u, nil
+}
+
+func (f *UserRepo) FindByID(ctx context.Context, id string) (*user.User, error) {
+	for _, u := range f.Users {
+		if strconv.Itoa(u.ID) == id {
+			return u, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (f *UserRepo) UpdateGrantedScopes(ctx context.Context, userID int, scopes []string) error {
+	for _, u := range f.Users {
+		if u.ID == userID {
+			u.GrantedScopes = scopes
+		}
+	}
+	return nil
+}
+
+func (f *UserRepo) UpdateRefreshToken(ctx context.Context, userID int, refreshToken string) error {
+	f.Saved = refreshToken
+	f.SavedID = userID
+	return nil
+}
+
+func (f *UserRepo) SaveIMAPAccount(ctx context.Context, userID int, account *user.IMAPAccount) error {
+	for _, u := range f.Users {
+		if u.ID == userID {
+			u.IMAP = account
+		}
+	}
+	return nil
+}
+
+func (f *UserRepo) DeleteAccount(ctx context.Context, u *user.User, grantRevoked bool) error {
+	delete(f.Users, u.Email)
+	f.GrantRevoked = grantRevoked
+	return nil
+}
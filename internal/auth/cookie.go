@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AccessCookieName  = "auramail_access"
+	RefreshCookieName = "auramail_refresh"
+	CSRFCookieName    = "auramail_csrf"
+	CSRFHeaderName    = "X-CSRF-Token"
+
+	// The refresh cookie is only needed by the refresh endpoint, so it is not
+	// sent along with every API call.
+	refreshCookiePath = "/auth"
+)
+
+var ErrCSRFMismatch = errors.New("csrf token missing or mismatched")
+
+// CookieConfig controls browser (cookie) auth. With AUTH_MODE=cookie the login
+// callback sets HttpOnly cookies instead of handing tokens to JavaScript, and
+// requests authenticated by those cookies must echo the CSRF cookie in the
+// X-CSRF-Token header when they change state.
+type CookieConfig struct {
+	Enabled  bool
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+func LoadCookieConfig() CookieConfig {
+	cfg := CookieConfig{
+		Enabled:  strings.EqualFold(os.Getenv("AUTH_MODE"), "cookie"),
+		Domain:   os.Getenv("AUTH_COOKIE_DOMAIN"),
+		Secure:   os.Getenv("AUTH_COOKIE_INSECURE") != "true",
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch strings.ToLower(os.Getenv("AUTH_COOKIE_SAMESITE")) {
+	case "strict":
+		cfg.SameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies that are not Secure.
+		cfg.SameSite = http.SameSiteNoneMode
+		cfg.Secure = true
+	}
+	return cfg
+}
+
+// SetAuthCookies stores a token pair in cookies together with a fresh CSRF
+// token. The CSRF cookie is deliberately readable by JavaScript.
+func (c CookieConfig) SetAuthCookies(w http.ResponseWriter, tokens *TokenPair) error {
+	csrf, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, c.cookie(AccessCookieName, tokens.AccessToken, "/", AccessTokenTTL, true))
+	http.SetCookie(w, c.cookie(RefreshCookieName, tokens.RefreshToken, refreshCookiePath, RefreshTokenTTL, true))
+	http.SetCookie(w, c.cookie(CSRFCookieName, csrf, "/", RefreshTokenTTL, false))
+	return nil
+}
+
+func (c CookieConfig) ClearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, c.cookie(AccessCookieName, "", "/", -1, true))
+	http.SetCookie(w, c.cookie(RefreshCookieName, "", refreshCookiePath, -1, true))
+	http.SetCookie(w, c.cookie(CSRFCookieName, "", "/", -1, false))
+}
+
+func (c CookieConfig) cookie(name, value, path string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.Domain,
+		Secure:   c.Secure,
+		HttpOnly: httpOnly,
+		SameSite: c.SameSite,
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.MaxAge = int(ttl.Seconds())
+	}
+	return cookie
+}
+
+// VerifyCSRF implements the double-submit check: the X-CSRF-Token header must
+// equal the CSRF cookie. A cross-site page can make the browser send the
+// cookie but cannot read it to fill in the header.
+func VerifyCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil || cookie.Value == "" {
+		return ErrCSRFMismatch
+	}
+	header := r.Header.Get(CSRFHeaderName)
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return ErrCSRFMismatch
+	}
+	return nil
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
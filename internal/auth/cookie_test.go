@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func cookiesFrom(rec *httptest.ResponseRecorder) map[string]*http.Cookie {
+	out := make(map[string]*http.Cookie)
+	for _, c := range rec.Result().Cookies() {
+		out[c.Name] = c
+	}
+	return out
+}
+
+func TestCookieModeMiddleware(t *testing.T) {
+	svc, u := newTestService(t)
+	t.Setenv("AUTH_MODE", "cookie")
+	authn := NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users)
+
+	pair, err := svc.IssueTokens(context.Background(), u, ClientInfo{Device: "browser"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	if err := LoadCookieConfig().SetAuthCookies(rec, pair); err != nil {
+		t.Fatalf("SetAuthCookies: %v", err)
+	}
+	cookies := cookiesFrom(rec)
+	if !cookies[AccessCookieName].HttpOnly || !cookies[RefreshCookieName].HttpOnly || !cookies[AccessCookieName].Secure {
+		t.Error("token cookies must be HttpOnly and Secure")
+	}
+	if cookies[CSRFCookieName].HttpOnly {
+		t.Error("csrf cookie must be readable by the client")
+	}
+
+	call := func(method, csrf string) int {
+		req := httptest.NewRequest(method, "/auth/logout", nil)
+		req.AddCookie(cookies[AccessCookieName])
+		req.AddCookie(cookies[CSRFCookieName])
+		if csrf != "" {
+			req.Header.Set(CSRFHeaderName, csrf)
+		}
+		rec := httptest.NewRecorder()
+		authn.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		csrf   string
+		want   int
+	}{
+		{"safe method needs no csrf", http.MethodGet, "", http.StatusOK},
+		{"post without csrf", http.MethodPost, "", http.StatusForbidden},
+		{"post with wrong csrf", http.MethodPost, "forged", http.StatusForbidden},
+		{"post with csrf", http.MethodPost, cookies[CSRFCookieName].Value, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := call(tt.method, tt.csrf); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	t.Setenv("AUTH_MODE", "")
+	if got := call(http.MethodGet, ""); got != http.StatusUnauthorized {
+		t.Errorf("cookie accepted in bearer mode: got %d", got)
+	}
+}
+
+func TestCookieModeRefresh(t *testing.T) {
+	svc, u := newTestService(t)
+	t.Setenv("AUTH_MODE", "cookie")
+	h := NewHandler(nil, nil, svc)
+
+	pair, _ := svc.IssueTokens(context.Background(), u, ClientInfo{Device: "browser"})
+	rec := httptest.NewRecorder()
+	LoadCookieConfig().SetAuthCookies(rec, pair)
+	cookies := cookiesFrom(rec)
+
+	refresh := func(csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+		req.AddCookie(cookies[RefreshCookieName])
+		req.AddCookie(cookies[CSRFCookieName])
+		req.Header.Set(CSRFHeaderName, csrf)
+		rec := httptest.NewRecorder()
+		h.Refresh(rec, req)
+		return rec
+	}
+
+	if rec := refresh(""); rec.Code != http.StatusForbidden {
+		t.Fatalf("refresh without csrf got %d, want 403", rec.Code)
+	}
+
+	rec = refresh(cookies[CSRFCookieName].Value)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("refresh got %d, want 204", rec.Code)
+	}
+	rotated := cookiesFrom(rec)
+	if rotated[RefreshCookieName] == nil || rotated[RefreshCookieName].Value == pair.RefreshToken {
+		t.Error("refresh cookie was not rotated")
+	}
+	if rotated[CSRFCookieName] == nil || rotated[CSRFCookieName].Value == cookies[CSRFCookieName].Value {
+		t.Error("csrf token was not rotated")
+	}
+	if rec.Body.Len() != 0 {
+		t.Error("tokens must not be returned in the body in cookie mode")
+	}
+}
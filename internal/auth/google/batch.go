@@ -0,0 +1,203 @@
+package google
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+const (
+	defaultBatchURL = "https://gmail.googleapis.com/batch/gmail/v1"
+
+	// batchSize is the number of messages per batch. Gmail accepts up to
+	// 100 sub-requests but rate-limits batches larger than about 50.
+	batchSize = 50
+)
+
+var errMissingPart = errors.New("batch response has no part for the request")
+
+// FetchBatch fetches ids through Gmail's batch endpoint, which carries many
+// requests in one multipart/mixed round trip. Each part succeeds or fails on
+// its own and costs quota like a single call; parts that failed with a rate
+// limit or server error are sent again in a smaller batch.
+func (m *gmailMailbox) FetchBatch(ctx context.Context, ids []string) ([]*mailbox.Message, []error) {
+	msgs := make([]*mailbox.Message, len(ids))
+	errs := make([]error, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		end := min(start+batchSize, len(ids))
+		m.fetchChunk(ctx, ids[start:end], msgs[start:end], errs[start:end])
+		if errors.Is(errs[start], mailbox.ErrReauthRequired) {
+			for i := end; i < len(ids); i++ {
+				errs[i] = errs[start]
+			}
+			break
+		}
+	}
+	return msgs, errs
+}
+
+func (m *gmailMailbox) fetchChunk(ctx context.Context, ids []string, msgs []*mailbox.Message, errs []error) {
+	pending := make([]int, len(ids))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := m.quota.wait(ctx, len(pending)*unitsMessagesGet); err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+			return
+		}
+		retry := m.sendBatch(ctx, ids, pending, msgs, errs)
+		if len(retry) == 0 {
+			return
+		}
+
+		// Wait as long as the most demanding part asks for.
+		var delay time.Duration
+		ok, limited := attempt < m.retry.attempts, false
+		for _, i := range retry {
+			d, fits := m.retry.delay(attempt, errs[i])
+			delay, ok, limited = max(delay, d), ok && fits, limited || rateLimited(errs[i])
+		}
+		if !ok {
+			for _, i := range retry {
+				errs[i] = fmt.Errorf("%w: %w", mailbox.ErrUnavailable, errs[i])
+			}
+			return
+		}
+		if limited {
+			m.quota.pause(delay)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			for _, i := range retry {
+				errs[i] = err
+			}
+			return
+		}
+		pending = retry
+	}
+}
+
+// sendBatch fetches ids[i] for each i in pending, filling in msgs and errs,
+// and returns the indexes worth another try.
+func (m *gmailMailbox) sendBatch(ctx context.Context, ids []string, pending []int, msgs []*mailbox.Message, errs []error) []int {
+	fail := func(err error, retry bool) []int {
+		for _, i := range pending {
+			errs[i] = err
+		}
+		if retry {
+			return pending
+		}
+		return nil
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, i := range pending {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", "<item-"+strconv.Itoa(i)+">")
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return fail(err, false)
+		}
+		fmt.Fprintf(part, "GET /gmail/v1/users/me/messages/%s?format=full HTTP/1.1\r\n\r\n", url.PathEscape(ids[i]))
+	}
+	if err := w.Close(); err != nil {
+		return fail(err, false)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.batchURL, &body)
+	if err != nil {
+		return fail(err, false)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+w.Boundary())
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		err = mailbox.CheckGrant(err)
+		return fail(err, ctx.Err() == nil && retryable(err))
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return fail(err, retryable(err))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fail(fmt.Errorf("unexpected batch response type %q", res.Header.Get("Content-Type")), false)
+	}
+
+	answered := map[int]bool{}
+	r := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		i, ok := partIndex(part.Header.Get("Content-ID"))
+		if !ok || i >= len(ids) || answered[i] {
+			continue
+		}
+		answered[i] = true
+		msgs[i], errs[i] = readPart(ids[i], part)
+	}
+
+	var retry []int
+	for _, i := range pending {
+		if !answered[i] {
+			errs[i] = errMissingPart
+		}
+		if errs[i] != nil && (errs[i] == errMissingPart || retryable(errs[i])) {
+			retry = append(retry, i)
+		}
+	}
+	return retry
+}
+
+// partIndex reads the index back out of a response part's Content-ID, which
+// Gmail derives from the request's: <item-3> comes back as <response-item-3>.
+func partIndex(contentID string) (int, bool) {
+	rest, ok := strings.CutPrefix(strings.Trim(contentID, "<>"), "response-item-")
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(rest)
+	return i, err == nil && i >= 0
+}
+
+// readPart decodes one embedded HTTP response.
+func readPart(id string, part *multipart.Part) (*mailbox.Message, error) {
+	res, err := http.ReadResponse(bufio.NewReader(part), nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid batch response part: %w", err)
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, messageNotFound(err)
+	}
+
+	var msg gmail.Message
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("invalid message %s in batch response: %w", id, err)
+	}
+	return toMessage(id, &msg), nil
+}
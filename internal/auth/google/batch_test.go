@@ -0,0 +1,170 @@
+package google
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+// fakeBatch answers Gmail batch requests. Messages in flaky are rate limited
+// the first time they are asked for, and those in dropped are left out of
+// the first response they should be in.
+type fakeBatch struct {
+	mu       sync.Mutex
+	batches  [][]string
+	flaky    map[string]bool
+	dropped  map[string]bool
+	notFound map[string]bool
+}
+
+func (f *fakeBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != http.MethodPost || err != nil {
+		http.Error(w, "bad batch request", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Read the whole request first: HTTP/1 servers may close the request
+	// body once the response starts.
+	var ids, contentIDs []string
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			http.Error(w, "bad part", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, strings.TrimPrefix(req.URL.Path, "/gmail/v1/users/me/messages/"))
+		contentIDs = append(contentIDs, part.Header.Get("Content-ID"))
+	}
+	f.batches = append(f.batches, ids)
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for i, id := range ids {
+		if f.dropped[id] {
+			delete(f.dropped, id)
+			continue
+		}
+		var status, body string
+		switch {
+		case f.flaky[id]:
+			delete(f.flaky, id)
+			status = "429 Too Many Requests"
+			body = `{"error":{"code":429,"message":"Too many concurrent requests for user","errors":[{"reason":"rateLimitExceeded"}]}}`
+		case f.notFound[id]:
+			status = "404 Not Found"
+			body = `{"error":{"code":404,"message":"Requested entity was not found."}}`
+		default:
+			status = "200 OK"
+			text := base64.URLEncoding.EncodeToString([]byte("Body of " + id))
+			body = fmt.Sprintf(`{"id":%q,"threadId":"thread-1","snippet":"snippet","payload":{"mimeType":"text/plain","headers":[{"name":"Subject","value":"Subject %s"}],"body":{"data":%q}}}`, id, id, text)
+		}
+
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", "<response-"+strings.Trim(contentIDs[i], "<>")+">")
+		pw, _ := mw.CreatePart(h)
+		fmt.Fprintf(pw, "HTTP/1.1 %s\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n%s", status, body)
+	}
+	mw.Close()
+}
+
+func newBatchMailbox(t *testing.T, h http.Handler) *gmailMailbox {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	m := newMailbox(nil, srv.Client(), newQuotaBucket())
+	m.batchURL = srv.URL
+	m.retry = retryPolicy{attempts: 3, base: time.Millisecond, max: 10 * time.Millisecond}
+	return m
+}
+
+func TestFetchBatch(t *testing.T) {
+	f := &fakeBatch{
+		flaky:    map[string]bool{"m3": true},
+		dropped:  map[string]bool{"m4": true},
+		notFound: map[string]bool{"m2": true},
+	}
+	mb := newBatchMailbox(t, f)
+
+	ids := []string{"m1", "m2", "m3", "m4"}
+	msgs, errs := mb.FetchBatch(context.Background(), ids)
+
+	for _, i := range []int{0, 2, 3} {
+		if errs[i] != nil {
+			t.Fatalf("%s: %v", ids[i], errs[i])
+		}
+		if msgs[i].ID != ids[i] || msgs[i].Subject != "Subject "+ids[i] || msgs[i].Body != "Body of "+ids[i] || msgs[i].ThreadID != "thread-1" {
+			t.Errorf("%s: got %+v", ids[i], msgs[i])
+		}
+	}
+	if !errors.Is(errs[1], mailbox.ErrMessageNotFound) {
+		t.Errorf("m2: got %v, want ErrMessageNotFound", errs[1])
+	}
+
+	// Only the rate limited and the missing part were sent again.
+	if len(f.batches) != 2 || !slices.Equal(f.batches[1], []string{"m3", "m4"}) {
+		t.Errorf("batches = %v", f.batches)
+	}
+}
+
+func TestFetchBatchSplitsLargeRequests(t *testing.T) {
+	f := &fakeBatch{}
+	mb := newBatchMailbox(t, f)
+
+	ids := make([]string, 2*batchSize+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%d", i)
+	}
+	msgs, errs := mb.FetchBatch(context.Background(), ids)
+	for i := range ids {
+		if errs[i] != nil || msgs[i].ID != ids[i] {
+			t.Fatalf("%s: got %+v, %v", ids[i], msgs[i], errs[i])
+		}
+	}
+	if len(f.batches) != 3 || len(f.batches[0]) != batchSize || len(f.batches[2]) != 1 {
+		t.Errorf("sent batches of %d, %d and %d", len(f.batches[0]), len(f.batches[1]), len(f.batches[len(f.batches)-1]))
+	}
+}
+
+func TestFetchBatchGivesUp(t *testing.T) {
+	var calls int
+	mb := newBatchMailbox(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, `{"error":{"code":503,"message":"Backend Error"}}`, http.StatusServiceUnavailable)
+	}))
+
+	_, errs := mb.FetchBatch(context.Background(), []string{"m1", "m2"})
+	for _, err := range errs {
+		var apiErr *googleapi.Error
+		if !errors.Is(err, mailbox.ErrUnavailable) || !errors.As(err, &apiErr) || apiErr.Code != http.StatusServiceUnavailable {
+			t.Errorf("got %v, want the 503 as ErrUnavailable", err)
+		}
+	}
+	if calls != mb.retry.attempts {
+		t.Errorf("sent %d batches, want %d", calls, mb.retry.attempts)
+	}
+}
@@ -1,133 +1,164 @@
 package google
 
 import (
+	"context"
 	"encoding/json"
-	"io"
-	"log"
+	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
 
 	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/mailbox"
 	"github.com/r7rainz/auramail/internal/user"
-	"golang.org/x/oauth2"
 )
 
+const (
+	defaultUserInfoURL = "https://www.googleapis.com/oauth2/v3/userinfo"
+	defaultRevokeURL   = "https://oauth2.googleapis.com/revoke"
+)
+
+// revokeClient bounds the revoke call, which account deletion waits on.
+var revokeClient = &http.Client{Timeout: 10 * time.Second}
+
+// Handler is the Google identity provider and serves its login endpoints.
 type Handler struct {
 	oauthConfig *oauth2.Config
-	userRepo    user.Repository
+	userInfoURL string
+	revokeURL   string
+	flow        *provider.Flow
+	quota       *quotaTracker
 }
 
 type GoogleUser struct {
-	Sub   string `json:"sub"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	Sub           string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
 }
 
-func NewHandler(cfg *oauth2.Config, userRepo user.Repository) *Handler {
-	return &Handler{oauthConfig: cfg, userRepo: userRepo}
+func NewHandler(cfg *oauth2.Config, userRepo user.Repository, authService *auth.Service) *Handler {
+	h := &Handler{
+		oauthConfig: cfg,
+		userInfoURL: defaultUserInfoURL,
+		revokeURL:   defaultRevokeURL,
+		quota:       newQuotaTracker(),
+	}
+	h.flow = provider.NewFlow(h, userRepo, authService)
+	return h
 }
 
 func (h *Handler) GoogleAuth(w http.ResponseWriter, r *http.Request) {
-	state := "random-state-for-now"
-
-	authURL := h.oauthConfig.AuthCodeURL(
-		state,
-		oauth2.AccessTypeOffline,
-		oauth2.ApprovalForce,
-	)
-	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
+	h.flow.Login(w, r)
 }
 
 func (h *Handler) GoogleCallback(w http.ResponseWriter, r *http.Request) {
-	codeStr := r.URL.Query().Get("code")
-	if codeStr == "" {
-		http.Error(w, "missing code", http.StatusBadRequest)
-		return
-	}
+	h.flow.Callback(w, r)
+}
 
-	ctx := r.Context()
+func (h *Handler) Name() string { return "google" }
 
-	token, err := h.oauthConfig.Exchange(ctx, codeStr)
-	if err != nil {
-		log.Printf("exchange failed: %v", err)
-		http.Error(w, "oauth exchange failed", http.StatusInternalServerError)
-		return
+// AuthCodeURL always sets include_granted_scopes, so the token Google returns
+// covers everything the user granted before plus anything added now, and a
+// scope upgrade never loses read access.
+func (h *Handler) AuthCodeURL(state, verifier string, scopes []string) string {
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOffline,
+		oauth2.ApprovalForce,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("include_granted_scopes", "true"),
 	}
+	if len(scopes) > 0 {
+		all := append(slices.Clone(h.oauthConfig.Scopes), scopes...)
+		opts = append(opts, oauth2.SetAuthURLParam("scope", strings.Join(all, " ")))
+	}
+	return h.oauthConfig.AuthCodeURL(state, opts...)
+}
 
-	client := h.oauthConfig.Client(ctx, token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v3/userinfo")
+func (h *Handler) OptionalScopes() map[string]string {
+	return optionalScopes
+}
+
+func (h *Handler) Exchange(ctx context.Context, code, verifier string) (*oauth2.Token, error) {
+	return h.oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+}
+
+func (h *Handler) UserInfo(ctx context.Context, token *oauth2.Token) (*provider.User, error) {
+	resp, err := h.oauthConfig.Client(ctx, token).Get(h.userInfoURL)
 	if err != nil {
-		log.Printf("userinfo request failed: %v", err)
-		http.Error(w, "failed to fetch user info", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("userinfo request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "invalid google response", http.StatusUnauthorized)
-		return
+		return nil, fmt.Errorf("userinfo returned %s", resp.Status)
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "failed to read response", http.StatusInternalServerError)
-		return
-	}
-
-	var user GoogleUser
-	if error := json.Unmarshal(body, &user); error != nil {
-		http.Error(w, "invalid google user payload", http.StatusInternalServerError)
-		return
+	var gu GoogleUser
+	if err := json.NewDecoder(resp.Body).Decode(&gu); err != nil {
+		return nil, fmt.Errorf("invalid google user payload: %w", err)
 	}
+	return &provider.User{Subject: gu.Sub, Email: gu.Email, EmailVerified: gu.EmailVerified, Name: gu.Name}, nil
+}
 
-	log.Printf("google user: %s (%s)", user.Email, user.Sub)
-
-	u, err := h.userRepo.FindOrCreateGoogleUser(
-		ctx,
-		user.Email,
-		user.Name,
-		user.Sub,
-	)
+// Mailbox ignores userID; Google keeps the refresh token it issued at login.
+func (h *Handler) Mailbox(ctx context.Context, userID int, refreshToken string) (mailbox.Mailbox, error) {
+	client := gmailClient(ctx, refreshToken)
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		http.Error(w, "failed to persist user", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	return newMailbox(srv, client, h.quota.bucket(refreshToken)), nil
+}
 
+func (h *Handler) IMAPScope() string {
+	return "mail.imap"
+}
 
+// IMAPAccessToken gets a fresh access token for XOAUTH2 logins to
+// imap.gmail.com, for Workspace colleges that turned off the Gmail API but
+// not IMAP.
+func (h *Handler) IMAPAccessToken(ctx context.Context, refreshToken string) (string, error) {
+	token, err := h.oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
 	if err != nil {
-		http.Error(w, "failed to generate token", http.StatusInternalServerError)
-		return
-	}
-
-	if token.RefreshToken != "" {
-		//save the google token to db
-		if err := h.userRepo.UpdateRefreshToken(ctx, u.ID, token.RefreshToken); err != nil {
-			log.Fatalf("failed to save google refresh token: %v", err)
-		}
-	}else{
-		log.Printf("no google refresh token received, using existing one")
+		return "", err
 	}
+	return token.AccessToken, nil
+}
 
-	accessToken, err := auth.GenerateAccessToken(
-		u.ID,
-		u.Email,
-		u.Name,
-	)
+// RevokeGrant revokes the refresh token and with it every scope the user
+// granted, so AuraMail disappears from their Google account's third-party
+// access list.
+func (h *Handler) RevokeGrant(ctx context.Context, refreshToken string) error {
+	form := url.Values{"token": {refreshToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.revokeURL, strings.NewReader(form.Encode()))
 	if err != nil {
-		http.Error(w, "failed to generate access token", http.StatusInternalServerError)
-		return
+		return err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	appRefreshToken, err := auth.GenerateRefreshToken(u.ID, u.Email) 
+	resp, err := revokeClient.Do(req)
 	if err != nil {
-		http.Error(w, "failed to generate refresh token", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("google revoke request failed: %w", err)
 	}
+	defer resp.Body.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"accessToken": accessToken,
-		"refreshToken" : appRefreshToken,
-	})
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest:
+		// invalid_token: already revoked or expired.
+		return nil
+	default:
+		return fmt.Errorf("google revoke returned %s", resp.Status)
+	}
 }
 
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
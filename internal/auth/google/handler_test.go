@@ -0,0 +1,209 @@
+package google
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/auth/authtest"
+)
+
+// fakeGoogle stands in for Google's token and userinfo endpoints. It remembers
+// the PKCE challenge from the authorization URL and checks the verifier on
+// exchange.
+type fakeGoogle struct {
+	*httptest.Server
+	challenge string
+}
+
+func newFakeGoogle(t *testing.T) *fakeGoogle {
+	f := &fakeGoogle{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "google-access",
+			"refresh_token": "google-refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer google-access" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(GoogleUser{Sub: "1184", Email: "student@vitbhopal.ac.in", EmailVerified: true, Name: "Student"})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestHandler(t *testing.T) (*Handler, *fakeGoogle, *authtest.UserRepo) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("OAUTH_REDIRECT_ALLOWLIST", "https://app.auramail.in")
+
+	g := newFakeGoogle(t)
+	cfg := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/auth/google/callback",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  g.URL + "/auth",
+			TokenURL: g.URL + "/token",
+		},
+	}
+	repo := &authtest.UserRepo{}
+	h := NewHandler(cfg, repo, auth.NewService(repo, authtest.RefreshStore{}, &authtest.SessionStore{}, auth.NewMemoryRevocationList(), nil, auth.NewMemoryAuthCodeStore()))
+	h.userInfoURL = g.URL + "/userinfo"
+	return h, g, repo
+}
+
+// startLogin runs GoogleAuth and returns the state sent to Google and the
+// cookie the browser would carry back.
+func startLogin(t *testing.T, h *Handler, g *fakeGoogle, target string) (string, *http.Cookie) {
+	rec := httptest.NewRecorder()
+	h.GoogleAuth(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("GoogleAuth status = %d", rec.Code)
+	}
+
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("bad redirect: %v", err)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("missing PKCE challenge in %s", loc)
+	}
+	g.challenge = q.Get("code_challenge")
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected one HttpOnly state cookie, got %v", cookies)
+	}
+	return q.Get("state"), cookies[0]
+}
+
+func callback(h *Handler, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/google/callback?code=abc&state="+url.QueryEscape(state), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.GoogleCallback(rec, req)
+	return rec
+}
+
+func TestGoogleLoginFlow(t *testing.T) {
+	h, g, repo := newTestHandler(t)
+
+	state, cookie := startLogin(t, h, g, "/auth/google")
+	if state == "" || state == "random-state-for-now" {
+		t.Fatalf("state was not randomised: %q", state)
+	}
+
+	rec := callback(h, state, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	var body map[string]string
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body["accessToken"] == "" || body["refreshToken"] == "" {
+		t.Errorf("missing tokens in %v", body)
+	}
+	if repo.Saved != "google-refresh" {
+		t.Errorf("google refresh token not stored, got %q", repo.Saved)
+	}
+}
+
+func TestGoogleLoginRedirectTo(t *testing.T) {
+	h, g, _ := newTestHandler(t)
+
+	rec := httptest.NewRecorder()
+	h.GoogleAuth(rec, httptest.NewRequest(http.MethodGet, "/auth/google?redirect_to=https://evil.example/cb", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("disallowed redirect_to status = %d", rec.Code)
+	}
+
+	state, cookie := startLogin(t, h, g, "/auth/google?redirect_to=https://app.auramail.in/done")
+	rec = callback(h, state, cookie)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback status = %d, body = %s", rec.Code, rec.Body)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || loc.Host != "app.auramail.in" || loc.Path != "/done" {
+		t.Fatalf("unexpected redirect %q", rec.Header().Get("Location"))
+	}
+	if loc.Query().Get("code") == "" || loc.Fragment != "" || strings.Contains(loc.String(), "Token") {
+		t.Errorf("expected only a one-time code in %q", loc)
+	}
+}
+
+func TestRevokeGrant(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm.Get("token")
+		if got != "google-refresh" {
+			http.Error(w, `{"error":"invalid_token"}`, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	h := &Handler{revokeURL: srv.URL}
+	if err := h.RevokeGrant(context.Background(), "google-refresh"); err != nil {
+		t.Fatalf("RevokeGrant: %v", err)
+	}
+	if got != "google-refresh" {
+		t.Errorf("revoked token = %q", got)
+	}
+	if err := h.RevokeGrant(context.Background(), "already-revoked"); err != nil {
+		t.Errorf("revoking an unknown token: %v", err)
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	if err := h.RevokeGrant(context.Background(), "google-refresh"); err == nil {
+		t.Error("expected an error when Google is unavailable")
+	}
+}
+
+func TestAuthCodeURLScopes(t *testing.T) {
+	h := &Handler{oauthConfig: NewOAuthConfig()}
+
+	loc, _ := url.Parse(h.AuthCodeURL("s", oauth2.GenerateVerifier(), nil))
+	if loc.Query().Get("include_granted_scopes") != "true" {
+		t.Error("include_granted_scopes must always be set")
+	}
+	if strings.Contains(loc.Query().Get("scope"), "gmail.modify") {
+		t.Error("write scopes requested by default")
+	}
+
+	loc, _ = url.Parse(h.AuthCodeURL("s", oauth2.GenerateVerifier(), []string{optionalScopes["gmail.modify"]}))
+	scopes := strings.Fields(loc.Query().Get("scope"))
+	if !slices.Contains(scopes, "https://www.googleapis.com/auth/gmail.readonly") || !slices.Contains(scopes, optionalScopes["gmail.modify"]) {
+		t.Errorf("upgrade should add to the default scopes, got %v", scopes)
+	}
+}
@@ -0,0 +1,269 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/utils"
+)
+
+type gmailMailbox struct {
+	srv *gmail.Service
+
+	// client is the authorized client srv uses, for the batch endpoint the
+	// generated library does not cover.
+	client   *http.Client
+	batchURL string
+
+	quota *quotaBucket
+	retry retryPolicy
+}
+
+func NewMailbox(srv *gmail.Service, client *http.Client) mailbox.Mailbox {
+	return newMailbox(srv, client, newQuotaBucket())
+}
+
+func newMailbox(srv *gmail.Service, client *http.Client, quota *quotaBucket) *gmailMailbox {
+	return &gmailMailbox{
+		srv:      srv,
+		client:   client,
+		batchURL: defaultBatchURL,
+		quota:    quota,
+		retry:    defaultRetryPolicy,
+	}
+}
+
+func (m *gmailMailbox) Search(ctx context.Context, query string, max int) ([]string, error) {
+	var res *gmail.ListMessagesResponse
+	err := m.call(ctx, unitsMessagesList, func() (err error) {
+		res, err = m.srv.Users.Messages.List("me").Q(query).MaxResults(int64(max)).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(res.Messages))
+	for _, msg := range res.Messages {
+		ids = append(ids, msg.Id)
+	}
+	return ids, nil
+}
+
+func (m *gmailMailbox) SearchPage(ctx context.Context, req mailbox.SearchRequest) (*mailbox.Page, error) {
+	call := m.srv.Users.Messages.List("me").Q(windowQuery(req)).Context(ctx)
+	if req.PageSize > 0 {
+		call = call.MaxResults(int64(req.PageSize))
+	}
+	if req.PageToken != "" {
+		call = call.PageToken(req.PageToken)
+	}
+	var res *gmail.ListMessagesResponse
+	err := m.call(ctx, unitsMessagesList, func() (err error) {
+		res, err = call.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &mailbox.Page{
+		IDs:           make([]string, 0, len(res.Messages)),
+		NextPageToken: res.NextPageToken,
+		Estimate:      int(res.ResultSizeEstimate),
+	}
+	for _, msg := range res.Messages {
+		page.IDs = append(page.IDs, msg.Id)
+	}
+	return page, nil
+}
+
+// windowQuery adds the date window to the search. Gmail takes after: and
+// before: as epoch seconds, which avoids its day boundaries being in the
+// mailbox owner's time zone. The query is grouped so the window applies to
+// every alternative of an OR.
+func windowQuery(req mailbox.SearchRequest) string {
+	var terms []string
+	if !req.After.IsZero() {
+		terms = append(terms, fmt.Sprintf("after:%d", req.After.Unix()))
+	}
+	if !req.Before.IsZero() {
+		terms = append(terms, fmt.Sprintf("before:%d", req.Before.Unix()))
+	}
+	if len(terms) == 0 {
+		return req.Query
+	}
+	if req.Query != "" {
+		terms = append([]string{"(" + req.Query + ")"}, terms...)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Cursor is the mailbox's current history ID.
+func (m *gmailMailbox) Cursor(ctx context.Context) (string, error) {
+	var profile *gmail.Profile
+	err := m.call(ctx, unitsGetProfile, func() (err error) {
+		profile, err = m.srv.Users.GetProfile("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(profile.HistoryId, 10), nil
+}
+
+// Added walks the history since cursor. Gmail keeps about a week of history
+// and answers 404 for older start IDs.
+func (m *gmailMailbox) Added(ctx context.Context, cursor string) ([]string, string, error) {
+	start, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return nil, "", mailbox.ErrCursorExpired
+	}
+
+	var ids []string
+	seen := map[string]bool{}
+	next := cursor
+	pageToken := ""
+	for {
+		call := m.srv.Users.History.List("me").StartHistoryId(start).HistoryTypes("messageAdded").Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		var res *gmail.ListHistoryResponse
+		err := m.call(ctx, unitsHistoryList, func() (err error) {
+			res, err = call.Do()
+			return err
+		})
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, "", mailbox.ErrCursorExpired
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, h := range res.History {
+			for _, added := range h.MessagesAdded {
+				if added.Message != nil && !seen[added.Message.Id] {
+					seen[added.Message.Id] = true
+					ids = append(ids, added.Message.Id)
+				}
+			}
+		}
+		if res.HistoryId != 0 {
+			next = strconv.FormatUint(res.HistoryId, 10)
+		}
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+
+	// History is oldest first.
+	slices.Reverse(ids)
+	return ids, next, nil
+}
+
+// Watch publishes inbox changes to a Pub/Sub topic, which Gmail must be
+// allowed to publish to. Watches last seven days and have to be renewed.
+func (m *gmailMailbox) Watch(ctx context.Context, topic string) (time.Time, error) {
+	req := &gmail.WatchRequest{TopicName: topic, LabelIds: []string{"INBOX"}}
+	var res *gmail.WatchResponse
+	err := m.call(ctx, unitsWatch, func() (err error) {
+		res, err = m.srv.Users.Watch("me", req).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(res.Expiration), nil
+}
+
+func (m *gmailMailbox) Fetch(ctx context.Context, id string) (*mailbox.Message, error) {
+	var msg *gmail.Message
+	err := m.call(ctx, unitsMessagesGet, func() (err error) {
+		msg, err = m.srv.Users.Messages.Get("me", id).Format("full").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, messageNotFound(err)
+	}
+	return toMessage(id, msg), nil
+}
+
+// messageNotFound turns Gmail's 404 for a message that was deleted since it
+// was listed into mailbox.ErrMessageNotFound.
+func messageNotFound(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return mailbox.ErrMessageNotFound
+	}
+	return err
+}
+
+func toMessage(id string, msg *gmail.Message) *mailbox.Message {
+	// Snippets come HTML-escaped ("Don&#39;t miss").
+	email := &mailbox.Message{ID: id, ThreadID: msg.ThreadId, Snippet: html.UnescapeString(msg.Snippet)}
+	for _, h := range msg.Payload.Headers {
+		switch h.Name {
+		case "Subject":
+			email.Subject = utils.DecodeHeader(h.Value)
+		case "From":
+			email.From = utils.DecodeHeader(h.Value)
+		case "Date":
+			email.Date = h.Value
+		}
+	}
+	email.Body = utils.ParseBody(msg.Payload)
+	email.Attachments = attachments(msg.Payload, nil)
+	return email
+}
+
+// attachments lists the parts Gmail stores separately. Their IDs change
+// between fetches of the same message, so they are only good for a
+// FetchAttachment soon after.
+func attachments(part *gmail.MessagePart, found []mailbox.Attachment) []mailbox.Attachment {
+	if part == nil {
+		return found
+	}
+	if part.Filename != "" && part.Body != nil && part.Body.AttachmentId != "" {
+		found = append(found, mailbox.Attachment{
+			ID:       part.Body.AttachmentId,
+			Filename: part.Filename,
+			MimeType: part.MimeType,
+			Size:     int(part.Body.Size),
+		})
+	}
+	for _, p := range part.Parts {
+		found = attachments(p, found)
+	}
+	return found
+}
+
+func (m *gmailMailbox) FetchAttachment(ctx context.Context, messageID, attachmentID string) ([]byte, error) {
+	var body *gmail.MessagePartBody
+	err := m.call(ctx, unitsAttachmentsGet, func() (err error) {
+		body, err = m.srv.Users.Messages.Attachments.Get("me", messageID, attachmentID).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, messageNotFound(err)
+	}
+
+	data, err := utils.DecodeBase64(body.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attachment data: %w", err)
+	}
+	return data, nil
+}
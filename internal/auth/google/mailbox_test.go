@@ -0,0 +1,60 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+func TestWindowQuery(t *testing.T) {
+	after := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		req  mailbox.SearchRequest
+		want string
+	}{
+		{"no window", mailbox.SearchRequest{Query: "from:placement OR subject:drive"}, "from:placement OR subject:drive"},
+		{"or query", mailbox.SearchRequest{Query: "from:placement OR subject:drive", After: after, Before: before},
+			"(from:placement OR subject:drive) after:1767225600 before:1782864000"},
+		{"after only", mailbox.SearchRequest{Query: "subject:drive", After: after}, "(subject:drive) after:1767225600"},
+		{"no query", mailbox.SearchRequest{Before: before}, "before:1782864000"},
+	}
+	for _, tt := range tests {
+		if got := windowQuery(tt.req); got != tt.want {
+			t.Errorf("%s: windowQuery = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetchMissingMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found."}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	gs, err := gmail.NewService(ctx, option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMailbox(gs, srv.Client(), newQuotaBucket())
+
+	if _, err := m.Fetch(ctx, "deleted"); !errors.Is(err, mailbox.ErrMessageNotFound) {
+		t.Errorf("Fetch = %v, want ErrMessageNotFound", err)
+	}
+	if _, err := m.FetchAttachment(ctx, "deleted", "att"); !errors.Is(err, mailbox.ErrMessageNotFound) {
+		t.Errorf("FetchAttachment = %v, want ErrMessageNotFound", err)
+	}
+}
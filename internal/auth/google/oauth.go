@@ -3,6 +3,7 @@ package google
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 
 	"golang.org/x/oauth2"
@@ -11,6 +12,16 @@ import (
 	"google.golang.org/api/option"
 )
 
+// optionalScopes are asked for only when a user turns on a feature that needs
+// them; everyone starts with read-only mail access.
+var optionalScopes = map[string]string{
+	"gmail.modify":    "https://www.googleapis.com/auth/gmail.modify",
+	"gmail.compose":   "https://www.googleapis.com/auth/gmail.compose",
+	"calendar.events": "https://www.googleapis.com/auth/calendar.events",
+	// Gmail's IMAP server only takes tokens with full mail access.
+	"mail.imap": "https://mail.google.com/",
+}
+
 func NewOAuthConfig() *oauth2.Config {
 	redirectURL := os.Getenv("GOOGLE_OAUTH_REDIRECT_URI")
 	if redirectURL == "" {
@@ -32,6 +43,12 @@ func NewOAuthConfig() *oauth2.Config {
 }
 
 func CreateGmailService(ctx context.Context, refreshToken string) (*gmail.Service, error) {
+	return gmail.NewService(ctx, option.WithHTTPClient(gmailClient(ctx, refreshToken)))
+}
+
+// gmailClient is an HTTP client that authorizes requests with the user's
+// stored grant.
+func gmailClient(ctx context.Context, refreshToken string) *http.Client {
 	config := NewOAuthConfig()
 
 	//Create token from stored refresh token
@@ -41,7 +58,5 @@ func CreateGmailService(ctx context.Context, refreshToken string) (*gmail.Servic
 	}
 
 	tokenSource := config.TokenSource(ctx, token)
-	httpClient := oauth2.NewClient(ctx, tokenSource)
-
-	return gmail.NewService(ctx, option.WithHTTPClient(httpClient))
+	return oauth2.NewClient(ctx, tokenSource)
 }
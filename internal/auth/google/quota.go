@@ -0,0 +1,257 @@
+package google
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+// Gmail charges every call against a quota of 250 units per user per
+// second, at these prices:
+// https://developers.google.com/gmail/api/reference/quota
+const (
+	userQuotaPerSecond = 250
+
+	unitsMessagesGet    = 5
+	unitsMessagesList   = 5
+	unitsAttachmentsGet = 5
+	unitsHistoryList    = 2
+	unitsGetProfile     = 1
+	unitsWatch          = 100
+)
+
+// quotaIdle is how long a user's bucket is kept after its last call. A full
+// bucket is no different from a new one, so dropping it loses nothing.
+const quotaIdle = time.Minute
+
+// quotaBucket spends one user's quota. A call reserves its units up front
+// and waits until the bucket has refilled enough to cover them, so the
+// workers of one user queue up instead of all running into the rate limit.
+type quotaBucket struct {
+	mu      sync.Mutex
+	units   float64 // negative while reserved units are not refilled yet
+	updated time.Time
+}
+
+func newQuotaBucket() *quotaBucket {
+	return &quotaBucket{units: userQuotaPerSecond, updated: time.Now()}
+}
+
+func (b *quotaBucket) refill(now time.Time) {
+	b.units = min(userQuotaPerSecond, b.units+now.Sub(b.updated).Seconds()*userQuotaPerSecond)
+	b.updated = now
+}
+
+// reserve takes units and returns how long to wait before spending them.
+func (b *quotaBucket) reserve(now time.Time, units int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.units -= float64(units)
+	if b.units >= 0 {
+		return 0
+	}
+	return time.Duration(-b.units / userQuotaPerSecond * float64(time.Second))
+}
+
+func (b *quotaBucket) wait(ctx context.Context, units int) error {
+	delay := b.reserve(time.Now(), units)
+	if err := sleep(ctx, delay); err != nil {
+		b.mu.Lock()
+		b.units += float64(units)
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// pause holds back every call of the user for d, after Gmail said they are
+// over quota.
+func (b *quotaBucket) pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.units = min(b.units, -d.Seconds()*userQuotaPerSecond)
+}
+
+func (b *quotaBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.updated) > quotaIdle
+}
+
+// quotaTracker hands out the bucket of each user, so that every mailbox
+// opened for them draws on the same quota. Users are told apart by their
+// grant, which is all Mailbox gets.
+type quotaTracker struct {
+	mu      sync.Mutex
+	buckets map[[sha256.Size]byte]*quotaBucket
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{buckets: map[[sha256.Size]byte]*quotaBucket{}}
+}
+
+func (t *quotaTracker) bucket(refreshToken string) *quotaBucket {
+	key := sha256.Sum256([]byte(refreshToken))
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, b := range t.buckets {
+		if k != key && b.idle(now) {
+			delete(t.buckets, k)
+		}
+	}
+	b, ok := t.buckets[key]
+	if !ok {
+		b = newQuotaBucket()
+		t.buckets[key] = b
+	}
+	return b
+}
+
+// retryPolicy is exponential backoff with jitter. A Retry-After longer than
+// max is not waited out: the call fails with mailbox.ErrUnavailable.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{attempts: 5, base: time.Second, max: 32 * time.Second}
+
+// delay is how long to wait before attempt+1, and false if err asks for
+// longer than the policy is willing to wait.
+func (p retryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	d := min(p.base<<(attempt-1), p.max)
+	d = d/2 + rand.N(d/2+1)
+	if after, ok := retryAfter(err); ok {
+		if after > p.max {
+			return 0, false
+		}
+		d = max(d, after)
+	}
+	return d, true
+}
+
+// call runs do after spending units of the user's quota, and runs it again
+// with backoff while Gmail answers with a rate limit or a server error.
+// Errors it gave up retrying wrap mailbox.ErrUnavailable.
+func (m *gmailMailbox) call(ctx context.Context, units int, do func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := m.quota.wait(ctx, units); err != nil {
+			return err
+		}
+		err := do()
+		if err == nil {
+			return nil
+		}
+		err = mailbox.CheckGrant(err)
+		if ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		delay, ok := m.retry.delay(attempt, err)
+		if !ok || attempt == m.retry.attempts {
+			return fmt.Errorf("%w: %w", mailbox.ErrUnavailable, err)
+		}
+		if rateLimited(err) {
+			m.quota.pause(delay)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// retryable reports whether the request was turned down for now rather than
+// for good: rate limits, server errors and connections that broke.
+func retryable(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 500 || rateLimited(err)
+	}
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// rateLimited reports whether Gmail refused the request for exceeding a
+// quota. It says so with a 429, or a 403 with a rate limit reason.
+func rateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, e := range apiErr.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// gmailRetryAfter matches the time Gmail puts in the message of a per-user
+// rate limit error, e.g. "User-rate limit exceeded.  Retry after
+// 2026-03-02T09:30:12.000Z".
+var gmailRetryAfter = regexp.MustCompile(`Retry after (\S+Z)`)
+
+// retryAfter reads when Gmail wants to be asked again, from the Retry-After
+// header in seconds or as a date, or from the error message.
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	if v := apiErr.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(time.Until(t), 0), true
+		}
+	}
+	if match := gmailRetryAfter.FindStringSubmatch(apiErr.Message); match != nil {
+		if t, err := time.Parse(time.RFC3339, match[1]); err == nil {
+			return max(time.Until(t), 0), true
+		}
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
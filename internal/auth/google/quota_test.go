@@ -0,0 +1,140 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+func testMailbox() *gmailMailbox {
+	m := newMailbox(nil, nil, newQuotaBucket())
+	m.retry = retryPolicy{attempts: 3, base: time.Millisecond, max: 10 * time.Millisecond}
+	return m
+}
+
+var userRateLimit = &googleapi.Error{
+	Code:    http.StatusForbidden,
+	Message: "User-rate limit exceeded.",
+	Errors:  []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+}
+
+func TestCallRetries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rate limit then success", func(t *testing.T) {
+		m := testMailbox()
+		calls := 0
+		err := m.call(ctx, unitsMessagesGet, func() error {
+			calls++
+			if calls < 3 {
+				return userRateLimit
+			}
+			return nil
+		})
+		if err != nil || calls != 3 {
+			t.Errorf("call = %v after %d calls, want success after 3", err, calls)
+		}
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		m := testMailbox()
+		calls := 0
+		notFound := &googleapi.Error{Code: http.StatusNotFound}
+		err := m.call(ctx, unitsMessagesGet, func() error {
+			calls++
+			return notFound
+		})
+		if err != notFound || calls != 1 {
+			t.Errorf("call = %v after %d calls, want the 404 at once", err, calls)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		m := testMailbox()
+		calls := 0
+		err := m.call(ctx, unitsMessagesGet, func() error {
+			calls++
+			return &googleapi.Error{Code: http.StatusServiceUnavailable}
+		})
+		var apiErr *googleapi.Error
+		if !errors.Is(err, mailbox.ErrUnavailable) || !errors.As(err, &apiErr) || calls != 3 {
+			t.Errorf("call = %v after %d calls, want ErrUnavailable after 3", err, calls)
+		}
+	})
+
+	t.Run("retry after too long", func(t *testing.T) {
+		m := testMailbox()
+		calls := 0
+		err := m.call(ctx, unitsMessagesGet, func() error {
+			calls++
+			return &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}}
+		})
+		if !errors.Is(err, mailbox.ErrUnavailable) || calls != 1 {
+			t.Errorf("call = %v after %d calls, want ErrUnavailable without waiting", err, calls)
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	soon := time.Now().Add(20 * time.Second).UTC()
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+		ok   bool
+	}{
+		{"seconds", &googleapi.Error{Header: http.Header{"Retry-After": {"7"}}}, 7 * time.Second, true},
+		{"date", &googleapi.Error{Header: http.Header{"Retry-After": {soon.Format(http.TimeFormat)}}}, 20 * time.Second, true},
+		{"gmail message", &googleapi.Error{Message: "User-rate limit exceeded.  Retry after " + soon.Format("2006-01-02T15:04:05.000Z")}, 20 * time.Second, true},
+		{"none", userRateLimit, 0, false},
+		{"not an api error", errors.New("boom"), 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.err)
+		if ok != tt.ok || got > tt.want || got < tt.want-2*time.Second {
+			t.Errorf("%s: retryAfter = %v, %v, want about %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{attempts: 5, base: time.Second, max: 8 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 6: 8 * time.Second} {
+		d, ok := p.delay(attempt, userRateLimit)
+		if !ok || d < want/2 || d > want {
+			t.Errorf("attempt %d: delay = %v, want between %v and %v", attempt, d, want/2, want)
+		}
+	}
+
+	withHeader := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"5"}}}
+	if d, ok := p.delay(1, withHeader); !ok || d != 5*time.Second {
+		t.Errorf("delay with Retry-After: 5 = %v, %v", d, ok)
+	}
+}
+
+func TestQuotaBucket(t *testing.T) {
+	b := newQuotaBucket()
+	now := b.updated
+
+	if d := b.reserve(now, userQuotaPerSecond); d != 0 {
+		t.Errorf("the first second's quota waited %v", d)
+	}
+	if d := b.reserve(now, 50); d != 200*time.Millisecond {
+		t.Errorf("50 more units waited %v, want 200ms", d)
+	}
+	// Half a second later the debt is paid and 75 units are back.
+	if d := b.reserve(now.Add(500*time.Millisecond), 75); d != 0 {
+		t.Errorf("refilled units waited %v", d)
+	}
+
+	tracker := newQuotaTracker()
+	if tracker.bucket("token-a") != tracker.bucket("token-a") || tracker.bucket("token-a") == tracker.bucket("token-b") {
+		t.Error("buckets are not per grant")
+	}
+}
@@ -2,7 +2,12 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 
@@ -19,60 +24,299 @@ type refreshRequest struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
-func NewHandler(cfg *oauth2.Config, userRepo user.Repository) *Handler {
+type tokenRequest struct {
+	Code         string `json:"code"`
+	CodeVerifier string `json:"codeVerifier"`
+}
+
+func NewHandler(cfg *oauth2.Config, userRepo user.Repository, service *Service) *Handler {
 	return &Handler{
 		oauthConfig: cfg,
 		userRepo:    userRepo,
-		service:     NewService(userRepo),
+		service:     service,
 	}
 }
 
-func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
-	var req refreshRequest
+// ExchangeToken trades the one-time code from the login redirect for a token
+// pair.
+func (h *Handler) ExchangeToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
 
-	_, err := ValidateRefreshToken(req.RefreshToken)
+	tokens, err := h.service.ExchangeAuthCode(r.Context(), req.Code, req.CodeVerifier)
+	if errors.Is(err, ErrInvalidAuthCode) {
+		http.Error(w, "invalid or expired code", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		log.Printf("code exchange failed: %v", err)
+		http.Error(w, "code exchange failed", http.StatusInternalServerError)
 		return
 	}
 
-	foundUser, err := h.userRepo.FindByRefreshToken(r.Context(), req.RefreshToken)
-	if err != nil {
-		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+func (h *Handler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if cookies := LoadCookieConfig(); cookies.Enabled {
+		if c, err := r.Cookie(RefreshCookieName); err == nil {
+			h.refreshCookies(w, r, cookies, c.Value)
+			return
+		}
+	}
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
-	_ = foundUser
 
-	accessToken, err := h.service.Refresh(r.Context(), req.RefreshToken)
-	if err != nil {
+	tokens, err := h.service.Refresh(r.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
 		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
 		return
 	}
+	if err != nil {
+		log.Printf("refresh failed: %v", err)
+		http.Error(w, "refresh failed", http.StatusInternalServerError)
+		return
+	}
 
-	w.Header().Set("Context-Type", "application/json")
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{
-		"access_token": accessToken,
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
 	}); err != nil {
 		http.Error(w, "failed to write response", http.StatusInternalServerError)
 	}
 }
 
+// refreshCookies is Refresh for browsers in cookie mode: the refresh token
+// comes from its cookie and the new pair is written back as cookies.
+func (h *Handler) refreshCookies(w http.ResponseWriter, r *http.Request, cookies CookieConfig, refreshToken string) {
+	if err := VerifyCSRF(r); err != nil {
+		http.Error(w, "invalid csrf token", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := h.service.Refresh(r.Context(), refreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		cookies.ClearAuthCookies(w)
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("refresh failed: %v", err)
+		http.Error(w, "refresh failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := cookies.SetAuthCookies(w, tokens); err != nil {
+		log.Printf("failed to set auth cookies: %v", err)
+		http.Error(w, "refresh failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
-	userID, ok := r.Context().Value("userID").(int)
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
 	if !ok {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	sessionID, _ := r.Context().Value(SessionIDContextKey).(string)
+	tokenID, _ := r.Context().Value(TokenIDContextKey).(string)
 
-	if err := h.service.Logout(r.Context(), userID); err != nil {
+	if err := h.service.Logout(r.Context(), userID, sessionID, tokenID); err != nil {
+		log.Printf("logout failed for user %d: %v", userID, err)
 		http.Error(w, "logout failed", http.StatusInternalServerError)
 		return
 	}
 
+	if cookies := LoadCookieConfig(); cookies.Enabled {
+		cookies.ClearAuthCookies(w)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+type sessionResponse struct {
+	*Session
+	Current bool `json:"current"`
+}
+
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value(SessionIDContextKey).(string)
+
+	sessions, err := h.service.Sessions(r.Context(), userID)
+	if err != nil {
+		log.Printf("failed to list sessions for user %d: %v", userID, err)
+		http.Error(w, "failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, sessionResponse{Session: s, Current: s.ID == currentID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.service.RevokeSession(r.Context(), userID, r.PathValue("id"))
+	if errors.Is(err, ErrSessionNotFound) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to revoke session for user %d: %v", userID, err)
+		http.Error(w, "failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAllSessions is "log out everywhere", including the current device.
+func (h *Handler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.service.RevokeAllSessions(r.Context(), userID); err != nil {
+		log.Printf("failed to revoke sessions for user %d: %v", userID, err)
+		http.Error(w, "failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type createPersonalAccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type createPersonalAccessTokenResponse struct {
+	*PersonalAccessToken
+	Token string `json:"token"`
+}
+
+func (h *Handler) CreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req createPersonalAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || req.ExpiresInDays < 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	token, pat, err := h.service.CreatePersonalAccessToken(r.Context(), userID, req.Name, req.Scopes, ttl)
+	if errors.Is(err, ErrInvalidScope) {
+		http.Error(w, "scopes must be a non-empty subset of "+strings.Join(PersonalAccessTokenScopes, ", "), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to create personal access token for user %d: %v", userID, err)
+		http.Error(w, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createPersonalAccessTokenResponse{PersonalAccessToken: pat, Token: token})
+}
+
+func (h *Handler) ListPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := h.service.PersonalAccessTokens(r.Context(), userID)
+	if err != nil {
+		log.Printf("failed to list personal access tokens for user %d: %v", userID, err)
+		http.Error(w, "failed to list tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *Handler) RevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.service.RevokePersonalAccessToken(r.Context(), userID, id)
+	if errors.Is(err, ErrPersonalAccessTokenNotFound) {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to revoke personal access token for user %d: %v", userID, err)
+		http.Error(w, "failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JWKS publishes the public access token signing keys so other services can
+// verify AuraMail tokens without sharing a secret.
+func (h *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	keys, err := currentKeySet()
+	if err != nil {
+		log.Printf("failed to load signing keys: %v", err)
+		http.Error(w, "signing keys unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": keys.JWKS()})
+}
@@ -4,23 +4,30 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/r7rainz/auramail/internal/user"
 )
 
+// AccessTokenClaims carries the user ID as the standard string "sub" claim,
+// so that services verifying against the JWKS can decode it; UserID is filled
+// in from it by ValidateAccessToken.
 type AccessTokenClaims struct {
-	UserID int    `json:"sub"`
-	Email  string `json:"email"`
-	Name   string `json:"name,omitempty"`
+	UserID    int       `json:"-"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name,omitempty"`
+	Role      user.Role `json:"role,omitempty"`
+	SessionID string    `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-type RefreshTokenClaims struct {
-	UserID int `json:"sub"`
-	Email string `json:"email"`
-	jwt.RegisteredClaims
-}
+const AccessTokenTTL = 15 * time.Minute
+
+// AccessTokenAudience is the "aud" of every access token.
+const AccessTokenAudience = "auramail-api"
 
 func jwtSecret() ([]byte, error) {
 	secret := os.Getenv("JWT_SECRET")
@@ -30,26 +37,34 @@ func jwtSecret() ([]byte, error) {
 	return []byte(secret), nil
 }
 
-func GenerateAccessToken(userID int, email, name string) (string, error) {
-	expirationTime := time.Now().Add(15 * time.Minute)
+func GenerateAccessToken(userID int, email, name string, role user.Role, sessionID string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	expirationTime := time.Now().Add(AccessTokenTTL)
 	claims := &AccessTokenClaims{
-		UserID: userID,
-		Email:  email,
-		Name:   name,
+		UserID:    userID,
+		Email:     email,
+		Name:      name,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{AccessTokenAudience},
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "AuraMail",
+			ID:        jti,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	key, err := jwtSecret()
+	keys, err := currentKeySet()
 	if err != nil {
 		return "", err
 	}
-	tokenString, err := token.SignedString(key)
+	tokenString, err := keys.sign(claims)
 	if err != nil {
 		return "", fmt.Errorf("could not sign the token : %w", err)
 	}
@@ -58,20 +73,16 @@ func GenerateAccessToken(userID int, email, name string) (string, error) {
 }
 
 func ValidateAccessToken(token string) (*AccessTokenClaims, error) {
-	key, err := jwtSecret()
+	keys, err := currentKeySet()
 	if err != nil {
-		return nil, err 
+		return nil, err
 	}
 
 	parsedToken, err := jwt.ParseWithClaims(
 		token,
 		&AccessTokenClaims{},
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return key, nil
-		},
+		keys.keyFunc,
+		jwt.WithAudience(AccessTokenAudience),
 	)
 
 	if err != nil {
@@ -82,60 +93,10 @@ func ValidateAccessToken(token string) (*AccessTokenClaims, error) {
 	if !ok || !parsedToken.Valid {
 		return nil, errors.New("invalid access token claims")
 	}
-
-	return claims, nil
-}
-
-func ValidateRefreshToken(token string) (*RefreshTokenClaims, error) {
-	key, err := jwtSecret()
+	claims.UserID, err = strconv.Atoi(claims.Subject)
 	if err != nil {
-		return nil, err 
-	}
-
-	parsedToken, err := jwt.ParseWithClaims(
-		token,
-		&RefreshTokenClaims{},
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return key, nil
-		},
-	)
-
-	if err != nil {
-		return nil, fmt.Errorf("invalid refresh token: %w", err)
-	}
-
-	claims, ok := parsedToken.Claims.(*RefreshTokenClaims)
-	if !ok || !parsedToken.Valid {
-		return nil, errors.New("invalid refresh token claims")
+		return nil, fmt.Errorf("invalid access token subject: %w", err)
 	}
 
 	return claims, nil
 }
-
-func GenerateRefreshToken(userID int, email string) (string, error) {
-	expirationTime := time.Now().Add(14 * 24 * time.Hour)
-	claims := &RefreshTokenClaims{
-		UserID: userID,
-		Email:  email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "AuraMail",
-		},
-	}
-	
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	key, err := jwtSecret()
-	if err!= nil {
-		return "", err
-	}
-
-	tokenString, err := token.SignedString(key)
-	if err != nil {
-		return "", fmt.Errorf("coult not sign the token %w", err)
-	}
-	return tokenString, nil
-}
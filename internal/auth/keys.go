@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKeyID identifies the HS256 JWT_SECRET key, which signs when no
+// asymmetric keys are configured and only verifies once they are. It is never
+// published in the JWKS.
+const legacyKeyID = "hs256"
+
+var ErrUnknownKeyID = errors.New("unknown signing key")
+
+// SigningKey is one entry of the key set. Private is nil for keys that may
+// only verify tokens, which is how a key is kept around after rotation until
+// every token it signed has expired.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.PrivateKey
+	Public  crypto.PublicKey
+}
+
+type KeySet struct {
+	active string
+	keys   map[string]*SigningKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+var (
+	keySetMu     sync.Mutex
+	keySetConfig string
+	keySet       *KeySet
+)
+
+// currentKeySet returns the key set described by the environment, reloading
+// it only when the configuration changes.
+func currentKeySet() (*KeySet, error) {
+	config := strings.Join([]string{
+		os.Getenv("JWT_SIGNING_KEYS"),
+		os.Getenv("JWT_ACTIVE_KID"),
+		os.Getenv("JWT_SECRET"),
+	}, "|")
+
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+
+	if keySet != nil && config == keySetConfig {
+		return keySet, nil
+	}
+
+	ks, err := LoadKeySet()
+	if err != nil {
+		return nil, err
+	}
+	keySet, keySetConfig = ks, config
+	return ks, nil
+}
+
+// LoadKeySet reads JWT_SIGNING_KEYS, a comma separated list of kid:path pairs
+// pointing at PEM files. Private keys (PKCS#8 RSA or Ed25519) can sign, public
+// keys only verify. JWT_ACTIVE_KID picks the signing key and defaults to the
+// last private key listed. Without JWT_SIGNING_KEYS the set falls back to
+// HS256 with JWT_SECRET. With both set, JWT_SECRET stays on to verify the
+// HS256 tokens issued before the switch.
+func LoadKeySet() (*KeySet, error) {
+	raw := os.Getenv("JWT_SIGNING_KEYS")
+	if raw == "" {
+		secret, err := jwtSecret()
+		if err != nil {
+			return nil, err
+		}
+		return NewKeySet(legacyKeyID, &SigningKey{
+			ID:      legacyKeyID,
+			Method:  jwt.SigningMethodHS256,
+			Private: secret,
+			Public:  secret,
+		})
+	}
+
+	var keys []*SigningKey
+	active := ""
+	for _, entry := range strings.Split(raw, ",") {
+		kid, path, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q", entry)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key %s: %w", kid, err)
+		}
+		key, err := ParseSigningKey(kid, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		if key.Private != nil {
+			active = kid
+		}
+	}
+
+	if secret, err := jwtSecret(); err == nil {
+		keys = append(keys, &SigningKey{
+			ID:     legacyKeyID,
+			Method: jwt.SigningMethodHS256,
+			Public: secret,
+		})
+	}
+
+	if kid := os.Getenv("JWT_ACTIVE_KID"); kid != "" {
+		active = kid
+	}
+	return NewKeySet(active, keys...)
+}
+
+func NewKeySet(active string, keys ...*SigningKey) (*KeySet, error) {
+	ks := &KeySet{active: active, keys: make(map[string]*SigningKey)}
+	for _, k := range keys {
+		if _, dup := ks.keys[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		ks.keys[k.ID] = k
+	}
+
+	signer, ok := ks.keys[active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q: %w", active, ErrUnknownKeyID)
+	}
+	if signer.Private == nil {
+		return nil, fmt.Errorf("active key %q has no private key", active)
+	}
+	return ks, nil
+}
+
+// ParseSigningKey decodes a PEM encoded PKCS#8 private key or PKIX public key.
+func ParseSigningKey(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not PEM encoded", kid)
+	}
+
+	key := &SigningKey{ID: kid}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key %s: %w", kid, err)
+		}
+		key.Private = parsed
+		switch k := parsed.(type) {
+		case *rsa.PrivateKey:
+			key.Public = &k.PublicKey
+		case ed25519.PrivateKey:
+			key.Public = k.Public()
+		}
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key %s: %w", kid, err)
+		}
+		key.Public = parsed
+	default:
+		return nil, fmt.Errorf("key %s has unsupported PEM type %q", kid, block.Type)
+	}
+
+	switch key.Public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("key %s must be RSA or Ed25519", kid)
+	}
+	return key, nil
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	k := ks.keys[ks.active]
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != legacyKeyID {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.Private)
+}
+
+// keyFunc resolves the verification key from the token's kid and refuses any
+// algorithm other than the one the key was registered with.
+func (ks *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKeyID, kid)
+	}
+	if t.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return k.Public, nil
+}
+
+// JWKS returns the public half of every asymmetric key, including keys that no
+// longer sign, so other services keep accepting tokens during a rotation.
+func (ks *KeySet) JWKS() []JWK {
+	jwks := []JWK{}
+	for _, k := range ks.keys {
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA",
+				Kid: k.ID,
+				Use: "sig",
+				Alg: k.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "OKP",
+				Kid: k.ID,
+				Use: "sig",
+				Alg: k.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return jwks
+}
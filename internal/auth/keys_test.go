@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+func writeKey(t *testing.T, dir, name string, key any, public bool) string {
+	t.Helper()
+	var (
+		der []byte
+		typ = "PRIVATE KEY"
+		err error
+	)
+	if public {
+		typ = "PUBLIC KEY"
+		der, err = x509.MarshalPKIXPublicKey(key)
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatalf("marshal %s: %v", name, err)
+	}
+
+	path := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	k1 := writeKey(t, dir, "k1", rsaKey, false)
+	k2 := writeKey(t, dir, "k2", edKey, false)
+
+	// k1 signs, k2 is already published.
+	t.Setenv("JWT_SIGNING_KEYS", "k1:"+k1+",k2:"+k2)
+	t.Setenv("JWT_ACTIVE_KID", "k1")
+	oldToken, err := GenerateAccessToken(1, "a@b.c", "A", user.RoleStudent, "s1")
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+
+	parsed, _, _ := jwt.NewParser().ParseUnverified(oldToken, &AccessTokenClaims{})
+	if parsed.Header["kid"] != "k1" || parsed.Header["alg"] != "RS256" {
+		t.Errorf("unexpected header %v", parsed.Header)
+	}
+
+	// Verifiers that only know the registered claims can read the subject.
+	var registered jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(oldToken, &registered); err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	if registered.Subject != "1" || len(registered.Audience) != 1 || registered.Audience[0] != AccessTokenAudience {
+		t.Errorf("unexpected registered claims %+v", registered)
+	}
+
+	// k2 takes over signing, k1 only verifies.
+	pub1 := writeKey(t, dir, "k1pub", &rsaKey.PublicKey, true)
+	t.Setenv("JWT_SIGNING_KEYS", "k1:"+pub1+",k2:"+k2)
+	t.Setenv("JWT_ACTIVE_KID", "k2")
+
+	newToken, err := GenerateAccessToken(1, "a@b.c", "A", user.RoleStudent, "s1")
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	for _, tok := range []string{oldToken, newToken} {
+		if _, err := ValidateAccessToken(tok); err != nil {
+			t.Errorf("ValidateAccessToken: %v", err)
+		}
+	}
+
+	ks, _ := currentKeySet()
+	if got := len(ks.JWKS()); got != 2 {
+		t.Errorf("JWKS has %d keys, want 2", got)
+	}
+
+	// k1 retired.
+	t.Setenv("JWT_SIGNING_KEYS", "k2:"+k2)
+	t.Setenv("JWT_ACTIVE_KID", "")
+	if _, err := ValidateAccessToken(oldToken); !errors.Is(err, ErrUnknownKeyID) {
+		t.Errorf("got %v, want ErrUnknownKeyID", err)
+	}
+	if _, err := ValidateAccessToken(newToken); err != nil {
+		t.Errorf("ValidateAccessToken: %v", err)
+	}
+}
+
+func TestValidateRejectsAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	t.Setenv("JWT_SIGNING_KEYS", "k1:"+writeKey(t, dir, "k1", edKey, false))
+	t.Setenv("JWT_ACTIVE_KID", "")
+
+	// An HS256 token claiming to come from k1, keyed with the public key bytes.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "1",
+			Audience:  jwt.ClaimStrings{AccessTokenAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	forged.Header["kid"] = "k1"
+	signed, err := forged.SignedString([]byte(edKey.Public().(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ValidateAccessToken(signed); err == nil {
+		t.Error("HS256 token accepted for an EdDSA key")
+	}
+}
+
+func TestLegacySecretFallback(t *testing.T) {
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	tok, err := GenerateAccessToken(3, "a@b.c", "A", user.RoleStudent, "s1")
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	claims, err := ValidateAccessToken(tok)
+	if err != nil || claims.UserID != 3 {
+		t.Fatalf("ValidateAccessToken = %v, %v", claims, err)
+	}
+
+	ks, _ := currentKeySet()
+	if len(ks.JWKS()) != 0 {
+		t.Error("HS256 secret must not be published")
+	}
+}
+
+func TestLegacySecretVerifiesAfterSwitch(t *testing.T) {
+	t.Setenv("JWT_SIGNING_KEYS", "")
+	t.Setenv("JWT_SECRET", "test-secret")
+	legacy, err := GenerateAccessToken(3, "a@b.c", "A", user.RoleStudent, "s1")
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	t.Setenv("JWT_SIGNING_KEYS", "k1:"+writeKey(t, dir, "k1", edKey, false))
+	t.Setenv("JWT_ACTIVE_KID", "")
+
+	if claims, err := ValidateAccessToken(legacy); err != nil || claims.UserID != 3 {
+		t.Errorf("ValidateAccessToken = %v, %v", claims, err)
+	}
+
+	tok, err := GenerateAccessToken(3, "a@b.c", "A", user.RoleStudent, "s1")
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	parsed, _, _ := jwt.NewParser().ParseUnverified(tok, &AccessTokenClaims{})
+	if parsed.Header["kid"] != "k1" {
+		t.Errorf("signed with %v, want k1", parsed.Header)
+	}
+
+	ks, _ := currentKeySet()
+	if got := len(ks.JWKS()); got != 1 {
+		t.Errorf("JWKS has %d keys, want 1", got)
+	}
+
+	// The secret can never be made the signer again by kid alone.
+	t.Setenv("JWT_ACTIVE_KID", legacyKeyID)
+	if _, err := GenerateAccessToken(3, "a@b.c", "A", user.RoleStudent, "s1"); err == nil {
+		t.Error("verify-only HS256 key was allowed to sign")
+	}
+}
@@ -0,0 +1,206 @@
+package microsoft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+const defaultGraphURL = "https://graph.microsoft.com/v1.0"
+
+// Handler is the Microsoft (Entra ID / Graph) identity provider and serves
+// its login endpoints.
+type Handler struct {
+	oauthConfig *oauth2.Config
+	graphURL    string
+	users       user.Repository
+	flow        *provider.Flow
+}
+
+type graphUser struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+// idTokenClaims are the ID token claims that say which address Microsoft
+// has verified. The email claim alone is whatever the user's tenant admin
+// typed in, so it only counts when xms_edov says the tenant owns the
+// domain. verified_primary_email is an optional claim the app registration
+// has to ask for.
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	ObjectID             string   `json:"oid"`
+	Email                string   `json:"email"`
+	EmailDomainVerified  bool     `json:"xms_edov"`
+	VerifiedPrimaryEmail []string `json:"verified_primary_email"`
+}
+
+func NewHandler(cfg *oauth2.Config, userRepo user.Repository, authService *auth.Service) *Handler {
+	h := &Handler{
+		oauthConfig: cfg,
+		graphURL:    defaultGraphURL,
+		users:       userRepo,
+	}
+	h.flow = provider.NewFlow(h, userRepo, authService)
+	return h
+}
+
+func (h *Handler) MicrosoftAuth(w http.ResponseWriter, r *http.Request) {
+	h.flow.Login(w, r)
+}
+
+func (h *Handler) MicrosoftCallback(w http.ResponseWriter, r *http.Request) {
+	h.flow.Callback(w, r)
+}
+
+func (h *Handler) Name() string { return "microsoft" }
+
+// AuthCodeURL ignores scopes; OptionalScopes offers none yet.
+func (h *Handler) AuthCodeURL(state, verifier string, scopes []string) string {
+	return h.oauthConfig.AuthCodeURL(
+		state,
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+		oauth2.S256ChallengeOption(verifier),
+	)
+}
+
+func (h *Handler) Exchange(ctx context.Context, code, verifier string) (*oauth2.Token, error) {
+	return h.oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+}
+
+// UserInfo takes the address from the ID token, never from Graph's mail or
+// userPrincipalName: any tenant can set those to an address it does not own.
+// An email claim Microsoft has not verified is passed on as unverified.
+func (h *Handler) UserInfo(ctx context.Context, token *oauth2.Token) (*provider.User, error) {
+	claims, err := h.idTokenClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	email, verified := verifiedEmail(claims)
+	if email == "" {
+		return nil, fmt.Errorf("microsoft id_token has no email")
+	}
+
+	client := h.oauthConfig.Client(ctx, token)
+	resp, err := client.Get(h.graphURL + "/me?$select=id,displayName")
+	if err != nil {
+		return nil, fmt.Errorf("graph /me request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("graph /me returned %s", resp.Status)
+	}
+
+	var gu graphUser
+	if err := json.NewDecoder(resp.Body).Decode(&gu); err != nil {
+		return nil, fmt.Errorf("invalid graph user payload: %w", err)
+	}
+	if gu.ID == "" || gu.ID != claims.ObjectID {
+		return nil, fmt.Errorf("graph user %q does not match the id token", gu.ID)
+	}
+	return &provider.User{Subject: gu.ID, Email: email, EmailVerified: verified, Name: gu.DisplayName}, nil
+}
+
+// idTokenClaims reads the ID token that came with token. It arrived straight
+// from the token endpoint over TLS in exchange for our client secret, so its
+// signature is not checked again (OpenID Connect Core 3.1.3.7); the audience
+// still has to be us.
+func (h *Handler) idTokenClaims(token *oauth2.Token) (*idTokenClaims, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return nil, fmt.Errorf("microsoft token response has no id_token")
+	}
+	var claims idTokenClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, &claims); err != nil {
+		return nil, fmt.Errorf("invalid microsoft id_token: %w", err)
+	}
+	if !slices.Contains(claims.Audience, h.oauthConfig.ClientID) {
+		return nil, fmt.Errorf("microsoft id_token was issued to %v", claims.Audience)
+	}
+	return &claims, nil
+}
+
+// verifiedEmail prefers verified_primary_email and otherwise returns the
+// email claim, verified only when xms_edov is set.
+func verifiedEmail(claims *idTokenClaims) (string, bool) {
+	if len(claims.VerifiedPrimaryEmail) > 0 {
+		return claims.VerifiedPrimaryEmail[0], true
+	}
+	return claims.Email, claims.Email != "" && claims.EmailDomainVerified
+}
+
+// Mailbox reads mail through Graph. Microsoft answers every refresh with a
+// new refresh token and may stop accepting the old one, so each new one is
+// stored for userID as soon as it arrives.
+func (h *Handler) Mailbox(ctx context.Context, userID int, refreshToken string) (mailbox.Mailbox, error) {
+	if refreshToken == "" {
+		return nil, fmt.Errorf("no microsoft refresh token stored")
+	}
+	ts := &rotatingTokenSource{
+		base:   h.oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}),
+		stored: refreshToken,
+		save: func(refreshToken string) error {
+			return h.users.UpdateRefreshToken(context.WithoutCancel(ctx), userID, refreshToken)
+		},
+	}
+	return NewMailbox(oauth2.NewClient(ctx, ts), h.graphURL), nil
+}
+
+// rotatingTokenSource saves the refresh token that comes with each new access
+// token whenever it differs from the stored one.
+type rotatingTokenSource struct {
+	base oauth2.TokenSource
+	save func(refreshToken string) error
+
+	mu     sync.Mutex
+	stored string
+}
+
+func (s *rotatingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.RefreshToken == "" || token.RefreshToken == s.stored {
+		return token, nil
+	}
+	// The access token is good either way; saving is tried again with the
+	// next one.
+	if err := s.save(token.RefreshToken); err != nil {
+		log.Printf("failed to store rotated microsoft refresh token: %v", err)
+		return token, nil
+	}
+	s.stored = token.RefreshToken
+	return token, nil
+}
+
+func (h *Handler) OptionalScopes() map[string]string { return nil }
+
+// RevokeGrant is a no-op: Microsoft has no endpoint to revoke a single
+// app's refresh token. Users remove AuraMail under "Apps and services" in
+// their Microsoft account (or their admin does in Entra ID), and the stored
+// token is deleted with the account either way.
+func (h *Handler) RevokeGrant(ctx context.Context, refreshToken string) error {
+	return nil
+}
+
+func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/auth/microsoft", h.MicrosoftAuth)
+	mux.HandleFunc("/auth/microsoft/callback", h.MicrosoftCallback)
+}
@@ -0,0 +1,336 @@
+package microsoft
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/auth/authtest"
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+// fakeMicrosoft stands in for the Entra ID token endpoint and the Graph API.
+type fakeMicrosoft struct {
+	*httptest.Server
+	challenge string
+	search    string
+	idClaims  jwt.MapClaims // claims of the id_token sent with the code exchange
+}
+
+func newFakeMicrosoft(t *testing.T) *fakeMicrosoft {
+	f := &fakeMicrosoft{idClaims: jwt.MapClaims{
+		"aud":      "client",
+		"oid":      "ms-42",
+		"email":    "student@college.edu",
+		"xms_edov": true,
+	}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		refreshToken := "ms-refresh"
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		case "refresh_token":
+			// Every refresh rotates the refresh token.
+			refreshToken = "ms-refresh-rotated"
+			if r.PostForm.Get("refresh_token") != "ms-refresh" {
+				// Like the real endpoint, answer in JSON so the error code is parsed.
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+		}
+		resp := map[string]any{
+			"access_token":  "ms-access",
+			"refresh_token": refreshToken,
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		}
+		if r.PostForm.Get("grant_type") == "authorization_code" {
+			idToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, f.idClaims).SignedString([]byte("unchecked"))
+			resp["id_token"] = idToken
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	graph := http.NewServeMux()
+	graph.HandleFunc("GET /me", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":                "ms-42",
+			"displayName":       "Student",
+			"mail":              "dean@college.edu",
+			"userPrincipalName": "student@college.onmicrosoft.com",
+		})
+	})
+	graph.HandleFunc("GET /me/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("$skiptoken") == "page2" {
+			json.NewEncoder(w).Encode(map[string]any{"value": []map[string]string{{"id": "AAMk3"}}})
+			return
+		}
+		f.search = r.URL.Query().Get("$search")
+		json.NewEncoder(w).Encode(map[string]any{
+			"value":           []map[string]string{{"id": "AAMk1"}, {"id": "AAMk2"}},
+			"@odata.nextLink": f.URL + "/v1.0/me/messages?$select=id&$skiptoken=page2",
+		})
+	})
+	graph.HandleFunc("GET /me/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "AAMk1" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Prefer"), `body-content-type="text"`) {
+			http.Error(w, "expected text bodies", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":               "AAMk1",
+			"conversationId":   "AAQk1",
+			"subject":          "Campus drive: Contoso",
+			"bodyPreview":      "Register by Friday",
+			"receivedDateTime": "2026-01-20T10:00:00Z",
+			"from":             map[string]any{"emailAddress": map[string]string{"name": "Placement Office", "address": "placementoffice@college.edu"}},
+			"body":             map[string]string{"contentType": "text", "content": "Register   by\n Friday"},
+			"attachments": []map[string]any{
+				{"@odata.type": "#microsoft.graph.fileAttachment", "id": "att1", "name": "JD.pdf", "contentType": "application/pdf", "size": 7},
+				{"@odata.type": "#microsoft.graph.fileAttachment", "id": "logo", "name": "logo.png", "isInline": true},
+				{"@odata.type": "#microsoft.graph.itemAttachment", "id": "fwd", "name": "Fwd: drive"},
+			},
+		})
+	})
+	graph.HandleFunc("GET /me/messages/{id}/attachments/{attachment}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "AAMk1" || r.PathValue("attachment") != "att1" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"@odata.type":  "#microsoft.graph.fileAttachment",
+			"id":           "att1",
+			"contentBytes": base64.StdEncoding.EncodeToString([]byte("%PDF-1.")),
+		})
+	})
+	mux.Handle("/v1.0/", http.StripPrefix("/v1.0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ms-access" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		graph.ServeHTTP(w, r)
+	})))
+
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestHandler(t *testing.T) (*Handler, *fakeMicrosoft, *authtest.UserRepo) {
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	f := newFakeMicrosoft(t)
+	cfg := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/auth/microsoft/callback",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  f.URL + "/authorize",
+			TokenURL: f.URL + "/token",
+		},
+	}
+	repo := &authtest.UserRepo{}
+	h := NewHandler(cfg, repo, auth.NewService(repo, authtest.RefreshStore{}, &authtest.SessionStore{}, auth.NewMemoryRevocationList(), nil, auth.NewMemoryAuthCodeStore()))
+	h.graphURL = f.URL + "/v1.0"
+	return h, f, repo
+}
+
+func login(t *testing.T, h *Handler, f *fakeMicrosoft) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.MicrosoftAuth(rec, httptest.NewRequest(http.MethodGet, "/auth/microsoft", nil))
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), f.URL+"/authorize") {
+		t.Fatalf("unexpected redirect %q", rec.Header().Get("Location"))
+	}
+	f.challenge = loc.Query().Get("code_challenge")
+	if f.challenge == "" {
+		t.Fatal("missing PKCE challenge")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/microsoft/callback?code=abc&state="+url.QueryEscape(loc.Query().Get("state")), nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	rec = httptest.NewRecorder()
+	h.MicrosoftCallback(rec, req)
+	return rec
+}
+
+func TestMicrosoftLoginFlow(t *testing.T) {
+	h, f, repo := newTestHandler(t)
+
+	if rec := login(t, h, f); rec.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	if repo.Created.Provider != "microsoft" || repo.Created.ProviderID != "ms-42" {
+		t.Errorf("unexpected user %+v", repo.Created)
+	}
+	if repo.Created.Email != "student@college.edu" {
+		t.Errorf("email should come from the id token, got %q", repo.Created.Email)
+	}
+	if repo.Saved != "ms-refresh" {
+		t.Errorf("microsoft refresh token not stored, got %q", repo.Saved)
+	}
+}
+
+func TestMicrosoftLoginVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   string // "" when the login is refused
+	}{
+		{"verified primary email", jwt.MapClaims{"aud": "client", "oid": "ms-42", "email": "alias@college.edu", "verified_primary_email": []string{"student@college.edu"}}, "student@college.edu"},
+		{"unverified domain", jwt.MapClaims{"aud": "client", "oid": "ms-42", "email": "someone@vitbhopal.ac.in", "xms_edov": false}, ""},
+		{"no email claim", jwt.MapClaims{"aud": "client", "oid": "ms-42"}, ""},
+		{"other audience", jwt.MapClaims{"aud": "someone-else", "oid": "ms-42", "email": "student@college.edu", "xms_edov": true}, ""},
+		{"other user", jwt.MapClaims{"aud": "client", "oid": "ms-7", "email": "student@college.edu", "xms_edov": true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, f, repo := newTestHandler(t)
+			f.idClaims = tt.claims
+
+			rec := login(t, h, f)
+			if tt.want == "" {
+				if rec.Code == http.StatusOK || repo.Created != nil {
+					t.Fatalf("login accepted: status = %d, user = %+v", rec.Code, repo.Created)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("callback status = %d, body = %s", rec.Code, rec.Body)
+			}
+			if repo.Created.Email != tt.want {
+				t.Errorf("email = %q, want %q", repo.Created.Email, tt.want)
+			}
+		})
+	}
+}
+
+func TestMicrosoftMailbox(t *testing.T) {
+	h, f, repo := newTestHandler(t)
+	ctx := context.Background()
+
+	mb, err := h.Mailbox(ctx, 7, "ms-refresh")
+	if err != nil {
+		t.Fatalf("Mailbox: %v", err)
+	}
+
+	ids, err := mb.Search(ctx, "from:placementoffice@college.edu OR subject:placement", 10)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != "AAMk1" {
+		t.Errorf("got ids %v", ids)
+	}
+	if f.search != `"from:placementoffice@college.edu OR subject:placement"` {
+		t.Errorf("search was sent as %q", f.search)
+	}
+	if repo.Saved != "ms-refresh-rotated" || repo.SavedID != 7 {
+		t.Errorf("rotated refresh token not stored, got %q for user %d", repo.Saved, repo.SavedID)
+	}
+
+	msg, err := mb.Fetch(ctx, "AAMk1")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if msg.Subject != "Campus drive: Contoso" || msg.Body != "Register by Friday" ||
+		msg.From != "Placement Office <placementoffice@college.edu>" || msg.ThreadID != "AAQk1" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].ID != "att1" || msg.Attachments[0].Filename != "JD.pdf" {
+		t.Errorf("unexpected attachments %+v", msg.Attachments)
+	}
+	data, err := mb.FetchAttachment(ctx, "AAMk1", "att1")
+	if err != nil || string(data) != "%PDF-1." {
+		t.Errorf("FetchAttachment = %q, %v", data, err)
+	}
+
+	if _, err := mb.Fetch(ctx, "missing"); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestMicrosoftMailboxSearchPage(t *testing.T) {
+	h, f, _ := newTestHandler(t)
+	ctx := context.Background()
+
+	mb, err := h.Mailbox(ctx, 7, "ms-refresh")
+	if err != nil {
+		t.Fatalf("Mailbox: %v", err)
+	}
+
+	req := mailbox.SearchRequest{
+		Query:    "subject:placement",
+		After:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Before:   time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC),
+		PageSize: 2,
+	}
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatal("paging did not stop")
+		}
+		page, err := mb.SearchPage(ctx, req)
+		if err != nil {
+			t.Fatalf("SearchPage: %v", err)
+		}
+		ids = append(ids, page.IDs...)
+		if page.NextPageToken == "" {
+			break
+		}
+		req.PageToken = page.NextPageToken
+	}
+
+	if strings.Join(ids, ",") != "AAMk1,AAMk2,AAMk3" {
+		t.Errorf("got ids %v", ids)
+	}
+	if want := `"(subject:placement) AND received>=2026-01-01 AND received<2026-07-01"`; f.search != want {
+		t.Errorf("search was sent as %q, want %q", f.search, want)
+	}
+
+	req.PageToken = "https://evil.example/me/messages?x=1"
+	if _, err := mb.SearchPage(ctx, req); err == nil {
+		t.Error("expected a foreign page token to be rejected")
+	}
+}
+
+func TestMicrosoftMailboxRevokedGrant(t *testing.T) {
+	h, _, repo := newTestHandler(t)
+	ctx := context.Background()
+
+	mb, err := h.Mailbox(ctx, 7, "revoked-refresh")
+	if err != nil {
+		t.Fatalf("Mailbox: %v", err)
+	}
+	if _, err := mb.Search(ctx, "subject:placement", 10); !errors.Is(err, mailbox.ErrReauthRequired) {
+		t.Errorf("Search = %v, want ErrReauthRequired", err)
+	}
+	if repo.Saved != "" {
+		t.Errorf("stored %q after a failed refresh", repo.Saved)
+	}
+}
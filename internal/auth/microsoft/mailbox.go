@@ -0,0 +1,217 @@
+package microsoft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/utils"
+)
+
+// graphMailbox reads an Outlook / Microsoft 365 mailbox through the Graph
+// messages API.
+type graphMailbox struct {
+	client  *http.Client
+	baseURL string
+}
+
+func NewMailbox(client *http.Client, graphURL string) mailbox.Mailbox {
+	return &graphMailbox{client: client, baseURL: strings.TrimSuffix(graphURL, "/")}
+}
+
+type graphMessage struct {
+	ID               string `json:"id"`
+	ConversationID   string `json:"conversationId"`
+	Subject          string `json:"subject"`
+	BodyPreview      string `json:"bodyPreview"`
+	ReceivedDateTime string `json:"receivedDateTime"`
+	From             struct {
+		EmailAddress struct {
+			Name    string `json:"name"`
+			Address string `json:"address"`
+		} `json:"emailAddress"`
+	} `json:"from"`
+	Body struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"body"`
+	Attachments []graphAttachment `json:"attachments"`
+}
+
+type graphAttachment struct {
+	Type         string `json:"@odata.type"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	Size         int    `json:"size"`
+	IsInline     bool   `json:"isInline"`
+	ContentBytes []byte `json:"contentBytes"`
+}
+
+const fileAttachmentType = "#microsoft.graph.fileAttachment"
+
+// Search passes query to Graph's $search, whose KQL syntax accepts the same
+// "from:" and "subject:" terms as Gmail. Results come back newest first.
+func (m *graphMailbox) Search(ctx context.Context, query string, max int) ([]string, error) {
+	params := url.Values{
+		"$select": {"id"},
+		"$top":    {strconv.Itoa(max)},
+	}
+	if query != "" {
+		params.Set("$search", strconv.Quote(query))
+	}
+
+	var res struct {
+		Value []graphMessage `json:"value"`
+	}
+	if err := m.get(ctx, "/me/messages?"+params.Encode(), &res); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(res.Value))
+	for _, msg := range res.Value {
+		ids = append(ids, msg.ID)
+	}
+	return ids, nil
+}
+
+// SearchPage follows Graph's @odata.nextLink, keeping the part after the API
+// root as the page token. The date window becomes KQL received: terms, which
+// only have day precision.
+func (m *graphMailbox) SearchPage(ctx context.Context, req mailbox.SearchRequest) (*mailbox.Page, error) {
+	path := req.PageToken
+	if path == "" {
+		params := url.Values{"$select": {"id"}}
+		if req.PageSize > 0 {
+			params.Set("$top", strconv.Itoa(req.PageSize))
+		}
+		if query := kqlWindow(req); query != "" {
+			params.Set("$search", strconv.Quote(query))
+		}
+		path = "/me/messages?" + params.Encode()
+	} else if !strings.HasPrefix(path, "/me/messages?") {
+		return nil, fmt.Errorf("invalid graph page token")
+	}
+
+	var res struct {
+		Value    []graphMessage `json:"value"`
+		NextLink string         `json:"@odata.nextLink"`
+	}
+	if err := m.get(ctx, path, &res); err != nil {
+		return nil, err
+	}
+
+	page := &mailbox.Page{IDs: make([]string, 0, len(res.Value))}
+	for _, msg := range res.Value {
+		page.IDs = append(page.IDs, msg.ID)
+	}
+	if res.NextLink != "" {
+		next, ok := strings.CutPrefix(res.NextLink, m.baseURL)
+		if !ok {
+			return nil, fmt.Errorf("graph returned a next link outside %s", m.baseURL)
+		}
+		page.NextPageToken = next
+	}
+	return page, nil
+}
+
+func kqlWindow(req mailbox.SearchRequest) string {
+	var terms []string
+	if !req.After.IsZero() {
+		terms = append(terms, "received>="+req.After.UTC().Format(time.DateOnly))
+	}
+	if !req.Before.IsZero() {
+		terms = append(terms, "received<"+req.Before.UTC().Format(time.DateOnly))
+	}
+	if len(terms) == 0 {
+		return req.Query
+	}
+	if req.Query != "" {
+		terms = append([]string{"(" + req.Query + ")"}, terms...)
+	}
+	return strings.Join(terms, " AND ")
+}
+
+func (m *graphMailbox) Fetch(ctx context.Context, id string) (*mailbox.Message, error) {
+	params := url.Values{
+		"$select": {"id,conversationId,subject,from,receivedDateTime,bodyPreview,body"},
+		"$expand": {"attachments($select=id,name,contentType,size,isInline)"},
+	}
+
+	var msg graphMessage
+	if err := m.get(ctx, "/me/messages/"+url.PathEscape(id)+"?"+params.Encode(), &msg); err != nil {
+		return nil, err
+	}
+
+	from := msg.From.EmailAddress.Address
+	if name := msg.From.EmailAddress.Name; name != "" && name != from {
+		from = fmt.Sprintf("%s <%s>", name, from)
+	}
+	email := &mailbox.Message{
+		ID:       msg.ID,
+		ThreadID: msg.ConversationID,
+		Subject:  msg.Subject,
+		From:     from,
+		Date:     msg.ReceivedDateTime,
+		Body:     utils.CleanTextForAi(msg.Body.Content),
+		Snippet:  msg.BodyPreview,
+	}
+	for _, a := range msg.Attachments {
+		// Inline images are part of the body; item attachments (attached
+		// mails and events) have no file content.
+		if a.IsInline || (a.Type != "" && a.Type != fileAttachmentType) {
+			continue
+		}
+		email.Attachments = append(email.Attachments, mailbox.Attachment{
+			ID:       a.ID,
+			Filename: a.Name,
+			MimeType: a.ContentType,
+			Size:     a.Size,
+		})
+	}
+	return email, nil
+}
+
+func (m *graphMailbox) FetchAttachment(ctx context.Context, messageID, attachmentID string) ([]byte, error) {
+	var a graphAttachment
+	path := "/me/messages/" + url.PathEscape(messageID) + "/attachments/" + url.PathEscape(attachmentID)
+	if err := m.get(ctx, path, &a); err != nil {
+		return nil, err
+	}
+	if a.Type != fileAttachmentType {
+		return nil, fmt.Errorf("attachment %s is a %s, not a file", attachmentID, a.Type)
+	}
+	return a.ContentBytes, nil
+}
+
+func (m *graphMailbox) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	// Ask Graph to convert HTML bodies to text for us.
+	req.Header.Set("Prefer", `outlook.body-content-type="text"`)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return mailbox.CheckGrant(fmt.Errorf("graph request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return mailbox.ErrMessageNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("graph %s returned %s", req.URL.Path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid graph response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package microsoft
+
+import (
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/microsoft"
+)
+
+// NewOAuthConfig returns the Entra ID (v2 endpoint) configuration, or nil when
+// MICROSOFT_OAUTH_CLIENT_ID is not set. MICROSOFT_TENANT restricts logins to
+// one directory; it defaults to "common", which admits work, school and
+// personal accounts.
+func NewOAuthConfig() *oauth2.Config {
+	clientID := os.Getenv("MICROSOFT_OAUTH_CLIENT_ID")
+	if clientID == "" {
+		return nil
+	}
+
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("MICROSOFT_OAUTH_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("MICROSOFT_OAUTH_REDIRECT_URI"),
+		Scopes: []string{
+			"openid",
+			"email",
+			"profile",
+			"offline_access",
+			"User.Read",
+			"Mail.Read",
+		},
+		Endpoint: microsoft.AzureADEndpoint(os.Getenv("MICROSOFT_TENANT")),
+	}
+}
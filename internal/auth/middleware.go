@@ -3,28 +3,82 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/user"
 )
 
 type contextKey string
-const UserIDContextKey contextKey = "userID"
 
-func AuthMiddleware(next http.Handler) http.Handler {
+const (
+	UserIDContextKey    contextKey = "userID"
+	SessionIDContextKey contextKey = "sessionID"
+	TokenIDContextKey   contextKey = "tokenID"
+	RoleContextKey      contextKey = "role"
+
+	// PersonalAccessTokenContextKey holds the *PersonalAccessToken when the
+	// request was not made with a session.
+	PersonalAccessTokenContextKey contextKey = "personalAccessToken"
+)
+
+// touchInterval is how often the last use of one session or personal access
+// token is written; the session and token lists do not need it any finer.
+const touchInterval = time.Minute
+
+type Authenticator struct {
+	revocations RevocationList
+	pats        PersonalAccessTokenStore
+	sessions    SessionStore
+	users       user.Repository
+
+	mu      sync.Mutex
+	touched map[string]time.Time // by "sid:<id>" or "pat:<id>"
+	pruned  time.Time
+}
+
+func NewAuthenticator(revocations RevocationList, pats PersonalAccessTokenStore, sessions SessionStore, users user.Repository) *Authenticator {
+	return &Authenticator{revocations: revocations, pats: pats, sessions: sessions, users: users, touched: map[string]time.Time{}}
+}
+
+// AuthMiddleware accepts session access tokens. Personal access tokens are
+// refused unless the route is wrapped with RequireScope instead.
+func (a *Authenticator) AuthMiddleware(next http.Handler) http.Handler {
+	return a.authenticate("", next)
+}
+
+// RequireScope authenticates like AuthMiddleware but also lets in personal
+// access tokens that were granted scope. Session tokens carry every scope.
+func (a *Authenticator) RequireScope(scope string, next http.Handler) http.Handler {
+	return a.authenticate(scope, next)
+}
+
+func (a *Authenticator) authenticate(scope string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		tokenString, fromCookie := accessTokenFromRequest(r)
+		if tokenString == "" {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if !fromCookie && isPersonalAccessToken(tokenString) {
+			a.servePersonalAccessToken(w, r, tokenString, scope, next)
 			return
 		}
 
-		tokenString := parts[1]
+		// Browsers attach cookies to cross-site requests on their own, a
+		// Bearer header they do not.
+		if fromCookie && !safeMethod(r.Method) {
+			if err := VerifyCSRF(r); err != nil {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
 
 		claims, err := ValidateAccessToken(tokenString)
 		if err != nil {
@@ -32,7 +86,140 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		revoked, err := a.isRevoked(r.Context(), claims)
+		if err != nil {
+			log.Printf("revocation check failed: %v", err)
+			http.Error(w, "failed to verify token", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		if a.due(sessionRevocationKey(claims.SessionID)) {
+			if err := a.sessions.Touch(r.Context(), claims.SessionID); err != nil {
+				log.Printf("failed to touch session %s: %v", claims.SessionID, err)
+			}
+		}
+
 		ctx := context.WithValue(r.Context(), UserIDContextKey, claims.UserID)
+		ctx = context.WithValue(ctx, SessionIDContextKey, claims.SessionID)
+		ctx = context.WithValue(ctx, TokenIDContextKey, claims.ID)
+		ctx = context.WithValue(ctx, RoleContextKey, claims.Role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func (a *Authenticator) servePersonalAccessToken(w http.ResponseWriter, r *http.Request, token, scope string, next http.Handler) {
+	pat, err := a.pats.FindByHash(r.Context(), HashToken(token))
+	if errors.Is(err, ErrPersonalAccessTokenNotFound) || (err == nil && !pat.Active(time.Now())) {
+		http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("personal access token lookup failed: %v", err)
+		http.Error(w, "failed to verify token", http.StatusInternalServerError)
+		return
+	}
+
+	if scope == "" || !pat.HasScope(scope) {
+		http.Error(w, "token is missing the required scope", http.StatusForbidden)
+		return
+	}
+
+	// Unlike access tokens, these live for months, so the account is checked
+	// on every use rather than trusting its revocation to have gone through.
+	u, err := a.users.FindByID(r.Context(), strconv.Itoa(pat.UserID))
+	if errors.Is(err, user.ErrUserNotFound) || (err == nil && u.Status != user.StatusActive) {
+		http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load user %d of personal access token %d: %v", pat.UserID, pat.ID, err)
+		http.Error(w, "failed to verify token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("personal access token %d (%s, %q) of user %d: %s %s",
+		pat.ID, pat.Prefix, pat.Name, pat.UserID, r.Method, r.URL.Path)
+	if a.due("pat:" + strconv.Itoa(pat.ID)) {
+		if err := a.pats.Touch(r.Context(), pat.ID); err != nil {
+			log.Printf("failed to touch personal access token %d: %v", pat.ID, err)
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), UserIDContextKey, pat.UserID)
+	ctx = context.WithValue(ctx, PersonalAccessTokenContextKey, pat)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// due reports whether the last use of key should be written now, and if so
+// counts it as written.
+func (a *Authenticator) due(key string) bool {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if last, ok := a.touched[key]; ok && now.Sub(last) < touchInterval {
+		return false
+	}
+	if now.Sub(a.pruned) >= touchInterval {
+		for k, last := range a.touched {
+			if now.Sub(last) >= touchInterval {
+				delete(a.touched, k)
+			}
+		}
+		a.pruned = now
+	}
+	a.touched[key] = now
+	return true
+}
+
+// RequireRole authenticates like AuthMiddleware and then requires the user's
+// role to be at least role. The role comes from the access token, so a change
+// takes effect at the user's next refresh.
+func (a *Authenticator) RequireRole(role user.Role, next http.Handler) http.Handler {
+	return a.authenticate("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, _ := r.Context().Value(RoleContextKey).(user.Role)
+		if !current.AtLeast(role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// accessTokenFromRequest prefers the Authorization header and falls back to
+// the access cookie when cookie mode is enabled.
+func accessTokenFromRequest(r *http.Request) (token string, fromCookie bool) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			return "", false
+		}
+		return parts[1], false
+	}
+
+	if !LoadCookieConfig().Enabled {
+		return "", false
+	}
+	cookie, err := r.Cookie(AccessCookieName)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (a *Authenticator) isRevoked(ctx context.Context, claims *AccessTokenClaims) (bool, error) {
+	if claims.ID == "" || claims.SessionID == "" {
+		return true, nil
+	}
+	for _, key := range []string{tokenRevocationKey(claims.ID), sessionRevocationKey(claims.SessionID)} {
+		revoked, err := a.revocations.IsRevoked(ctx, key)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Personal access tokens are opaque like refresh tokens; the prefix tells
+// them apart from JWTs in the Authorization header and makes leaked tokens
+// easy to grep for.
+const personalAccessTokenPrefix = "amp_"
+
+const (
+	ScopeSummariesRead = "summaries:read"
+	ScopeEmailsSync    = "emails:sync"
+)
+
+// PersonalAccessTokenScopes lists every scope a personal access token can be
+// granted. Account management (sessions, tokens) is deliberately not one.
+var PersonalAccessTokenScopes = []string{ScopeSummariesRead, ScopeEmailsSync}
+
+var (
+	ErrPersonalAccessTokenNotFound = errors.New("personal access token not found")
+	ErrInvalidScope                = errors.New("invalid scope")
+)
+
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+func (t *PersonalAccessToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+type PersonalAccessTokenStore interface {
+	Create(ctx context.Context, token *PersonalAccessToken) error
+
+	FindByHash(ctx context.Context, tokenHash string) (*PersonalAccessToken, error)
+
+	// ListActive returns the user's unrevoked tokens, newest first.
+	ListActive(ctx context.Context, userID int) ([]*PersonalAccessToken, error)
+
+	Touch(ctx context.Context, id int) error
+
+	// Revoke returns ErrPersonalAccessTokenNotFound unless id is an active
+	// token of userID.
+	Revoke(ctx context.Context, userID int, id int) error
+
+	// RevokeAll revokes every active token of userID.
+	RevokeAll(ctx context.Context, userID int) error
+}
+
+func isPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return ErrInvalidScope
+	}
+	for _, s := range scopes {
+		if !slices.Contains(PersonalAccessTokenScopes, s) {
+			return ErrInvalidScope
+		}
+	}
+	return nil
+}
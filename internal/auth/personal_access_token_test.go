@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+type memoryPersonalAccessTokenStore struct {
+	mu     sync.Mutex
+	nextID int
+	tokens map[int]*PersonalAccessToken
+}
+
+func newMemoryPersonalAccessTokenStore() *memoryPersonalAccessTokenStore {
+	return &memoryPersonalAccessTokenStore{tokens: make(map[int]*PersonalAccessToken)}
+}
+
+func (m *memoryPersonalAccessTokenStore) Create(ctx context.Context, token *PersonalAccessToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	token.ID = m.nextID
+	token.CreatedAt = time.Now()
+	m.tokens[token.ID] = token
+	return nil
+}
+
+func (m *memoryPersonalAccessTokenStore) FindByHash(ctx context.Context, tokenHash string) (*PersonalAccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.TokenHash == tokenHash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, ErrPersonalAccessTokenNotFound
+}
+
+func (m *memoryPersonalAccessTokenStore) ListActive(ctx context.Context, userID int) ([]*PersonalAccessToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*PersonalAccessToken
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryPersonalAccessTokenStore) Touch(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[id]; ok {
+		now := time.Now()
+		t.LastUsedAt = &now
+	}
+	return nil
+}
+
+func (m *memoryPersonalAccessTokenStore) Revoke(ctx context.Context, userID int, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[id]
+	if !ok || t.UserID != userID || t.RevokedAt != nil {
+		return ErrPersonalAccessTokenNotFound
+	}
+	now := time.Now()
+	t.RevokedAt = &now
+	return nil
+}
+
+func (m *memoryPersonalAccessTokenStore) RevokeAll(ctx context.Context, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	authn := NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users)
+
+	token, pat, err := svc.CreatePersonalAccessToken(ctx, u.ID, "summary script", []string{ScopeSummariesRead}, 0)
+	if err != nil {
+		t.Fatalf("CreatePersonalAccessToken: %v", err)
+	}
+	if !strings.HasPrefix(token, personalAccessTokenPrefix) || !strings.HasPrefix(token, pat.Prefix) {
+		t.Errorf("unexpected token %q with prefix %q", token, pat.Prefix)
+	}
+	if pat.TokenHash == token {
+		t.Error("token must be stored hashed")
+	}
+
+	call := func(h func(http.Handler) http.Handler) (int, int) {
+		req := httptest.NewRequest(http.MethodGet, "/emails/stream", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		var userID int
+		h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, _ = r.Context().Value(UserIDContextKey).(int)
+		})).ServeHTTP(rec, req)
+		return rec.Code, userID
+	}
+	scoped := func(scope string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler { return authn.RequireScope(scope, next) }
+	}
+
+	if code, userID := call(scoped(ScopeSummariesRead)); code != http.StatusOK || userID != u.ID {
+		t.Errorf("granted scope: got %d for user %d", code, userID)
+	}
+	if code, _ := call(scoped(ScopeEmailsSync)); code != http.StatusForbidden {
+		t.Errorf("missing scope: got %d, want 403", code)
+	}
+	if code, _ := call(authn.AuthMiddleware); code != http.StatusForbidden {
+		t.Errorf("account route: got %d, want 403", code)
+	}
+	if stored := svc.pats.(*memoryPersonalAccessTokenStore).tokens[pat.ID]; stored.LastUsedAt == nil {
+		t.Error("last use was not recorded")
+	}
+
+	if err := svc.RevokePersonalAccessToken(ctx, 99, pat.ID); !errors.Is(err, ErrPersonalAccessTokenNotFound) {
+		t.Errorf("revoking another user's token got %v", err)
+	}
+	if err := svc.RevokePersonalAccessToken(ctx, u.ID, pat.ID); err != nil {
+		t.Fatalf("RevokePersonalAccessToken: %v", err)
+	}
+	if code, _ := call(scoped(ScopeSummariesRead)); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: got %d, want 401", code)
+	}
+}
+
+func TestPersonalAccessTokenValidation(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+
+	for _, scopes := range [][]string{nil, {"sessions:write"}, {ScopeEmailsSync, "admin"}} {
+		if _, _, err := svc.CreatePersonalAccessToken(ctx, u.ID, "x", scopes, 0); !errors.Is(err, ErrInvalidScope) {
+			t.Errorf("scopes %v: got %v, want ErrInvalidScope", scopes, err)
+		}
+	}
+
+	_, pat, err := svc.CreatePersonalAccessToken(ctx, u.ID, "x", []string{ScopeEmailsSync}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePersonalAccessToken: %v", err)
+	}
+	if !pat.Active(time.Now()) || pat.Active(time.Now().Add(2*time.Hour)) {
+		t.Error("token should expire after its ttl")
+	}
+}
+
+// A user an admin rejects or sets back to pending loses every credential, not
+// just their sessions.
+func TestRevokeAllAccessRevokesPersonalAccessTokens(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	authn := NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users)
+
+	token, _, err := svc.CreatePersonalAccessToken(ctx, u.ID, "summary script", []string{ScopeSummariesRead}, 0)
+	if err != nil {
+		t.Fatalf("CreatePersonalAccessToken: %v", err)
+	}
+	session, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	svc.users.(*stubUserRepo).users[99] = &user.User{ID: 99, Status: user.StatusActive}
+	other, _, _ := svc.CreatePersonalAccessToken(ctx, 99, "other user", []string{ScopeSummariesRead}, 0)
+
+	call := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/summaries", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		authn.RequireScope(ScopeSummariesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if err := svc.RevokeAllAccess(ctx, u.ID); err != nil {
+		t.Fatalf("RevokeAllAccess: %v", err)
+	}
+	if code := call(token); code != http.StatusUnauthorized {
+		t.Errorf("personal access token got %d, want 401", code)
+	}
+	if code := call(session.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("session got %d, want 401", code)
+	}
+	if code := call(other); code != http.StatusOK {
+		t.Errorf("another user's token got %d, want 200", code)
+	}
+}
+
+// Status is checked on use too, so a user an admin rejected is locked out
+// even when revoking their credentials failed.
+func TestInactiveUserIsRefused(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	authn := NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users)
+
+	token, _, err := svc.CreatePersonalAccessToken(ctx, u.ID, "summary script", []string{ScopeSummariesRead}, 0)
+	if err != nil {
+		t.Fatalf("CreatePersonalAccessToken: %v", err)
+	}
+	pair, err := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	call := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/summaries", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		authn.RequireScope(ScopeSummariesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, status := range []user.Status{user.StatusRejected, user.StatusPending} {
+		u.Status = status
+		if code := call(); code != http.StatusUnauthorized {
+			t.Errorf("%s: personal access token got %d, want 401", status, code)
+		}
+		if _, err := svc.Refresh(ctx, pair.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("%s: refresh got %v, want ErrInvalidRefreshToken", status, err)
+		}
+	}
+
+	u.Status = user.StatusActive
+	if code := call(); code != http.StatusOK {
+		t.Errorf("active again: personal access token got %d, want 200", code)
+	}
+	if _, err := svc.Refresh(ctx, pair.RefreshToken); err != nil {
+		t.Errorf("active again: refresh got %v", err)
+	}
+}
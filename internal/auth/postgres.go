@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresRefreshTokenStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresRefreshTokenStore(db *pgxpool.Pool) *PostgresRefreshTokenStore {
+	return &PostgresRefreshTokenStore{db: db}
+}
+
+func (s *PostgresRefreshTokenStore) Create(ctx context.Context, token *RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, device, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	err := s.db.QueryRow(ctx, query,
+		token.UserID,
+		token.TokenHash,
+		token.FamilyID,
+		token.Device,
+		token.ExpiresAt,
+	).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save refresh token for user %d: %w", token.UserID, err)
+	}
+	return nil
+}
+
+func (s *PostgresRefreshTokenStore) FindByHash(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	query := `
+		SELECT id, user_id, token_hash, family_id, COALESCE(device, ''), expires_at, rotated_at, revoked_at, created_at
+		FROM refresh_tokens WHERE token_hash = $1`
+
+	var t RefreshToken
+	err := s.db.QueryRow(ctx, query, tokenHash).Scan(
+		&t.ID, &t.UserID, &t.TokenHash, &t.FamilyID, &t.Device,
+		&t.ExpiresAt, &t.RotatedAt, &t.RevokedAt, &t.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find refresh token: %w", err)
+	}
+	return &t, nil
+}
+
+func (s *PostgresRefreshTokenStore) Rotate(ctx context.Context, id int, next *RefreshToken) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start rotation of refresh token %d: %w", id, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The IS NULL guards make this the single point where two concurrent
+	// refreshes with the same token are told apart.
+	query := `
+		UPDATE refresh_tokens SET rotated_at = NOW()
+		WHERE id = $1 AND rotated_at IS NULL AND revoked_at IS NULL`
+
+	tag, err := tx.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to rotate refresh token %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrRefreshTokenReused
+	}
+
+	query = `
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, device, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	err = tx.QueryRow(ctx, query,
+		next.UserID,
+		next.TokenHash,
+		next.FamilyID,
+		next.Device,
+		next.ExpiresAt,
+	).Scan(&next.ID, &next.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save refresh token for user %d: %w", next.UserID, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit rotation of refresh token %d: %w", id, err)
+	}
+	return nil
+}
+
+func (s *PostgresRefreshTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	query := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+
+	_, err := s.db.Exec(ctx, query, familyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token family %s: %w", familyID, err)
+	}
+	return nil
+}
+
+type PostgresSessionStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresSessionStore(db *pgxpool.Pool) *PostgresSessionStore {
+	return &PostgresSessionStore{db: db}
+}
+
+const sessionColumns = `id, user_id, COALESCE(device, ''), COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_used_at, revoked_at`
+
+func scanSession(row pgx.Row) (*Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.UserID, &s.Device, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *PostgresSessionStore) Create(ctx context.Context, session *Session) error {
+	query := `
+		INSERT INTO sessions (id, user_id, device, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at, last_used_at`
+
+	err := s.db.QueryRow(ctx, query,
+		session.ID,
+		session.UserID,
+		session.Device,
+		session.UserAgent,
+		session.IP,
+	).Scan(&session.CreatedAt, &session.LastUsedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create session for user %d: %w", session.UserID, err)
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) FindByID(ctx context.Context, id string) (*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+
+	session, err := scanSession(s.db.QueryRow(ctx, query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find session: %w", err)
+	}
+	return session, nil
+}
+
+func (s *PostgresSessionStore) ListActive(ctx context.Context, userID int) ([]*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY last_used_at DESC`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions for user %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *PostgresSessionStore) Touch(ctx context.Context, id string) error {
+	_, err := s.db.Exec(ctx, `UPDATE sessions SET last_used_at = NOW() WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to touch session %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) Revoke(ctx context.Context, userID int, id string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	tag, err := s.db.Exec(ctx, query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session %s: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) RevokeAll(ctx context.Context, userID int) ([]string, error) {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL RETURNING id`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions for user %d: %w", userID, err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions for user %d: %w", userID, err)
+	}
+	return ids, nil
+}
+
+type PostgresRevocationStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresRevocationStore(db *pgxpool.Pool) *PostgresRevocationStore {
+	return &PostgresRevocationStore{db: db}
+}
+
+func (s *PostgresRevocationStore) Revoke(ctx context.Context, key string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO revoked_tokens (key, expires_at) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET expires_at = GREATEST(revoked_tokens.expires_at, EXCLUDED.expires_at), revoked_at = NOW()`
+
+	if _, err := s.db.Exec(ctx, query, key, expiresAt); err != nil {
+		return fmt.Errorf("failed to revoke %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *PostgresRevocationStore) IsRevoked(ctx context.Context, key string) (bool, error) {
+	var revoked bool
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE key = $1 AND expires_at > NOW())`
+	if err := s.db.QueryRow(ctx, query, key).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("failed to check revocation of %s: %w", key, err)
+	}
+	return revoked, nil
+}
+
+func (s *PostgresRevocationStore) RevokedSince(ctx context.Context, since time.Time) ([]RevokedToken, error) {
+	query := `
+		SELECT key, expires_at, revoked_at FROM revoked_tokens
+		WHERE revoked_at > $1 AND expires_at > NOW()`
+
+	rows, err := s.db.Query(ctx, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revoked tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []RevokedToken
+	for rows.Next() {
+		var e RevokedToken
+		if err := rows.Scan(&e.Key, &e.ExpiresAt, &e.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan revoked token: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresRevocationStore) PruneExpired(ctx context.Context) error {
+	if _, err := s.db.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= NOW()`); err != nil {
+		return fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+	return nil
+}
+
+type PostgresPersonalAccessTokenStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresPersonalAccessTokenStore(db *pgxpool.Pool) *PostgresPersonalAccessTokenStore {
+	return &PostgresPersonalAccessTokenStore{db: db}
+}
+
+const personalAccessTokenColumns = `id, user_id, name, prefix, token_hash, scopes, expires_at, last_used_at, created_at, revoked_at`
+
+func scanPersonalAccessToken(row pgx.Row) (*PersonalAccessToken, error) {
+	var t PersonalAccessToken
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.TokenHash, &t.Scopes,
+		&t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt, &t.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *PostgresPersonalAccessTokenStore) Create(ctx context.Context, token *PersonalAccessToken) error {
+	query := `
+		INSERT INTO personal_access_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	err := s.db.QueryRow(ctx, query,
+		token.UserID,
+		token.Name,
+		token.Prefix,
+		token.TokenHash,
+		token.Scopes,
+		token.ExpiresAt,
+	).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save personal access token for user %d: %w", token.UserID, err)
+	}
+	return nil
+}
+
+func (s *PostgresPersonalAccessTokenStore) FindByHash(ctx context.Context, tokenHash string) (*PersonalAccessToken, error) {
+	query := `SELECT ` + personalAccessTokenColumns + ` FROM personal_access_tokens WHERE token_hash = $1`
+
+	token, err := scanPersonalAccessToken(s.db.QueryRow(ctx, query, tokenHash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPersonalAccessTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find personal access token: %w", err)
+	}
+	return token, nil
+}
+
+func (s *PostgresPersonalAccessTokenStore) ListActive(ctx context.Context, userID int) ([]*PersonalAccessToken, error) {
+	query := `SELECT ` + personalAccessTokenColumns + ` FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list personal access tokens for user %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	tokens := []*PersonalAccessToken{}
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan personal access token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresPersonalAccessTokenStore) Touch(ctx context.Context, id int) error {
+	_, err := s.db.Exec(ctx, `UPDATE personal_access_tokens SET last_used_at = NOW() WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to touch personal access token %d: %w", id, err)
+	}
+	return nil
+}
+
+func (s *PostgresPersonalAccessTokenStore) Revoke(ctx context.Context, userID int, id int) error {
+	query := `UPDATE personal_access_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	tag, err := s.db.Exec(ctx, query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke personal access token %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrPersonalAccessTokenNotFound
+	}
+	return nil
+}
+
+func (s *PostgresPersonalAccessTokenStore) RevokeAll(ctx context.Context, userID int) error {
+	query := `UPDATE personal_access_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+
+	if _, err := s.db.Exec(ctx, query, userID); err != nil {
+		return fmt.Errorf("failed to revoke personal access tokens of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+type PostgresAuthCodeStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresAuthCodeStore(db *pgxpool.Pool) *PostgresAuthCodeStore {
+	return &PostgresAuthCodeStore{db: db}
+}
+
+func (s *PostgresAuthCodeStore) Create(ctx context.Context, code *AuthCode) error {
+	// Codes that were never exchanged are cleared out here rather than by a
+	// background job; there are only ever a handful.
+	if _, err := s.db.Exec(ctx, `DELETE FROM auth_codes WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("failed to prune authorization codes: %w", err)
+	}
+
+	query := `
+		INSERT INTO auth_codes (code_hash, user_id, device, user_agent, ip, code_challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7)`
+
+	_, err := s.db.Exec(ctx, query,
+		code.CodeHash,
+		code.UserID,
+		code.Client.Device,
+		code.Client.UserAgent,
+		code.Client.IP,
+		code.CodeChallenge,
+		code.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save authorization code for user %d: %w", code.UserID, err)
+	}
+	return nil
+}
+
+func (s *PostgresAuthCodeStore) Consume(ctx context.Context, codeHash string) (*AuthCode, error) {
+	// Deleting is the single-use guard: of two concurrent exchanges only one
+	// gets the row back.
+	query := `
+		DELETE FROM auth_codes
+		WHERE code_hash = $1
+		RETURNING user_id, COALESCE(device, ''), COALESCE(user_agent, ''), COALESCE(ip, ''),
+		          COALESCE(code_challenge, ''), expires_at`
+
+	c := AuthCode{CodeHash: codeHash}
+	err := s.db.QueryRow(ctx, query, codeHash).Scan(
+		&c.UserID, &c.Client.Device, &c.Client.UserAgent, &c.Client.IP, &c.CodeChallenge, &c.ExpiresAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAuthCodeNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume authorization code: %w", err)
+	}
+	if time.Now().After(c.ExpiresAt) {
+		return nil, ErrAuthCodeNotFound
+	}
+	return &c, nil
+}
@@ -0,0 +1,280 @@
+package provider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/r7rainz/auramail/internal/auth"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// Flow serves the login and callback endpoints for one provider.
+type Flow struct {
+	provider    IdentityProvider
+	userRepo    user.Repository
+	authService *auth.Service
+}
+
+func NewFlow(provider IdentityProvider, userRepo user.Repository, authService *auth.Service) *Flow {
+	return &Flow{provider: provider, userRepo: userRepo, authService: authService}
+}
+
+func (f *Flow) Login(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectTo := query.Get("redirect_to")
+	if redirectTo != "" && !allowedRedirect(redirectTo) {
+		http.Error(w, "redirect_to is not allowed", http.StatusBadRequest)
+		return
+	}
+
+	codeChallenge := query.Get("code_challenge")
+	if codeChallenge != "" && (query.Get("code_challenge_method") != "S256" || !validCodeChallenge(codeChallenge)) {
+		http.Error(w, "code_challenge must be an S256 challenge", http.StatusBadRequest)
+		return
+	}
+	if isAppRedirect(redirectTo) && codeChallenge == "" {
+		http.Error(w, "code_challenge is required for app redirects", http.StatusBadRequest)
+		return
+	}
+
+	var scopes []string
+	optional := f.provider.OptionalScopes()
+	for _, feature := range strings.Split(query.Get("scopes"), ",") {
+		if feature = strings.TrimSpace(feature); feature == "" {
+			continue
+		}
+		scope, ok := optional[feature]
+		if !ok {
+			http.Error(w, "unsupported scope: "+feature, http.StatusBadRequest)
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+
+	state, err := newState()
+	if err != nil {
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = setStateCookie(w, r, &loginState{
+		State:         state,
+		Verifier:      verifier,
+		RedirectTo:    redirectTo,
+		Invite:        query.Get("invite"),
+		CodeChallenge: codeChallenge,
+		ExpiresAt:     time.Now().Add(stateTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("failed to set oauth state: %v", err)
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, f.provider.AuthCodeURL(state, verifier, scopes), http.StatusTemporaryRedirect)
+}
+
+func (f *Flow) Callback(w http.ResponseWriter, r *http.Request) {
+	name := f.provider.Name()
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		clearStateCookie(w)
+		http.Error(w, name+" login failed: "+reason, http.StatusBadRequest)
+		return
+	}
+
+	ls, err := readStateCookie(r, query.Get("state"))
+	clearStateCookie(w)
+	switch {
+	case errors.Is(err, ErrStateMissing), errors.Is(err, ErrStateExpired):
+		http.Error(w, "login session expired, please sign in again", http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrStateMismatch), errors.Is(err, ErrStateInvalid):
+		http.Error(w, "invalid oauth state", http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("failed to read oauth state: %v", err)
+		http.Error(w, "failed to verify login", http.StatusInternalServerError)
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		http.Error(w, "missing code", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	token, err := f.provider.Exchange(ctx, code, ls.Verifier)
+	if err != nil {
+		log.Printf("%s exchange failed: %v", name, err)
+		http.Error(w, "oauth exchange failed", http.StatusInternalServerError)
+		return
+	}
+
+	identity, err := f.provider.UserInfo(ctx, token)
+	if err != nil {
+		log.Printf("%s userinfo failed: %v", name, err)
+		http.Error(w, "failed to fetch user info", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("%s user: %s (%s)", name, identity.Email, identity.Subject)
+
+	// Both the domain allowlist and the account lookup trust the address, so
+	// an address the provider has not verified goes no further.
+	if !identity.EmailVerified {
+		log.Printf("%s login refused for %s: email not verified", name, identity.Email)
+		rejectSignup(w, r, ls.RedirectTo, rejectEmailUnverified)
+		return
+	}
+
+	policy := LoadSignupPolicy()
+	if !policy.AllowsEmail(identity.Email) {
+		log.Printf("%s login refused for %s: domain not allowed", name, identity.Email)
+		rejectSignup(w, r, ls.RedirectTo, rejectDomain)
+		return
+	}
+	// Without an invite under the invite-only policy, existing users can
+	// still log in; the zero Signup just stops a new account being created.
+	signup, _ := policy.Signup(ls.Invite)
+
+	u, err := f.userRepo.FindOrCreateProviderUser(ctx, name, identity.Email, identity.Name, identity.Subject, signup)
+	switch {
+	case errors.Is(err, user.ErrProviderMismatch):
+		http.Error(w, "this email is already registered with a different sign-in provider", http.StatusConflict)
+		return
+	case errors.Is(err, user.ErrUserNotFound):
+		rejectSignup(w, r, ls.RedirectTo, rejectInviteRequired)
+		return
+	case errors.Is(err, user.ErrInvalidInvite):
+		rejectSignup(w, r, ls.RedirectTo, rejectInviteInvalid)
+		return
+	case err != nil:
+		log.Printf("failed to persist %s user %s: %v", name, identity.Email, err)
+		http.Error(w, "failed to persist user", http.StatusInternalServerError)
+		return
+	}
+
+	switch u.Status {
+	case user.StatusActive:
+	case user.StatusPending:
+		rejectSignup(w, r, ls.RedirectTo, rejectPending)
+		return
+	default:
+		rejectSignup(w, r, ls.RedirectTo, rejectRejected)
+		return
+	}
+
+	if token.RefreshToken != "" {
+		if err := f.userRepo.UpdateRefreshToken(ctx, u.ID, token.RefreshToken); err != nil {
+			log.Printf("failed to save %s refresh token for user %d: %v", name, u.ID, err)
+			http.Error(w, "failed to persist user", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		log.Printf("no %s refresh token received, using existing one", name)
+	}
+
+	// The token response lists every scope the grant now covers, including
+	// ones from earlier logins.
+	if granted, _ := token.Extra("scope").(string); granted != "" {
+		if err := f.userRepo.UpdateGrantedScopes(ctx, u.ID, strings.Fields(granted)); err != nil {
+			log.Printf("failed to save %s scopes for user %d: %v", name, u.ID, err)
+			http.Error(w, "failed to persist user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	client := auth.ClientInfoFromRequest(r)
+
+	// Browsers in cookie mode get their session straight away. Apps cannot
+	// read our cookies, so they take the code handoff below even then.
+	if cookies := auth.LoadCookieConfig(); cookies.Enabled && !isAppRedirect(ls.RedirectTo) {
+		tokens, err := f.authService.IssueTokens(ctx, u, client)
+		if err != nil {
+			log.Printf("failed to issue tokens for user %d: %v", u.ID, err)
+			http.Error(w, "failed to generate tokens", http.StatusInternalServerError)
+			return
+		}
+		if err := cookies.SetAuthCookies(w, tokens); err != nil {
+			log.Printf("failed to set auth cookies for user %d: %v", u.ID, err)
+			http.Error(w, "failed to generate tokens", http.StatusInternalServerError)
+			return
+		}
+		if ls.RedirectTo != "" {
+			http.Redirect(w, r, ls.RedirectTo, http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	redirectTo := ls.RedirectTo
+	if redirectTo == "" {
+		redirectTo = os.Getenv("FRONTEND_REDIRECT_URL")
+	}
+	if redirectTo != "" {
+		// Tokens never go in the URL; the frontend exchanges the code at
+		// POST /auth/token.
+		code, err := f.authService.IssueAuthCode(ctx, u, client, ls.CodeChallenge)
+		if err != nil {
+			log.Printf("failed to issue authorization code for user %d: %v", u.ID, err)
+			http.Error(w, "failed to generate tokens", http.StatusInternalServerError)
+			return
+		}
+		target, err := withQuery(redirectTo, "code", code)
+		if err != nil {
+			log.Printf("invalid frontend redirect %q: %v", redirectTo, err)
+			http.Error(w, "failed to redirect", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	tokens, err := f.authService.IssueTokens(ctx, u, client)
+	if err != nil {
+		log.Printf("failed to issue tokens for user %d: %v", u.ID, err)
+		http.Error(w, "failed to generate tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+}
+
+func withQuery(target, key, value string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// validCodeChallenge accepts what RFC 7636 allows for a base64url encoded
+// SHA-256: exactly 43 characters.
+func validCodeChallenge(challenge string) bool {
+	if len(challenge) != 43 {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(challenge)
+	return err == nil
+}
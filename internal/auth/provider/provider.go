@@ -0,0 +1,248 @@
+// Package provider runs the OAuth login flow for any identity provider and
+// maps stored users back to the provider that hosts their mailbox.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/mailbox/imap"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// DefaultProvider is assumed for accounts created before the provider was
+// recorded.
+const DefaultProvider = "google"
+
+// User is the identity a provider vouches for after login. EmailVerified
+// says the provider has checked that Subject owns Email; unverified addresses
+// are never matched to accounts or sign-up domains.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type IdentityProvider interface {
+	// Name is stored as users.provider, e.g. "google".
+	Name() string
+
+	// AuthCodeURL is where the browser is sent to log in. verifier is the
+	// PKCE code verifier; implementations send its S256 challenge. scopes are
+	// provider scopes requested on top of the default read-only set, taken
+	// from OptionalScopes.
+	AuthCodeURL(state, verifier string, scopes []string) string
+
+	// OptionalScopes maps the features a user can opt into (e.g.
+	// "gmail.modify") to the provider scope each one needs.
+	OptionalScopes() map[string]string
+
+	Exchange(ctx context.Context, code, verifier string) (*oauth2.Token, error)
+
+	UserInfo(ctx context.Context, token *oauth2.Token) (*User, error)
+
+	// Mailbox opens the mail of user userID using the refresh token saved at
+	// login. Providers that rotate refresh tokens store the new one for
+	// userID as they receive it.
+	Mailbox(ctx context.Context, userID int, refreshToken string) (mailbox.Mailbox, error)
+
+	// RevokeGrant withdraws the access the user granted AuraMail at the
+	// provider. A token the provider no longer knows is not an error.
+	RevokeGrant(ctx context.Context, refreshToken string) error
+}
+
+// IMAPTokenSource is implemented by providers whose access tokens also log in
+// to their IMAP servers, for users who read mail over IMAP with XOAUTH2.
+type IMAPTokenSource interface {
+	// IMAPScope is the optional scope feature the token needs.
+	IMAPScope() string
+
+	IMAPAccessToken(ctx context.Context, refreshToken string) (string, error)
+}
+
+// Registry holds the configured providers by name.
+type Registry map[string]IdentityProvider
+
+func NewRegistry(providers ...IdentityProvider) Registry {
+	r := make(Registry, len(providers))
+	for _, p := range providers {
+		r[p.Name()] = p
+	}
+	return r
+}
+
+// Mailbox returns mailbox.ErrReauthRequired without contacting the provider
+// once the user's grant is known to be dead, which is what pauses sync and
+// background work for them until they log in again.
+func (r Registry) Mailbox(ctx context.Context, u *user.User) (mailbox.Mailbox, error) {
+	if u.IMAP != nil {
+		if u.ReauthRequired {
+			return nil, mailbox.ErrReauthRequired
+		}
+		cfg, err := r.IMAPConfig(u, u.IMAP)
+		if err != nil {
+			return nil, err
+		}
+		return imap.New(cfg), nil
+	}
+
+	if u.ReauthRequired || u.RefreshToken == "" {
+		return nil, mailbox.ErrReauthRequired
+	}
+	p, err := r.lookup(u)
+	if err != nil {
+		return nil, err
+	}
+	return p.Mailbox(ctx, u.ID, u.RefreshToken)
+}
+
+// IMAPConfig is how u reaches account. Port 143 is upgraded with STARTTLS and
+// any other port expects TLS from the start. Only public addresses are
+// dialled, since the host was typed in by the user.
+func (r Registry) IMAPConfig(u *user.User, account *user.IMAPAccount) (imap.Config, error) {
+	cfg := imap.Config{
+		Host:       account.Host,
+		Port:       account.Port,
+		Username:   account.Username,
+		Password:   account.Password,
+		PublicOnly: true,
+	}
+	if account.Port == 143 {
+		cfg.Security = imap.SecuritySTARTTLS
+	}
+	if account.Auth != user.IMAPAuthXOAuth2 {
+		return cfg, nil
+	}
+
+	p, err := r.lookup(u)
+	if err != nil {
+		return cfg, err
+	}
+	src, ok := p.(IMAPTokenSource)
+	if !ok {
+		return cfg, fmt.Errorf("%s accounts cannot log in to imap with xoauth2", p.Name())
+	}
+	if u.RefreshToken == "" {
+		return cfg, mailbox.ErrReauthRequired
+	}
+	refreshToken := u.RefreshToken
+	cfg.Token = func(ctx context.Context) (string, error) {
+		token, err := src.IMAPAccessToken(ctx, refreshToken)
+		return token, mailbox.CheckGrant(err)
+	}
+	return cfg, nil
+}
+
+// IMAPScope returns the optional scope feature u's provider needs for IMAP
+// with XOAUTH2, or "" if it cannot do that.
+func (r Registry) IMAPScope(u *user.User) string {
+	p, err := r.lookup(u)
+	if err != nil {
+		return ""
+	}
+	if src, ok := p.(IMAPTokenSource); ok {
+		return src.IMAPScope()
+	}
+	return ""
+}
+
+func (r Registry) RevokeGrant(ctx context.Context, u *user.User) error {
+	if u.RefreshToken == "" {
+		return nil
+	}
+	p, err := r.lookup(u)
+	if err != nil {
+		return err
+	}
+	return p.RevokeGrant(ctx, u.RefreshToken)
+}
+
+func (r Registry) lookup(u *user.User) (IdentityProvider, error) {
+	name := u.Provider
+	if name == "" {
+		name = DefaultProvider
+	}
+	p, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("identity provider %q is not configured", name)
+	}
+	return p, nil
+}
+
+// OptionalScopes returns the sorted feature names u's provider offers.
+func (r Registry) OptionalScopes(u *user.User) []string {
+	p, err := r.lookup(u)
+	if err != nil {
+		return []string{}
+	}
+	features := make([]string, 0, len(p.OptionalScopes()))
+	for feature := range p.OptionalScopes() {
+		features = append(features, feature)
+	}
+	slices.Sort(features)
+	return features
+}
+
+// MissingScopes returns the features among want whose provider scopes u has
+// not granted. Features the user's provider does not offer count as missing.
+func (r Registry) MissingScopes(u *user.User, want ...string) []string {
+	var optional map[string]string
+	if p, err := r.lookup(u); err == nil {
+		optional = p.OptionalScopes()
+	}
+
+	var missing []string
+	for _, feature := range want {
+		scope, ok := optional[feature]
+		if !ok || !u.HasGrantedScope(scope) {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
+
+type insufficientScopeResponse struct {
+	Error      string   `json:"error"`
+	Missing    []string `json:"missing"`
+	UpgradeURL string   `json:"upgradeUrl"`
+}
+
+// RequireScopes reports whether u has granted every feature in features
+// (e.g. "gmail.modify"). Otherwise it answers 403 with the login URL that asks
+// for just the missing ones; the provider keeps the rest of the grant.
+func (r Registry) RequireScopes(w http.ResponseWriter, u *user.User, features ...string) bool {
+	missing := r.MissingScopes(u, features...)
+	if len(missing) == 0 {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(insufficientScopeResponse{
+		Error:      "insufficient_scope",
+		Missing:    missing,
+		UpgradeURL: LoginURL(u, missing...),
+	})
+	return false
+}
+
+// LoginURL is where u logs in to their provider again, asking for features
+// on top of the default read-only scopes.
+func LoginURL(u *user.User, features ...string) string {
+	name := u.Provider
+	if name == "" {
+		name = DefaultProvider
+	}
+	if len(features) == 0 {
+		return "/auth/" + name
+	}
+	return "/auth/" + name + "?scopes=" + url.QueryEscape(strings.Join(features, ","))
+}
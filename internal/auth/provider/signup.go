@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// Sign-up policies, chosen with SIGNUP_POLICY.
+const (
+	SignupOpen     = "open"
+	SignupInvite   = "invite"
+	SignupApproval = "approval"
+)
+
+var (
+	ErrDomainNotAllowed = errors.New("email domain is not allowed")
+	ErrInviteRequired   = errors.New("an invite code is required to sign up")
+)
+
+// SignupPolicy decides who may log in and how new accounts are created.
+// Domains applies to every login, so narrowing it also locks out existing
+// accounts outside the list; Mode only affects accounts that do not exist yet.
+type SignupPolicy struct {
+	Mode    string
+	Domains []string
+}
+
+func LoadSignupPolicy() SignupPolicy {
+	p := SignupPolicy{Mode: strings.ToLower(strings.TrimSpace(os.Getenv("SIGNUP_POLICY")))}
+	if p.Mode == "" {
+		p.Mode = SignupOpen
+	}
+	for _, d := range strings.Split(os.Getenv("SIGNUP_ALLOWED_DOMAINS"), ",") {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if d != "" {
+			p.Domains = append(p.Domains, d)
+		}
+	}
+	return p
+}
+
+func (p SignupPolicy) AllowsEmail(email string) bool {
+	if len(p.Domains) == 0 {
+		return true
+	}
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range p.Domains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// Signup returns how to create an account for someone logging in for the
+// first time with the given invite code (possibly empty). Under the approval
+// policy a valid invite skips the queue. Unknown modes fail closed.
+func (p SignupPolicy) Signup(invite string) (user.Signup, error) {
+	var hash string
+	if invite != "" {
+		hash = user.HashInviteCode(invite)
+	}
+
+	switch p.Mode {
+	case SignupOpen:
+		return user.Signup{Status: user.StatusActive}, nil
+	case SignupInvite:
+		if hash == "" {
+			return user.Signup{}, ErrInviteRequired
+		}
+		return user.Signup{Status: user.StatusActive, InviteHash: hash}, nil
+	case SignupApproval:
+		if hash != "" {
+			return user.Signup{Status: user.StatusActive, InviteHash: hash}, nil
+		}
+		return user.Signup{Status: user.StatusPending}, nil
+	}
+	return user.Signup{}, ErrInviteRequired
+}
+
+// signupRejection is shown to people the sign-up policy turns away. Code is
+// also handed to the frontend, which may want to show its own page.
+type signupRejection struct {
+	Status  int
+	Code    string
+	Title   string
+	Message string
+}
+
+var (
+	rejectEmailUnverified = signupRejection{http.StatusForbidden, "email_unverified",
+		"Email address not verified", "Your sign-in provider has not verified this email address. Verify it with them, or sign in with a different account."}
+	rejectDomain = signupRejection{http.StatusForbidden, "domain_not_allowed",
+		"This email address can't be used", "AuraMail is only available to accounts from your institution. Sign in with your college email address."}
+	rejectInviteRequired = signupRejection{http.StatusForbidden, "invite_required",
+		"Invite only", "AuraMail is invite-only right now. Ask a coordinator for an invite link."}
+	rejectInviteInvalid = signupRejection{http.StatusForbidden, "invite_invalid",
+		"Invite not valid", "This invite has expired, was already used, or was issued for a different email address."}
+	rejectPending = signupRejection{http.StatusForbidden, "approval_pending",
+		"Waiting for approval", "Your account has been created and is waiting for an administrator to approve it. Try signing in again later."}
+	rejectRejected = signupRejection{http.StatusForbidden, "account_rejected",
+		"Access denied", "An administrator declined access for this account."}
+)
+
+var signupErrorPage = template.Must(template.New("signup").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Title}} · AuraMail</title></head>
+<body style="font-family: sans-serif; max-width: 32rem; margin: 4rem auto; padding: 0 1rem">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// rejectSignup sends the user back to the frontend with the reason in the
+// fragment when the login came from one, and renders an error page otherwise.
+func rejectSignup(w http.ResponseWriter, r *http.Request, redirectTo string, rej signupRejection) {
+	if redirectTo != "" {
+		http.Redirect(w, r, redirectTo+"#"+url.Values{"error": {rej.Code}}.Encode(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(rej.Status)
+	signupErrorPage.Execute(w, rej)
+}
@@ -0,0 +1,212 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	stateCookieName = "auramail_oauth_state"
+	stateTTL        = 10 * time.Minute
+)
+
+var (
+	ErrStateMissing  = errors.New("missing oauth state")
+	ErrStateInvalid  = errors.New("invalid oauth state")
+	ErrStateExpired  = errors.New("oauth state expired")
+	ErrStateMismatch = errors.New("oauth state mismatch")
+)
+
+// loginState is what we need to remember between sending the browser to the
+// provider and receiving it back on the callback. It travels in an HMAC
+// signed cookie so no server-side storage is needed.
+type loginState struct {
+	State      string `json:"s"`
+	Verifier   string `json:"v"`
+	RedirectTo string `json:"r,omitempty"`
+	Invite     string `json:"i,omitempty"`
+
+	// CodeChallenge is the app's own PKCE challenge for the code it will get
+	// back on RedirectTo, not the one we send to the provider.
+	CodeChallenge string `json:"c,omitempty"`
+	ExpiresAt     int64  `json:"e"`
+}
+
+func stateSecret() ([]byte, error) {
+	secret := os.Getenv("OAUTH_STATE_SECRET")
+	if secret == "" {
+		secret = os.Getenv("JWT_SECRET")
+	}
+	if secret == "" {
+		return nil, errors.New("OAUTH_STATE_SECRET not set")
+	}
+	return []byte(secret), nil
+}
+
+func newState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate oauth state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func setStateCookie(w http.ResponseWriter, r *http.Request, ls *loginState) error {
+	key, err := stateSecret()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(ls)
+	if err != nil {
+		return err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    encoded + "." + sign(key, encoded),
+		Path:     "/auth",
+		MaxAge:   int(stateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readStateCookie verifies the signed cookie and checks it against the state
+// the provider echoed back.
+func readStateCookie(r *http.Request, returnedState string) (*loginState, error) {
+	cookie, err := r.Cookie(stateCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrStateMissing
+	}
+
+	key, err := stateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(key, encoded))) {
+		return nil, ErrStateInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrStateInvalid
+	}
+	var ls loginState
+	if err := json.Unmarshal(payload, &ls); err != nil {
+		return nil, ErrStateInvalid
+	}
+
+	if time.Now().Unix() > ls.ExpiresAt {
+		return nil, ErrStateExpired
+	}
+	if returnedState == "" || subtle.ConstantTimeCompare([]byte(ls.State), []byte(returnedState)) != 1 {
+		return nil, ErrStateMismatch
+	}
+	return &ls, nil
+}
+
+func clearStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    "",
+		Path:     "/auth",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+func sign(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// allowedRedirect reports whether target may receive the browser after login.
+// OAUTH_REDIRECT_ALLOWLIST is comma separated. Web entries are origins (e.g.
+// https://app.auramail.in) and match any path on them; app entries use a
+// custom scheme (e.g. in.auramail.app:/oauth) and must match exactly, apart
+// from the query.
+func allowedRedirect(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Fragment != "" {
+		return false
+	}
+
+	var want string
+	if isAppRedirect(target) {
+		if blockedSchemes[strings.ToLower(u.Scheme)] {
+			return false
+		}
+		stripped := *u
+		stripped.RawQuery = ""
+		stripped.ForceQuery = false
+		want = stripped.String()
+	} else {
+		if u.Host == "" {
+			return false
+		}
+		want = u.Scheme + "://" + u.Host
+	}
+
+	return slices.Contains(redirectAllowlist(), want)
+}
+
+// TrustedOrigin reports whether origin (e.g. from the Origin header) is one
+// of the web clients in OAUTH_REDIRECT_ALLOWLIST. App entries are never
+// origins.
+func TrustedOrigin(origin string) bool {
+	return origin != "" && !isAppRedirect(origin) && slices.Contains(redirectAllowlist(), origin)
+}
+
+// redirectAllowlist returns the entries of OAUTH_REDIRECT_ALLOWLIST, web
+// origins without a trailing slash.
+func redirectAllowlist() []string {
+	var entries []string
+	for _, entry := range strings.Split(os.Getenv("OAUTH_REDIRECT_ALLOWLIST"), ",") {
+		entry = strings.TrimSpace(entry)
+		if !isAppRedirect(entry) {
+			entry = strings.TrimSuffix(entry, "/")
+		}
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Schemes a browser would run or read locally rather than hand to an app.
+var blockedSchemes = map[string]bool{
+	"javascript": true,
+	"data":       true,
+	"vbscript":   true,
+	"file":       true,
+	"blob":       true,
+}
+
+// isAppRedirect reports whether target uses a custom (mobile app) scheme.
+func isAppRedirect(target string) bool {
+	scheme, _, ok := strings.Cut(target, ":")
+	if !ok || scheme == "" {
+		return false
+	}
+	scheme = strings.ToLower(scheme)
+	return scheme != "http" && scheme != "https"
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const RefreshTokenTTL = 14 * 24 * time.Hour
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenReused   = errors.New("refresh token reused")
+)
+
+// RefreshToken is one link in a rotation chain. Every token issued from the
+// same login shares a FamilyID so the whole chain can be revoked at once.
+type RefreshToken struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	FamilyID  string
+	Device    string
+	ExpiresAt time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+type RefreshTokenStore interface {
+	Create(ctx context.Context, token *RefreshToken) error
+
+	FindByHash(ctx context.Context, tokenHash string) (*RefreshToken, error)
+
+	// Rotate flags the token as spent and saves next in its place, both or
+	// neither. It returns ErrRefreshTokenReused when the token was already
+	// rotated or revoked.
+	Rotate(ctx context.Context, id int, next *RefreshToken) error
+
+	RevokeFamily(ctx context.Context, familyID string) error
+}
+
+// HashToken returns the value stored in place of an opaque token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/cache"
+)
+
+// Revocation entries are keyed by what they revoke: a single access token
+// ("jti:<id>") or every access token of a session ("sid:<id>"). An entry only
+// has to live as long as the tokens it covers, after that they are rejected
+// as expired anyway.
+func tokenRevocationKey(jti string) string   { return "jti:" + jti }
+func sessionRevocationKey(sid string) string { return "sid:" + sid }
+
+type RevokedToken struct {
+	Key       string
+	ExpiresAt time.Time
+	RevokedAt time.Time
+}
+
+type RevocationList interface {
+	Revoke(ctx context.Context, key string, expiresAt time.Time) error
+
+	IsRevoked(ctx context.Context, key string) (bool, error)
+}
+
+// RevocationStore is the durable side of a PersistentRevocationList.
+type RevocationStore interface {
+	RevocationList
+
+	// RevokedSince returns unexpired entries revoked after since.
+	RevokedSince(ctx context.Context, since time.Time) ([]RevokedToken, error)
+
+	PruneExpired(ctx context.Context) error
+}
+
+// MemoryRevocationList keeps entries in process memory until they expire.
+// Expired entries are removed every minute until Close.
+type MemoryRevocationList struct {
+	entries *cache.MemoryCache
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewMemoryRevocationList() *MemoryRevocationList {
+	m := &MemoryRevocationList{entries: cache.NewMemoryCache(), stop: make(chan struct{})}
+	go m.cleanup(time.Minute)
+	return m
+}
+
+func (m *MemoryRevocationList) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.entries.DeleteExpired()
+		}
+	}
+}
+
+// Close stops removing expired entries. The list still answers afterwards.
+func (m *MemoryRevocationList) Close() {
+	m.once.Do(func() { close(m.stop) })
+}
+
+func (m *MemoryRevocationList) Revoke(ctx context.Context, key string, expiresAt time.Time) error {
+	if ttl := time.Until(expiresAt); ttl > 0 {
+		m.entries.Set(key, true, ttl)
+	}
+	return nil
+}
+
+func (m *MemoryRevocationList) IsRevoked(ctx context.Context, key string) (bool, error) {
+	_, found := m.entries.Get(key)
+	return found, nil
+}
+
+// PersistentRevocationList answers from memory and writes through to a
+// RevocationStore. Sync pulls in entries written by other instances, so a
+// revocation is seen everywhere within one sync interval and survives
+// restarts.
+type PersistentRevocationList struct {
+	memory *MemoryRevocationList
+	store  RevocationStore
+
+	mu       sync.Mutex
+	lastSync time.Time
+}
+
+func NewPersistentRevocationList(store RevocationStore) *PersistentRevocationList {
+	return &PersistentRevocationList{memory: NewMemoryRevocationList(), store: store}
+}
+
+// Close stops the cleanup of the in-memory entries. Syncing stops with the
+// context given to Start.
+func (p *PersistentRevocationList) Close() {
+	p.memory.Close()
+}
+
+func (p *PersistentRevocationList) Revoke(ctx context.Context, key string, expiresAt time.Time) error {
+	if err := p.store.Revoke(ctx, key, expiresAt); err != nil {
+		return err
+	}
+	return p.memory.Revoke(ctx, key, expiresAt)
+}
+
+func (p *PersistentRevocationList) IsRevoked(ctx context.Context, key string) (bool, error) {
+	return p.memory.IsRevoked(ctx, key)
+}
+
+func (p *PersistentRevocationList) Sync(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// lastSync is the newest revoked_at seen, so it is on the database's
+	// clock like the entries it is compared with. Overlap a little so entries
+	// committed late by transactions that started earlier are not missed.
+	since := p.lastSync.Add(-5 * time.Second)
+
+	entries, err := p.store.RevokedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p.memory.Revoke(ctx, e.Key, e.ExpiresAt)
+		if e.RevokedAt.After(p.lastSync) {
+			p.lastSync = e.RevokedAt
+		}
+	}
+	return nil
+}
+
+// Start loads every live entry and keeps syncing until ctx is cancelled.
+func (p *PersistentRevocationList) Start(ctx context.Context, interval time.Duration) error {
+	if err := p.Sync(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := p.Sync(ctx); err != nil {
+					log.Printf("revocation sync failed: %v", err)
+				}
+				if err := p.store.PruneExpired(ctx); err != nil {
+					log.Printf("revocation prune failed: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
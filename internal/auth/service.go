@@ -3,6 +3,10 @@ package auth
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
 
 	"github.com/r7rainz/auramail/internal/user"
 )
@@ -10,32 +14,290 @@ import (
 var ErrInvalidRefreshToken = errors.New("invalid refresh token")
 
 type Service struct {
-	users user.Repository
+	users       user.Repository
+	tokens      RefreshTokenStore
+	sessions    SessionStore
+	revocations RevocationList
+	pats        PersonalAccessTokenStore
+	codes       AuthCodeStore
 }
 
-func NewService(users user.Repository) *Service {
-	return &Service{users: users}
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
 }
 
-func (s *Service) Refresh(ctx context.Context, refreshToken string) (string, error) {
-	_, err := ValidateRefreshToken(refreshToken)
+func NewService(users user.Repository, tokens RefreshTokenStore, sessions SessionStore, revocations RevocationList, pats PersonalAccessTokenStore, codes AuthCodeStore) *Service {
+	return &Service{users: users, tokens: tokens, sessions: sessions, revocations: revocations, pats: pats, codes: codes}
+}
+
+// IssueTokens starts a new session, and with it a new refresh token family,
+// for a fresh login.
+func (s *Service) IssueTokens(ctx context.Context, u *user.User, client ClientInfo) (*TokenPair, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.sessions.Create(ctx, &Session{
+		ID:        sessionID,
+		UserID:    u.ID,
+		Device:    client.Device,
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+	})
 	if err != nil {
-		return "", ErrInvalidRefreshToken
+		return nil, err
 	}
 
-	u, err := s.users.FindByRefreshToken(ctx, refreshToken)
+	return s.issue(ctx, u, sessionID, client.Device)
+}
+
+// IssueAuthCode returns a single-use code that ExchangeAuthCode turns into a
+// token pair for u within AuthCodeTTL. codeChallenge, if not empty, is the
+// S256 PKCE challenge the verifier will be checked against.
+func (s *Service) IssueAuthCode(ctx context.Context, u *user.User, client ClientInfo, codeChallenge string) (string, error) {
+	code, err := randomToken(32)
 	if err != nil {
-		return "", ErrInvalidRefreshToken
+		return "", err
 	}
-	
-	accessToken, err := GenerateAccessToken(u.ID, u.Email, u.Name)
+
+	err = s.codes.Create(ctx, &AuthCode{
+		CodeHash:      HashToken(code),
+		UserID:        u.ID,
+		Client:        client,
+		CodeChallenge: codeChallenge,
+		ExpiresAt:     time.Now().Add(AuthCodeTTL),
+	})
 	if err != nil {
 		return "", err
 	}
-	return accessToken, nil
+	return code, nil
+}
+
+// ExchangeAuthCode starts the session for a login handed over by
+// IssueAuthCode. The code is spent even when the verifier is wrong, so a
+// guessed or intercepted code cannot be retried.
+func (s *Service) ExchangeAuthCode(ctx context.Context, code, codeVerifier string) (*TokenPair, error) {
+	if code == "" {
+		return nil, ErrInvalidAuthCode
+	}
+
+	c, err := s.codes.Consume(ctx, HashToken(code))
+	if errors.Is(err, ErrAuthCodeNotFound) {
+		return nil, ErrInvalidAuthCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !verifyCodeChallenge(c.CodeChallenge, codeVerifier) {
+		return nil, ErrInvalidAuthCode
+	}
+
+	u, err := s.users.FindByID(ctx, strconv.Itoa(c.UserID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user %d for code exchange: %w", c.UserID, err)
+	}
+	return s.IssueTokens(ctx, u, c.Client)
+}
+
+// Refresh spends the given refresh token and returns a new pair from the same
+// family. Presenting a token that was already spent means it leaked, so the
+// whole family is revoked and the legitimate holder has to log in again.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	rt, err := s.tokens.FindByHash(ctx, HashToken(refreshToken))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.RevokedAt != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if rt.RotatedAt != nil {
+		return nil, s.revokeReused(ctx, rt)
+	}
+
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Everything that can fail for reasons other than the token goes before
+	// the rotation, so a failed refresh can be retried with the same token.
+	u, err := s.users.FindByID(ctx, strconv.Itoa(rt.UserID))
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user %d: %w", rt.UserID, err)
+	}
+	if u.Status != user.StatusActive {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	pair, next, err := newTokenPair(u, rt.FamilyID, rt.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.tokens.Rotate(ctx, rt.ID, next); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			return nil, s.revokeReused(ctx, rt)
+		}
+		return nil, err
+	}
+
+	if err := s.sessions.Touch(ctx, rt.FamilyID); err != nil {
+		log.Printf("failed to touch session %s: %v", rt.FamilyID, err)
+	}
+
+	return pair, nil
 }
 
-func (s *Service) Logout(ctx context.Context, userID int) error {
-	return s.users.ClearRefreshToken(ctx, userID)
+func (s *Service) Sessions(ctx context.Context, userID int) ([]*Session, error) {
+	return s.sessions.ListActive(ctx, userID)
 }
 
+// Logout ends the session the access token belongs to and revokes the token
+// itself, so it stops working immediately rather than when it expires.
+func (s *Service) Logout(ctx context.Context, userID int, sessionID, tokenID string) error {
+	if tokenID != "" {
+		if err := s.revocations.Revoke(ctx, tokenRevocationKey(tokenID), time.Now().Add(AccessTokenTTL)); err != nil {
+			return err
+		}
+	}
+	err := s.RevokeSession(ctx, userID, sessionID)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil
+	}
+	return err
+}
+
+// RevokeSession ends one of the user's sessions, its refresh tokens and any
+// access tokens already issued for it.
+func (s *Service) RevokeSession(ctx context.Context, userID int, sessionID string) error {
+	if err := s.sessions.Revoke(ctx, userID, sessionID); err != nil {
+		return err
+	}
+	return s.revokeSessionTokens(ctx, sessionID)
+}
+
+// RevokeAllSessions logs the user out everywhere.
+func (s *Service) RevokeAllSessions(ctx context.Context, userID int) error {
+	ids, err := s.sessions.RevokeAll(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.revokeSessionTokens(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeAllAccess logs the user out everywhere and revokes their personal
+// access tokens, for a user who may no longer use AuraMail at all.
+func (s *Service) RevokeAllAccess(ctx context.Context, userID int) error {
+	if err := s.RevokeAllSessions(ctx, userID); err != nil {
+		return err
+	}
+	return s.pats.RevokeAll(ctx, userID)
+}
+
+func (s *Service) revokeSessionTokens(ctx context.Context, sessionID string) error {
+	if err := s.tokens.RevokeFamily(ctx, sessionID); err != nil {
+		return err
+	}
+	return s.revocations.Revoke(ctx, sessionRevocationKey(sessionID), time.Now().Add(AccessTokenTTL))
+}
+
+// CreatePersonalAccessToken returns the plaintext token, which is never
+// stored and cannot be shown again. A zero ttl means it does not expire.
+func (s *Service) CreatePersonalAccessToken(ctx context.Context, userID int, name string, scopes []string, ttl time.Duration) (string, *PersonalAccessToken, error) {
+	if err := validateScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := personalAccessTokenPrefix + secret
+
+	pat := &PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    token[:len(personalAccessTokenPrefix)+6],
+		TokenHash: HashToken(token),
+		Scopes:    scopes,
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		pat.ExpiresAt = &expiresAt
+	}
+	if err := s.pats.Create(ctx, pat); err != nil {
+		return "", nil, err
+	}
+	return token, pat, nil
+}
+
+func (s *Service) PersonalAccessTokens(ctx context.Context, userID int) ([]*PersonalAccessToken, error) {
+	return s.pats.ListActive(ctx, userID)
+}
+
+func (s *Service) RevokePersonalAccessToken(ctx context.Context, userID, id int) error {
+	return s.pats.Revoke(ctx, userID, id)
+}
+
+func (s *Service) issue(ctx context.Context, u *user.User, familyID, device string) (*TokenPair, error) {
+	pair, rt, err := newTokenPair(u, familyID, device)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.tokens.Create(ctx, rt); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// newTokenPair mints a pair for u and the refresh token record to store for
+// it, leaving the storing to the caller.
+func newTokenPair(u *user.User, familyID, device string) (*TokenPair, *RefreshToken, error) {
+	accessToken, err := GenerateAccessToken(u.ID, u.Email, u.Name, u.Role, familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rt := &RefreshToken{
+		UserID:    u.ID,
+		TokenHash: HashToken(refreshToken),
+		FamilyID:  familyID,
+		Device:    device,
+		ExpiresAt: time.Now().Add(RefreshTokenTTL),
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken}, rt, nil
+}
+
+func (s *Service) revokeReused(ctx context.Context, rt *RefreshToken) error {
+	log.Printf("refresh token reuse detected for user %d, revoking family %s", rt.UserID, rt.FamilyID)
+	if err := s.sessions.Revoke(ctx, rt.UserID, rt.FamilyID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+	if err := s.revokeSessionTokens(ctx, rt.FamilyID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
@@ -0,0 +1,537 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+type memoryRefreshStore struct {
+	mu     sync.Mutex
+	nextID int
+	tokens map[string]*RefreshToken
+}
+
+func newMemoryRefreshStore() *memoryRefreshStore {
+	return &memoryRefreshStore{tokens: make(map[string]*RefreshToken)}
+}
+
+func (m *memoryRefreshStore) Create(ctx context.Context, token *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	token.ID = m.nextID
+	token.CreatedAt = time.Now()
+	m.tokens[token.TokenHash] = token
+	return nil
+}
+
+func (m *memoryRefreshStore) FindByHash(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (m *memoryRefreshStore) Rotate(ctx context.Context, id int, next *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.ID == id {
+			if t.RotatedAt != nil || t.RevokedAt != nil {
+				return ErrRefreshTokenReused
+			}
+			now := time.Now()
+			t.RotatedAt = &now
+			m.nextID++
+			next.ID = m.nextID
+			next.CreatedAt = now
+			m.tokens[next.TokenHash] = next
+			return nil
+		}
+	}
+	return ErrRefreshTokenNotFound
+}
+
+func (m *memoryRefreshStore) RevokeFamily(ctx context.Context, familyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, t := range m.tokens {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]*Session)}
+}
+
+func (m *memorySessionStore) Create(ctx context.Context, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.CreatedAt = time.Now()
+	session.LastUsedAt = session.CreatedAt
+	m.sessions[session.ID] = session
+	return nil
+}
+
+func (m *memorySessionStore) FindByID(ctx context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	copied := *s
+	return &copied, nil
+}
+
+func (m *memorySessionStore) ListActive(ctx context.Context, userID int) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*Session
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.RevokedAt == nil {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func (m *memorySessionStore) Touch(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.LastUsedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *memorySessionStore) Revoke(ctx context.Context, userID int, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.UserID != userID || s.RevokedAt != nil {
+		return ErrSessionNotFound
+	}
+	now := time.Now()
+	s.RevokedAt = &now
+	return nil
+}
+
+func (m *memorySessionStore) RevokeAll(ctx context.Context, userID int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	now := time.Now()
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.RevokedAt == nil {
+			s.RevokedAt = &now
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids, nil
+}
+
+type stubUserRepo struct {
+	user.Repository
+	users map[int]*user.User
+	err   error // returned by FindByID while set
+}
+
+func (s *stubUserRepo) FindByID(ctx context.Context, id string) (*user.User, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := s.users[n]
+	if !ok {
+		return nil, user.ErrUserNotFound
+	}
+	return u, nil
+}
+
+func newTestService(t *testing.T) (*Service, *user.User) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	u := &user.User{ID: 7, Email: "student@vitbhopal.ac.in", Name: "Student", Status: user.StatusActive}
+	repo := &stubUserRepo{users: map[int]*user.User{u.ID: u}}
+	revocations := NewMemoryRevocationList()
+	t.Cleanup(revocations.Close)
+	return NewService(repo, newMemoryRefreshStore(), newMemorySessionStore(), revocations, newMemoryPersonalAccessTokenStore(), NewMemoryAuthCodeStore()), u
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+
+	first, err := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+
+	second, err := svc.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+
+	claims, err := ValidateAccessToken(second.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateAccessToken: %v", err)
+	}
+	if claims.UserID != u.ID {
+		t.Errorf("got user %d, want %d", claims.UserID, u.ID)
+	}
+
+	if _, err := svc.Refresh(ctx, second.RefreshToken); err != nil {
+		t.Errorf("rotated token should still be usable once: %v", err)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+
+	first, err := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	second, err := svc.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	if _, err := svc.Refresh(ctx, first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("got %v, want ErrRefreshTokenReused", err)
+	}
+
+	if _, err := svc.Refresh(ctx, second.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("token from a revoked family should be rejected, got %v", err)
+	}
+}
+
+func TestRefreshRejectsUnknownAndExpired(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+
+	if _, err := svc.Refresh(ctx, "not-a-token"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("got %v, want ErrInvalidRefreshToken", err)
+	}
+
+	pair, err := svc.IssueTokens(ctx, u, ClientInfo{Device: "phone"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+	store := svc.tokens.(*memoryRefreshStore)
+	store.tokens[HashToken(pair.RefreshToken)].ExpiresAt = time.Now().Add(-time.Minute)
+
+	if _, err := svc.Refresh(ctx, pair.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("got %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRefreshSurvivesUserLookupFailure(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+
+	pair, err := svc.IssueTokens(ctx, u, ClientInfo{Device: "phone"})
+	if err != nil {
+		t.Fatalf("IssueTokens: %v", err)
+	}
+
+	repo := svc.users.(*stubUserRepo)
+	repo.err = errors.New("connection refused")
+	_, err = svc.Refresh(ctx, pair.RefreshToken)
+	if err == nil || errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("got %v, want the lookup error", err)
+	}
+
+	repo.err = nil
+	if _, err := svc.Refresh(ctx, pair.RefreshToken); err != nil {
+		t.Fatalf("retry after a failed lookup: %v", err)
+	}
+}
+
+func middlewareCaller(authn *Authenticator) func(accessToken string) int {
+	return func(accessToken string) int {
+		req := httptest.NewRequest(http.MethodGet, "/emails/sync", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rec := httptest.NewRecorder()
+		authn.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(rec, req)
+		return rec.Code
+	}
+}
+
+func TestRevokedSessionRejectedByMiddleware(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	call := middlewareCaller(NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users))
+
+	laptop, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	phone, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "phone"})
+
+	sessions, _ := svc.Sessions(ctx, u.ID)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+
+	claims, _ := ValidateAccessToken(laptop.AccessToken)
+	if err := svc.RevokeSession(ctx, u.ID, claims.SessionID); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+
+	if code := call(laptop.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("revoked session got %d, want 401", code)
+	}
+	if _, err := svc.Refresh(ctx, laptop.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("refresh on revoked session got %v", err)
+	}
+	if code := call(phone.AccessToken); code != http.StatusOK {
+		t.Errorf("other session got %d, want 200", code)
+	}
+
+	if err := svc.RevokeSession(ctx, 99, claims.SessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoking another user's session got %v", err)
+	}
+
+	if err := svc.RevokeAllSessions(ctx, u.ID); err != nil {
+		t.Fatalf("RevokeAllSessions: %v", err)
+	}
+	if code := call(phone.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("after logout everywhere got %d, want 401", code)
+	}
+}
+
+func TestAuthenticateRecordsSessionUse(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	authn := NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users)
+	call := middlewareCaller(authn)
+
+	pair, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	claims, _ := ValidateAccessToken(pair.AccessToken)
+	session := svc.sessions.(*memorySessionStore).sessions[claims.SessionID]
+	lastUsed := func() time.Time {
+		stored, _ := svc.sessions.FindByID(ctx, claims.SessionID)
+		return stored.LastUsedAt
+	}
+
+	hourAgo := time.Now().Add(-time.Hour)
+	session.LastUsedAt = hourAgo
+	if code := call(pair.AccessToken); code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if !lastUsed().After(hourAgo) {
+		t.Fatal("use of the access token was not recorded")
+	}
+
+	// Further requests within a minute do not write again.
+	session.LastUsedAt = hourAgo
+	call(pair.AccessToken)
+	if !lastUsed().Equal(hourAgo) {
+		t.Error("last use was written again within the touch interval")
+	}
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	call := middlewareCaller(NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users))
+
+	laptop, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	phone, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "phone"})
+
+	claims, err := ValidateAccessToken(laptop.AccessToken)
+	if err != nil {
+		t.Fatalf("ValidateAccessToken: %v", err)
+	}
+	if claims.ID == "" {
+		t.Fatal("access token has no jti")
+	}
+
+	if err := svc.Logout(ctx, u.ID, claims.SessionID, claims.ID); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if revoked, _ := svc.revocations.IsRevoked(ctx, tokenRevocationKey(claims.ID)); !revoked {
+		t.Error("jti was not added to the revocation list")
+	}
+	if code := call(laptop.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("logged out token got %d, want 401", code)
+	}
+	if code := call(phone.AccessToken); code != http.StatusOK {
+		t.Errorf("other session got %d, want 200", code)
+	}
+
+	// Logging out twice is harmless.
+	if err := svc.Logout(ctx, u.ID, claims.SessionID, claims.ID); err != nil {
+		t.Errorf("second Logout: %v", err)
+	}
+}
+
+type memoryRevocationStore struct {
+	*MemoryRevocationList
+	mu      sync.Mutex
+	entries []RevokedToken
+	skew    time.Duration // how far the store's clock is ahead of ours
+}
+
+func (m *memoryRevocationStore) Revoke(ctx context.Context, key string, expiresAt time.Time) error {
+	m.mu.Lock()
+	m.entries = append(m.entries, RevokedToken{Key: key, ExpiresAt: expiresAt, RevokedAt: time.Now().Add(m.skew)})
+	m.mu.Unlock()
+	return m.MemoryRevocationList.Revoke(ctx, key, expiresAt)
+}
+
+func (m *memoryRevocationStore) RevokedSince(ctx context.Context, since time.Time) ([]RevokedToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []RevokedToken
+	for _, e := range m.entries {
+		if e.RevokedAt.After(since) && e.ExpiresAt.After(time.Now()) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryRevocationStore) PruneExpired(ctx context.Context) error { return nil }
+
+func TestPersistentRevocationListSyncsOtherInstances(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryRevocationStore{MemoryRevocationList: NewMemoryRevocationList()}
+	a := NewPersistentRevocationList(store)
+	b := NewPersistentRevocationList(store)
+	for _, list := range []interface{ Close() }{store, a, b} {
+		t.Cleanup(list.Close)
+	}
+
+	if err := a.Revoke(ctx, "jti:abc", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if revoked, _ := b.IsRevoked(ctx, "jti:abc"); revoked {
+		t.Fatal("b should not see the entry before syncing")
+	}
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if revoked, _ := b.IsRevoked(ctx, "jti:abc"); !revoked {
+		t.Error("b did not pick up the revocation")
+	}
+}
+
+func TestPersistentRevocationListSyncsOnStoreClock(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryRevocationStore{MemoryRevocationList: NewMemoryRevocationList(), skew: -time.Minute}
+	a := NewPersistentRevocationList(store)
+	b := NewPersistentRevocationList(store)
+	for _, list := range []interface{ Close() }{store, a, b} {
+		t.Cleanup(list.Close)
+	}
+
+	for _, key := range []string{"jti:first", "jti:second"} {
+		if err := b.Sync(ctx); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if err := a.Revoke(ctx, key, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Revoke: %v", err)
+		}
+		if err := b.Sync(ctx); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if revoked, _ := b.IsRevoked(ctx, key); !revoked {
+			t.Errorf("b missed %s revoked on a store clock a minute behind", key)
+		}
+	}
+}
+
+func TestMemoryRevocationListClose(t *testing.T) {
+	m := NewMemoryRevocationList()
+	done := make(chan struct{})
+	go func() {
+		m.cleanup(time.Millisecond)
+		close(done)
+	}()
+	m.Revoke(context.Background(), "jti:abc", time.Now().Add(time.Minute))
+
+	m.Close()
+	m.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup kept running after Close")
+	}
+	if revoked, _ := m.IsRevoked(context.Background(), "jti:abc"); !revoked {
+		t.Error("entries were dropped by Close")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	svc, u := newTestService(t)
+	ctx := context.Background()
+	authn := NewAuthenticator(svc.revocations, svc.pats, svc.sessions, svc.users)
+
+	tests := []struct {
+		role user.Role
+		want int
+	}{
+		{user.RoleStudent, http.StatusForbidden},
+		{user.RoleCoordinator, http.StatusForbidden},
+		{user.RoleAdmin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		u.Role = tt.role
+		pair, err := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+		if err != nil {
+			t.Fatalf("IssueTokens: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+		rec := httptest.NewRecorder()
+		authn.RequireRole(user.RoleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.role, rec.Code, tt.want)
+		}
+	}
+
+	// Promotions reach the token on the next refresh.
+	u.Role = user.RoleStudent
+	pair, _ := svc.IssueTokens(ctx, u, ClientInfo{Device: "laptop"})
+	u.Role = user.RoleCoordinator
+	refreshed, err := svc.Refresh(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	claims, _ := ValidateAccessToken(refreshed.AccessToken)
+	if claims.Role != user.RoleCoordinator || !claims.Role.AtLeast(user.RoleStudent) || claims.Role.AtLeast(user.RoleAdmin) {
+		t.Errorf("refreshed token has role %q", claims.Role)
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one login on one device. Its ID doubles as the family ID of the
+// refresh tokens issued for it and is embedded in access tokens as "sid".
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"-"`
+	Device     string     `json:"device"`
+	UserAgent  string     `json:"userAgent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+type SessionStore interface {
+	Create(ctx context.Context, session *Session) error
+
+	FindByID(ctx context.Context, id string) (*Session, error)
+
+	// ListActive returns the user's sessions that have not been revoked,
+	// most recently used first.
+	ListActive(ctx context.Context, userID int) ([]*Session, error)
+
+	Touch(ctx context.Context, id string) error
+
+	// Revoke returns ErrSessionNotFound unless id is an active session of userID.
+	Revoke(ctx context.Context, userID int, id string) error
+
+	// RevokeAll revokes every active session of userID and returns their IDs.
+	RevokeAll(ctx context.Context, userID int) ([]string, error)
+}
+
+// ClientInfo describes where a login came from.
+type ClientInfo struct {
+	Device    string
+	UserAgent string
+	IP        string
+}
+
+func ClientInfoFromRequest(r *http.Request) ClientInfo {
+	ua := r.UserAgent()
+	device := r.Header.Get("X-Device-Name")
+	if device == "" {
+		device = deviceLabel(ua)
+	}
+	return ClientInfo{Device: device, UserAgent: ua, IP: clientIP(r)}
+}
+
+// clientIP is informational only (shown in the sessions list), so trusting the
+// first X-Forwarded-For hop from our proxy is acceptable.
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func deviceLabel(ua string) string {
+	browser := ""
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		os = "iOS"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return "Unknown device"
+	}
+}
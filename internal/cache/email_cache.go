@@ -32,7 +32,7 @@ func (c *MemoryCache) Set(key string, value interface{}, duration time.Duration)
 
 //Get retrieves an item only if it hasn't expired
 func (c *MemoryCache) Get(key string) (interface{}, bool) {
-	c.mu.Lock()
+	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	item,found := c.items[key]
@@ -52,13 +52,18 @@ func (c *MemoryCache) Delete(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			c.mu.Lock()
-			for key, item := range c.items {
-				if time.Now().After(item.ExpiresAt) {
-					delete(c.items, key)
-				}
-			}
-			c.mu.Unlock()
+			c.DeleteExpired()
 		}
 	}()
 }
+
+// DeleteExpired removes every item that has expired.
+func (c *MemoryCache) DeleteExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, item := range c.items {
+		if time.Now().After(item.ExpiresAt) {
+			delete(c.items, key)
+		}
+	}
+}
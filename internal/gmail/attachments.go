@@ -0,0 +1,86 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/attachment"
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+// maxAttachments bounds the attachments read from one message.
+const maxAttachments = 5
+
+// StoredAttachment is a file attached to a summarized message, kept with the
+// text extracted from it. Error says why there is no text, if there is none.
+type StoredAttachment struct {
+	UserID    int
+	MessageID string
+	Position  int
+	Filename  string
+	MimeType  string
+	Size      int
+	Content   []byte
+	Text      string
+	Error     string
+}
+
+type AttachmentStore interface {
+	// Save stores the attachment, replacing the one at the same position of
+	// the same message.
+	Save(ctx context.Context, a *StoredAttachment) error
+}
+
+// readAttachments downloads the attachments of msg that text can be read
+// from, stores them and returns them for the summarizer. Images and other
+// formats without text are passed over. A file that is too large or cannot be
+// read is reported with its error and does not hold up the message; a failed
+// download fails the message, so it is tried again on the next run.
+func readAttachments(ctx context.Context, mb mailbox.Mailbox, store AttachmentStore, userID int, msg *mailbox.Message) ([]ai.Attachment, error) {
+	var read []ai.Attachment
+	for _, a := range msg.Attachments {
+		kind := attachment.KindOf(a.Filename, a.MimeType)
+		if kind == "" {
+			continue
+		}
+		if len(read) == maxAttachments {
+			log.Printf("Skipping attachments of %s beyond the first %d", msg.ID, maxAttachments)
+			break
+		}
+
+		stored := &StoredAttachment{
+			UserID:    userID,
+			MessageID: msg.ID,
+			Position:  len(read),
+			Filename:  a.Filename,
+			MimeType:  a.MimeType,
+			Size:      a.Size,
+		}
+		if a.Size > attachment.MaxSize {
+			stored.Error = fmt.Sprintf("%s: %v", kind, attachment.ErrTooLarge)
+		} else {
+			data, err := mb.FetchAttachment(ctx, msg.ID, a.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download attachment %q of %s: %w", a.Filename, msg.ID, err)
+			}
+			stored.Content = data
+			stored.Size = len(data)
+			if stored.Text, err = attachment.Extract(kind, data); err != nil {
+				stored.Error = err.Error()
+			}
+		}
+		if err := store.Save(ctx, stored); err != nil {
+			log.Printf("Error saving attachment %q of %s: %v", a.Filename, msg.ID, err)
+		}
+
+		read = append(read, ai.Attachment{
+			Filename: a.Filename,
+			MimeType: a.MimeType,
+			Text:     stored.Text,
+			Error:    stored.Error,
+		})
+	}
+	return read, nil
+}
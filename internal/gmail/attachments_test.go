@@ -0,0 +1,171 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/attachment"
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+type memoryAttachmentStore struct {
+	mu    sync.Mutex
+	saved []*StoredAttachment
+}
+
+func (s *memoryAttachmentStore) Save(ctx context.Context, a *StoredAttachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *a
+	s.saved = append(s.saved, &stored)
+	return nil
+}
+
+// attachmentMailbox serves one message with the given attachments, whose
+// content is looked up by attachment ID.
+type attachmentMailbox struct {
+	fakeMailbox
+	attachments []mailbox.Attachment
+	files       map[string][]byte
+	err         error // if set, every download fails with it
+
+	mu         sync.Mutex
+	downloaded []string
+}
+
+func (m *attachmentMailbox) Fetch(ctx context.Context, id string) (*mailbox.Message, error) {
+	return &mailbox.Message{ID: id, Subject: "Drive " + id, Attachments: m.attachments}, nil
+}
+
+func (m *attachmentMailbox) FetchAttachment(ctx context.Context, messageID, attachmentID string) ([]byte, error) {
+	m.mu.Lock()
+	m.downloaded = append(m.downloaded, attachmentID)
+	m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	data, ok := m.files[attachmentID]
+	if !ok {
+		return nil, mailbox.ErrUnavailable
+	}
+	return data, nil
+}
+
+func TestSummarizeReadsAttachments(t *testing.T) {
+	mb := &attachmentMailbox{
+		attachments: []mailbox.Attachment{
+			{ID: "a1", Filename: "logo.png", MimeType: "image/png", Size: 2048},
+			{ID: "a2", Filename: "Shortlist.csv", MimeType: "application/octet-stream", Size: 40},
+			{ID: "a3", Filename: "JD.pdf", MimeType: "application/pdf", Size: attachment.MaxSize + 1},
+			{ID: "a4", Filename: "Eligibility.xlsx", MimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Size: 9000},
+			{ID: "a5", Filename: "Notice.docx", MimeType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Size: 12},
+		},
+		files: map[string][]byte{
+			"a1": []byte("\x89PNG"),
+			"a2": []byte("Roll No,Name\n2101,Asha Rao\n"),
+			"a4": []byte("not a zip file"),
+			"a5": []byte("not a zip file"),
+		},
+	}
+	repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{}}
+	s := testSummarizer(repo)
+	store := s.attachments.(*memoryAttachmentStore)
+	var got []ai.Attachment
+	s.analyze = func(ctx context.Context, userID int, subject, snippet, body string, attachments []ai.Attachment) (*ai.AIResult, error) {
+		got = attachments
+		return &ai.AIResult{Summary: subject, Attachments: attachments}, nil
+	}
+
+	done, err := s.summarize(context.Background(), mb, 7, []string{"m1"}, nil)
+	if err != nil || done.summarized != 1 || done.failed != 0 {
+		t.Fatalf("summarize = %+v, %v, want the message summarized", done, err)
+	}
+
+	if len(got) != 4 {
+		t.Fatalf("analyze got %d attachments, want 4: %+v", len(got), got)
+	}
+	if got[0].Filename != "Shortlist.csv" || got[0].Text != "Roll No | Name\n2101 | Asha Rao" || got[0].Error != "" {
+		t.Errorf("csv attachment = %+v", got[0])
+	}
+	for i, want := range map[int]string{1: "pdf: attachment too large", 2: "xlsx: failed to open package", 3: "docx: failed to open package"} {
+		if got[i].Text != "" || !strings.HasPrefix(got[i].Error, want) {
+			t.Errorf("attachment %d = %+v, want error %q", i, got[i], want)
+		}
+	}
+	if strings.Join(mb.downloaded, ",") != "a2,a4,a5" {
+		t.Errorf("downloaded %v, want only the readable attachments within the size limit", mb.downloaded)
+	}
+
+	if len(store.saved) != 4 {
+		t.Fatalf("stored %d attachments, want 4", len(store.saved))
+	}
+	csv := store.saved[0]
+	if csv.UserID != 7 || csv.MessageID != "m1" || csv.Position != 0 || string(csv.Content) != string(mb.files["a2"]) || csv.Text != got[0].Text {
+		t.Errorf("stored csv = %+v", csv)
+	}
+	if pdf := store.saved[1]; pdf.Position != 1 || pdf.Content != nil || pdf.Size != attachment.MaxSize+1 {
+		t.Errorf("stored pdf = %+v", pdf)
+	}
+	if res := repo.summaries["m1"]; res == nil || len(res.Attachments) != 4 {
+		t.Errorf("saved summary = %+v, want it to report the attachments", res)
+	}
+}
+
+func TestReadAttachmentsLimit(t *testing.T) {
+	mb := &attachmentMailbox{files: map[string][]byte{}}
+	for i := range maxAttachments + 2 {
+		id := "a" + strings.Repeat("x", i)
+		mb.attachments = append(mb.attachments, mailbox.Attachment{ID: id, Filename: "round.csv", MimeType: "text/csv"})
+		mb.files[id] = []byte("Round,Time\nTest,10 AM\n")
+	}
+	msg, _ := mb.Fetch(context.Background(), "m1")
+
+	read, err := readAttachments(context.Background(), mb, &memoryAttachmentStore{}, 7, msg)
+	if err != nil {
+		t.Fatalf("readAttachments: %v", err)
+	}
+	if len(read) != maxAttachments || len(mb.downloaded) != maxAttachments {
+		t.Errorf("read %d and downloaded %d attachments, want %d", len(read), len(mb.downloaded), maxAttachments)
+	}
+}
+
+// A download that fails is not the attachment's fault, so nothing is recorded
+// against it and the message is left for the next run.
+func TestSummarizeAttachmentDownloadFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{"unavailable", mailbox.ErrUnavailable, nil},
+		{"grant revoked", mailbox.ErrReauthRequired, mailbox.ErrReauthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := &attachmentMailbox{
+				attachments: []mailbox.Attachment{{ID: "a1", Filename: "Shortlist.csv", MimeType: "text/csv", Size: 40}},
+				err:         tt.err,
+			}
+			repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{}}
+			s := testSummarizer(repo)
+
+			done, err := s.summarize(context.Background(), mb, 7, []string{"m1"}, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("summarize error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (done.summarized != 0 || done.failed != 1) {
+				t.Errorf("summarize = %+v, want the message failed", done)
+			}
+			if _, ok := repo.summaries["m1"]; ok {
+				t.Error("summary saved without its attachment")
+			}
+			if saved := s.attachments.(*memoryAttachmentStore).saved; len(saved) != 0 {
+				t.Errorf("stored %+v, want nothing", saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// placementQuery is what the sync endpoints and backfills search for when the
+// client does not pass a query.
+const placementQuery = "from:placementoffice@vitbhopal.ac.in OR subject:placement"
+
+// streamQuery is the stream's default. It is kept to the placement office
+// alone, since everything it finds is sent to the AI, and push ingestion
+// uses it too so both advance the same sync cursor.
+const streamQuery = "from:placementoffice@vitbhopal.ac.in"
+
+const (
+	backfillPageSize = 100
+
+	defaultBackfillWindowDays = 180
+)
+
+var (
+	ErrBackfillNotFound = errors.New("backfill not found")
+	ErrBackfillRunning  = errors.New("a backfill is already running")
+
+	// errBackfillMailbox marks failures of the mailbox itself, as opposed to
+	// our own storage, so the job can report which without the raw error.
+	errBackfillMailbox = errors.New("mailbox request failed")
+)
+
+type BackfillStatus string
+
+const (
+	BackfillRunning   BackfillStatus = "running"
+	BackfillCompleted BackfillStatus = "completed"
+	// BackfillPaused means the provider revoked the grant. Starting the same
+	// backfill after the user logs in again continues from the cursor.
+	BackfillPaused    BackfillStatus = "paused"
+	BackfillFailed    BackfillStatus = "failed"
+	BackfillCancelled BackfillStatus = "cancelled"
+)
+
+// BackfillJob pages through every message matching Query inside the date
+// window. PageToken is the cursor of the next page to process and is saved
+// after each page, so an interrupted job redoes at most one page.
+type BackfillJob struct {
+	ID          int            `json:"id"`
+	UserID      int            `json:"-"`
+	Query       string         `json:"query"`
+	After       *time.Time     `json:"after,omitempty"`
+	Before      *time.Time     `json:"before,omitempty"`
+	PageToken   string         `json:"-"`
+	Status      BackfillStatus `json:"status"`
+	Pages       int            `json:"pages"`
+	Processed   int            `json:"processed"`
+	Summarized  int            `json:"summarized"`
+	Failed      int            `json:"failed"`
+	Estimate    int            `json:"estimate"`
+	Error       string         `json:"error,omitempty"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	CompletedAt *time.Time     `json:"completedAt,omitempty"`
+}
+
+// sameRun reports whether job searches the same mail as query and window, in
+// which case restarting it should continue from its cursor.
+func (j *BackfillJob) sameRun(query string, after, before *time.Time) bool {
+	return j.Query == query && sameTime(j.After, after) && sameTime(j.Before, before)
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+type BackfillStore interface {
+	Create(ctx context.Context, job *BackfillJob) error
+
+	// Latest returns the user's most recent job, or ErrBackfillNotFound.
+	Latest(ctx context.Context, userID int) (*BackfillJob, error)
+
+	// ListRunning returns the jobs of every user that were running when the
+	// process last stopped.
+	ListRunning(ctx context.Context) ([]*BackfillJob, error)
+
+	// SaveProgress stores the cursor and counters of a running job. It
+	// returns ErrBackfillNotFound once the job was cancelled or deleted,
+	// which tells the runner to stop.
+	SaveProgress(ctx context.Context, job *BackfillJob) error
+
+	// SetStatus returns ErrBackfillNotFound if there is no such job.
+	SetStatus(ctx context.Context, id int, status BackfillStatus, errMsg string) error
+}
+
+// backfillWindow is the default date window: the last BACKFILL_WINDOW_DAYS
+// days (180 if unset), which covers a placement season.
+func backfillWindow(now time.Time) time.Time {
+	days, err := strconv.Atoi(os.Getenv("BACKFILL_WINDOW_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultBackfillWindowDays
+	}
+	// Whole days, so starting the same backfill again later today still
+	// resumes the earlier job.
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -days)
+}
+
+type mailboxSource interface {
+	Mailbox(ctx context.Context, u *user.User) (mailbox.Mailbox, error)
+}
+
+type runningBackfill struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Backfiller runs backfill jobs in the background, one per user at a time.
+type Backfiller struct {
+	summarizer
+	jobs      BackfillStore
+	providers mailboxSource
+
+	mu      sync.Mutex
+	base    context.Context
+	running map[int]*runningBackfill // by user ID
+	wg      sync.WaitGroup
+}
+
+func NewBackfiller(jobs BackfillStore, attachments AttachmentStore, threads ThreadStore, users *user.PostgresRepository, providers provider.Registry) *Backfiller {
+	return &Backfiller{
+		summarizer: summarizer{users: users, attachments: attachments, threads: threads, analyze: ai.AnalyzeEmail},
+		jobs:       jobs,
+		providers:  providers,
+		base:       context.Background(),
+		running:    map[int]*runningBackfill{},
+	}
+}
+
+// Start resumes the jobs that were running when the process last stopped.
+// Jobs run until ctx is cancelled and are left running in the store then, so
+// the next Start picks them up again.
+func (b *Backfiller) Start(ctx context.Context) error {
+	b.mu.Lock()
+	b.base = ctx
+	b.mu.Unlock()
+
+	jobs, err := b.jobs.ListRunning(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		running, ok := b.reserve(job.UserID)
+		if !ok {
+			// A request of the user got in first and runs the job.
+			continue
+		}
+		// Or got in and finished it before the slot was free again.
+		current, err := b.jobs.Latest(ctx, job.UserID)
+		if err != nil || current.ID != job.ID || current.Status != BackfillRunning {
+			b.release(job.UserID, running)
+			continue
+		}
+		log.Printf("resuming backfill %d of user %d after %d pages", current.ID, current.UserID, current.Pages)
+		b.launch(current, running)
+	}
+	return nil
+}
+
+// Enqueue starts a backfill of query for the user. If their last backfill
+// searched the same mail and did not finish, it continues from its cursor
+// instead of starting over. A job the last process left running is resumed
+// and returned instead, whatever it searches.
+func (b *Backfiller) Enqueue(ctx context.Context, userID int, query string, after, before *time.Time) (*BackfillJob, error) {
+	running, ok := b.reserve(userID)
+	if !ok {
+		return nil, ErrBackfillRunning
+	}
+
+	job, err := b.nextJob(ctx, userID, query, after, before)
+	if errors.Is(err, ErrBackfillRunning) && job != nil {
+		// Left running by the last process and not yet resumed by Start,
+		// which skips users it finds reserved.
+		b.launch(job, running)
+		return job, nil
+	}
+	if err != nil {
+		b.release(userID, running)
+		return nil, err
+	}
+	b.launch(job, running)
+	return job, nil
+}
+
+// nextJob marks the job Enqueue should run as running in the store. If the
+// user's last job is still running there, it returns that job along with
+// ErrBackfillRunning.
+func (b *Backfiller) nextJob(ctx context.Context, userID int, query string, after, before *time.Time) (*BackfillJob, error) {
+	last, err := b.jobs.Latest(ctx, userID)
+	if err != nil && !errors.Is(err, ErrBackfillNotFound) {
+		return nil, err
+	}
+	if last != nil && last.Status == BackfillRunning {
+		return last, ErrBackfillRunning
+	}
+
+	if last != nil && (last.Status == BackfillPaused || last.Status == BackfillFailed) && last.sameRun(query, after, before) {
+		if err := b.jobs.SetStatus(ctx, last.ID, BackfillRunning, ""); err != nil {
+			return nil, err
+		}
+		last.Status, last.Error = BackfillRunning, ""
+		return last, nil
+	}
+
+	job := &BackfillJob{UserID: userID, Query: query, After: after, Before: before, Status: BackfillRunning}
+	if err := b.jobs.Create(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Cancel stops the user's running backfill and returns it, or
+// ErrBackfillNotFound if none is running. It returns once the job has stopped
+// writing summaries.
+func (b *Backfiller) Cancel(ctx context.Context, userID int) (*BackfillJob, error) {
+	job, err := b.jobs.Latest(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != BackfillRunning {
+		return nil, ErrBackfillNotFound
+	}
+	if err := b.jobs.SetStatus(ctx, job.ID, BackfillCancelled, ""); err != nil {
+		return nil, err
+	}
+	job.Status = BackfillCancelled
+
+	b.mu.Lock()
+	running, ok := b.running[userID]
+	b.mu.Unlock()
+	if ok {
+		running.cancel()
+		select {
+		case <-running.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return job, nil
+}
+
+// Stop cancels the user's backfill, if any, before their account is deleted.
+func (b *Backfiller) Stop(ctx context.Context, userID int) error {
+	_, err := b.Cancel(ctx, userID)
+	if errors.Is(err, ErrBackfillNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (b *Backfiller) Status(ctx context.Context, userID int) (*BackfillJob, error) {
+	return b.jobs.Latest(ctx, userID)
+}
+
+// Wait blocks until every launched job has returned.
+func (b *Backfiller) Wait() {
+	b.wg.Wait()
+}
+
+// reserve claims the user's one backfill slot, so that checking for a
+// running job and starting one cannot interleave with another request or
+// with Start. It reports false if the slot is taken.
+func (b *Backfiller) reserve(userID int) (*runningBackfill, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, busy := b.running[userID]; busy {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(b.base)
+	running := &runningBackfill{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	b.running[userID] = running
+	return running, true
+}
+
+// release frees the slot reserve claimed.
+func (b *Backfiller) release(userID int, running *runningBackfill) {
+	b.mu.Lock()
+	delete(b.running, userID)
+	b.mu.Unlock()
+	running.cancel()
+	close(running.done)
+}
+
+// launch runs a copy of job in the slot reserved for its user, leaving the
+// caller free to hand job out, and frees the slot when it returns.
+func (b *Backfiller) launch(job *BackfillJob, running *runningBackfill) {
+	run := *job
+	job = &run
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.release(job.UserID, running)
+		b.run(running.ctx, job)
+	}()
+}
+
+func (b *Backfiller) run(ctx context.Context, job *BackfillJob) {
+	status, errMsg := b.process(ctx, job)
+	if ctx.Err() != nil {
+		// Cancelled by the user (already recorded) or shutting down, in
+		// which case the job stays running and resumes on the next Start.
+		return
+	}
+	if err := b.jobs.SetStatus(context.WithoutCancel(ctx), job.ID, status, errMsg); err != nil {
+		log.Printf("failed to record backfill %d as %s: %v", job.ID, status, err)
+	}
+}
+
+func (b *Backfiller) process(ctx context.Context, job *BackfillJob) (BackfillStatus, string) {
+	u, err := b.users.FindByID(ctx, strconv.Itoa(job.UserID))
+	if err != nil {
+		return BackfillFailed, "user not found"
+	}
+
+	mb, err := b.providers.Mailbox(ctx, u)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", errBackfillMailbox, err)
+	} else {
+		err = b.processPages(ctx, mb, job)
+	}
+	switch {
+	case err == nil:
+		return BackfillCompleted, ""
+	case errors.Is(err, mailbox.ErrReauthRequired):
+		if !u.ReauthRequired {
+			if err := b.users.MarkReauthRequired(ctx, u.ID); err != nil {
+				log.Printf("failed to mark user %d for reauthorization: %v", u.ID, err)
+			}
+		}
+		return BackfillPaused, "reauth_required"
+	case errors.Is(err, ErrBackfillNotFound):
+		return BackfillCancelled, ""
+	default:
+		log.Printf("backfill %d of user %d failed: %v", job.ID, job.UserID, err)
+		if errors.Is(err, errBackfillMailbox) {
+			return BackfillFailed, "provider_error"
+		}
+		return BackfillFailed, "internal_error"
+	}
+}
+
+func (b *Backfiller) processPages(ctx context.Context, mb mailbox.Mailbox, job *BackfillJob) error {
+	req := mailbox.SearchRequest{Query: job.Query, PageToken: job.PageToken, PageSize: backfillPageSize}
+	if job.After != nil {
+		req.After = *job.After
+	}
+	if job.Before != nil {
+		req.Before = *job.Before
+	}
+
+	for {
+		page, err := mb.SearchPage(ctx, req)
+		if err != nil {
+			return fmt.Errorf("%w: failed to list page %d: %w", errBackfillMailbox, job.Pages+1, err)
+		}
+
+		done, err := b.summarize(ctx, mb, job.UserID, page.IDs, nil)
+		if err != nil {
+			return err
+		}
+
+		job.Pages++
+		job.Processed += len(page.IDs)
+		job.Summarized += done.summarized
+		job.Failed += done.failed
+		if page.Estimate > 0 {
+			job.Estimate = page.Estimate
+		}
+		if page.NextPageToken == "" {
+			// Estimates are rough; once done, the count is exact.
+			job.Estimate = job.Processed
+		}
+		job.PageToken = page.NextPageToken
+		if err := b.jobs.SaveProgress(ctx, job); err != nil {
+			return err
+		}
+
+		if page.NextPageToken == "" {
+			return nil
+		}
+		req.PageToken = page.NextPageToken
+	}
+}
@@ -0,0 +1,337 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// fakeMailbox serves pages of two IDs each: page token "" is m1,m2, "p2" is
+// m3,m4 and "p3" is m5.
+type fakeMailbox struct {
+	mu       sync.Mutex
+	requests []mailbox.SearchRequest
+	revoked  string        // fetching this ID answers ErrReauthRequired
+	block    chan struct{} // if set, searches wait until it is closed
+}
+
+var fakePages = map[string]*mailbox.Page{
+	"":   {IDs: []string{"m1", "m2"}, NextPageToken: "p2", Estimate: 4},
+	"p2": {IDs: []string{"m3", "m4"}, NextPageToken: "p3", Estimate: 4},
+	"p3": {IDs: []string{"m5"}},
+}
+
+func (m *fakeMailbox) Search(ctx context.Context, query string, max int) ([]string, error) {
+	return fakePages[""].IDs, nil
+}
+
+func (m *fakeMailbox) SearchPage(ctx context.Context, req mailbox.SearchRequest) (*mailbox.Page, error) {
+	if m.block != nil {
+		<-m.block
+	}
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	m.mu.Unlock()
+	page, ok := fakePages[req.PageToken]
+	if !ok {
+		return nil, errors.New("bad page token")
+	}
+	return page, nil
+}
+
+func (m *fakeMailbox) Fetch(ctx context.Context, id string) (*mailbox.Message, error) {
+	if id == m.revoked {
+		return nil, mailbox.ErrReauthRequired
+	}
+	return &mailbox.Message{ID: id, Subject: "Drive " + id}, nil
+}
+
+func (m *fakeMailbox) FetchAttachment(ctx context.Context, messageID, attachmentID string) ([]byte, error) {
+	return nil, mailbox.ErrMessageNotFound
+}
+
+type fakeMailboxSource struct {
+	mb *fakeMailbox
+}
+
+func (s fakeMailboxSource) Mailbox(ctx context.Context, u *user.User) (mailbox.Mailbox, error) {
+	return s.mb, nil
+}
+
+type fakeSummaryRepo struct {
+	mu        sync.Mutex
+	summaries map[string]*ai.AIResult
+	reauth    bool
+}
+
+func (r *fakeSummaryRepo) FindByID(ctx context.Context, id string) (*user.User, error) {
+	n, _ := strconv.Atoi(id)
+	return &user.User{ID: n}, nil
+}
+
+func (r *fakeSummaryRepo) MarkReauthRequired(ctx context.Context, userID int) error {
+	r.reauth = true
+	return nil
+}
+
+func (r *fakeSummaryRepo) GetSummary(ctx context.Context, gmailID string) (*ai.AIResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.summaries[gmailID]; ok {
+		return s, nil
+	}
+	return nil, errors.New("no rows")
+}
+
+func (r *fakeSummaryRepo) SaveSummary(ctx context.Context, userID int, gmailID string, res *ai.AIResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.summaries[gmailID] = res
+	return nil
+}
+
+type memoryBackfillStore struct {
+	mu   sync.Mutex
+	jobs []*BackfillJob
+}
+
+func (s *memoryBackfillStore) Create(ctx context.Context, job *BackfillJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.ID = len(s.jobs) + 1
+	stored := *job
+	s.jobs = append(s.jobs, &stored)
+	return nil
+}
+
+func (s *memoryBackfillStore) Latest(ctx context.Context, userID int) (*BackfillJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		if s.jobs[i].UserID == userID {
+			job := *s.jobs[i]
+			return &job, nil
+		}
+	}
+	return nil, ErrBackfillNotFound
+}
+
+func (s *memoryBackfillStore) ListRunning(ctx context.Context) ([]*BackfillJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var running []*BackfillJob
+	for _, job := range s.jobs {
+		if job.Status == BackfillRunning {
+			copied := *job
+			running = append(running, &copied)
+		}
+	}
+	return running, nil
+}
+
+func (s *memoryBackfillStore) SaveProgress(ctx context.Context, job *BackfillJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.jobs[job.ID-1]
+	if stored.Status != BackfillRunning {
+		return ErrBackfillNotFound
+	}
+	status := stored.Status
+	*stored = *job
+	stored.Status = status
+	return nil
+}
+
+func (s *memoryBackfillStore) SetStatus(ctx context.Context, id int, status BackfillStatus, errMsg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[id-1].Status = status
+	s.jobs[id-1].Error = errMsg
+	return nil
+}
+
+func testSummarizer(repo *fakeSummaryRepo) summarizer {
+	return summarizer{
+		users:       repo,
+		attachments: &memoryAttachmentStore{},
+		threads:     &memoryThreadStore{},
+		analyze: func(ctx context.Context, userID int, subject, snippet, body string, attachments []ai.Attachment) (*ai.AIResult, error) {
+			return &ai.AIResult{Summary: subject}, nil
+		},
+	}
+}
+
+func newTestBackfiller(mb *fakeMailbox) (*Backfiller, *memoryBackfillStore, *fakeSummaryRepo) {
+	store := &memoryBackfillStore{}
+	repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{}}
+	b := &Backfiller{
+		summarizer: testSummarizer(repo),
+		jobs:       store,
+		providers:  fakeMailboxSource{mb},
+		base:       context.Background(),
+		running:    map[int]*runningBackfill{},
+	}
+	return b, store, repo
+}
+
+func TestBackfillPagesThroughEverything(t *testing.T) {
+	mb := &fakeMailbox{}
+	b, _, repo := newTestBackfiller(mb)
+	repo.summaries["m2"] = &ai.AIResult{Summary: "already done"}
+
+	after := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := b.Enqueue(context.Background(), 7, "subject:placement", &after, nil); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	b.Wait()
+
+	job, err := b.Status(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if job.Status != BackfillCompleted || job.Pages != 3 || job.Processed != 5 || job.Summarized != 4 || job.Estimate != 5 {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if len(repo.summaries) != 5 {
+		t.Errorf("got %d summaries, want 5", len(repo.summaries))
+	}
+	if len(mb.requests) != 3 || !mb.requests[0].After.Equal(after) || mb.requests[2].PageToken != "p3" {
+		t.Errorf("unexpected search requests %+v", mb.requests)
+	}
+}
+
+func TestBackfillResumesFromCursor(t *testing.T) {
+	mb := &fakeMailbox{}
+	b, store, _ := newTestBackfiller(mb)
+
+	// A job that got through the first page before the process stopped.
+	store.jobs = []*BackfillJob{{ID: 1, UserID: 7, Query: "q", Status: BackfillRunning, PageToken: "p2", Pages: 1, Processed: 2}}
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	b.Wait()
+
+	if len(mb.requests) != 2 || mb.requests[0].PageToken != "p2" {
+		t.Errorf("resume should start at p2, got %+v", mb.requests)
+	}
+	job := store.jobs[0]
+	if job.Status != BackfillCompleted || job.Pages != 3 || job.Processed != 5 {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
+
+func TestBackfillRunsOnceUnderConcurrentRequests(t *testing.T) {
+	mb := &fakeMailbox{block: make(chan struct{})}
+	b, store, _ := newTestBackfiller(mb)
+	store.jobs = []*BackfillJob{{ID: 1, UserID: 7, Query: "q", Status: BackfillPaused, PageToken: "p2", Pages: 1, Processed: 2}}
+
+	// Requests racing each other and the startup resume all see the paused
+	// job, but only one may run it.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started := 0
+	for range 10 {
+		wg.Go(func() {
+			_, err := b.Enqueue(context.Background(), 7, "q", nil, nil)
+			if err != nil && !errors.Is(err, ErrBackfillRunning) {
+				t.Errorf("Enqueue: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				started++
+			}
+		})
+	}
+	wg.Go(func() {
+		if err := b.Start(context.Background()); err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	})
+	wg.Wait()
+	close(mb.block)
+	b.Wait()
+
+	if started != 1 || len(store.jobs) != 1 {
+		t.Errorf("%d requests started a job, %d jobs stored; want 1 and 1", started, len(store.jobs))
+	}
+	if len(mb.requests) != 2 || store.jobs[0].Status != BackfillCompleted {
+		t.Errorf("job ran %d searches to %s, want 2 to completed", len(mb.requests), store.jobs[0].Status)
+	}
+}
+
+func TestBackfillEnqueueResumesLeftoverJob(t *testing.T) {
+	mb := &fakeMailbox{}
+	b, store, _ := newTestBackfiller(mb)
+	store.jobs = []*BackfillJob{{ID: 1, UserID: 7, Query: "q", Status: BackfillRunning, PageToken: "p2", Pages: 1, Processed: 2}}
+
+	// The user asks before Start ran; their request resumes the job and
+	// Start leaves it alone afterwards.
+	if job, err := b.Enqueue(context.Background(), 7, "other", nil, nil); err != nil || job.ID != 1 {
+		t.Errorf("Enqueue = %+v, %v; want the resumed job", job, err)
+	}
+	b.Wait()
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	b.Wait()
+
+	if len(mb.requests) != 2 || mb.requests[0].PageToken != "p2" || store.jobs[0].Status != BackfillCompleted {
+		t.Errorf("job = %+v after searches %+v", store.jobs[0], mb.requests)
+	}
+}
+
+func TestBackfillPausesOnRevokedGrant(t *testing.T) {
+	mb := &fakeMailbox{revoked: "m3"}
+	b, store, repo := newTestBackfiller(mb)
+
+	if _, err := b.Enqueue(context.Background(), 7, "q", nil, nil); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	b.Wait()
+
+	job := store.jobs[0]
+	if job.Status != BackfillPaused || job.Error != "reauth_required" || job.PageToken != "p2" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if !repo.reauth {
+		t.Error("user was not marked for reauthorization")
+	}
+
+	// Once the user is back, the same backfill continues at the cursor.
+	mb.revoked = ""
+	mb.requests = nil
+	resumed, err := b.Enqueue(context.Background(), 7, "q", nil, nil)
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	b.Wait()
+	if resumed.ID != job.ID || mb.requests[0].PageToken != "p2" {
+		t.Errorf("expected job %d to resume at p2, got job %d and %+v", job.ID, resumed.ID, mb.requests)
+	}
+	if store.jobs[0].Status != BackfillCompleted {
+		t.Errorf("status = %s, want completed", store.jobs[0].Status)
+	}
+}
+
+func TestBackfillHidesProviderErrors(t *testing.T) {
+	mb := &fakeMailbox{}
+	b, store, _ := newTestBackfiller(mb)
+	store.jobs = []*BackfillJob{{ID: 1, UserID: 7, Query: "q", Status: BackfillRunning, PageToken: "expired"}}
+
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	b.Wait()
+
+	if job := store.jobs[0]; job.Status != BackfillFailed || job.Error != "provider_error" {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
@@ -1,52 +1,83 @@
 package gmail
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/r7rainz/auramail/internal/ai"
 	"github.com/r7rainz/auramail/internal/auth"
-	"github.com/r7rainz/auramail/internal/auth/google"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/mailbox"
 	"github.com/r7rainz/auramail/internal/user"
 	"github.com/r7rainz/auramail/internal/utils"
 )
 
 type GmailHandler struct {
-    userRepo *user.PostgresRepository
+    userRepo    *user.PostgresRepository
+    providers   provider.Registry
+    backfills   *Backfiller
+    cursors     SyncCursorStore
+    watches     *WatchManager
+    threads     ThreadStore
+    summarizer  summarizer
 }
 
-func NewHandler(repo *user.PostgresRepository) *GmailHandler {
+func NewHandler(repo *user.PostgresRepository, providers provider.Registry, backfills *Backfiller, cursors SyncCursorStore, watches *WatchManager, attachments AttachmentStore, threads ThreadStore) *GmailHandler {
 	return &GmailHandler {
-		userRepo: repo,
+		userRepo:    repo,
+		providers:   providers,
+		backfills:   backfills,
+		cursors:     cursors,
+		watches:     watches,
+		threads:     threads,
+		summarizer:  summarizer{users: repo, attachments: attachments, threads: threads, analyze: ai.AnalyzeEmail},
 	}
 }
 
 func (h *GmailHandler) SyncPlacementEmails(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	userID, ok := ctx.Value(auth.UserIDContextKey).(string)
+	userID, ok := ctx.Value(auth.UserIDContextKey).(int)
 	if !ok {
 		http.Error(w, "Unauthorized: No UserID found", http.StatusUnauthorized)
+		return
 	}
 
-	u, err := h.userRepo.FindByID(ctx, userID)
+	u, err := h.userRepo.FindByID(ctx, strconv.Itoa(userID))
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	srv, err := google.CreateGmailService(ctx, u.RefreshToken)
+	mb, err := h.providers.Mailbox(ctx, u)
+	if errors.Is(err, mailbox.ErrReauthRequired) {
+		h.reauthRequired(ctx, w, u)
+		return
+	}
 	if err != nil {
-		log.Printf("Gmail Service Error: %v", err)
-		http.Error(w, "Failed to connect to Gmail", 500)
+		log.Printf("Mailbox Error: %v", err)
+		http.Error(w, "Failed to connect to mailbox", 500)
 		return
 	}
 
-	query := "from:placementoffice@vitbhopal.ac.in OR subject:placement"
-	emails, err := utils.ListPlacementEmails(srv, query, 20)
-	if err != nil {
+	emails, err := utils.ListPlacementEmails(ctx, mb, placementQuery, 20)
+	if errors.Is(err, mailbox.ErrReauthRequired) {
+		h.reauthRequired(ctx, w, u)
+		return
+	}
+	var dropped *mailbox.DroppedError
+	if errors.As(err, &dropped) {
+		// Partial results beat none; the client learns what is missing.
+		log.Printf("sync of user %d: %v", u.ID, err)
+		w.Header().Set("X-Dropped-Messages", strings.Join(dropped.IDs, ","))
+	} else if err != nil {
 		http.Error(w, "Extraction Failed", http.StatusInternalServerError)
 		return
 	}
@@ -77,17 +108,35 @@ func (h *GmailHandler) StreamPlacementEmails(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	srv, err := google.CreateGmailService(ctx, u.RefreshToken)
+	mb, err := h.providers.Mailbox(ctx, u)
+	if errors.Is(err, mailbox.ErrReauthRequired) {
+		// EventSource ignores the body of non-200 responses, so the error
+		// goes out as an event like no_emails_found.
+		h.markReauthRequired(ctx, u)
+		fmt.Fprintf(w, "data: %s\n\n", reauthRequiredBody(u))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to initialize Gmail service", http.StatusUnauthorized)
+		http.Error(w, "Failed to initialize mailbox", http.StatusUnauthorized)
 		return
 	}
 
-	query := r.URL.Query().Get("query")
+	// Users who open the stream get their new mail pushed from now on.
+	if err := h.watches.Ensure(ctx, u, mb); err != nil && !errors.Is(err, mailbox.ErrReauthRequired) {
+		log.Printf("failed to watch mailbox of user %d: %v", u.ID, err)
+	}
+
+	// Only the default query, which push ingestion advances too, keeps a
+	// sync cursor; any other query is searched in full every time, so that
+	// clients cannot pile up cursor rows.
+	query, cursors := r.URL.Query().Get("query"), h.cursors
 	if query == "" {
-		query = "from:placementoffice@vitbhopal.ac.in"
+		query = streamQuery
+	}
+	if query != streamQuery {
+		cursors = nil
 	}
-	emailStream := FetchAndSummarize(ctx, srv, h.userRepo, query, u.ID)
+	emailStream, streamErr := h.summarizer.fetchAndSummarize(ctx, mb, cursors, query, u.ID)
 
 	foundAny := false
 
@@ -102,6 +151,22 @@ func (h *GmailHandler) StreamPlacementEmails(w http.ResponseWriter, r *http.Requ
 		case summary, ok := <-emailStream:
 			if !ok {
 				//channel closed
+				select {
+				case err := <-streamErr:
+					if errors.Is(err, mailbox.ErrReauthRequired) {
+						h.markReauthRequired(ctx, u)
+						fmt.Fprintf(w, "data: %s\n\n", reauthRequiredBody(u))
+						return
+					}
+					var dropped *mailbox.DroppedError
+					if errors.As(err, &dropped) {
+						log.Printf("stream of user %d: %v", u.ID, err)
+						body, _ := json.Marshal(droppedResponse{Error: "messages_dropped", IDs: dropped.IDs, Retryable: dropped.Temporary()})
+						fmt.Fprintf(w, "data: %s\n\n", body)
+						return
+					}
+				default:
+				}
 				if !foundAny {
 					fmt.Fprintf(w, "data: {\"error\": \"no_emails_found\"}\n\n")
 				}
@@ -124,3 +189,242 @@ func (h *GmailHandler) StreamPlacementEmails(w http.ResponseWriter, r *http.Requ
 	}
 
 }
+
+// droppedResponse ends a stream that had to leave messages out. Retryable
+// means opening the stream again later may get them.
+type droppedResponse struct {
+	Error     string   `json:"error"`
+	IDs       []string `json:"ids"`
+	Retryable bool     `json:"retryable"`
+}
+
+type reauthRequiredResponse struct {
+	Error    string `json:"error"`
+	LoginURL string `json:"loginUrl,omitempty"`
+}
+
+// reauthRequiredBody tells the client to send the user through the login of
+// the provider whose grant died. An IMAP app password that stopped working
+// has no login; the user links the account again with a new one.
+func reauthRequiredBody(u *user.User) []byte {
+	if u.IMAP != nil && u.IMAP.Auth == user.IMAPAuthPassword {
+		body, _ := json.Marshal(reauthRequiredResponse{Error: "imap_reauth_required"})
+		return body
+	}
+	body, _ := json.Marshal(reauthRequiredResponse{Error: "reauth_required", LoginURL: provider.LoginURL(u)})
+	return body
+}
+
+func (h *GmailHandler) markReauthRequired(ctx context.Context, u *user.User) {
+	if u.ReauthRequired {
+		return
+	}
+	log.Printf("mailbox grant of user %d was revoked, pausing until they log in again", u.ID)
+	if err := h.userRepo.MarkReauthRequired(ctx, u.ID); err != nil {
+		log.Printf("failed to mark user %d for reauthorization: %v", u.ID, err)
+	}
+}
+
+func (h *GmailHandler) reauthRequired(ctx context.Context, w http.ResponseWriter, u *user.User) {
+	h.markReauthRequired(ctx, u)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(reauthRequiredBody(u))
+}
+
+type backfillRequest struct {
+	Query  string `json:"query"`
+	After  string `json:"after"`
+	Before string `json:"before"`
+}
+
+// StartBackfill summarizes every message matching the query inside the date
+// window in the background, page by page. Dates are YYYY-MM-DD in UTC, before
+// is exclusive, and after defaults to BACKFILL_WINDOW_DAYS ago. Starting the
+// same backfill again after it paused or failed continues where it stopped.
+func (h *GmailHandler) StartBackfill(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, ok := ctx.Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized: No UserID found", http.StatusUnauthorized)
+		return
+	}
+
+	var req backfillRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Query == "" {
+		req.Query = placementQuery
+	}
+	after, err := parseBackfillDate(req.After)
+	if err != nil {
+		http.Error(w, "after must be a YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+	if after == nil {
+		start := backfillWindow(time.Now())
+		after = &start
+	}
+	before, err := parseBackfillDate(req.Before)
+	if err != nil {
+		http.Error(w, "before must be a YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+	if before != nil && !before.After(*after) {
+		http.Error(w, "before must be later than after", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.userRepo.FindByID(ctx, strconv.Itoa(userID))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if _, err := h.providers.Mailbox(ctx, u); errors.Is(err, mailbox.ErrReauthRequired) {
+		h.reauthRequired(ctx, w, u)
+		return
+	} else if err != nil {
+		log.Printf("Mailbox Error: %v", err)
+		http.Error(w, "Failed to connect to mailbox", http.StatusInternalServerError)
+		return
+	}
+
+	job, err := h.backfills.Enqueue(ctx, u.ID, req.Query, after, before)
+	if errors.Is(err, ErrBackfillRunning) {
+		http.Error(w, "a backfill is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to start backfill for user %d: %v", u.ID, err)
+		http.Error(w, "failed to start backfill", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func parseBackfillDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// BackfillStatus reports the progress of the caller's latest backfill.
+func (h *GmailHandler) BackfillStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized: No UserID found", http.StatusUnauthorized)
+		return
+	}
+
+	job, err := h.backfills.Status(r.Context(), userID)
+	if errors.Is(err, ErrBackfillNotFound) {
+		http.Error(w, "no backfill found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load backfill of user %d: %v", userID, err)
+		http.Error(w, "failed to load backfill", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func (h *GmailHandler) CancelBackfill(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized: No UserID found", http.StatusUnauthorized)
+		return
+	}
+
+	job, err := h.backfills.Cancel(r.Context(), userID)
+	if errors.Is(err, ErrBackfillNotFound) {
+		http.Error(w, "no backfill running", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to cancel backfill of user %d: %v", userID, err)
+		http.Error(w, "failed to cancel backfill", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+const (
+	defaultThreadLimit = 50
+	maxThreadLimit     = 200
+)
+
+// ListThreads returns the caller's drives as merged records, the one with
+// the latest mail first. ?limit= caps how many.
+func (h *GmailHandler) ListThreads(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized: No UserID found", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultThreadLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxThreadLimit)
+	}
+
+	threads, err := h.threads.List(r.Context(), userID, limit)
+	if err != nil {
+		log.Printf("failed to list threads of user %d: %v", userID, err)
+		http.Error(w, "failed to list threads", http.StatusInternalServerError)
+		return
+	}
+	records := make([]*ThreadRecord, 0, len(threads))
+	for _, t := range threads {
+		records = append(records, t.Record())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// GetThread returns one of the caller's drives with the timeline of what
+// each of its messages changed.
+func (h *GmailHandler) GetThread(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(auth.UserIDContextKey).(int)
+	if !ok {
+		http.Error(w, "Unauthorized: No UserID found", http.StatusUnauthorized)
+		return
+	}
+
+	t, err := h.threads.Get(r.Context(), userID, r.PathValue("threadId"))
+	if errors.Is(err, ErrThreadNotFound) {
+		http.Error(w, "thread not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to load thread of user %d: %v", userID, err)
+		http.Error(w, "failed to load thread", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Record())
+}
@@ -0,0 +1,388 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresBackfillStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresBackfillStore(db *pgxpool.Pool) *PostgresBackfillStore {
+	return &PostgresBackfillStore{db: db}
+}
+
+const backfillColumns = `id, user_id, query, after_at, before_at, page_token, status,
+	pages, processed, summarized, failed, estimate, error, created_at, updated_at, completed_at`
+
+func scanBackfillJob(row pgx.Row) (*BackfillJob, error) {
+	var job BackfillJob
+	err := row.Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Query,
+		&job.After,
+		&job.Before,
+		&job.PageToken,
+		&job.Status,
+		&job.Pages,
+		&job.Processed,
+		&job.Summarized,
+		&job.Failed,
+		&job.Estimate,
+		&job.Error,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *PostgresBackfillStore) Create(ctx context.Context, job *BackfillJob) error {
+	query := `
+		INSERT INTO backfill_jobs (user_id, query, after_at, before_at, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, updated_at`
+
+	err := s.db.QueryRow(ctx, query, job.UserID, job.Query, job.After, job.Before, job.Status).
+		Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		// backfill_jobs_one_running_idx
+		return ErrBackfillRunning
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create backfill for user %d: %w", job.UserID, err)
+	}
+	return nil
+}
+
+func (s *PostgresBackfillStore) Latest(ctx context.Context, userID int) (*BackfillJob, error) {
+	query := `SELECT ` + backfillColumns + ` FROM backfill_jobs
+		WHERE user_id = $1 ORDER BY id DESC LIMIT 1`
+
+	job, err := scanBackfillJob(s.db.QueryRow(ctx, query, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrBackfillNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find backfill of user %d: %w", userID, err)
+	}
+	return job, nil
+}
+
+func (s *PostgresBackfillStore) ListRunning(ctx context.Context) ([]*BackfillJob, error) {
+	query := `SELECT ` + backfillColumns + ` FROM backfill_jobs WHERE status = 'running' ORDER BY id`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running backfills: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*BackfillJob{}
+	for rows.Next() {
+		job, err := scanBackfillJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan backfill: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *PostgresBackfillStore) SaveProgress(ctx context.Context, job *BackfillJob) error {
+	query := `
+		UPDATE backfill_jobs
+		SET page_token = $2, pages = $3, processed = $4, summarized = $5, failed = $6, estimate = $7, updated_at = NOW()
+		WHERE id = $1 AND status = 'running'`
+
+	tag, err := s.db.Exec(ctx, query,
+		job.ID,
+		job.PageToken,
+		job.Pages,
+		job.Processed,
+		job.Summarized,
+		job.Failed,
+		job.Estimate,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save progress of backfill %d: %w", job.ID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrBackfillNotFound
+	}
+	return nil
+}
+
+func (s *PostgresBackfillStore) SetStatus(ctx context.Context, id int, status BackfillStatus, errMsg string) error {
+	query := `
+		UPDATE backfill_jobs
+		SET status = $2, error = $3, updated_at = NOW(),
+			completed_at = CASE WHEN $2 = 'completed' THEN NOW() ELSE NULL END
+		WHERE id = $1`
+
+	tag, err := s.db.Exec(ctx, query, id, status, errMsg)
+	if err != nil {
+		return fmt.Errorf("failed to set status of backfill %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrBackfillNotFound
+	}
+	return nil
+}
+
+type PostgresSyncCursorStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresSyncCursorStore(db *pgxpool.Pool) *PostgresSyncCursorStore {
+	return &PostgresSyncCursorStore{db: db}
+}
+
+func (s *PostgresSyncCursorStore) Get(ctx context.Context, userID int, query string) (*SyncCursor, error) {
+	q := `SELECT cursor, recent_ids, updated_at FROM sync_cursors WHERE user_id = $1 AND query = $2`
+
+	c := &SyncCursor{UserID: userID, Query: query}
+	err := s.db.QueryRow(ctx, q, userID, query).Scan(&c.Cursor, &c.RecentIDs, &c.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSyncCursorNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sync cursor of user %d: %w", userID, err)
+	}
+	return c, nil
+}
+
+func (s *PostgresSyncCursorStore) Save(ctx context.Context, c *SyncCursor) error {
+	q := `
+		INSERT INTO sync_cursors (user_id, query, cursor, recent_ids)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, query) DO UPDATE
+		SET cursor = EXCLUDED.cursor, recent_ids = EXCLUDED.recent_ids, updated_at = NOW()`
+
+	if _, err := s.db.Exec(ctx, q, c.UserID, c.Query, c.Cursor, c.RecentIDs); err != nil {
+		return fmt.Errorf("failed to save sync cursor of user %d: %w", c.UserID, err)
+	}
+	return nil
+}
+
+type PostgresWatchStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresWatchStore(db *pgxpool.Pool) *PostgresWatchStore {
+	return &PostgresWatchStore{db: db}
+}
+
+const watchColumns = `user_id, email_address, expires_at`
+
+func scanWatch(row pgx.Row) (*Watch, error) {
+	var w Watch
+	if err := row.Scan(&w.UserID, &w.EmailAddress, &w.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (s *PostgresWatchStore) Save(ctx context.Context, w *Watch) error {
+	query := `
+		INSERT INTO gmail_watches (user_id, email_address, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET email_address = EXCLUDED.email_address, expires_at = EXCLUDED.expires_at,
+			updated_at = NOW()`
+
+	if _, err := s.db.Exec(ctx, query, w.UserID, w.EmailAddress, w.ExpiresAt); err != nil {
+		return fmt.Errorf("failed to save gmail watch of user %d: %w", w.UserID, err)
+	}
+	return nil
+}
+
+func (s *PostgresWatchStore) Get(ctx context.Context, userID int) (*Watch, error) {
+	query := `SELECT ` + watchColumns + ` FROM gmail_watches WHERE user_id = $1`
+
+	w, err := scanWatch(s.db.QueryRow(ctx, query, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWatchNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find gmail watch of user %d: %w", userID, err)
+	}
+	return w, nil
+}
+
+func (s *PostgresWatchStore) FindByEmail(ctx context.Context, email string) (*Watch, error) {
+	query := `SELECT ` + watchColumns + ` FROM gmail_watches WHERE email_address = $1`
+
+	w, err := scanWatch(s.db.QueryRow(ctx, query, email))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWatchNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find gmail watch: %w", err)
+	}
+	return w, nil
+}
+
+func (s *PostgresWatchStore) ListExpiring(ctx context.Context, t time.Time) ([]*Watch, error) {
+	query := `SELECT ` + watchColumns + ` FROM gmail_watches WHERE expires_at < $1 ORDER BY expires_at`
+
+	rows, err := s.db.Query(ctx, query, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expiring gmail watches: %w", err)
+	}
+	defer rows.Close()
+
+	watches := []*Watch{}
+	for rows.Next() {
+		w, err := scanWatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan gmail watch: %w", err)
+		}
+		watches = append(watches, w)
+	}
+	return watches, rows.Err()
+}
+
+func (s *PostgresWatchStore) Delete(ctx context.Context, userID int) error {
+	if _, err := s.db.Exec(ctx, `DELETE FROM gmail_watches WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete gmail watch of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+type PostgresAttachmentStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresAttachmentStore(db *pgxpool.Pool) *PostgresAttachmentStore {
+	return &PostgresAttachmentStore{db: db}
+}
+
+func (s *PostgresAttachmentStore) Save(ctx context.Context, a *StoredAttachment) error {
+	query := `
+		INSERT INTO email_attachments (user_id, message_id, position, filename, mime_type, size, content, text, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id, message_id, position) DO UPDATE
+		SET filename = EXCLUDED.filename, mime_type = EXCLUDED.mime_type, size = EXCLUDED.size,
+			content = EXCLUDED.content, text = EXCLUDED.text, error = EXCLUDED.error, updated_at = NOW()`
+
+	_, err := s.db.Exec(ctx, query, a.UserID, a.MessageID, a.Position, a.Filename, a.MimeType, a.Size, a.Content, a.Text, a.Error)
+	if err != nil {
+		return fmt.Errorf("failed to save attachment of message %s: %w", a.MessageID, err)
+	}
+	return nil
+}
+
+type PostgresThreadStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresThreadStore(db *pgxpool.Pool) *PostgresThreadStore {
+	return &PostgresThreadStore{db: db}
+}
+
+// Update locks the thread's row for the transaction, so concurrent updates
+// of the same thread apply one after the other.
+func (s *PostgresThreadStore) Update(ctx context.Context, userID int, threadID string, fn func(*Thread)) (*Thread, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start update of thread %s: %w", threadID, err)
+	}
+	defer tx.Rollback(ctx)
+
+	insertQuery := `INSERT INTO email_threads (user_id, thread_id) VALUES ($1, $2)
+		ON CONFLICT (user_id, thread_id) DO NOTHING`
+	if _, err := tx.Exec(ctx, insertQuery, userID, threadID); err != nil {
+		return nil, fmt.Errorf("failed to create thread %s: %w", threadID, err)
+	}
+
+	selectQuery := `SELECT user_id, thread_id, messages, updated_at FROM email_threads
+		WHERE user_id = $1 AND thread_id = $2 FOR UPDATE`
+	t, err := scanThread(tx.QueryRow(ctx, selectQuery, userID, threadID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock thread %s: %w", threadID, err)
+	}
+
+	fn(t)
+	messages, err := json.Marshal(t.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal thread %s: %w", threadID, err)
+	}
+	var latest *time.Time
+	if n := len(t.Messages); n > 0 {
+		latest = &t.Messages[n-1].Date
+	}
+	updateQuery := `UPDATE email_threads SET messages = $3, latest_at = $4, updated_at = NOW()
+		WHERE user_id = $1 AND thread_id = $2
+		RETURNING updated_at`
+	if err := tx.QueryRow(ctx, updateQuery, userID, threadID, messages, latest).Scan(&t.UpdatedAt); err != nil {
+		return nil, fmt.Errorf("failed to save thread %s: %w", threadID, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit thread %s: %w", threadID, err)
+	}
+	return t, nil
+}
+
+func (s *PostgresThreadStore) Get(ctx context.Context, userID int, threadID string) (*Thread, error) {
+	query := `SELECT user_id, thread_id, messages, updated_at FROM email_threads
+		WHERE user_id = $1 AND thread_id = $2`
+
+	t, err := scanThread(s.db.QueryRow(ctx, query, userID, threadID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrThreadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find thread %s: %w", threadID, err)
+	}
+	return t, nil
+}
+
+func (s *PostgresThreadStore) List(ctx context.Context, userID int, limit int) ([]*Thread, error) {
+	query := `SELECT user_id, thread_id, messages, updated_at FROM email_threads
+		WHERE user_id = $1
+		ORDER BY latest_at DESC NULLS LAST
+		LIMIT $2`
+
+	rows, err := s.db.Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list threads of user %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	threads := []*Thread{}
+	for rows.Next() {
+		t, err := scanThread(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan thread: %w", err)
+		}
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
+
+func scanThread(row pgx.Row) (*Thread, error) {
+	var t Thread
+	var messages []byte
+	if err := row.Scan(&t.UserID, &t.ThreadID, &messages, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(messages, &t.Messages); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal thread %s: %w", t.ThreadID, err)
+	}
+	return &t, nil
+}
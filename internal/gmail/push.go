@@ -0,0 +1,178 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+// PushConfig describes how Pub/Sub authenticates its push requests: an OIDC
+// token signed by Google for Audience on behalf of ServiceAccount.
+type PushConfig struct {
+	Audience       string
+	ServiceAccount string
+}
+
+// LoadPushConfig reads PUBSUB_PUSH_AUDIENCE and PUBSUB_PUSH_SERVICE_ACCOUNT.
+// Push is disabled while the audience is unset.
+func LoadPushConfig() PushConfig {
+	return PushConfig{
+		Audience:       os.Getenv("PUBSUB_PUSH_AUDIENCE"),
+		ServiceAccount: os.Getenv("PUBSUB_PUSH_SERVICE_ACCOUNT"),
+	}
+}
+
+func (c PushConfig) Enabled() bool {
+	return c.Audience != ""
+}
+
+// PushVerifier checks the OIDC tokens Pub/Sub attaches to push requests.
+// The idtoken validator checks the signature against Google's published
+// keys, which it caches as long as Google allows, and the audience and
+// expiry; the issuer and service account are checked here.
+type PushVerifier struct {
+	cfg       PushConfig
+	validator *idtoken.Validator
+}
+
+func NewPushVerifier(ctx context.Context, cfg PushConfig) (*PushVerifier, error) {
+	validator, err := idtoken.NewValidator(ctx, option.WithHTTPClient(&http.Client{Timeout: 10 * time.Second}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create push token validator: %w", err)
+	}
+	return &PushVerifier{cfg: cfg, validator: validator}, nil
+}
+
+func (v *PushVerifier) Verify(ctx context.Context, token string) error {
+	payload, err := v.validator.Validate(ctx, token, v.cfg.Audience)
+	if err != nil {
+		return fmt.Errorf("invalid push token: %w", err)
+	}
+
+	if iss := payload.Issuer; iss != "https://accounts.google.com" && iss != "accounts.google.com" {
+		return fmt.Errorf("invalid push token issuer %q", iss)
+	}
+	if v.cfg.ServiceAccount == "" {
+		return nil
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if email != v.cfg.ServiceAccount || !verified {
+		return fmt.Errorf("push token is for %q, not the configured service account", email)
+	}
+	return nil
+}
+
+// pushEnvelope is the body of a Pub/Sub push request.
+type pushEnvelope struct {
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// gmailNotification is what Gmail publishes when a watched mailbox changes.
+// HistoryID is the mailbox's history ID after the change.
+type gmailNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// SyncQueue takes users whose mailbox changed.
+type SyncQueue interface {
+	Enqueue(userID int)
+}
+
+type PushHandler struct {
+	verifier *PushVerifier
+	watches  WatchStore
+	cursors  SyncCursorStore
+	queue    SyncQueue
+}
+
+func NewPushHandler(verifier *PushVerifier, watches WatchStore, cursors SyncCursorStore, queue SyncQueue) *PushHandler {
+	return &PushHandler{verifier: verifier, watches: watches, cursors: cursors, queue: queue}
+}
+
+// Push receives Gmail change notifications from a Pub/Sub push subscription.
+// Anything that is authenticated is acknowledged with 204, including
+// notifications that cannot be used, because Pub/Sub redelivers every
+// other answer.
+func (h *PushHandler) Push(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "missing push token", http.StatusUnauthorized)
+		return
+	}
+	if err := h.verifier.Verify(r.Context(), token); err != nil {
+		log.Printf("rejected gmail push: %v", err)
+		http.Error(w, "invalid push token", http.StatusUnauthorized)
+		return
+	}
+
+	var env pushEnvelope
+	var note gmailNotification
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&env); err != nil {
+		log.Printf("ignoring malformed gmail push: %v", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Message.Data)
+	if err == nil {
+		err = json.Unmarshal(data, &note)
+	}
+	if err != nil || note.EmailAddress == "" {
+		log.Printf("ignoring gmail push %s without a notification: %v", env.Message.MessageID, err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	watch, err := h.watches.FindByEmail(r.Context(), strings.ToLower(note.EmailAddress))
+	if errors.Is(err, ErrWatchNotFound) {
+		// A watch of a deleted account that has not expired yet.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to look up gmail watch: %v", err)
+		http.Error(w, "failed to look up watch", http.StatusInternalServerError)
+		return
+	}
+
+	if h.seen(r.Context(), watch.UserID, note.HistoryID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.queue.Enqueue(watch.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// seen reports whether the user's last sync already got past historyID, as
+// it has for redeliveries and notifications that arrive out of order. When
+// in doubt the sync runs.
+func (h *PushHandler) seen(ctx context.Context, userID int, historyID uint64) bool {
+	if historyID == 0 {
+		return false
+	}
+	state, err := h.cursors.Get(ctx, userID, streamQuery)
+	if err != nil {
+		if !errors.Is(err, ErrSyncCursorNotFound) {
+			log.Printf("failed to read sync cursor of user %d: %v", userID, err)
+		}
+		return false
+	}
+	synced, err := strconv.ParseUint(state.Cursor, 10, 64)
+	return err == nil && historyID <= synced
+}
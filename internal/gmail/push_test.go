@@ -0,0 +1,353 @@
+package gmail
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+const (
+	testPushAudience       = "https://auramail.example/gmail/push"
+	testPushServiceAccount = "pubsub-push@auramail.iam.gserviceaccount.com"
+)
+
+// fakePushSender plays Pub/Sub: it publishes its signing key like Google's
+// certs endpoint and posts Gmail notifications with an OIDC token.
+type fakePushSender struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newFakePushSender(t *testing.T) *fakePushSender {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakePushSender{key: key}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "push-key",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// verifier checks tokens against the sender's key by sending the requests
+// for Google's certs to the sender.
+func (s *fakePushSender) verifier(t *testing.T) *PushVerifier {
+	target, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	validator, err := idtoken.NewValidator(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PushVerifier{cfg: PushConfig{Audience: testPushAudience, ServiceAccount: testPushServiceAccount}, validator: validator}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// pushClaims are the claims of a Pub/Sub push token, with aud a single
+// string as Google sends it.
+type pushClaims struct {
+	Issuer        string
+	Audience      string
+	Email         string
+	EmailVerified bool
+	ExpiresAt     time.Time
+}
+
+func (s *fakePushSender) token(t *testing.T, key *rsa.PrivateKey, edit func(*pushClaims)) string {
+	claims := &pushClaims{
+		Issuer:        "https://accounts.google.com",
+		Audience:      testPushAudience,
+		Email:         testPushServiceAccount,
+		EmailVerified: true,
+		ExpiresAt:     time.Now().Add(time.Hour),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            claims.Issuer,
+		"aud":            claims.Audience,
+		"email":          claims.Email,
+		"email_verified": claims.EmailVerified,
+		"iat":            time.Now().Unix(),
+		"exp":            claims.ExpiresAt.Unix(),
+	})
+	token.Header["kid"] = "push-key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (s *fakePushSender) send(h http.HandlerFunc, token, email string, historyID uint64) int {
+	data, _ := json.Marshal(map[string]any{"emailAddress": email, "historyId": historyID})
+	body, _ := json.Marshal(map[string]any{
+		"message":      map[string]string{"data": base64.StdEncoding.EncodeToString(data), "messageId": "1"},
+		"subscription": "projects/auramail/subscriptions/gmail-push",
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/gmail/push", strings.NewReader(string(body)))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec.Code
+}
+
+type memoryWatchStore struct {
+	mu      sync.Mutex
+	watches map[int]*Watch
+}
+
+func (s *memoryWatchStore) Save(ctx context.Context, w *Watch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *w
+	s.watches[w.UserID] = &copied
+	return nil
+}
+
+func (s *memoryWatchStore) Get(ctx context.Context, userID int) (*Watch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w, ok := s.watches[userID]; ok {
+		return w, nil
+	}
+	return nil, ErrWatchNotFound
+}
+
+func (s *memoryWatchStore) FindByEmail(ctx context.Context, email string) (*Watch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.watches {
+		if w.EmailAddress == email {
+			return w, nil
+		}
+	}
+	return nil, ErrWatchNotFound
+}
+
+func (s *memoryWatchStore) ListExpiring(ctx context.Context, t time.Time) ([]*Watch, error) {
+	return nil, nil
+}
+
+func (s *memoryWatchStore) Delete(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watches, userID)
+	return nil
+}
+
+type recordingQueue struct {
+	users []int
+}
+
+func (q *recordingQueue) Enqueue(userID int) {
+	q.users = append(q.users, userID)
+}
+
+func TestPushEnqueuesSync(t *testing.T) {
+	sender := newFakePushSender(t)
+	watches := &memoryWatchStore{watches: map[int]*Watch{
+		7: {UserID: 7, EmailAddress: "student@vitbhopal.ac.in", ExpiresAt: time.Now().Add(time.Hour)},
+	}}
+	queue := &recordingQueue{}
+	h := NewPushHandler(sender.verifier(t), watches, memorySyncCursorStore{}, queue)
+
+	token := sender.token(t, sender.key, nil)
+	if code := sender.send(h.Push, token, "Student@vitbhopal.ac.in", 1234); code != http.StatusNoContent {
+		t.Fatalf("push = %d, want 204", code)
+	}
+	if code := sender.send(h.Push, token, "someone-else@vitbhopal.ac.in", 99); code != http.StatusNoContent {
+		t.Fatalf("push for an unwatched mailbox = %d, want 204", code)
+	}
+	if len(queue.users) != 1 || queue.users[0] != 7 {
+		t.Errorf("queued syncs = %v, want [7]", queue.users)
+	}
+}
+
+func TestPushSkipsSyncedHistory(t *testing.T) {
+	sender := newFakePushSender(t)
+	watches := &memoryWatchStore{watches: map[int]*Watch{7: {UserID: 7, EmailAddress: "student@vitbhopal.ac.in"}}}
+	cursors := memorySyncCursorStore{}
+	cursors.Save(context.Background(), &SyncCursor{UserID: 7, Query: streamQuery, Cursor: "1234"})
+	queue := &recordingQueue{}
+	h := NewPushHandler(sender.verifier(t), watches, cursors, queue)
+
+	token := sender.token(t, sender.key, nil)
+	for _, historyID := range []uint64{1200, 1234, 1235} {
+		if code := sender.send(h.Push, token, "student@vitbhopal.ac.in", historyID); code != http.StatusNoContent {
+			t.Fatalf("push of history %d = %d, want 204", historyID, code)
+		}
+	}
+	if len(queue.users) != 1 {
+		t.Errorf("queued syncs = %v, want only the one past the cursor", queue.users)
+	}
+}
+
+func TestPushRejectsBadTokens(t *testing.T) {
+	sender := newFakePushSender(t)
+	watches := &memoryWatchStore{watches: map[int]*Watch{7: {UserID: 7, EmailAddress: "student@vitbhopal.ac.in"}}}
+	queue := &recordingQueue{}
+	h := NewPushHandler(sender.verifier(t), watches, memorySyncCursorStore{}, queue)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"missing", ""},
+		{"wrong audience", sender.token(t, sender.key, func(c *pushClaims) { c.Audience = "https://other.example" })},
+		{"wrong issuer", sender.token(t, sender.key, func(c *pushClaims) { c.Issuer = "https://evil.example" })},
+		{"wrong service account", sender.token(t, sender.key, func(c *pushClaims) { c.Email = "attacker@example.com" })},
+		{"unverified email", sender.token(t, sender.key, func(c *pushClaims) { c.EmailVerified = false })},
+		{"expired", sender.token(t, sender.key, func(c *pushClaims) { c.ExpiresAt = time.Now().Add(-time.Minute) })},
+		{"not signed by google", sender.token(t, otherKey, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := sender.send(h.Push, tt.token, "student@vitbhopal.ac.in", 1); code != http.StatusUnauthorized {
+				t.Errorf("push = %d, want 401", code)
+			}
+		})
+	}
+	if len(queue.users) != 0 {
+		t.Errorf("rejected pushes queued syncs %v", queue.users)
+	}
+}
+
+func TestIngesterCoalescesNotifications(t *testing.T) {
+	in := &Ingester{queue: make(chan int, 10), pending: map[int]bool{}}
+
+	in.Enqueue(7)
+	in.Enqueue(7)
+	in.Enqueue(8)
+	if len(in.queue) != 2 {
+		t.Fatalf("queued %d syncs, want 2", len(in.queue))
+	}
+
+	// The second notification of user 7 arrived while the first was queued,
+	// so finishing that sync schedules exactly one more.
+	<-in.queue
+	<-in.queue
+	in.done(7)
+	in.done(8)
+	if len(in.queue) != 1 || <-in.queue != 7 {
+		t.Error("expected one more sync of user 7")
+	}
+}
+
+func TestIngesterCloseFinishesQueuedSyncs(t *testing.T) {
+	repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{}}
+	in := &Ingester{
+		summarizer: testSummarizer(repo),
+		providers:  fakeMailboxSource{&fakeMailbox{}},
+		queue:      make(chan int, 10),
+		pending:    map[int]bool{},
+		stop:       make(chan struct{}),
+	}
+	var mu sync.Mutex
+	synced := map[int]bool{}
+	in.analyze = func(ctx context.Context, userID int, subject, snippet, body string, attachments []ai.Attachment) (*ai.AIResult, error) {
+		mu.Lock()
+		synced[userID] = true
+		mu.Unlock()
+		return nil, errors.New("not summarized, so the next user fetches too")
+	}
+
+	in.Enqueue(7)
+	in.Enqueue(8)
+	in.Enqueue(7)
+	in.Start(context.Background(), 1)
+	in.Close()
+
+	if !synced[7] || !synced[8] || len(in.queue) != 0 || len(in.pending) != 0 {
+		t.Errorf("synced %v with %d still queued, want every queued sync run before Close returns", synced, len(in.queue))
+	}
+}
+
+type watchingMailbox struct {
+	fakeMailbox
+	watches int
+}
+
+func (m *watchingMailbox) Watch(ctx context.Context, topic string) (time.Time, error) {
+	m.watches++
+	if topic != "projects/auramail/topics/gmail" {
+		return time.Time{}, fmt.Errorf("unexpected topic %q", topic)
+	}
+	return time.Now().Add(7 * 24 * time.Hour), nil
+}
+
+func TestWatchManagerEnsure(t *testing.T) {
+	t.Setenv("GMAIL_PUBSUB_TOPIC", "projects/auramail/topics/gmail")
+	ctx := context.Background()
+	store := &memoryWatchStore{watches: map[int]*Watch{}}
+	m := &WatchManager{watches: store}
+	u := &user.User{ID: 7, Email: "Student@vitbhopal.ac.in"}
+	mb := &watchingMailbox{}
+
+	for range 2 {
+		if err := m.Ensure(ctx, u, mb); err != nil {
+			t.Fatalf("Ensure: %v", err)
+		}
+	}
+	if mb.watches != 1 {
+		t.Errorf("registered %d watches, want 1", mb.watches)
+	}
+	if w := store.watches[7]; w == nil || w.EmailAddress != "student@vitbhopal.ac.in" {
+		t.Errorf("unexpected watch %+v", w)
+	}
+
+	// A watch that is due for renewal is registered again.
+	store.watches[7].ExpiresAt = time.Now().Add(24 * time.Hour)
+	if err := m.Ensure(ctx, u, mb); err != nil {
+		t.Fatalf("Ensure: %v", err)
+	}
+	if mb.watches != 2 {
+		t.Errorf("registered %d watches, want 2", mb.watches)
+	}
+
+	// Mailboxes that cannot push are left alone.
+	if err := m.Ensure(ctx, u, &fakeMailbox{}); err != nil {
+		t.Errorf("Ensure without push support: %v", err)
+	}
+}
@@ -2,93 +2,50 @@ package gmail
 
 import (
 	"context"
+	"errors"
 	"log"
-	"sync"
-
-	"google.golang.org/api/gmail/v1"
 
 	"github.com/r7rainz/auramail/internal/ai"
-	"github.com/r7rainz/auramail/internal/user"
-	"github.com/r7rainz/auramail/internal/utils"
+	"github.com/r7rainz/auramail/internal/mailbox"
 )
 
-func FetchAndSummarize(ctx context.Context, srv *gmail.Service,repo *user.PostgresRepository, query string, userID int) chan *ai.AIResult {
+// fetchAndSummarize streams summaries of the newest messages matching query
+// on the first channel; recentMessageIDs finds them and summarize does the
+// rest, so what is sent is each message's thread as merged so far and a
+// client keeps the latest one per threadId. If the stream ends because the
+// provider revoked the grant, mailbox.ErrReauthRequired is sent on the second
+// one before the first is closed. Otherwise, if some messages could not be
+// fetched, a *mailbox.DroppedError listing them is sent there.
+func (s *summarizer) fetchAndSummarize(ctx context.Context, mb mailbox.Mailbox, cursors SyncCursorStore, query string, userID int) (chan *ai.AIResult, <-chan error) {
 	out := make(chan *ai.AIResult)
+	errc := make(chan error, 1)
 
 	go func() {
 		defer close(out)
 
-		// 1. Safety check: Ensure list is not nil
-		list, err := srv.Users.Messages.List("me").Q(query).MaxResults(10).Do()
-		if err != nil || list == nil || len(list.Messages) == 0 {
-			log.Printf("No messages found or error: %v", err)
+		ids, err := recentMessageIDs(ctx, mb, cursors, userID, query, 10)
+		if err == nil && len(ids) == 0 {
 			return
 		}
-
-		var wg sync.WaitGroup
-		jobs := make(chan string, len(list.Messages))
-
-		// 2. Start workers
-		workerCount := 5 // 10 might hit OpenAI rate limits too fast, 5 is safer
-		for i := 0; i < workerCount; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				for id := range jobs {
-					//checking db first
-					cached, err := repo.GetSummary(ctx, id)
-					if err == nil && cached != nil {
-						select{
-						case <-ctx.Done(): return
-					case out <-cached: continue
-						}
-					}
-
-					msg, err := srv.Users.Messages.Get("me", id).Format("full").Do()
-					if err != nil {
-						continue
-					}
-					
-					subject := ""
-					for _, h := range msg.Payload.Headers {
-						if h.Name == "Subject" {
-							subject = h.Value
-						}
-					}
-
-					body := utils.ParseBody(msg.Payload)
-
-					// 3. Summarize and Validate
-					summary, err := ai.AnalyzeEmail(ctx, userID, subject, msg.Snippet, body)
-					if err != nil || summary == nil {
-						log.Printf("Skipping empty summary for %s: %v", id, err)
-						continue
-					}
-
-					err = repo.SaveSummary(ctx, userID, id, summary)
-					if err != nil{
-						log.Printf("Error saving summary to DB: %v", err)
-					}
-					
-					// Only send if we have a valid result
-					select {
-					case <-ctx.Done():
-						return
-					case out <- summary:
-					}
+		var b batch
+		if err == nil {
+			b, err = s.summarize(ctx, mb, userID, ids, func(summary *ai.AIResult) {
+				select {
+				case <-ctx.Done():
+				case out <- summary:
 				}
-			}()
+			})
 		}
 
-		// 4. Feed the jobs
-		for _, m := range list.Messages {
-			jobs <- m.Id
+		switch {
+		case errors.Is(err, mailbox.ErrReauthRequired):
+			errc <- err
+		case err != nil:
+			log.Printf("stream of user %d stopped: %v", userID, err)
+		case b.dropped != nil:
+			errc <- b.dropped
 		}
-		close(jobs)
-		
-		// 5. Wait for completion
-		wg.Wait()
 	}()
 
-	return out
+	return out, errc
 }
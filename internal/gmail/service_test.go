@@ -0,0 +1,60 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+func TestFetchAndSummarizeStreamsThreads(t *testing.T) {
+	repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{
+		"m1": {Summary: "Contoso drive", Deadline: ptr("2026-03-05"), ThreadID: "t1"},
+	}}
+	s := testSummarizer(repo)
+	s.analyze = func(ctx context.Context, userID int, subject, snippet, body string, attachments []ai.Attachment) (*ai.AIResult, error) {
+		return &ai.AIResult{Summary: subject, Deadline: ptr("2026-03-08")}, nil
+	}
+	msg, _ := (&threadMailbox{}).Fetch(context.Background(), "m1")
+	if _, err := addToThread(context.Background(), s.threads, 7, msg, repo.summaries["m1"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// fakeMailbox finds m1 and m2, which threadMailbox puts in one thread.
+	out, errc := s.fetchAndSummarize(context.Background(), &threadMailbox{}, nil, placementQuery, 7)
+	var got []*ai.AIResult
+	for summary := range out {
+		got = append(got, summary)
+	}
+	if len(got) != 2 {
+		t.Fatalf("streamed %d summaries, want 2", len(got))
+	}
+	if got[0].ThreadID != "t1" || *got[0].Deadline != "2026-03-05" {
+		t.Errorf("first event = %+v, want the stored thread", got[0])
+	}
+	if got[1].ThreadID != "t1" || *got[1].Deadline != "2026-03-08" || got[1].Summary != "Re: Contoso drive" {
+		t.Errorf("second event = %+v, want the thread merged with the reply", got[1])
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("stream error = %v", err)
+	default:
+	}
+}
+
+func TestFetchAndSummarizeReauth(t *testing.T) {
+	repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{}}
+	s := testSummarizer(repo)
+
+	out, errc := s.fetchAndSummarize(context.Background(), &fakeMailbox{revoked: "m2"}, nil, placementQuery, 7)
+	for range out {
+	}
+	if err := <-errc; !errors.Is(err, mailbox.ErrReauthRequired) {
+		t.Errorf("stream error = %v, want ErrReauthRequired", err)
+	}
+	if len(repo.summaries) != 0 {
+		t.Errorf("saved %d summaries after the grant was revoked", len(repo.summaries))
+	}
+}
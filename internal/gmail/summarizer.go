@@ -0,0 +1,161 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+const summarizeWorkers = 5
+
+type summaryRepository interface {
+	FindByID(ctx context.Context, id string) (*user.User, error)
+	MarkReauthRequired(ctx context.Context, userID int) error
+	GetSummary(ctx context.Context, gmailID string) (*ai.AIResult, error)
+	SaveSummary(ctx context.Context, userID int, gmailID string, res *ai.AIResult) error
+}
+
+// summarizer is the pipeline every path into the summaries shares: the
+// stream, backfills and push ingestion.
+type summarizer struct {
+	users       summaryRepository
+	attachments AttachmentStore
+	threads     ThreadStore
+	analyze     func(ctx context.Context, userID int, subject, snippet, body string, attachments []ai.Attachment) (*ai.AIResult, error)
+}
+
+// batch is how a call to summarize went. Messages that could not be fetched
+// count as failed and are listed in dropped as well.
+type batch struct {
+	summarized, failed int
+	dropped            error // a *mailbox.DroppedError, or nil
+}
+
+// summarize stores a summary for each of ids that has none yet, merges it
+// into the message's thread and reports how many it added and how many
+// failed. The messages are fetched together up front. A message that cannot
+// be fetched, have its attachments downloaded or be summarized is counted as
+// failed and skipped; only a revoked grant or cancellation aborts the batch.
+//
+// If emit is not nil it gets the merged summary of the thread of every
+// message: of those summarized earlier once per thread, before any fetching,
+// and of the others as they are done. It is called from several goroutines.
+func (s *summarizer) summarize(ctx context.Context, mb mailbox.Mailbox, userID int, ids []string, emit func(*ai.AIResult)) (batch, error) {
+	var pending []string
+	served := map[string]bool{} // threads already emitted
+	for _, id := range ids {
+		cached, err := s.users.GetSummary(ctx, id)
+		if err != nil || cached == nil {
+			pending = append(pending, id)
+			continue
+		}
+		if emit == nil || served[cached.ThreadID] {
+			continue
+		}
+		if cached.ThreadID != "" {
+			served[cached.ThreadID] = true
+			// Summaries stored before threads existed have none.
+			if t, err := s.threads.Get(ctx, userID, cached.ThreadID); err == nil {
+				cached = t.Record().Summary
+			}
+		}
+		emit(cached)
+	}
+
+	msgs, errs := mailbox.FetchAll(ctx, mb, pending, summarizeWorkers)
+	var summarized, failed atomic.Int64
+	for _, err := range errs {
+		if errors.Is(err, mailbox.ErrReauthRequired) {
+			return batch{}, mailbox.ErrReauthRequired
+		}
+		if err != nil {
+			failed.Add(1)
+		}
+	}
+
+	jobs := make(chan *mailbox.Message)
+	var reauth atomic.Bool
+	var wg sync.WaitGroup
+	for range summarizeWorkers {
+		wg.Go(func() {
+			for msg := range jobs {
+				if reauth.Load() {
+					continue
+				}
+				attachments, err := readAttachments(ctx, mb, s.attachments, userID, msg)
+				if errors.Is(err, mailbox.ErrReauthRequired) {
+					reauth.Store(true)
+					continue
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Skipping %s: %v", msg.ID, err)
+					}
+					failed.Add(1)
+					continue
+				}
+				summary, err := s.analyze(ctx, userID, msg.Subject, msg.Snippet, msg.Body, attachments)
+				if err != nil || summary == nil {
+					log.Printf("Skipping empty summary for %s: %v", msg.ID, err)
+					failed.Add(1)
+					continue
+				}
+				// The summary may be shared with other callers through the AI
+				// cache, so the thread goes on a copy.
+				result := *summary
+				result.ThreadID = threadOf(msg)
+				summary = &result
+				if err := s.users.SaveSummary(ctx, userID, msg.ID, summary); err != nil {
+					log.Printf("Error saving summary to DB: %v", err)
+					failed.Add(1)
+					continue
+				}
+				summarized.Add(1)
+
+				rec, err := addToThread(ctx, s.threads, userID, msg, summary)
+				if err != nil {
+					log.Printf("Error merging summary into its thread: %v", err)
+				}
+				if emit == nil {
+					continue
+				}
+				if rec != nil {
+					summary = rec.Summary
+				}
+				emit(summary)
+			}
+		})
+	}
+
+feed:
+	for i, msg := range msgs {
+		if errs[i] != nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- msg:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if reauth.Load() {
+		return batch{}, mailbox.ErrReauthRequired
+	}
+	if err := ctx.Err(); err != nil {
+		return batch{}, err
+	}
+	return batch{
+		summarized: int(summarized.Load()),
+		failed:     int(failed.Load()),
+		dropped:    mailbox.Dropped(pending, errs),
+	}, nil
+}
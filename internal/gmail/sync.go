@@ -0,0 +1,125 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+// maxIncrementalAdds caps how many new messages an incremental sync checks
+// against the query in one search; past that a full resync is cheaper.
+const maxIncrementalAdds = 500
+
+var ErrSyncCursorNotFound = errors.New("sync cursor not found")
+
+// SyncCursor remembers where the last sync of Query stopped in the user's
+// mailbox change log and which messages it showed.
+type SyncCursor struct {
+	UserID    int
+	Query     string
+	Cursor    string
+	RecentIDs []string
+	UpdatedAt time.Time
+}
+
+type SyncCursorStore interface {
+	// Get returns ErrSyncCursorNotFound if the query was never synced.
+	Get(ctx context.Context, userID int, query string) (*SyncCursor, error)
+
+	Save(ctx context.Context, cursor *SyncCursor) error
+}
+
+// recentMessageIDs returns the IDs of the newest max messages matching query.
+// Mailboxes with a change feed only report what was added since the stored
+// cursor, so a sync where nothing arrived costs a single history call; the
+// rest, and every mailbox if cursors is nil, are searched every time.
+func recentMessageIDs(ctx context.Context, mb mailbox.Mailbox, cursors SyncCursorStore, userID int, query string, max int) ([]string, error) {
+	feed, ok := mb.(mailbox.ChangeFeed)
+	if !ok || cursors == nil {
+		return mb.Search(ctx, query, max)
+	}
+
+	state, err := cursors.Get(ctx, userID, query)
+	switch {
+	case err == nil:
+		ids, err := incrementalSync(ctx, mb, feed, state, max)
+		if err == nil {
+			saveSyncCursor(ctx, cursors, state)
+			return ids, nil
+		}
+		if !errors.Is(err, mailbox.ErrCursorExpired) {
+			return nil, err
+		}
+		log.Printf("sync cursor of user %d expired, resyncing", userID)
+	case errors.Is(err, ErrSyncCursorNotFound):
+		state = &SyncCursor{UserID: userID, Query: query}
+	default:
+		return nil, err
+	}
+
+	// Take the cursor before searching so nothing that arrives in between
+	// is missed; seeing it again next time is harmless.
+	cursor, err := feed.Cursor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := mb.Search(ctx, query, max)
+	if err != nil {
+		return nil, err
+	}
+	state.Cursor, state.RecentIDs = cursor, ids
+	saveSyncCursor(ctx, cursors, state)
+	return ids, nil
+}
+
+// incrementalSync advances state past the messages added since its cursor.
+// The change log is not filtered by query, so the added messages are checked
+// with one search capped at their count: new mail is the newest in the
+// mailbox, so every added message that matches is among that many results.
+func incrementalSync(ctx context.Context, mb mailbox.Mailbox, feed mailbox.ChangeFeed, state *SyncCursor, max int) ([]string, error) {
+	added, next, err := feed.Added(ctx, state.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if len(added) > maxIncrementalAdds {
+		return nil, mailbox.ErrCursorExpired
+	}
+
+	var matched []string
+	if len(added) > 0 {
+		found, err := mb.Search(ctx, state.Query, len(added))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range found {
+			if slices.Contains(added, id) {
+				matched = append(matched, id)
+			}
+		}
+	}
+
+	ids := matched
+	for _, id := range state.RecentIDs {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > max {
+		ids = ids[:max]
+	}
+
+	state.Cursor, state.RecentIDs = next, ids
+	return ids, nil
+}
+
+// saveSyncCursor does not fail the sync: a cursor that was not saved only
+// means the next sync repeats this one.
+func saveSyncCursor(ctx context.Context, cursors SyncCursorStore, state *SyncCursor) {
+	if err := cursors.Save(ctx, state); err != nil {
+		log.Printf("failed to save sync cursor of user %d: %v", state.UserID, err)
+	}
+}
@@ -0,0 +1,138 @@
+package gmail
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+// feedMailbox is a mailbox with a change log. Messages are numbered in order
+// of arrival and the cursor is the number of messages seen so far; cursors
+// below expiredBefore are too old.
+type feedMailbox struct {
+	fakeMailbox
+	messages      []string // "id subject", oldest first
+	expiredBefore int
+	searches      int
+	historyCalls  int
+}
+
+func (m *feedMailbox) Search(ctx context.Context, query string, max int) ([]string, error) {
+	m.searches++
+	var ids []string
+	for i := len(m.messages) - 1; i >= 0 && len(ids) < max; i-- {
+		id, subject, _ := strings.Cut(m.messages[i], " ")
+		if strings.Contains(subject, query) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *feedMailbox) Cursor(ctx context.Context) (string, error) {
+	return strconv.Itoa(len(m.messages)), nil
+}
+
+func (m *feedMailbox) Added(ctx context.Context, cursor string) ([]string, string, error) {
+	m.historyCalls++
+	n, _ := strconv.Atoi(cursor)
+	if n < m.expiredBefore {
+		return nil, "", mailbox.ErrCursorExpired
+	}
+	var ids []string
+	for i := len(m.messages) - 1; i >= n; i-- {
+		id, _, _ := strings.Cut(m.messages[i], " ")
+		ids = append(ids, id)
+	}
+	return ids, strconv.Itoa(len(m.messages)), nil
+}
+
+type memorySyncCursorStore map[string]*SyncCursor
+
+func (s memorySyncCursorStore) Get(ctx context.Context, userID int, query string) (*SyncCursor, error) {
+	c, ok := s[strconv.Itoa(userID)+query]
+	if !ok {
+		return nil, ErrSyncCursorNotFound
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (s memorySyncCursorStore) Save(ctx context.Context, c *SyncCursor) error {
+	copied := *c
+	s[strconv.Itoa(c.UserID)+c.Query] = &copied
+	return nil
+}
+
+func TestRecentMessageIDsIncremental(t *testing.T) {
+	ctx := context.Background()
+	mb := &feedMailbox{messages: []string{"m1 placement", "m2 newsletter", "m3 placement"}}
+	cursors := memorySyncCursorStore{}
+
+	sync := func() []string {
+		t.Helper()
+		ids, err := recentMessageIDs(ctx, mb, cursors, 7, "placement", 2)
+		if err != nil {
+			t.Fatalf("recentMessageIDs: %v", err)
+		}
+		return ids
+	}
+
+	// The first sync has no cursor and searches.
+	if ids := sync(); !slices.Equal(ids, []string{"m3", "m1"}) {
+		t.Fatalf("full sync = %v", ids)
+	}
+	if mb.searches != 1 || cursors["7placement"].Cursor != "3" {
+		t.Fatalf("searches = %d, cursor = %+v", mb.searches, cursors["7placement"])
+	}
+
+	// Nothing arrived: one history call, no search.
+	if ids := sync(); !slices.Equal(ids, []string{"m3", "m1"}) {
+		t.Errorf("unchanged sync = %v", ids)
+	}
+	if mb.searches != 1 || mb.historyCalls != 1 {
+		t.Errorf("searches = %d, history calls = %d, want 1, 1", mb.searches, mb.historyCalls)
+	}
+
+	// Only the new placement mail is added in front.
+	mb.messages = append(mb.messages, "m4 newsletter", "m5 placement")
+	if ids := sync(); !slices.Equal(ids, []string{"m5", "m3"}) {
+		t.Errorf("incremental sync = %v", ids)
+	}
+	if cursors["7placement"].Cursor != "5" {
+		t.Errorf("cursor = %q, want 5", cursors["7placement"].Cursor)
+	}
+}
+
+func TestRecentMessageIDsExpiredCursor(t *testing.T) {
+	ctx := context.Background()
+	mb := &feedMailbox{messages: []string{"m1 placement", "m2 placement"}, expiredBefore: 2}
+	cursors := memorySyncCursorStore{"7placement": {UserID: 7, Query: "placement", Cursor: "1", RecentIDs: []string{"m1"}}}
+
+	ids, err := recentMessageIDs(ctx, mb, cursors, 7, "placement", 10)
+	if err != nil {
+		t.Fatalf("recentMessageIDs: %v", err)
+	}
+	if !slices.Equal(ids, []string{"m2", "m1"}) || mb.searches != 1 {
+		t.Errorf("expected a full resync, got %v after %d searches", ids, mb.searches)
+	}
+	if cursors["7placement"].Cursor != "2" {
+		t.Errorf("cursor = %q, want 2", cursors["7placement"].Cursor)
+	}
+}
+
+func TestRecentMessageIDsWithoutCursors(t *testing.T) {
+	mb := &feedMailbox{messages: []string{"m1 placement", "m2 newsletter"}}
+
+	ids, err := recentMessageIDs(context.Background(), mb, nil, 7, "newsletter", 10)
+	if err != nil {
+		t.Fatalf("recentMessageIDs: %v", err)
+	}
+	if !slices.Equal(ids, []string{"m2"}) || mb.searches != 1 || mb.historyCalls != 0 {
+		t.Errorf("got %v after %d searches and %d history calls, want a plain search", ids, mb.searches, mb.historyCalls)
+	}
+}
@@ -0,0 +1,211 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+var ErrThreadNotFound = errors.New("thread not found")
+
+// Thread is a placement drive as its mails come in: the announcement, then
+// reminders, deadline extensions, shortlists and schedules in the same
+// conversation. Each message keeps its own summary; Record merges them.
+type Thread struct {
+	UserID    int
+	ThreadID  string
+	Messages  []ThreadMessage // oldest first
+	UpdatedAt time.Time
+}
+
+// ThreadMessage is the summary of one message of a thread.
+type ThreadMessage struct {
+	ID      string       `json:"id"`
+	Subject string       `json:"subject"`
+	Date    time.Time    `json:"date"`
+	Summary *ai.AIResult `json:"summary"`
+}
+
+// add puts m in date order, replacing the copy of it the thread already has.
+func (t *Thread) add(m ThreadMessage) {
+	t.Messages = slices.DeleteFunc(t.Messages, func(old ThreadMessage) bool { return old.ID == m.ID })
+	i, _ := slices.BinarySearchFunc(t.Messages, m.Date, func(old ThreadMessage, date time.Time) int {
+		if old.Date.After(date) {
+			return 1
+		}
+		return -1
+	})
+	t.Messages = slices.Insert(t.Messages, i, m)
+}
+
+// ThreadRecord is the current state of a drive and how it got there.
+type ThreadRecord struct {
+	ThreadID  string         `json:"threadId"`
+	Summary   *ai.AIResult   `json:"summary"`
+	Timeline  []ThreadUpdate `json:"timeline"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// ThreadUpdate is what one message of a thread said and changed. The first
+// message sets every field it mentions, so its changes have no From.
+type ThreadUpdate struct {
+	MessageID string        `json:"messageId"`
+	Subject   string        `json:"subject"`
+	Date      time.Time     `json:"date"`
+	Summary   string        `json:"summary"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// mergedFields are the summary fields, by JSON name, that a later message
+// overrides whenever it states them, in the order changes are listed.
+// otherLinks and attachments accumulate instead, and the one-line summary
+// is the latest message's without being listed as a change.
+var mergedFields = []string{
+	"category", "company", "role", "deadline", "location", "timings", "eventDetails",
+	"eligibility", "salary", "requirements", "applyLink", "description", "attachmentSummary",
+}
+
+// Record replays the messages oldest first. The latest value of each field
+// wins, so an extended deadline or a new venue replaces the announced one,
+// while a reminder that leaves a field out does not erase it.
+func (t *Thread) Record() *ThreadRecord {
+	rec := &ThreadRecord{ThreadID: t.ThreadID, UpdatedAt: t.UpdatedAt, Timeline: []ThreadUpdate{}}
+	merged := map[string]any{}
+	var links []string
+	var attachments []ai.Attachment
+
+	for _, m := range t.Messages {
+		if m.Summary == nil {
+			continue
+		}
+		fields := summaryFields(m.Summary)
+		update := ThreadUpdate{MessageID: m.ID, Subject: m.Subject, Date: m.Date, Summary: m.Summary.Summary, Changes: []FieldChange{}}
+		for _, name := range mergedFields {
+			value := fields[name]
+			if isBlank(value) {
+				continue
+			}
+			if old, ok := merged[name]; ok && sameValue(old, value) {
+				continue
+			}
+			update.Changes = append(update.Changes, FieldChange{Field: name, From: merged[name], To: value})
+			merged[name] = value
+		}
+		if m.Summary.Summary != "" {
+			merged["summary"] = m.Summary.Summary
+		}
+		for _, link := range m.Summary.OtherLinks {
+			if !slices.Contains(links, link) {
+				links = append(links, link)
+			}
+		}
+		attachments = append(attachments, m.Summary.Attachments...)
+		rec.Timeline = append(rec.Timeline, update)
+	}
+
+	summary := &ai.AIResult{}
+	if data, err := json.Marshal(merged); err == nil {
+		json.Unmarshal(data, summary)
+	}
+	summary.OtherLinks = links
+	summary.Attachments = attachments
+	summary.ThreadID = t.ThreadID
+	rec.Summary = summary
+	return rec
+}
+
+// summaryFields returns the fields of res by JSON name, as the model wrote
+// them.
+func summaryFields(res *ai.AIResult) map[string]any {
+	fields := map[string]any{}
+	if data, err := json.Marshal(res); err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+// isBlank reports whether the model left a field out: null, an empty string
+// or list, or a placeholder such as "N/A".
+func isBlank(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		s := strings.ToLower(strings.TrimSpace(v))
+		return s == "" || s == "null" || s == "n/a" || s == "na" || s == "none" || s == "not mentioned"
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+func sameValue(a, b any) bool {
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.EqualFold(strings.TrimSpace(as), strings.TrimSpace(bs))
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+type ThreadStore interface {
+	// Update applies fn to the user's thread, or to an empty one if it is
+	// not stored yet, and stores the result. Updates of the same thread run
+	// one at a time, so messages summarized concurrently are all kept.
+	Update(ctx context.Context, userID int, threadID string, fn func(*Thread)) (*Thread, error)
+
+	// Get returns the user's thread, or ErrThreadNotFound.
+	Get(ctx context.Context, userID int, threadID string) (*Thread, error)
+
+	// List returns up to limit of the user's threads, latest message first.
+	List(ctx context.Context, userID int, limit int) ([]*Thread, error)
+}
+
+// threadOf returns the thread msg belongs to. A message from a mailbox that
+// does not group messages is a thread of its own.
+func threadOf(msg *mailbox.Message) string {
+	if msg.ThreadID != "" {
+		return msg.ThreadID
+	}
+	return msg.ID
+}
+
+// messageDate parses the Date header, or the RFC 3339 time Graph reports. A
+// message without a readable date counts as received now.
+func messageDate(value string) time.Time {
+	if t, err := mail.ParseDate(value); err == nil {
+		return t.UTC()
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC()
+	}
+	return time.Now().UTC()
+}
+
+// addToThread files the summary of msg under its thread and returns the
+// thread's merged record.
+func addToThread(ctx context.Context, threads ThreadStore, userID int, msg *mailbox.Message, summary *ai.AIResult) (*ThreadRecord, error) {
+	m := ThreadMessage{ID: msg.ID, Subject: msg.Subject, Date: messageDate(msg.Date), Summary: summary}
+	t, err := threads.Update(ctx, userID, summary.ThreadID, func(t *Thread) { t.add(m) })
+	if err != nil {
+		return nil, fmt.Errorf("failed to add %s to thread %s: %w", msg.ID, summary.ThreadID, err)
+	}
+	return t.Record(), nil
+}
@@ -0,0 +1,205 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+type memoryThreadStore struct {
+	mu      sync.Mutex
+	threads map[string]*Thread // by user ID and thread ID
+}
+
+func (s *memoryThreadStore) Update(ctx context.Context, userID int, threadID string, fn func(*Thread)) (*Thread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.threads == nil {
+		s.threads = map[string]*Thread{}
+	}
+	key := threadKey(userID, threadID)
+	t, ok := s.threads[key]
+	if !ok {
+		t = &Thread{UserID: userID, ThreadID: threadID}
+		s.threads[key] = t
+	}
+	fn(t)
+	t.UpdatedAt = time.Now()
+	stored := *t
+	stored.Messages = append([]ThreadMessage(nil), t.Messages...)
+	return &stored, nil
+}
+
+func (s *memoryThreadStore) Get(ctx context.Context, userID int, threadID string) (*Thread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.threads[threadKey(userID, threadID)]
+	if !ok {
+		return nil, ErrThreadNotFound
+	}
+	stored := *t
+	return &stored, nil
+}
+
+func (s *memoryThreadStore) List(ctx context.Context, userID int, limit int) ([]*Thread, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var threads []*Thread
+	for _, t := range s.threads {
+		if t.UserID == userID {
+			threads = append(threads, t)
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].Messages[len(threads[i].Messages)-1].Date.After(threads[j].Messages[len(threads[j].Messages)-1].Date)
+	})
+	return threads[:min(limit, len(threads))], nil
+}
+
+func threadKey(userID int, threadID string) string {
+	return fmt.Sprintf("%d/%s", userID, threadID)
+}
+
+func ptr(s string) *string { return &s }
+
+func TestThreadRecord(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 9, 0, 0, 0, time.UTC) }
+	thread := &Thread{ThreadID: "t1"}
+	// Added out of order, the way a backfill may summarize them.
+	thread.add(ThreadMessage{ID: "m2", Subject: "Reminder", Date: day(3), Summary: &ai.AIResult{
+		Summary:  "Registration closes on 5 March",
+		Category: "drive",
+		Company:  ptr("contoso"),
+		Deadline: ptr("2026-03-05"),
+		Location: nil,
+	}})
+	thread.add(ThreadMessage{ID: "m1", Subject: "Contoso campus drive", Date: day(1), Summary: &ai.AIResult{
+		Summary:    "Contoso is hiring SDEs",
+		Category:   "drive",
+		Company:    ptr("Contoso"),
+		Role:       ptr("SDE"),
+		Deadline:   ptr("2026-03-05"),
+		Location:   "Hall 2",
+		OtherLinks: []string{"https://contoso.example/jd"},
+	}})
+	thread.add(ThreadMessage{ID: "m3", Subject: "Deadline extended", Date: day(4), Summary: &ai.AIResult{
+		Summary:     "Deadline extended to 8 March; test moved to the auditorium",
+		Category:    "drive",
+		Role:        ptr("N/A"),
+		Deadline:    ptr("2026-03-08"),
+		Location:    "Main Auditorium",
+		OtherLinks:  []string{"https://contoso.example/jd", "https://forms.example/contoso"},
+		Attachments: []ai.Attachment{{Filename: "Shortlist.csv", MimeType: "text/csv"}},
+	}})
+	// A summary stored again replaces its earlier copy.
+	thread.add(ThreadMessage{ID: "m2", Subject: "Reminder", Date: day(3), Summary: &ai.AIResult{
+		Summary:  "Registration closes on 5 March",
+		Category: "drive",
+		Company:  ptr("contoso"),
+		Deadline: ptr("2026-03-05"),
+	}})
+
+	rec := thread.Record()
+	s := rec.Summary
+	if s.ThreadID != "t1" || *s.Deadline != "2026-03-08" || s.Location != "Main Auditorium" || *s.Role != "SDE" || *s.Company != "Contoso" {
+		t.Errorf("merged summary = %+v, want the latest deadline and venue and the role kept", s)
+	}
+	if s.Summary != "Deadline extended to 8 March; test moved to the auditorium" {
+		t.Errorf("summary = %q, want the latest message's", s.Summary)
+	}
+	if !reflect.DeepEqual(s.OtherLinks, []string{"https://contoso.example/jd", "https://forms.example/contoso"}) || len(s.Attachments) != 1 {
+		t.Errorf("links = %v, attachments = %v", s.OtherLinks, s.Attachments)
+	}
+
+	if len(rec.Timeline) != 3 {
+		t.Fatalf("timeline has %d entries, want 3", len(rec.Timeline))
+	}
+	var ids []string
+	for _, u := range rec.Timeline {
+		ids = append(ids, u.MessageID)
+	}
+	if !reflect.DeepEqual(ids, []string{"m1", "m2", "m3"}) {
+		t.Errorf("timeline order = %v, want by date", ids)
+	}
+	if first := rec.Timeline[0].Changes; len(first) != 5 || first[0] != (FieldChange{Field: "category", To: "drive"}) {
+		t.Errorf("first message changes = %+v, want every field it set", first)
+	}
+	if changes := rec.Timeline[1].Changes; len(changes) != 0 {
+		t.Errorf("reminder changes = %+v, want none", changes)
+	}
+	want := []FieldChange{
+		{Field: "deadline", From: "2026-03-05", To: "2026-03-08"},
+		{Field: "location", From: "Hall 2", To: "Main Auditorium"},
+	}
+	if !reflect.DeepEqual(rec.Timeline[2].Changes, want) {
+		t.Errorf("extension changes = %+v, want %+v", rec.Timeline[2].Changes, want)
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+	for value, want := range map[string]string{
+		"Tue, 3 Mar 2026 14:30:00 +0530": "2026-03-03T09:00:00Z",
+		"2026-03-03T09:00:00Z":           "2026-03-03T09:00:00Z",
+	} {
+		if got := messageDate(value).Format(time.RFC3339); got != want {
+			t.Errorf("messageDate(%q) = %s, want %s", value, got, want)
+		}
+	}
+	if got := messageDate("someday"); time.Since(got) > time.Minute {
+		t.Errorf("messageDate of an unreadable date = %v, want now", got)
+	}
+}
+
+// threadMailbox serves a drive announcement and its extension in one thread
+// and an unrelated message without a thread ID.
+type threadMailbox struct {
+	fakeMailbox
+}
+
+func (m *threadMailbox) Fetch(ctx context.Context, id string) (*mailbox.Message, error) {
+	msgs := map[string]*mailbox.Message{
+		"m1": {ID: "m1", ThreadID: "t1", Subject: "Contoso drive", Date: "Sun, 1 Mar 2026 09:00:00 +0000"},
+		"m2": {ID: "m2", ThreadID: "t1", Subject: "Re: Contoso drive", Date: "Wed, 4 Mar 2026 09:00:00 +0000"},
+		"m3": {ID: "m3", Subject: "Fabrikam webinar", Date: "Mon, 2 Mar 2026 09:00:00 +0000"},
+	}
+	return msgs[id], nil
+}
+
+func TestSummarizeMergesThreads(t *testing.T) {
+	repo := &fakeSummaryRepo{summaries: map[string]*ai.AIResult{}}
+	s := testSummarizer(repo)
+	store := s.threads.(*memoryThreadStore)
+	s.analyze = func(ctx context.Context, userID int, subject, snippet, body string, attachments []ai.Attachment) (*ai.AIResult, error) {
+		deadline := map[string]string{"Contoso drive": "2026-03-05", "Re: Contoso drive": "2026-03-08"}[subject]
+		return &ai.AIResult{Summary: subject, Deadline: ptr(deadline)}, nil
+	}
+
+	done, err := s.summarize(context.Background(), &threadMailbox{}, 7, []string{"m2", "m1", "m3"}, nil)
+	if err != nil || done.summarized != 3 || done.failed != 0 {
+		t.Fatalf("summarize = %+v, %v, want all three summarized", done, err)
+	}
+
+	if repo.summaries["m1"].ThreadID != "t1" || repo.summaries["m3"].ThreadID != "m3" {
+		t.Errorf("saved thread IDs = %q, %q", repo.summaries["m1"].ThreadID, repo.summaries["m3"].ThreadID)
+	}
+	thread, err := store.Get(context.Background(), 7, "t1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	rec := thread.Record()
+	if len(rec.Timeline) != 2 || *rec.Summary.Deadline != "2026-03-08" || rec.Summary.Summary != "Re: Contoso drive" {
+		t.Errorf("thread record = %+v, %+v, want both messages with the extended deadline", rec.Summary, rec.Timeline)
+	}
+
+	threads, _ := store.List(context.Background(), 7, 10)
+	if len(threads) != 2 || threads[0].ThreadID != "t1" || threads[1].ThreadID != "m3" {
+		t.Errorf("listed %d threads, want t1 then m3", len(threads))
+	}
+}
@@ -0,0 +1,292 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/auth/provider"
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/user"
+)
+
+// watchRenewBefore is how long before expiry a watch is renewed. Gmail
+// watches last seven days and Google recommends renewing them daily.
+const watchRenewBefore = 6 * 24 * time.Hour
+
+var ErrWatchNotFound = errors.New("watch not found")
+
+// Watch records that new mail of EmailAddress is pushed to us until
+// ExpiresAt. Push notifications only carry the address, so this is how they
+// are matched to a user.
+type Watch struct {
+	UserID       int
+	EmailAddress string
+	ExpiresAt    time.Time
+}
+
+type WatchStore interface {
+	Save(ctx context.Context, w *Watch) error
+
+	// Get returns ErrWatchNotFound if the user has no watch.
+	Get(ctx context.Context, userID int) (*Watch, error)
+
+	// FindByEmail returns ErrWatchNotFound if no watch covers email.
+	FindByEmail(ctx context.Context, email string) (*Watch, error)
+
+	// ListExpiring returns the watches that expire before t.
+	ListExpiring(ctx context.Context, t time.Time) ([]*Watch, error)
+
+	Delete(ctx context.Context, userID int) error
+}
+
+// pushTopic is the Pub/Sub topic Gmail publishes to, e.g.
+// projects/auramail/topics/gmail. Watches are only registered when it is set.
+func pushTopic() string {
+	return os.Getenv("GMAIL_PUBSUB_TOPIC")
+}
+
+// WatchManager registers Gmail push watches for users and keeps them
+// renewed.
+type WatchManager struct {
+	watches   WatchStore
+	users     summaryRepository
+	providers mailboxSource
+}
+
+func NewWatchManager(watches WatchStore, users *user.PostgresRepository, providers provider.Registry) *WatchManager {
+	return &WatchManager{watches: watches, users: users, providers: providers}
+}
+
+// Ensure registers a watch for u unless a fresh one exists. Mailboxes that
+// cannot push are left alone.
+func (m *WatchManager) Ensure(ctx context.Context, u *user.User, mb mailbox.Mailbox) error {
+	topic := pushTopic()
+	watcher, ok := mb.(mailbox.Watcher)
+	if topic == "" || !ok {
+		return nil
+	}
+
+	w, err := m.watches.Get(ctx, u.ID)
+	if err == nil && time.Until(w.ExpiresAt) > watchRenewBefore {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrWatchNotFound) {
+		return err
+	}
+	return m.watch(ctx, u, watcher, topic)
+}
+
+func (m *WatchManager) watch(ctx context.Context, u *user.User, watcher mailbox.Watcher, topic string) error {
+	expires, err := watcher.Watch(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return m.watches.Save(ctx, &Watch{
+		UserID:       u.ID,
+		EmailAddress: strings.ToLower(u.Email),
+		ExpiresAt:    expires,
+	})
+}
+
+// Start renews watches that are due every interval until ctx is cancelled.
+func (m *WatchManager) Start(ctx context.Context, interval time.Duration) {
+	if pushTopic() == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			m.renewDue(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *WatchManager) renewDue(ctx context.Context) {
+	due, err := m.watches.ListExpiring(ctx, time.Now().Add(watchRenewBefore))
+	if err != nil {
+		log.Printf("failed to list gmail watches to renew: %v", err)
+		return
+	}
+
+	for _, w := range due {
+		err := m.renew(ctx, w)
+		if errors.Is(err, mailbox.ErrReauthRequired) || errors.Is(err, user.ErrUserNotFound) {
+			// Registered again by Ensure when the user is back.
+			if err := m.watches.Delete(ctx, w.UserID); err != nil {
+				log.Printf("failed to drop gmail watch of user %d: %v", w.UserID, err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to renew gmail watch of user %d: %v", w.UserID, err)
+		}
+	}
+}
+
+func (m *WatchManager) renew(ctx context.Context, w *Watch) error {
+	u, err := m.users.FindByID(ctx, strconv.Itoa(w.UserID))
+	if err != nil {
+		return user.ErrUserNotFound
+	}
+	mb, err := m.providers.Mailbox(ctx, u)
+	if err != nil {
+		return err
+	}
+	watcher, ok := mb.(mailbox.Watcher)
+	if !ok {
+		return user.ErrUserNotFound
+	}
+	err = m.watch(ctx, u, watcher, pushTopic())
+	if errors.Is(err, mailbox.ErrReauthRequired) && !u.ReauthRequired {
+		if err := m.users.MarkReauthRequired(ctx, u.ID); err != nil {
+			log.Printf("failed to mark user %d for reauthorization: %v", u.ID, err)
+		}
+	}
+	return err
+}
+
+// Ingester runs incremental syncs in the background when a push notification
+// says a mailbox changed. Notifications that arrive while a user's sync is
+// queued or running are folded into one more sync afterwards.
+type Ingester struct {
+	summarizer
+	providers mailboxSource
+	cursors   SyncCursorStore
+	queue     chan int
+
+	mu      sync.Mutex
+	pending map[int]bool // queued or running; true if notified again since
+
+	workers sync.WaitGroup
+	stop    chan struct{}
+	close   sync.Once
+}
+
+func NewIngester(users *user.PostgresRepository, providers provider.Registry, cursors SyncCursorStore, attachments AttachmentStore, threads ThreadStore) *Ingester {
+	return &Ingester{
+		summarizer: summarizer{users: users, attachments: attachments, threads: threads, analyze: ai.AnalyzeEmail},
+		providers:  providers,
+		cursors:    cursors,
+		queue:      make(chan int, 1024),
+		pending:    map[int]bool{},
+		stop:       make(chan struct{}),
+	}
+}
+
+// Enqueue schedules an incremental sync of the user's mailbox.
+func (in *Ingester) Enqueue(userID int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if _, ok := in.pending[userID]; ok {
+		in.pending[userID] = true
+		return
+	}
+	select {
+	case in.queue <- userID:
+		in.pending[userID] = false
+	default:
+		// Pub/Sub redelivers nothing we acked, but the next notification
+		// or stream of this user picks up the change from the cursor.
+		log.Printf("ingest queue full, dropping sync of user %d", userID)
+	}
+}
+
+// Start runs workers syncs at a time until Close is called or ctx is
+// cancelled.
+func (in *Ingester) Start(ctx context.Context, workers int) {
+	for range workers {
+		in.workers.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-in.stop:
+					in.drain(ctx)
+					return
+				case userID := <-in.queue:
+					in.sync(ctx, userID)
+					in.done(userID)
+				}
+			}
+		})
+	}
+}
+
+// drain runs the syncs still queued, including those queued again by
+// notifications that arrived while they ran.
+func (in *Ingester) drain(ctx context.Context) {
+	for {
+		select {
+		case userID := <-in.queue:
+			in.sync(ctx, userID)
+			in.done(userID)
+		default:
+			return
+		}
+	}
+}
+
+// Close lets the workers finish the running and queued syncs, whose
+// notifications were already acknowledged, and returns once they have.
+// Call it after the push endpoint stopped taking requests.
+func (in *Ingester) Close() {
+	in.close.Do(func() { close(in.stop) })
+	in.workers.Wait()
+}
+
+func (in *Ingester) done(userID int) {
+	in.mu.Lock()
+	again := in.pending[userID]
+	delete(in.pending, userID)
+	in.mu.Unlock()
+
+	if again {
+		in.Enqueue(userID)
+	}
+}
+
+func (in *Ingester) sync(ctx context.Context, userID int) {
+	u, err := in.users.FindByID(ctx, strconv.Itoa(userID))
+	if err != nil {
+		log.Printf("ingest: user %d not found: %v", userID, err)
+		return
+	}
+
+	mb, err := in.providers.Mailbox(ctx, u)
+	if err == nil {
+		var ids []string
+		ids, err = recentMessageIDs(ctx, mb, in.cursors, userID, streamQuery, 10)
+		if err == nil {
+			var done batch
+			done, err = in.summarize(ctx, mb, userID, ids, nil)
+			if done.failed > 0 {
+				log.Printf("ingest: %d of %d new messages of user %d were not summarized", done.failed, len(ids), userID)
+			}
+		}
+	}
+	if errors.Is(err, mailbox.ErrReauthRequired) {
+		if !u.ReauthRequired {
+			if err := in.users.MarkReauthRequired(ctx, userID); err != nil {
+				log.Printf("failed to mark user %d for reauthorization: %v", userID, err)
+			}
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("ingest: sync of user %d failed: %v", userID, err)
+	}
+}
@@ -0,0 +1,577 @@
+// Package imap reads a mailbox over IMAP4rev1 (RFC 3501) for college mail
+// that is neither Gmail nor Microsoft 365. It speaks only the commands the
+// sync pipeline needs and never changes the mailbox: folders are opened with
+// EXAMINE and bodies fetched with BODY.PEEK, so nothing gets marked as read.
+package imap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+const commandTimeout = time.Minute
+
+// limits bound what a server can make us hold in memory. The server is any
+// host a user typed in, so every response is read within them and a command
+// whose responses exceed one fails and leaves its connection closed.
+type limits struct {
+	line     int // one response line, literals aside
+	literal  int // one literal, such as a whole message
+	response int // all lines and literals one command reads
+	untagged int // untagged responses one command collects
+}
+
+var defaultLimits = limits{
+	line:     1 << 20,
+	literal:  64 << 20,
+	response: 80 << 20,
+	untagged: 10000,
+}
+
+var errResponseTooLarge = errors.New("imap response too large")
+
+type Security int
+
+const (
+	// SecurityTLS connects with TLS from the start, normally on port 993.
+	SecurityTLS Security = iota
+	// SecuritySTARTTLS upgrades a plain connection, normally on port 143,
+	// and refuses to log in if the server cannot.
+	SecuritySTARTTLS
+)
+
+type Config struct {
+	Host     string
+	Port     int
+	Security Security
+	Username string
+
+	// Password is an app password for LOGIN. It is ignored when Token is
+	// set.
+	Password string
+
+	// Token returns an OAuth access token for SASL XOAUTH2.
+	Token func(ctx context.Context) (string, error)
+
+	// Folder is the folder to read, INBOX if empty.
+	Folder string
+
+	// TLSConfig overrides the default of verifying Host against the system
+	// roots.
+	TLSConfig *tls.Config
+
+	// PublicOnly refuses to connect to loopback, private and link-local
+	// addresses, for hosts that users typed in.
+	PublicOnly bool
+}
+
+var ErrPrivateAddress = errors.New("imap host is not a public address")
+
+func (c Config) folder() string {
+	if c.Folder == "" {
+		return "INBOX"
+	}
+	return c.Folder
+}
+
+func (c Config) tlsConfig() *tls.Config {
+	if c.TLSConfig != nil {
+		return c.TLSConfig
+	}
+	return &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+}
+
+// commandError is a NO or BAD answer. The connection is still usable after
+// one.
+type commandError struct {
+	status string
+	code   string
+	text   string
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("imap %s: %s", e.status, e.text)
+}
+
+// response is one server response. Literals are cut out of line and kept in
+// order in literals.
+type response struct {
+	line     string
+	literals [][]byte
+}
+
+// astring is a command argument sent as a quoted string, or as a literal if
+// it cannot be quoted. Plain strings are sent as they are.
+type astring string
+
+type conn struct {
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	tag    int
+	caps   map[string]bool
+	limits limits
+
+	uidValidity uint32
+	uidNext     uint32
+}
+
+// dial connects, logs in and opens the folder read-only.
+func dial(ctx context.Context, cfg Config) (*conn, error) {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	if cfg.PublicOnly {
+		// Checked on the address actually dialled, so a DNS answer that
+		// changes after the settings were saved cannot get around it.
+		d.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, _ := net.SplitHostPort(address)
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	var nc net.Conn
+	var err error
+	if cfg.Security == SecurityTLS {
+		nc, err = (&tls.Dialer{NetDialer: d, Config: cfg.tlsConfig()}).DialContext(ctx, "tcp", addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	c := newConn(nc)
+	if err := c.setup(ctx, cfg); err != nil {
+		c.nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), limits: defaultLimits}
+}
+
+func (c *conn) setup(ctx context.Context, cfg Config) error {
+	stop := c.deadline(ctx)
+	budget := c.limits.response
+	greeting, err := c.readResponse(&budget)
+	stop()
+	if err != nil {
+		return fmt.Errorf("failed to read imap greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") {
+		return fmt.Errorf("imap server refused the connection: %s", greeting.line)
+	}
+
+	if cfg.Security == SecuritySTARTTLS {
+		if err := c.capabilities(ctx); err != nil {
+			return err
+		}
+		if !c.caps["STARTTLS"] {
+			return errors.New("imap server does not offer STARTTLS")
+		}
+		if _, err := c.command(ctx, "STARTTLS"); err != nil {
+			return fmt.Errorf("failed to start tls: %w", err)
+		}
+		tc := tls.Client(c.nc, cfg.tlsConfig())
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("failed to start tls: %w", err)
+		}
+		c.nc, c.r, c.w = tc, bufio.NewReader(tc), bufio.NewWriter(tc)
+	}
+	// Capabilities announced before STARTTLS must not be trusted.
+	if err := c.capabilities(ctx); err != nil {
+		return err
+	}
+
+	if err := c.login(ctx, cfg); err != nil {
+		return err
+	}
+	return c.examine(ctx, cfg.folder())
+}
+
+func (c *conn) capabilities(ctx context.Context) error {
+	untagged, err := c.command(ctx, "CAPABILITY")
+	if err != nil {
+		return fmt.Errorf("failed to read imap capabilities: %w", err)
+	}
+	c.caps = map[string]bool{}
+	for _, res := range untagged {
+		if rest, ok := strings.CutPrefix(res.line, "* CAPABILITY "); ok {
+			for _, capability := range strings.Fields(rest) {
+				c.caps[strings.ToUpper(capability)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// login authenticates with XOAUTH2 when cfg has a token source and with an
+// app password otherwise. A refused login is mailbox.ErrReauthRequired
+// unless the server says it is temporary.
+func (c *conn) login(ctx context.Context, cfg Config) error {
+	var err error
+	if cfg.Token != nil {
+		token, tokenErr := cfg.Token(ctx)
+		if tokenErr != nil {
+			return tokenErr
+		}
+		ir := base64.StdEncoding.EncodeToString([]byte("user=" + cfg.Username + "\x01auth=Bearer " + token + "\x01\x01"))
+		if c.caps["SASL-IR"] {
+			_, err = c.command(ctx, "AUTHENTICATE", "XOAUTH2", ir)
+		} else {
+			_, err = c.exchange(ctx, []string{ir}, "AUTHENTICATE", "XOAUTH2")
+		}
+	} else {
+		if c.caps["LOGINDISABLED"] {
+			return errors.New("imap server does not accept passwords")
+		}
+		_, err = c.command(ctx, "LOGIN", astring(cfg.Username), astring(cfg.Password))
+	}
+
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) && cmdErr.status == "NO" && cmdErr.code != "UNAVAILABLE" {
+		return fmt.Errorf("%w: %s", mailbox.ErrReauthRequired, cmdErr.text)
+	}
+	if err != nil {
+		return fmt.Errorf("imap login failed: %w", err)
+	}
+	return nil
+}
+
+// examine (re)opens folder read-only and records its UID state.
+func (c *conn) examine(ctx context.Context, folder string) error {
+	untagged, err := c.command(ctx, "EXAMINE", astring(folder))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", folder, err)
+	}
+	c.uidValidity, c.uidNext = 0, 0
+	for _, res := range untagged {
+		if v, ok := responseCode(res.line, "UIDVALIDITY"); ok {
+			c.uidValidity = v
+		}
+		if v, ok := responseCode(res.line, "UIDNEXT"); ok {
+			c.uidNext = v
+		}
+	}
+	if c.uidValidity == 0 {
+		return fmt.Errorf("imap server sent no UIDVALIDITY for %s", folder)
+	}
+	if c.uidNext == 0 {
+		// UIDNEXT is optional in IMAP4rev1; one past the highest UID
+		// serves the same purpose.
+		untagged, err := c.command(ctx, "UID FETCH * (UID)")
+		if err != nil {
+			return fmt.Errorf("failed to find the next uid: %w", err)
+		}
+		c.uidNext = 1
+		for _, res := range untagged {
+			if uid := fetchUID(res.line); uid >= c.uidNext {
+				c.uidNext = uid + 1
+			}
+		}
+	}
+	return nil
+}
+
+// search runs UID SEARCH and returns the matching UIDs.
+func (c *conn) search(ctx context.Context, criteria []any) ([]uint32, error) {
+	args := []any{"SEARCH"}
+	if needsUTF8(criteria) {
+		args = append(args, "CHARSET", "UTF-8")
+	}
+	untagged, err := c.command(ctx, "UID", append(args, criteria...)...)
+	if err != nil {
+		return nil, fmt.Errorf("imap search failed: %w", err)
+	}
+
+	var uids []uint32
+	for _, res := range untagged {
+		rest, ok := strings.CutPrefix(res.line, "* SEARCH")
+		if !ok {
+			continue
+		}
+		for _, f := range strings.Fields(rest) {
+			if uid, err := strconv.ParseUint(f, 10, 32); err == nil {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetchMessage returns the raw RFC 5322 message with uid.
+func (c *conn) fetchMessage(ctx context.Context, uid uint32) ([]byte, error) {
+	untagged, err := c.command(ctx, "UID FETCH", strconv.FormatUint(uint64(uid), 10), "(UID BODY.PEEK[])")
+	if err != nil {
+		return nil, fmt.Errorf("imap fetch failed: %w", err)
+	}
+	for _, res := range untagged {
+		if fetchUID(res.line) == uid && len(res.literals) > 0 {
+			return res.literals[0], nil
+		}
+	}
+	return nil, mailbox.ErrMessageNotFound
+}
+
+func (c *conn) logout() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.command(ctx, "LOGOUT")
+	c.nc.Close()
+}
+
+// command sends one tagged command and returns the untagged responses that
+// came back before its completion.
+func (c *conn) command(ctx context.Context, name string, args ...any) ([]response, error) {
+	return c.exchange(ctx, nil, name, args...)
+}
+
+// exchange is command for commands that take more input when the server
+// asks: continuation requests are answered with replies in order and then
+// with empty lines, which is what aborts a SASL exchange after the server
+// reports an error.
+func (c *conn) exchange(ctx context.Context, replies []string, name string, args ...any) ([]response, error) {
+	stop := c.deadline(ctx)
+	defer stop()
+
+	c.tag++
+	tag := "A" + strconv.Itoa(c.tag)
+	budget := c.limits.response
+	if err := c.send(tag, name, args, &budget); err != nil {
+		return nil, err
+	}
+
+	var untagged []response
+	for {
+		res, err := c.readResponse(&budget)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(res.line, "+"):
+			reply := ""
+			if len(replies) > 0 {
+				reply, replies = replies[0], replies[1:]
+			}
+			if err := c.writeLine(reply); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(res.line, tag+" "):
+			status, text, _ := strings.Cut(strings.TrimPrefix(res.line, tag+" "), " ")
+			status = strings.ToUpper(status)
+			if status == "OK" {
+				return untagged, nil
+			}
+			code := ""
+			if strings.HasPrefix(text, "[") {
+				code, _, _ = strings.Cut(strings.TrimPrefix(text, "["), "]")
+				code, _, _ = strings.Cut(code, " ")
+			}
+			return untagged, &commandError{status: status, code: strings.ToUpper(code), text: text}
+		default:
+			if len(untagged) == c.limits.untagged {
+				return nil, fmt.Errorf("%w: more than %d untagged responses to %s", errResponseTooLarge, c.limits.untagged, name)
+			}
+			untagged = append(untagged, *res)
+		}
+	}
+}
+
+// send writes a command, waiting for the server's go-ahead before each
+// literal unless it supports LITERAL+.
+func (c *conn) send(tag, name string, args []any, budget *int) error {
+	var b strings.Builder
+	b.WriteString(tag + " " + name)
+	for _, arg := range args {
+		b.WriteByte(' ')
+		switch v := arg.(type) {
+		case astring:
+			if quotable(string(v)) {
+				b.WriteString(quote(string(v)))
+				continue
+			}
+			if c.caps["LITERAL+"] {
+				fmt.Fprintf(&b, "{%d+}\r\n%s", len(v), v)
+				continue
+			}
+			fmt.Fprintf(&b, "{%d}", len(v))
+			if err := c.writeLine(b.String()); err != nil {
+				return err
+			}
+			res, err := c.readResponse(budget)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(res.line, "+") {
+				return fmt.Errorf("imap server refused a literal: %s", res.line)
+			}
+			b.Reset()
+			b.WriteString(string(v))
+		case string:
+			b.WriteString(v)
+		default:
+			return fmt.Errorf("unsupported imap argument %T", arg)
+		}
+	}
+	return c.writeLine(b.String())
+}
+
+func (c *conn) writeLine(line string) error {
+	if _, err := c.w.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// readResponse reads one response line together with any literals it
+// announces, taking what it reads from budget.
+func (c *conn) readResponse(budget *int) (*response, error) {
+	res := &response{}
+	var line strings.Builder
+	for {
+		part, err := c.readLine(min(c.limits.line-line.Len(), *budget))
+		if err != nil {
+			return nil, err
+		}
+		*budget -= len(part)
+		line.WriteString(part)
+
+		n, ok := literalSize(part)
+		if !ok {
+			break
+		}
+		if n > c.limits.literal || n > *budget {
+			return nil, fmt.Errorf("%w: literal of %d bytes", errResponseTooLarge, n)
+		}
+		*budget -= n
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return nil, err
+		}
+		res.literals = append(res.literals, literal)
+	}
+	res.line = line.String()
+	return res, nil
+}
+
+// readLine reads a line and returns it without its line break. A line
+// longer than limit is an error, found before more than limit is buffered.
+func (c *conn) readLine(limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit+2 {
+			return "", fmt.Errorf("%w: line longer than %d bytes", errResponseTooLarge, limit)
+		}
+		line = append(line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// deadline makes blocked reads and writes give up when ctx is done or the
+// command takes too long. The returned func must be called afterwards.
+func (c *conn) deadline(ctx context.Context) func() {
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > commandTimeout {
+		deadline = time.Now().Add(commandTimeout)
+	}
+	c.nc.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { c.nc.SetDeadline(time.Now()) })
+	return func() { stop() }
+}
+
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// literalSize reports whether line ends by announcing a literal, {n}.
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[open+1:len(line)-1], "+"))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// responseCode extracts a numeric response code such as
+// "* OK [UIDNEXT 42] Predicted next UID".
+func responseCode(line, name string) (uint32, bool) {
+	_, rest, ok := strings.Cut(line, "["+name+" ")
+	if !ok {
+		return 0, false
+	}
+	value, _, _ := strings.Cut(rest, "]")
+	n, err := strconv.ParseUint(value, 10, 32)
+	return uint32(n), err == nil
+}
+
+// fetchUID returns the UID in a FETCH response, or 0.
+func fetchUID(line string) uint32 {
+	if !strings.HasPrefix(line, "* ") || !strings.Contains(line, " FETCH (") {
+		return 0
+	}
+	_, rest, ok := strings.Cut(line, "UID ")
+	if !ok {
+		return 0
+	}
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		rest = rest[:end]
+	}
+	n, _ := strconv.ParseUint(rest, 10, 32)
+	return uint32(n)
+}
+
+// quotable reports whether s can be sent as a quoted string, which IMAP4rev1
+// limits to 7-bit text without line breaks.
+func quotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' || s[i] == 0 || s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func needsUTF8(args []any) bool {
+	for _, arg := range args {
+		if s, ok := arg.(astring); ok && !quotable(string(s)) {
+			return true
+		}
+	}
+	return false
+}
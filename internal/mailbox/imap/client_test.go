@@ -0,0 +1,88 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// hostileServer returns a client with small limits whose server answers the
+// first command with whatever replies writes.
+func hostileServer(t *testing.T, replies func(w *bufio.Writer)) *conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		w := bufio.NewWriter(server)
+		replies(w)
+		w.Flush()
+	}()
+
+	c := newConn(client)
+	c.limits = limits{line: 1 << 10, literal: 4 << 10, response: 16 << 10, untagged: 100}
+	return c
+}
+
+func TestResponseLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies func(w *bufio.Writer)
+	}{
+		{"endless line", func(w *bufio.Writer) {
+			w.WriteString("* SEARCH " + strings.Repeat("1 ", 1<<10))
+		}},
+		{"line continued by literals", func(w *bufio.Writer) {
+			for range 1 << 10 {
+				w.WriteString("* 1 FETCH (BODY[] {0}\r\n")
+			}
+		}},
+		{"oversized literal", func(w *bufio.Writer) {
+			w.WriteString("* 1 FETCH (UID 1 BODY[] {1000000000}\r\n")
+		}},
+		{"literals over the budget", func(w *bufio.Writer) {
+			for i := range 8 {
+				fmt.Fprintf(w, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", i+1, i+1, 3<<10, strings.Repeat("x", 3<<10))
+			}
+			w.WriteString("A1 OK done\r\n")
+		}},
+		{"untagged flood", func(w *bufio.Writer) {
+			for i := range 1000 {
+				fmt.Fprintf(w, "* %d EXISTS\r\n", i)
+			}
+			w.WriteString("A1 OK done\r\n")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := hostileServer(t, tt.replies)
+			_, err := c.command(context.Background(), "NOOP")
+			if !errors.Is(err, errResponseTooLarge) {
+				t.Errorf("command = %v, want errResponseTooLarge", err)
+			}
+			if !broken(err) {
+				t.Error("the connection is kept after an oversized response")
+			}
+		})
+	}
+}
+
+func TestResponseWithinLimits(t *testing.T) {
+	c := hostileServer(t, func(w *bufio.Writer) {
+		for i := range 3 {
+			fmt.Fprintf(w, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", i+1, i+1, 4<<10, strings.Repeat("x", 4<<10))
+		}
+		w.WriteString("A1 OK done\r\n")
+	})
+	untagged, err := c.command(context.Background(), "NOOP")
+	if err != nil || len(untagged) != 3 || len(untagged[2].literals[0]) != 4<<10 {
+		t.Errorf("command = %d responses, %v", len(untagged), err)
+	}
+}
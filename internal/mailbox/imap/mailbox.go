@@ -0,0 +1,292 @@
+package imap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+const (
+	// maxConns keeps us under the per-user connection limits servers
+	// enforce, which are often as low as ten.
+	maxConns    = 4
+	idleTimeout = 30 * time.Second
+)
+
+// imapMailbox holds a few logged-in connections between calls, because
+// logging in costs more round trips than most commands.
+type imapMailbox struct {
+	cfg     Config
+	account string
+	slots   chan struct{}
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+func New(cfg Config) mailbox.Mailbox {
+	sum := sha256.Sum256([]byte(strings.ToLower(cfg.Username + "@" + cfg.Host + "/" + cfg.folder())))
+	return &imapMailbox{
+		cfg:     cfg,
+		account: "imap-" + hex.EncodeToString(sum[:6]),
+		slots:   make(chan struct{}, maxConns),
+	}
+}
+
+// Check logs in and opens the folder once, to validate settings before they
+// are saved.
+func Check(ctx context.Context, cfg Config) error {
+	c, err := dial(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	c.logout()
+	return nil
+}
+
+// Message IDs are "<account>.<uidvalidity>.<uid>". UIDs are only unique
+// within one folder and UIDVALIDITY, and summaries are keyed by message ID
+// across all users, so the account is part of it.
+func (m *imapMailbox) messageID(uidValidity, uid uint32) string {
+	return fmt.Sprintf("%s.%d.%d", m.account, uidValidity, uid)
+}
+
+func (m *imapMailbox) parseID(id string) (uidValidity, uid uint32, err error) {
+	rest, ok := strings.CutPrefix(id, m.account+".")
+	if !ok {
+		return 0, 0, mailbox.ErrMessageNotFound
+	}
+	validity, u, _ := strings.Cut(rest, ".")
+	v, err1 := strconv.ParseUint(validity, 10, 32)
+	n, err2 := strconv.ParseUint(u, 10, 32)
+	if err1 != nil || err2 != nil {
+		return 0, 0, mailbox.ErrMessageNotFound
+	}
+	return uint32(v), uint32(n), nil
+}
+
+func (m *imapMailbox) Search(ctx context.Context, query string, max int) ([]string, error) {
+	page, err := m.SearchPage(ctx, mailbox.SearchRequest{Query: query, PageSize: max})
+	if err != nil {
+		return nil, err
+	}
+	return page.IDs, nil
+}
+
+// SearchPage sorts the matches by UID, which is arrival order, and pages
+// downwards from the newest. The page token is the UID the next page starts
+// below. A token from before the folder's UIDVALIDITY changed starts over.
+func (m *imapMailbox) SearchPage(ctx context.Context, req mailbox.SearchRequest) (*mailbox.Page, error) {
+	var page *mailbox.Page
+	err := m.session(ctx, func(c *conn) error {
+		uids, err := c.search(ctx, searchCriteria(req.Query, req.After, req.Before))
+		if err != nil {
+			return err
+		}
+		slices.Sort(uids)
+		slices.Reverse(uids)
+
+		if validity, below, err := m.parseID(req.PageToken); err == nil && validity == c.uidValidity {
+			start, found := slices.BinarySearchFunc(uids, below, func(uid, target uint32) int {
+				// uids are descending.
+				return int(target) - int(uid)
+			})
+			if found {
+				start++
+			}
+			uids = uids[start:]
+		}
+
+		page = &mailbox.Page{Estimate: len(uids)}
+		if req.PageSize > 0 && len(uids) > req.PageSize {
+			page.NextPageToken = m.messageID(c.uidValidity, uids[req.PageSize-1])
+			uids = uids[:req.PageSize]
+		}
+		for _, uid := range uids {
+			page.IDs = append(page.IDs, m.messageID(c.uidValidity, uid))
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (m *imapMailbox) Fetch(ctx context.Context, id string) (*mailbox.Message, error) {
+	raw, err := m.fetchRaw(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parseMessage(id, raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message %s: %w", id, err)
+	}
+	return msg, nil
+}
+
+// FetchAttachment fetches the whole message again and cuts the part out,
+// which saves parsing BODYSTRUCTURE for the rare attachment download.
+func (m *imapMailbox) FetchAttachment(ctx context.Context, messageID, attachmentID string) ([]byte, error) {
+	raw, err := m.fetchRaw(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := attachment(raw, attachmentID)
+	if !ok {
+		return nil, mailbox.ErrMessageNotFound
+	}
+	return content, nil
+}
+
+func (m *imapMailbox) fetchRaw(ctx context.Context, id string) ([]byte, error) {
+	validity, uid, err := m.parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	var raw []byte
+	err = m.session(ctx, func(c *conn) error {
+		if validity != c.uidValidity {
+			return mailbox.ErrMessageNotFound
+		}
+		raw, err = c.fetchMessage(ctx, uid)
+		return err
+	})
+	return raw, err
+}
+
+// Cursor is "<uidvalidity>.<uidnext>": new mail always gets a UID of at
+// least UIDNEXT.
+func (m *imapMailbox) Cursor(ctx context.Context) (string, error) {
+	var cursor string
+	err := m.session(ctx, func(c *conn) error {
+		if err := c.examine(ctx, m.cfg.folder()); err != nil {
+			return err
+		}
+		cursor = fmt.Sprintf("%d.%d", c.uidValidity, c.uidNext)
+		return nil
+	})
+	return cursor, err
+}
+
+func (m *imapMailbox) Added(ctx context.Context, cursor string) ([]string, string, error) {
+	validity, next, ok := strings.Cut(cursor, ".")
+	v, err1 := strconv.ParseUint(validity, 10, 32)
+	n, err2 := strconv.ParseUint(next, 10, 32)
+	if !ok || err1 != nil || err2 != nil {
+		return nil, "", mailbox.ErrCursorExpired
+	}
+
+	var ids []string
+	var nextCursor string
+	err := m.session(ctx, func(c *conn) error {
+		// Refresh UIDNEXT, which EXAMINE reports as of when it ran.
+		if err := c.examine(ctx, m.cfg.folder()); err != nil {
+			return err
+		}
+		if uint32(v) != c.uidValidity {
+			return mailbox.ErrCursorExpired
+		}
+		nextCursor = fmt.Sprintf("%d.%d", c.uidValidity, c.uidNext)
+		if uint32(n) >= c.uidNext {
+			return nil
+		}
+
+		uids, err := c.search(ctx, []any{"UID", strconv.FormatUint(n, 10) + ":*"})
+		if err != nil {
+			return err
+		}
+		slices.Sort(uids)
+		slices.Reverse(uids)
+		for _, uid := range uids {
+			// n:* always includes the highest UID, even below n.
+			if uid >= uint32(n) {
+				ids = append(ids, m.messageID(c.uidValidity, uid))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return ids, nextCursor, nil
+}
+
+// session runs fn on a logged-in connection. A reused connection the server
+// has dropped in the meantime is replaced once.
+func (m *imapMailbox) session(ctx context.Context, fn func(c *conn) error) error {
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-m.slots }()
+
+	c, reused, err := m.take(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	if err != nil && reused && broken(err) && ctx.Err() == nil {
+		c.nc.Close()
+		if c, err = dial(ctx, m.cfg); err != nil {
+			return err
+		}
+		err = fn(c)
+	}
+	if err != nil && broken(err) {
+		c.nc.Close()
+		return err
+	}
+	m.put(c)
+	return err
+}
+
+func (m *imapMailbox) take(ctx context.Context) (*conn, bool, error) {
+	m.mu.Lock()
+	if n := len(m.idle); n > 0 {
+		c := m.idle[n-1]
+		m.idle = m.idle[:n-1]
+		m.mu.Unlock()
+		return c, true, nil
+	}
+	m.mu.Unlock()
+
+	c, err := dial(ctx, m.cfg)
+	return c, false, err
+}
+
+// put parks c and logs it out if nobody needs it within idleTimeout.
+func (m *imapMailbox) put(c *conn) {
+	m.mu.Lock()
+	m.idle = append(m.idle, c)
+	m.mu.Unlock()
+
+	time.AfterFunc(idleTimeout, func() {
+		m.mu.Lock()
+		i := slices.Index(m.idle, c)
+		if i < 0 {
+			// Taken again; its next put starts a new timer.
+			m.mu.Unlock()
+			return
+		}
+		m.idle = slices.Delete(m.idle, i, i+1)
+		m.mu.Unlock()
+		c.logout()
+	})
+}
+
+// broken reports whether err left the connection unusable. Errors the
+// server answered with, and our own, leave it in a known state.
+func broken(err error) bool {
+	var cmdErr *commandError
+	return !errors.As(err, &cmdErr) &&
+		!errors.Is(err, mailbox.ErrMessageNotFound) &&
+		!errors.Is(err, mailbox.ErrCursorExpired)
+}
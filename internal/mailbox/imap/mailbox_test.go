@@ -0,0 +1,352 @@
+package imap
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+)
+
+const placementQuery = "from:placementoffice@college.edu OR subject:placement"
+
+var testDay = time.Date(2026, 3, 2, 9, 30, 0, 0, time.UTC)
+
+func driveMail(subject string) string {
+	return "From: Placement Office <placementoffice@college.edu>\n" +
+		"To: student@college.edu\n" +
+		"Subject: " + subject + "\n" +
+		"Date: Mon, 2 Mar 2026 09:30:00 +0000\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"\n" +
+		"Register   by\n Friday\n"
+}
+
+func jdMail() string {
+	return "From: careers@contoso.example\n" +
+		"Subject: =?UTF-8?B?UGxhY2VtZW50IGRyaXZlIOKAkyBDb250b3Nv?=\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"--outer\n" +
+		"Content-Type: multipart/alternative; boundary=inner\n" +
+		"\n" +
+		"--inner\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"Content-Transfer-Encoding: quoted-printable\n" +
+		"\n" +
+		"Apply before =\n" +
+		"the deadline.\n" +
+		"--inner\n" +
+		"Content-Type: text/html\n" +
+		"\n" +
+		"<p>Apply before the deadline.</p>\n" +
+		"--inner--\n" +
+		"--outer\n" +
+		"Content-Type: application/pdf; name=\"JD.pdf\"\n" +
+		"Content-Disposition: attachment; filename=\"JD.pdf\"\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		base64.StdEncoding.EncodeToString([]byte("%PDF-1.7 job description")) + "\n" +
+		"--outer--\n"
+}
+
+func TestSearchAndFetch(t *testing.T) {
+	s := newTestServer(t, false)
+	s.deliver(testDay, driveMail("Campus drive: Infosys"))
+	s.deliver(testDay, "From: news@college.edu\nSubject: Newsletter\n\nNothing to see.\n")
+	s.deliver(testDay, jdMail())
+
+	ctx := context.Background()
+	mb := New(s.config())
+
+	ids, err := mb.Search(ctx, placementQuery, 10)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("got ids %v, want the JD mail and the drive mail", ids)
+	}
+
+	jd, err := mb.Fetch(ctx, ids[0])
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if jd.Subject != "Placement drive – Contoso" || jd.Body != "Apply before the deadline." || jd.From != "careers@contoso.example" {
+		t.Errorf("unexpected message %+v", jd)
+	}
+	want := []mailbox.Attachment{{ID: "2", Filename: "JD.pdf", MimeType: "application/pdf", Size: 24}}
+	if !reflect.DeepEqual(jd.Attachments, want) {
+		t.Errorf("attachments = %+v, want %+v", jd.Attachments, want)
+	}
+	data, err := mb.FetchAttachment(ctx, ids[0], "2")
+	if err != nil || string(data) != "%PDF-1.7 job description" {
+		t.Errorf("FetchAttachment = %q, %v", data, err)
+	}
+	if _, err := mb.FetchAttachment(ctx, ids[0], "1.1"); !errors.Is(err, mailbox.ErrMessageNotFound) {
+		t.Errorf("a body part is not an attachment, got %v", err)
+	}
+
+	drive, err := mb.Fetch(ctx, ids[1])
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if drive.Subject != "Campus drive: Infosys" || drive.Body != "Register by Friday" || drive.Snippet != drive.Body {
+		t.Errorf("unexpected message %+v", drive)
+	}
+
+	if _, err := mb.Fetch(ctx, "imap-000000000000.1700.1"); !errors.Is(err, mailbox.ErrMessageNotFound) {
+		t.Errorf("Fetch of another account's message = %v, want ErrMessageNotFound", err)
+	}
+
+	// One login served every call, and nothing was opened read-write.
+	if s.logins != 1 {
+		t.Errorf("logged in %d times, want 1", s.logins)
+	}
+	for _, c := range s.commands {
+		if c == "SELECT" || c == "UID STORE" {
+			t.Errorf("client sent %s", c)
+		}
+	}
+}
+
+func TestSearchPage(t *testing.T) {
+	s := newTestServer(t, false)
+	s.deliver(testDay.AddDate(0, 0, -10), driveMail("Too old"))
+	for range 5 {
+		s.deliver(testDay, driveMail("Placement drive"))
+	}
+	s.deliver(testDay.AddDate(0, 0, 1), driveMail("Too new"))
+
+	ctx := context.Background()
+	mb := New(s.config()).(*imapMailbox)
+	req := mailbox.SearchRequest{
+		Query:    "subject:placement OR subject:too",
+		After:    testDay.AddDate(0, 0, -1),
+		Before:   testDay.Add(time.Hour),
+		PageSize: 2,
+	}
+
+	var uids []uint32
+	for pages := 1; ; pages++ {
+		page, err := mb.SearchPage(ctx, req)
+		if err != nil {
+			t.Fatalf("SearchPage: %v", err)
+		}
+		for _, id := range page.IDs {
+			_, uid, _ := mb.parseID(id)
+			uids = append(uids, uid)
+		}
+		if page.NextPageToken == "" {
+			if pages != 3 {
+				t.Errorf("got %d pages, want 3", pages)
+			}
+			break
+		}
+		req.PageToken = page.NextPageToken
+	}
+	if want := []uint32{6, 5, 4, 3, 2}; !slices.Equal(uids, want) {
+		t.Errorf("paged through %v, want %v", uids, want)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	s := newTestServer(t, false)
+	s.deliver(testDay, driveMail("First"))
+
+	ctx := context.Background()
+	mb := New(s.config()).(*imapMailbox)
+	feed := mailbox.Mailbox(mb).(mailbox.ChangeFeed)
+
+	cursor, err := feed.Cursor(ctx)
+	if err != nil {
+		t.Fatalf("Cursor: %v", err)
+	}
+	if cursor != "1700.2" {
+		t.Fatalf("cursor = %q", cursor)
+	}
+
+	added, next, err := feed.Added(ctx, cursor)
+	if err != nil || len(added) != 0 || next != cursor {
+		t.Fatalf("Added with nothing new = %v, %q, %v", added, next, err)
+	}
+
+	s.deliver(testDay, driveMail("Second"))
+	s.deliver(testDay, driveMail("Third"))
+	added, next, err = feed.Added(ctx, cursor)
+	if err != nil {
+		t.Fatalf("Added: %v", err)
+	}
+	if want := []string{mb.messageID(1700, 3), mb.messageID(1700, 2)}; !slices.Equal(added, want) || next != "1700.4" {
+		t.Errorf("Added = %v, %q, want %v, 1700.4", added, next, want)
+	}
+
+	// The server renumbered the folder.
+	s.mu.Lock()
+	s.uidValidity = 1800
+	s.mu.Unlock()
+	if _, _, err := feed.Added(ctx, next); !errors.Is(err, mailbox.ErrCursorExpired) {
+		t.Errorf("Added after a UIDVALIDITY change = %v, want ErrCursorExpired", err)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("wrong app password", func(t *testing.T) {
+		s := newTestServer(t, false)
+		cfg := s.config()
+		cfg.Password = "old-password"
+		if err := Check(ctx, cfg); !errors.Is(err, mailbox.ErrReauthRequired) {
+			t.Errorf("Check = %v, want ErrReauthRequired", err)
+		}
+	})
+
+	t.Run("password with quotes", func(t *testing.T) {
+		s := newTestServer(t, false)
+		s.password = `p"a\ss`
+		if err := Check(ctx, s.config()); err != nil {
+			t.Errorf("Check: %v", err)
+		}
+	})
+
+	t.Run("non-ascii password as literal", func(t *testing.T) {
+		s := newTestServer(t, false)
+		s.password = "pässwörd"
+		if err := Check(ctx, s.config()); err != nil {
+			t.Errorf("Check: %v", err)
+		}
+	})
+
+	t.Run("xoauth2 over starttls", func(t *testing.T) {
+		s := newTestServer(t, true)
+		cfg := s.config()
+		cfg.Token = func(ctx context.Context) (string, error) { return "oauth-token", nil }
+		if err := Check(ctx, cfg); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if !slices.Contains(s.commands, "STARTTLS") {
+			t.Error("client did not upgrade the connection")
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		s := newTestServer(t, false)
+		cfg := s.config()
+		cfg.Token = func(ctx context.Context) (string, error) { return "expired", nil }
+		if err := Check(ctx, cfg); !errors.Is(err, mailbox.ErrReauthRequired) {
+			t.Errorf("Check = %v, want ErrReauthRequired", err)
+		}
+	})
+
+	t.Run("private address", func(t *testing.T) {
+		s := newTestServer(t, false)
+		cfg := s.config()
+		cfg.PublicOnly = true
+		if err := Check(ctx, cfg); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("Check = %v, want ErrPrivateAddress", err)
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		s := newTestServer(t, false)
+		cfg := s.config()
+		cfg.TLSConfig = nil
+		if err := Check(ctx, cfg); err == nil {
+			t.Error("connected to a server with an untrusted certificate")
+		}
+	})
+}
+
+func TestSearchCriteria(t *testing.T) {
+	after := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		query string
+		want  []any
+	}{
+		{"", []any{"ALL"}},
+		{"from:a@b.c", []any{"FROM", astring("a@b.c")}},
+		{"from:a OR subject:b", []any{"OR", "FROM", astring("a"), "SUBJECT", astring("b")}},
+		{"from:a OR subject:b OR c", []any{"OR", "FROM", astring("a"), "OR", "SUBJECT", astring("b"), "TEXT", astring("c")}},
+		{`subject:"campus drive" -from:spam`, []any{"SUBJECT", astring("campus drive"), "NOT", "FROM", astring("spam")}},
+	}
+	for _, tt := range tests {
+		if got := searchCriteria(tt.query, time.Time{}, time.Time{}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchCriteria(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	got := searchCriteria("", after, before)
+	if want := []any{"SINCE", "1-Jan-2026", "BEFORE", "2-Feb-2026"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("window = %v, want %v", got, want)
+	}
+}
+
+func latin1Mail() string {
+	return "From: =?ISO-8859-1?Q?Cell_d=27Emploi_Universit=E9?= <emploi@univ.example>\n" +
+		"Subject: =?windows-1252?Q?=93Forum_entreprises=94?=\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\n" +
+		"Content-Transfer-Encoding: quoted-printable\n" +
+		"\n" +
+		"Inscription avant le 12 f=E9vrier, salle B=E9ta.\n"
+}
+
+func TestParseMessageCharsets(t *testing.T) {
+	msg, err := parseMessage("id", []byte(latin1Mail()))
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if msg.From != "Cell d'Emploi Université <emploi@univ.example>" || msg.Subject != "“Forum entreprises”" {
+		t.Errorf("headers = %q, %q", msg.From, msg.Subject)
+	}
+	if msg.Body != "Inscription avant le 12 février, salle Béta." {
+		t.Errorf("body = %q", msg.Body)
+	}
+}
+
+func TestParseMessageThreads(t *testing.T) {
+	for _, tt := range []struct{ headers, want string }{
+		{"Message-ID: <drive@college.edu>\n", "drive@college.edu"},
+		{"Message-ID: <reminder@college.edu>\nIn-Reply-To: <drive@college.edu>\n", "drive@college.edu"},
+		{"Message-ID: <list@college.edu>\nIn-Reply-To: <reminder@college.edu>\nReferences: <drive@college.edu>\n <reminder@college.edu>\n", "drive@college.edu"},
+		{"Subject: no IDs\n", ""},
+	} {
+		msg, err := parseMessage("id", []byte(tt.headers+"\nBody\n"))
+		if err != nil || msg.ThreadID != tt.want {
+			t.Errorf("parseMessage(%q) thread = %q, %v, want %q", tt.headers, msg.ThreadID, err, tt.want)
+		}
+	}
+}
+
+// FuzzParseMessage checks that no message, however mangled, stops the
+// parser or gets invalid UTF-8 past it.
+func FuzzParseMessage(f *testing.F) {
+	f.Add([]byte(driveMail("Campus drive")))
+	f.Add([]byte(jdMail()))
+	f.Add([]byte(latin1Mail()))
+	f.Add([]byte("Content-Type: multipart/alternative; boundary=b\n\n--b\nContent-Type: text/html; charset=koi8-r\nContent-Transfer-Encoding: base64\n\n8NLJ18XU\n--b--\n"))
+	f.Add([]byte("Subject: \xff\xfe\nContent-Type: text/plain; charset=utf-8\n\n\xc3\x28 broken\n"))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		msg, err := parseMessage("id", raw)
+		if err != nil {
+			return
+		}
+		for _, s := range []string{msg.Subject, msg.From, msg.Body, msg.Snippet} {
+			if !utf8.ValidString(s) {
+				t.Errorf("invalid UTF-8 %q", s)
+			}
+		}
+		for _, a := range msg.Attachments {
+			if _, ok := attachment(raw, a.ID); !ok {
+				t.Errorf("attachment %s cannot be cut out again", a.ID)
+			}
+		}
+	})
+}
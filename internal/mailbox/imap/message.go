@@ -0,0 +1,153 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
+	"github.com/r7rainz/auramail/internal/utils"
+)
+
+const snippetLength = 200
+
+// part is a leaf of a MIME tree. path numbers it the way IMAP does: "1" for
+// a single-part message and "2.1" for the first child of the second part.
+type part struct {
+	path        string
+	mediaType   string
+	charset     string
+	filename    string
+	disposition string
+	content     []byte
+}
+
+// parseMessage turns a raw message into the pipeline's view of it.
+func parseMessage(id string, raw []byte) (*mailbox.Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	email := &mailbox.Message{
+		ID:      id,
+		Subject: utils.DecodeHeader(msg.Header.Get("Subject")),
+		From:    utils.DecodeHeader(msg.Header.Get("From")),
+		Date:    msg.Header.Get("Date"),
+	}
+	email.ThreadID = threadID(msg.Header)
+
+	// The HTML version is what the sender's readers see, so it wins over a
+	// plain text alternative, as in utils.ParseBody.
+	var plain, html string
+	parts := walk(msg.Header, msg.Body, "")
+	for _, p := range parts {
+		if p.isAttachment() {
+			email.Attachments = append(email.Attachments, mailbox.Attachment{
+				ID:       p.path,
+				Filename: p.filename,
+				MimeType: p.mediaType,
+				Size:     len(p.content),
+			})
+			continue
+		}
+		switch {
+		case plain == "" && p.mediaType == "text/plain":
+			plain = utils.CleanTextForAi(utils.DecodeCharset(p.content, p.charset, p.mediaType))
+		case html == "" && p.mediaType == "text/html":
+			html = utils.HTMLBody(utils.DecodeCharset(p.content, p.charset, p.mediaType))
+		}
+	}
+	email.Body = html
+	if email.Body == "" {
+		email.Body = plain
+	}
+
+	email.Snippet = email.Body
+	if runes := []rune(email.Snippet); len(runes) > snippetLength {
+		email.Snippet = string(runes[:snippetLength])
+	}
+	return email, nil
+}
+
+// threadID names the conversation of a message after the message that
+// started it: the first of its References, else the message it replies to,
+// else the message itself. IMAP has no thread IDs of its own.
+func threadID(h mail.Header) string {
+	for _, key := range []string{"References", "In-Reply-To", "Message-Id"} {
+		if ids := strings.Fields(h.Get(key)); len(ids) > 0 {
+			return strings.Trim(ids[0], "<>")
+		}
+	}
+	return ""
+}
+
+// attachment returns the decoded content of the part at path.
+func attachment(raw []byte, path string) ([]byte, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	for _, p := range walk(msg.Header, msg.Body, "") {
+		if p.path == path && p.isAttachment() {
+			return p.content, true
+		}
+	}
+	return nil, false
+}
+
+func (p *part) isAttachment() bool {
+	return p.disposition == "attachment" || (p.filename != "" && p.disposition != "inline")
+}
+
+// header is what walk needs of a message or part header.
+type header interface {
+	Get(key string) string
+}
+
+// walk collects the leaves below a part. Parts that cannot be parsed are
+// skipped rather than failing the whole message.
+func walk(h header, body io.Reader, path string) []*part {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var parts []*part
+		r := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			child, err := r.NextRawPart()
+			if err != nil {
+				break
+			}
+			childPath := strconv.Itoa(i)
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			parts = append(parts, walk(child.Header, child, childPath)...)
+		}
+		return parts
+	}
+
+	if path == "" {
+		path = "1"
+	}
+	content, err := io.ReadAll(utils.DecodeTransfer(body, h.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return nil
+	}
+	p := &part{path: path, mediaType: mediaType, charset: params["charset"], filename: params["name"], content: content}
+	if disposition, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		p.disposition = disposition
+		if name := dparams["filename"]; name != "" {
+			p.filename = name
+		}
+	}
+	p.filename = utils.DecodeHeader(p.filename)
+	return []*part{p}
+}
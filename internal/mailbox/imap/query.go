@@ -0,0 +1,105 @@
+package imap
+
+import (
+	"strings"
+	"time"
+)
+
+// searchKeys maps the Gmail-style "key:value" terms the pipeline uses to
+// IMAP SEARCH keys. Anything else is searched for as text.
+var searchKeys = map[string]string{
+	"from":    "FROM",
+	"to":      "TO",
+	"cc":      "CC",
+	"subject": "SUBJECT",
+}
+
+// searchCriteria translates a query in the common "from:" / "subject:"
+// syntax, with OR between terms and a leading "-" to negate one, into UID
+// SEARCH criteria. IMAP dates have day precision, so the window is widened
+// to whole days: after is rounded down and before up.
+func searchCriteria(query string, after, before time.Time) []any {
+	var criteria []any
+	var chain [][]any
+	flush := func() {
+		for i, term := range chain {
+			if i < len(chain)-1 {
+				criteria = append(criteria, "OR")
+			}
+			criteria = append(criteria, term...)
+		}
+		chain = nil
+	}
+
+	orNext := false
+	for _, token := range tokenize(query) {
+		if token == "OR" {
+			orNext = len(chain) > 0
+			continue
+		}
+		if !orNext {
+			flush()
+		}
+		orNext = false
+		chain = append(chain, searchTerm(token))
+	}
+	flush()
+
+	if !after.IsZero() {
+		criteria = append(criteria, "SINCE", imapDate(after))
+	}
+	if !before.IsZero() {
+		day := before.UTC().Truncate(24 * time.Hour)
+		if day.Before(before) {
+			day = day.AddDate(0, 0, 1)
+		}
+		criteria = append(criteria, "BEFORE", imapDate(day))
+	}
+	if len(criteria) == 0 {
+		criteria = append(criteria, "ALL")
+	}
+	return criteria
+}
+
+func searchTerm(token string) []any {
+	var term []any
+	if rest, ok := strings.CutPrefix(token, "-"); ok && rest != "" {
+		term = append(term, "NOT")
+		token = rest
+	}
+	if key, value, ok := strings.Cut(token, ":"); ok && value != "" {
+		if imapKey, ok := searchKeys[strings.ToLower(key)]; ok {
+			return append(term, imapKey, astring(strings.Trim(value, `"`)))
+		}
+	}
+	return append(term, "TEXT", astring(strings.Trim(token, `"`)))
+}
+
+// tokenize splits query on spaces outside double quotes.
+func tokenize(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case r == ' ' && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func imapDate(t time.Time) string {
+	return t.UTC().Format("2-Jan-2006")
+}
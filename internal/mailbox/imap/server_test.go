@@ -0,0 +1,457 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r7rainz/auramail/internal/utils"
+)
+
+// testServer is an in-process IMAP server with one folder. It understands the
+// subset of IMAP4rev1 the client sends, checks credentials and records the
+// commands it was given.
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	tls      *tls.Config
+	starttls bool // plain listener that offers STARTTLS
+
+	mu          sync.Mutex
+	username    string
+	password    string
+	token       string
+	uidValidity uint32
+	nextUID     uint32
+	messages    []testMessage
+	logins      int
+	commands    []string
+}
+
+type testMessage struct {
+	uid  uint32
+	date time.Time
+	raw  string
+}
+
+func newTestServer(t *testing.T, starttls bool) *testServer {
+	s := &testServer{
+		t:           t,
+		tls:         testCertificate(t),
+		starttls:    starttls,
+		username:    "student@college.edu",
+		password:    "app-password",
+		token:       "oauth-token",
+		uidValidity: 1700,
+		nextUID:     1,
+	}
+
+	var err error
+	if starttls {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	} else {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+
+	go func() {
+		for {
+			nc, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+// config returns a client configuration for the server that trusts its
+// certificate.
+func (s *testServer) config() Config {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	security := SecurityTLS
+	if s.starttls {
+		security = SecuritySTARTTLS
+	}
+	return Config{
+		Host:      "127.0.0.1",
+		Port:      addr.Port,
+		Security:  security,
+		Username:  s.username,
+		Password:  s.password,
+		TLSConfig: &tls.Config{RootCAs: s.tls.RootCAs, ServerName: "127.0.0.1"},
+	}
+}
+
+func (s *testServer) deliver(date time.Time, raw string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid := s.nextUID
+	s.nextUID++
+	s.messages = append(s.messages, testMessage{uid: uid, date: date, raw: strings.ReplaceAll(raw, "\n", "\r\n")})
+	return uid
+}
+
+func (s *testServer) serve(nc net.Conn) {
+	defer nc.Close()
+	r, w := bufio.NewReader(nc), bufio.NewWriter(nc)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	reply("* OK test server ready")
+	authenticated := false
+	for {
+		tag, args, err := readCommand(r, w)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			reply("%s BAD empty command", tag)
+			continue
+		}
+		name := strings.ToUpper(args[0])
+		if name == "UID" && len(args) > 1 {
+			name += " " + strings.ToUpper(args[1])
+			args = args[1:]
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, name)
+		s.mu.Unlock()
+
+		switch name {
+		case "CAPABILITY":
+			caps := "IMAP4rev1 AUTH=XOAUTH2 LITERAL+"
+			// Only the implicit TLS listener takes an initial response,
+			// so XOAUTH2 over STARTTLS waits for the continuation.
+			if !s.starttls {
+				caps += " SASL-IR"
+			} else if _, ok := nc.(*tls.Conn); !ok {
+				caps += " STARTTLS LOGINDISABLED"
+			}
+			reply("* CAPABILITY %s", caps)
+			reply("%s OK CAPABILITY completed", tag)
+		case "STARTTLS":
+			reply("%s OK begin TLS", tag)
+			tc := tls.Server(nc, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			nc, r, w = tc, bufio.NewReader(tc), bufio.NewWriter(tc)
+		case "LOGIN":
+			if len(args) != 3 || args[1] != s.username || args[2] != s.password {
+				reply("%s NO [AUTHENTICATIONFAILED] invalid credentials", tag)
+				continue
+			}
+			authenticated = true
+			s.countLogin()
+			reply("%s OK LOGIN completed", tag)
+		case "AUTHENTICATE":
+			var ir string
+			if len(args) > 2 {
+				ir = args[2]
+			} else {
+				reply("+ ")
+				line, _ := r.ReadString('\n')
+				ir = strings.TrimSpace(line)
+			}
+			decoded, _ := base64.StdEncoding.DecodeString(ir)
+			if string(decoded) != "user="+s.username+"\x01auth=Bearer "+s.token+"\x01\x01" {
+				reply("+ %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`)))
+				r.ReadString('\n')
+				reply("%s NO [AUTHENTICATIONFAILED] invalid token", tag)
+				continue
+			}
+			authenticated = true
+			s.countLogin()
+			reply("%s OK AUTHENTICATE completed", tag)
+		case "EXAMINE":
+			if !authenticated {
+				reply("%s NO not authenticated", tag)
+				continue
+			}
+			s.mu.Lock()
+			reply("* %d EXISTS", len(s.messages))
+			reply("* OK [UIDVALIDITY %d] UIDs valid", s.uidValidity)
+			reply("* OK [UIDNEXT %d] Predicted next UID", s.nextUID)
+			s.mu.Unlock()
+			reply("%s OK [READ-ONLY] EXAMINE completed", tag)
+		case "UID SEARCH":
+			criteria := args[1:]
+			if len(criteria) > 1 && strings.EqualFold(criteria[0], "CHARSET") {
+				criteria = criteria[2:]
+			}
+			s.mu.Lock()
+			var uids []string
+			for _, m := range s.messages {
+				if m.matches(criteria, s.maxUID()) {
+					uids = append(uids, strconv.Itoa(int(m.uid)))
+				}
+			}
+			s.mu.Unlock()
+			reply("* SEARCH %s", strings.Join(uids, " "))
+			reply("%s OK SEARCH completed", tag)
+		case "UID FETCH":
+			if len(args) < 3 {
+				reply("%s BAD missing arguments", tag)
+				continue
+			}
+			s.mu.Lock()
+			for i, m := range s.messages {
+				if !inSet(args[1], m.uid, s.maxUID()) {
+					continue
+				}
+				if strings.Contains(strings.ToUpper(strings.Join(args[2:], " ")), "BODY.PEEK[]") {
+					fmt.Fprintf(w, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", i+1, m.uid, len(m.raw), m.raw)
+				} else {
+					fmt.Fprintf(w, "* %d FETCH (UID %d)\r\n", i+1, m.uid)
+				}
+			}
+			s.mu.Unlock()
+			reply("%s OK FETCH completed", tag)
+		case "LOGOUT":
+			reply("* BYE")
+			reply("%s OK LOGOUT completed", tag)
+			return
+		default:
+			reply("%s BAD unknown command %s", tag, name)
+		}
+	}
+}
+
+func (s *testServer) countLogin() {
+	s.mu.Lock()
+	s.logins++
+	s.mu.Unlock()
+}
+
+func (s *testServer) maxUID() uint32 {
+	if len(s.messages) == 0 {
+		return 0
+	}
+	return s.messages[len(s.messages)-1].uid
+}
+
+// readCommand reads a tag and the arguments of one command, unquoting
+// strings and reading literals.
+func readCommand(r *bufio.Reader, w *bufio.Writer) (string, []string, error) {
+	var args []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		literal := -1
+		if n, ok := literalSize(line); ok {
+			literal = n
+			if !strings.HasSuffix(line, "+}") {
+				fmt.Fprintf(w, "+ ready\r\n")
+				w.Flush()
+			}
+			line = line[:strings.LastIndexByte(line, '{')]
+		}
+		args = append(args, splitArgs(line)...)
+		if literal < 0 {
+			break
+		}
+		buf := make([]byte, literal)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", nil, err
+		}
+		args = append(args, string(buf))
+	}
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("empty line")
+	}
+	return args[0], args[1:], nil
+}
+
+func splitArgs(line string) []string {
+	var args []string
+	var current strings.Builder
+	inQuote, escaped, started := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case inQuote && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+			started = true
+		case r == ' ' && !inQuote:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// matches evaluates criteria, a list of search keys that must all match.
+func (m testMessage) matches(criteria []string, maxUID uint32) bool {
+	ok := true
+	for len(criteria) > 0 {
+		var match bool
+		var err error
+		criteria, match, err = m.matchOne(criteria, maxUID)
+		if err != nil {
+			return false
+		}
+		ok = ok && match
+	}
+	return ok
+}
+
+// matchOne evaluates the first search key of criteria and returns the keys
+// after it.
+func (m testMessage) matchOne(criteria []string, maxUID uint32) ([]string, bool, error) {
+	key := strings.ToUpper(criteria[0])
+	rest := criteria[1:]
+	header := func(name string) string {
+		for _, line := range strings.Split(m.raw, "\r\n") {
+			if line == "" {
+				break
+			}
+			if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, name) {
+				// Servers search decoded headers.
+				return strings.ToLower(utils.DecodeHeader(v))
+			}
+		}
+		return ""
+	}
+	arg := func() (string, error) {
+		if len(rest) == 0 {
+			return "", fmt.Errorf("%s needs an argument", key)
+		}
+		v := rest[0]
+		rest = rest[1:]
+		return v, nil
+	}
+	day := func(t time.Time) time.Time { return t.UTC().Truncate(24 * time.Hour) }
+
+	switch key {
+	case "ALL":
+		return rest, true, nil
+	case "FROM", "TO", "CC", "SUBJECT":
+		v, err := arg()
+		return rest, strings.Contains(header(key), strings.ToLower(v)), err
+	case "TEXT":
+		v, err := arg()
+		return rest, strings.Contains(strings.ToLower(m.raw), strings.ToLower(v)), err
+	case "SINCE", "BEFORE":
+		v, err := arg()
+		if err != nil {
+			return rest, false, err
+		}
+		d, err := time.Parse("2-Jan-2006", v)
+		if key == "SINCE" {
+			return rest, !day(m.date).Before(d), err
+		}
+		return rest, day(m.date).Before(d), err
+	case "UID":
+		v, err := arg()
+		return rest, inSet(v, m.uid, maxUID), err
+	case "NOT":
+		rest, match, err := m.matchOne(rest, maxUID)
+		return rest, !match, err
+	case "OR":
+		rest, a, err := m.matchOne(rest, maxUID)
+		if err != nil || len(rest) == 0 {
+			return rest, false, fmt.Errorf("OR needs two keys")
+		}
+		rest, b, err := m.matchOne(rest, maxUID)
+		return rest, a || b, err
+	}
+	return rest, false, fmt.Errorf("unknown search key %s", key)
+}
+
+// inSet reports whether uid is in a sequence set such as "4", "2:5" or "7:*".
+func inSet(set string, uid, maxUID uint32) bool {
+	for _, r := range strings.Split(set, ",") {
+		lo, hi, isRange := strings.Cut(r, ":")
+		parse := func(v string) uint32 {
+			if v == "*" {
+				return maxUID
+			}
+			n, _ := strconv.ParseUint(v, 10, 32)
+			return uint32(n)
+		}
+		a := parse(lo)
+		b := a
+		if isRange {
+			b = parse(hi)
+		}
+		if a > b {
+			a, b = b, a
+		}
+		if uid >= a && uid <= b {
+			return true
+		}
+	}
+	return false
+}
+
+// testCertificate returns a server config with a fresh self-signed
+// certificate for 127.0.0.1, whose RootCAs trust it.
+func testCertificate(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "imap.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      roots,
+	}
+}
@@ -0,0 +1,206 @@
+// Package mailbox is the provider-neutral view of a user's mail that the sync
+// and summary pipeline works against.
+package mailbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrReauthRequired means the provider no longer honours the stored grant
+	// (the user revoked access, changed their password, or the token expired)
+	// and nothing will work until they log in again.
+	ErrReauthRequired = errors.New("mailbox access revoked, reauthorization required")
+
+	// ErrCursorExpired means the provider no longer keeps changes that far
+	// back and the caller has to search again from scratch.
+	ErrCursorExpired = errors.New("change cursor expired, full resync required")
+
+	// ErrUnavailable means the provider kept turning requests down for now,
+	// usually for exceeding a rate limit, and trying later may work.
+	ErrUnavailable = errors.New("mailbox temporarily unavailable")
+)
+
+type Message struct {
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	Date    string `json:"date"`
+	Body    string `json:"body"`
+	Snippet string `json:"snippet"`
+
+	// ThreadID groups the message with the others of its conversation, such
+	// as the reminders and updates that follow an announcement. It is empty
+	// if the mailbox cannot tell.
+	ThreadID string `json:"threadId,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment describes a file attached to a message. ID is only meaningful to
+// the mailbox the message came from, together with the message ID.
+type Attachment struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mimeType"`
+	Size     int    `json:"size"`
+}
+
+// SearchRequest selects one page of a search. After and Before bound the date
+// the message was received (After inclusive, Before exclusive); a zero value
+// leaves that side open.
+type SearchRequest struct {
+	Query     string
+	After     time.Time
+	Before    time.Time
+	PageToken string
+	PageSize  int
+}
+
+type Page struct {
+	IDs []string
+	// NextPageToken is empty on the last page.
+	NextPageToken string
+	// Estimate is the provider's guess at the total number of matches, or 0
+	// if it does not give one.
+	Estimate int
+}
+
+type Mailbox interface {
+	// Search returns the IDs of up to max messages matching query, newest
+	// first. The query uses the provider's search syntax; "from:" and
+	// "subject:" terms work for every provider.
+	Search(ctx context.Context, query string, max int) ([]string, error)
+
+	// SearchPage returns one page of matches for req, newest first. Passing
+	// the returned NextPageToken back in req.PageToken continues where the
+	// previous page stopped; tokens stay valid across restarts.
+	SearchPage(ctx context.Context, req SearchRequest) (*Page, error)
+
+	Fetch(ctx context.Context, id string) (*Message, error)
+
+	// FetchAttachment returns the decoded content of one of the attachments
+	// Fetch listed for messageID.
+	FetchAttachment(ctx context.Context, messageID, attachmentID string) ([]byte, error)
+}
+
+// ChangeFeed is implemented by mailboxes that can list what arrived since an
+// earlier point, which costs far less quota than searching again.
+type ChangeFeed interface {
+	// Cursor returns the current position in the mailbox's change log.
+	Cursor(ctx context.Context) (string, error)
+
+	// Added returns the IDs of messages added since cursor, newest first,
+	// and the cursor to pass next time. It returns ErrCursorExpired if
+	// cursor is too old.
+	Added(ctx context.Context, cursor string) ([]string, string, error)
+}
+
+// Watcher is implemented by mailboxes that can push change notifications.
+type Watcher interface {
+	// Watch asks the provider to notify topic of new mail until the
+	// returned expiry, replacing any earlier watch.
+	Watch(ctx context.Context, topic string) (expires time.Time, err error)
+}
+
+// BatchFetcher is implemented by mailboxes that can fetch many messages in
+// one round trip.
+type BatchFetcher interface {
+	// FetchBatch fetches ids. The results line up with ids: for each, either
+	// the message or the error Fetch would have returned for it.
+	FetchBatch(ctx context.Context, ids []string) ([]*Message, []error)
+}
+
+// FetchAll fetches ids with FetchBatch if mb supports it, and otherwise with
+// up to workers concurrent Fetch calls. The results line up with ids. Once a
+// fetch reports ErrReauthRequired the remaining ones are not attempted and
+// report it too.
+func FetchAll(ctx context.Context, mb Mailbox, ids []string, workers int) ([]*Message, []error) {
+	if bf, ok := mb.(BatchFetcher); ok {
+		return bf.FetchBatch(ctx, ids)
+	}
+
+	msgs := make([]*Message, len(ids))
+	errs := make([]error, len(ids))
+	jobs := make(chan int)
+	var reauth atomic.Bool
+
+	var wg sync.WaitGroup
+	for range min(max(workers, 1), len(ids)) {
+		wg.Go(func() {
+			for i := range jobs {
+				if reauth.Load() {
+					errs[i] = ErrReauthRequired
+					continue
+				}
+				msgs[i], errs[i] = mb.Fetch(ctx, ids[i])
+				if errors.Is(errs[i], ErrReauthRequired) {
+					reauth.Store(true)
+				}
+			}
+		})
+	}
+	for i := range ids {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return msgs, errs
+}
+
+// DroppedError lists the messages a fetch had to leave out and why.
+type DroppedError struct {
+	IDs  []string
+	Errs []error
+}
+
+// Dropped collects the failures among the results of FetchAll. It returns
+// nil if every message was fetched.
+func Dropped(ids []string, errs []error) error {
+	var dropped DroppedError
+	for i, err := range errs {
+		if err != nil {
+			dropped.IDs = append(dropped.IDs, ids[i])
+			dropped.Errs = append(dropped.Errs, err)
+		}
+	}
+	if len(dropped.IDs) == 0 {
+		return nil
+	}
+	return &dropped
+}
+
+func (e *DroppedError) Error() string {
+	return fmt.Sprintf("%d messages could not be fetched, first %s: %v", len(e.IDs), e.IDs[0], e.Errs[0])
+}
+
+// Temporary reports whether any message was dropped only because the
+// provider was unavailable, so fetching again later may get it.
+func (e *DroppedError) Temporary() bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, ErrUnavailable) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckGrant turns an invalid_grant answer from the provider's token endpoint,
+// which surfaces on the first API call rather than when the client is built,
+// into ErrReauthRequired. Other errors are returned unchanged.
+func CheckGrant(err error) error {
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) && re.ErrorCode == "invalid_grant" {
+		return fmt.Errorf("%w: %v", ErrReauthRequired, err)
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+// Package secrets encrypts credentials before they are written to the database.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Ciphertexts look like enc:v1:<key version>:<wrapped data key>:<sealed value>.
+// Every value gets its own random data key, which is itself sealed with the
+// versioned key-encryption key from the ring.
+const (
+	prefix       = "enc:v1:"
+	keySize      = 32
+	dataKeyAAD   = "auramail-data-key"
+	keysEnv      = "CREDENTIAL_KEYS"
+	activeKeyEnv = "CREDENTIAL_ACTIVE_KEY"
+)
+
+var (
+	ErrUnknownKey       = errors.New("unknown key version")
+	ErrMalformedCipher  = errors.New("malformed ciphertext")
+	ErrKeyRingNotLoaded = errors.New("CREDENTIAL_KEYS not set")
+)
+
+type KeyRing struct {
+	active int
+	keys   map[int][]byte
+}
+
+func NewKeyRing(active int, keys map[int][]byte) (*KeyRing, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %d: %w", active, ErrUnknownKey)
+	}
+	for version, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key %d must be %d bytes, got %d", version, keySize, len(key))
+		}
+	}
+	return &KeyRing{active: active, keys: keys}, nil
+}
+
+// LoadKeyRing reads CREDENTIAL_KEYS as a comma separated list of
+// version:base64key pairs. CREDENTIAL_ACTIVE_KEY picks the version used for new
+// writes and defaults to the highest one.
+func LoadKeyRing() (*KeyRing, error) {
+	raw := os.Getenv(keysEnv)
+	if raw == "" {
+		return nil, ErrKeyRingNotLoaded
+	}
+
+	keys := make(map[int][]byte)
+	active := 0
+	for _, entry := range strings.Split(raw, ",") {
+		versionStr, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q", keysEnv, entry)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid key version %q", versionStr)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %d is not valid base64: %w", version, err)
+		}
+		keys[version] = key
+		if version > active {
+			active = version
+		}
+	}
+
+	if v := os.Getenv(activeKeyEnv); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", activeKeyEnv, v)
+		}
+		active = parsed
+	}
+
+	return NewKeyRing(active, keys)
+}
+
+func (k *KeyRing) ActiveVersion() int {
+	return k.active
+}
+
+func (k *KeyRing) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("could not generate data key: %w", err)
+	}
+
+	wrapped, err := seal(k.keys[k.active], dataKey, []byte(dataKeyAAD))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%d:%s:%s",
+		prefix,
+		k.active,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(sealed),
+	), nil
+}
+
+// Decrypt reverses Encrypt. Values written before encryption was enabled do
+// not carry the prefix and are returned unchanged so they keep working until
+// the rekey command rewrites them.
+func (k *KeyRing) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	version, wrapped, sealed, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+	kek, ok := k.keys[version]
+	if !ok {
+		return "", fmt.Errorf("key %d: %w", version, ErrUnknownKey)
+	}
+
+	dataKey, err := open(kek, wrapped, []byte(dataKeyAAD))
+	if err != nil {
+		return "", fmt.Errorf("could not unwrap data key: %w", err)
+	}
+	plaintext, err := open(dataKey, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether value is plaintext or sealed under a key other
+// than the active one.
+func (k *KeyRing) NeedsRotation(value string) bool {
+	if !IsEncrypted(value) {
+		return true
+	}
+	version, _, _, err := parse(value)
+	return err != nil || version != k.active
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+func parse(value string) (int, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return 0, nil, nil, ErrMalformedCipher
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, nil, ErrMalformedCipher
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, nil, nil, ErrMalformedCipher
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, ErrMalformedCipher
+	}
+	return version, wrapped, sealed, nil
+}
+
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrMalformedCipher
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,116 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	ring, err := NewKeyRing(1, map[int][]byte{1: testKey(1)})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+
+	sealed, err := ring.Encrypt("1//0google-refresh-token")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if strings.Contains(sealed, "google-refresh-token") {
+		t.Fatal("ciphertext leaks the plaintext")
+	}
+
+	again, _ := ring.Encrypt("1//0google-refresh-token")
+	if again == sealed {
+		t.Error("two encryptions of the same value should differ")
+	}
+
+	plain, err := ring.Decrypt(sealed)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if plain != "1//0google-refresh-token" {
+		t.Errorf("got %q", plain)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	oldRing, _ := NewKeyRing(1, map[int][]byte{1: testKey(1)})
+	sealed, _ := oldRing.Encrypt("token")
+
+	newRing, err := NewKeyRing(2, map[int][]byte{1: testKey(1), 2: testKey(2)})
+	if err != nil {
+		t.Fatalf("NewKeyRing: %v", err)
+	}
+
+	current, _ := newRing.Encrypt("token")
+
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{name: "plaintext legacy value", value: "token", want: true},
+		{name: "sealed with old key", value: sealed, want: true},
+		{name: "sealed with active key", value: current, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newRing.NeedsRotation(tt.value); got != tt.want {
+				t.Errorf("NeedsRotation = %v, want %v", got, tt.want)
+			}
+			plain, err := newRing.Decrypt(tt.value)
+			if err != nil || plain != "token" {
+				t.Errorf("Decrypt = %q, %v", plain, err)
+			}
+		})
+	}
+
+	retired, _ := NewKeyRing(2, map[int][]byte{2: testKey(2)})
+	if _, err := retired.Decrypt(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	ring, _ := NewKeyRing(1, map[int][]byte{1: testKey(1)})
+	sealed, _ := ring.Encrypt("token")
+
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if _, err := ring.Decrypt(tampered); err == nil {
+		t.Error("tampered ciphertext should not decrypt")
+	}
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(testKey(1))
+	k2 := base64.StdEncoding.EncodeToString(testKey(2))
+
+	t.Setenv("CREDENTIAL_KEYS", "1:"+k1+", 2:"+k2)
+	t.Setenv("CREDENTIAL_ACTIVE_KEY", "")
+	ring, err := LoadKeyRing()
+	if err != nil {
+		t.Fatalf("LoadKeyRing: %v", err)
+	}
+	if ring.ActiveVersion() != 2 {
+		t.Errorf("active version = %d, want 2", ring.ActiveVersion())
+	}
+
+	t.Setenv("CREDENTIAL_ACTIVE_KEY", "3")
+	if _, err := LoadKeyRing(); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+
+	t.Setenv("CREDENTIAL_KEYS", "1:"+base64.StdEncoding.EncodeToString([]byte("short")))
+	t.Setenv("CREDENTIAL_ACTIVE_KEY", "")
+	if _, err := LoadKeyRing(); err == nil {
+		t.Error("short key should be rejected")
+	}
+}
@@ -0,0 +1,68 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInvalidInvite  = errors.New("invite code is invalid, expired or used up")
+)
+
+// Signup describes how an account is created on first login. When InviteHash
+// is set the invite is redeemed in the same transaction that creates the user,
+// so a single-use code cannot be spent twice. The zero Signup creates no
+// account.
+type Signup struct {
+	Status     Status
+	InviteHash string
+}
+
+// Invite lets people sign up while the invite-only policy is active. Only the
+// hash of the code is stored; Email, when set, restricts who may redeem it.
+type Invite struct {
+	ID        int        `json:"id"`
+	CodeHash  string     `json:"-"`
+	Email     string     `json:"email,omitempty"`
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	CreatedBy int        `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+type InviteStore interface {
+	Create(ctx context.Context, invite *Invite) error
+
+	// ListActive returns invites that are unrevoked, unexpired and not used
+	// up, newest first.
+	ListActive(ctx context.Context) ([]*Invite, error)
+
+	// Revoke returns ErrInviteNotFound if there is no such active invite.
+	Revoke(ctx context.Context, id int) error
+}
+
+// NewInviteCode returns a code short enough to read out or paste into a link,
+// and the hash to store for it.
+func NewInviteCode() (code, hash string, err error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	code = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	return code, HashInviteCode(code), nil
+}
+
+// HashInviteCode ignores case and surrounding spaces, which people add when
+// copying codes by hand.
+func HashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,5 +1,7 @@
 package user
 
+import "slices"
+
 type User struct {
 	ID         int
 	Email      string
@@ -7,5 +9,40 @@ type User struct {
 	Provider   string
 	ProviderID string
 	RefreshToken string
+	Role       Role
+	Status     Status
+
+	// ReauthRequired is set once the provider rejects the stored grant and
+	// cleared by the next login.
+	ReauthRequired bool
+
+	// GrantedScopes are the provider scopes the user's grant covers, as the
+	// provider reported them at the last login.
+	GrantedScopes []string
+
+	// IMAP is set when the user reads mail over IMAP instead of through
+	// their login provider.
+	IMAP *IMAPAccount
+}
+
+const (
+	IMAPAuthPassword = "password"
+	IMAPAuthXOAuth2  = "xoauth2"
+)
+
+// IMAPAccount is a mailbox on a college mail server that is neither Gmail
+// nor Microsoft 365.
+type IMAPAccount struct {
+	Host     string
+	Port     int
+	Username string
+	// Auth is IMAPAuthPassword with an app password in Password, or
+	// IMAPAuthXOAuth2 to log in with the login provider's access token.
+	Auth     string
+	Password string
+}
+
+func (u *User) HasGrantedScope(scope string) bool {
+	return slices.Contains(u.GrantedScopes, scope)
 }
 
@@ -2,17 +2,24 @@ package user
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/r7rainz/auramail/internal/ai"
+	"github.com/r7rainz/auramail/internal/secrets"
 )
 
 type PostgresRepository struct {
-	db *pgxpool.Pool
+	db   *pgxpool.Pool
+	keys *secrets.KeyRing
 }
 
 // FindByID implements [Repository].
@@ -42,19 +49,42 @@ func (r *PostgresRepository) FindByID(ctx context.Context, id string) (*User, er
 
     var u User
     // 2. Use the ::int cast to ensure Postgres compares correctly
-    query := `SELECT id, email, name, provider, provider_id, refresh_token 
-              FROM users WHERE id = $1::int;`
+    query := `SELECT u.id, u.email, COALESCE(u.name, ''), COALESCE(u.provider, ''), u.provider_id, COALESCE(u.refresh_token, ''), u.role, u.status,
+                     u.reauth_required_at IS NOT NULL, u.granted_scopes,
+                     i.user_id IS NOT NULL, COALESCE(i.host, ''), COALESCE(i.port, 0), COALESCE(i.username, ''),
+                     COALESCE(i.auth, ''), COALESCE(i.password, '')
+              FROM users u LEFT JOIN imap_accounts i ON i.user_id = u.id
+              WHERE u.id = $1::int;`
 
+    var storedToken, storedPassword string
+    var hasIMAP bool
+    var imap IMAPAccount
     err := r.db.QueryRow(ctx, query, id).Scan(
-        &u.ID, &u.Email, &u.Name, &u.Provider, &u.ProviderID, &u.RefreshToken,
+        &u.ID, &u.Email, &u.Name, &u.Provider, &u.ProviderID, &storedToken, &u.Role, &u.Status, &u.ReauthRequired, &u.GrantedScopes,
+        &hasIMAP, &imap.Host, &imap.Port, &imap.Username, &imap.Auth, &storedPassword,
     )
 
+    if errors.Is(err, pgx.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
     if err != nil {
         // 3. Log the ACTUAL database error
         log.Printf("DB ERROR for ID %s: %v", id, err)
         return nil, err
     }
 
+    u.RefreshToken, err = r.keys.Decrypt(storedToken)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decrypt credentials for user %d: %w", u.ID, err)
+    }
+    if hasIMAP {
+        imap.Password, err = r.keys.Decrypt(storedPassword)
+        if err != nil {
+            return nil, fmt.Errorf("failed to decrypt imap credentials for user %d: %w", u.ID, err)
+        }
+        u.IMAP = &imap
+    }
+
     log.Printf("DB SUCCESS: Found user %s", u.Email)
     return &u, nil
 }
@@ -62,33 +92,75 @@ func (r *PostgresRepository) FindByID(ctx context.Context, id string) (*User, er
 // Save implements [Repository].
 func (r *PostgresRepository) Save(ctx context.Context, user *User) error {
 	query := `UPDATE users SET email = $1, name = $2, refresh_token = $3 WHERE id = $4;`
-	
-	_, err := r.db.Exec(ctx, query, user.Email, user.Name, user.RefreshToken, user.ID)
+
+	stored, err := r.encryptCredential(user.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(ctx, query, user.Email, optional(user.Name), stored, user.ID)
 	return err
 }
 
-func NewPostgresRepository(db *pgxpool.Pool) *PostgresRepository {
-	return &PostgresRepository{db: db}
+func NewPostgresRepository(db *pgxpool.Pool, keys *secrets.KeyRing) *PostgresRepository {
+	return &PostgresRepository{db: db, keys: keys}
 }
 
-func (r *PostgresRepository) FindOrCreateGoogleUser(ctx context.Context, email, name, sub string) (*User, error) {
-    var u User
-    query := `SELECT id, email, name FROM users WHERE email = $1`
-    err := r.db.QueryRow(ctx, query, email).Scan(&u.ID, &u.Email, &u.Name)
+func (r *PostgresRepository) FindOrCreateProviderUser(ctx context.Context, provider, email, name, subject string, signup Signup) (*User, error) {
+	var u User
+	// Accounts from before providers were recorded are Google accounts.
+	query := `SELECT id, email, COALESCE(name, ''), COALESCE(provider, 'google'), provider_id, role, status FROM users WHERE email = $1`
+	err := r.db.QueryRow(ctx, query, email).Scan(&u.ID, &u.Email, &u.Name, &u.Provider, &u.ProviderID, &u.Role, &u.Status)
 
-    if err == nil {
-        return &u, nil
-    }
+	if err == nil {
+		if u.Provider != provider || u.ProviderID != subject {
+			return nil, ErrProviderMismatch
+		}
+		return &u, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to find user %s: %w", email, err)
+	}
 
-    insertQuery := `INSERT INTO users (email, name, provider_id) 
-                    VALUES ($1, $2, $3) 
-                    RETURNING id, email, name`
-    err = r.db.QueryRow(ctx, insertQuery, email, name, sub).Scan(&u.ID, &u.Email, &u.Name)
-    if err != nil {
-        return nil, err
-    }
+	if signup.Status == "" {
+		return nil, ErrUserNotFound
+	}
 
-    return &u, nil
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start sign-up of %s: %w", email, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if signup.InviteHash != "" {
+		redeemQuery := `UPDATE invites SET uses = uses + 1
+			WHERE code_hash = $1
+			  AND revoked_at IS NULL
+			  AND (expires_at IS NULL OR expires_at > NOW())
+			  AND uses < max_uses
+			  AND (email IS NULL OR LOWER(email) = LOWER($2))`
+		tag, err := tx.Exec(ctx, redeemQuery, signup.InviteHash, email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to redeem invite for %s: %w", email, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return nil, ErrInvalidInvite
+		}
+	}
+
+	insertQuery := `INSERT INTO users (email, name, provider, provider_id, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, email, COALESCE(name, ''), provider, provider_id, role, status`
+	err = tx.QueryRow(ctx, insertQuery, email, optional(name), provider, subject, signup.Status).
+		Scan(&u.ID, &u.Email, &u.Name, &u.Provider, &u.ProviderID, &u.Role, &u.Status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %w", email, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit sign-up of %s: %w", email, err)
+	}
+	return &u, nil
 }
 
 func (r *PostgresRepository) UpdateRefreshToken(
@@ -96,9 +168,14 @@ func (r *PostgresRepository) UpdateRefreshToken(
 	userID int,
 	refreshToken string,
 ) error {
-	query := `UPDATE users SET refresh_token = $1 WHERE id = $2;`
+	query := `UPDATE users SET refresh_token = $1, reauth_required_at = NULL WHERE id = $2;`
 
-	_, err := r.db.Exec(ctx, query, refreshToken, userID)
+	stored, err := r.encryptCredential(refreshToken)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(ctx, query, stored, userID)
 	if err != nil {
 		return fmt.Errorf("failed to update refresh token for user %d: %w", userID, err)
 	}
@@ -106,28 +183,292 @@ func (r *PostgresRepository) UpdateRefreshToken(
 	return nil
 }
 
-func (r *PostgresRepository) FindByRefreshToken(ctx context.Context, token string) (*User, error) {
-	query := `SELECT id, email, name, provider, provider_id, refresh_token FROM users WHERE refresh_token = $1;`
+func (r *PostgresRepository) ClearRefreshToken(ctx context.Context, userID int) error {
+    query := `UPDATE users SET refresh_token = NULL WHERE id = $1;`
+	_, err := r.db.Exec(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to clear refresh token for user %d: %w", userID, err)
+	}
 
-	var u User
-	err := r.db.QueryRow(ctx, query, token).Scan(&u.ID, &u.Email, &u.Name, &u.Provider, &u.ProviderID, &u.RefreshToken)
+	return nil
+}
+
+func (r *PostgresRepository) UpdateGrantedScopes(ctx context.Context, userID int, scopes []string) error {
+	_, err := r.db.Exec(ctx, `UPDATE users SET granted_scopes = $1 WHERE id = $2`, scopes, userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find user by refresh token: %w", err)
+		return fmt.Errorf("failed to update granted scopes for user %d: %w", userID, err)
 	}
 
-	return &u, nil
+	return nil
 }
 
-func (r *PostgresRepository) ClearRefreshToken(ctx context.Context, userID int) error {
-    query := `UPDATE users SET refresh_token = NULL WHERE id = $1;`
+func (r *PostgresRepository) MarkReauthRequired(ctx context.Context, userID int) error {
+	query := `UPDATE users SET reauth_required_at = NOW() WHERE id = $1 AND reauth_required_at IS NULL;`
 	_, err := r.db.Exec(ctx, query, userID)
 	if err != nil {
-		return fmt.Errorf("failed to clear refresh token for user %d: %w", userID, err)
+		return fmt.Errorf("failed to mark user %d for reauthorization: %w", userID, err)
 	}
 
 	return nil
 }
 
+func (r *PostgresRepository) SaveIMAPAccount(ctx context.Context, userID int, account *IMAPAccount) error {
+	stored, err := r.encryptCredential(account.Password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start saving imap account of user %d: %w", userID, err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO imap_accounts (user_id, host, port, username, auth, password)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (user_id) DO UPDATE
+		 SET host = EXCLUDED.host, port = EXCLUDED.port, username = EXCLUDED.username,
+		     auth = EXCLUDED.auth, password = EXCLUDED.password, updated_at = NOW()`,
+		userID, account.Host, account.Port, account.Username, account.Auth, stored,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save imap account of user %d: %w", userID, err)
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET reauth_required_at = NULL WHERE id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to save imap account of user %d: %w", userID, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit imap account of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+func (r *PostgresRepository) DeleteIMAPAccount(ctx context.Context, userID int) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM imap_accounts WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete imap account of user %d: %w", userID, err)
+	}
+
+	return nil
+}
+
+// List returns every user without their provider credentials, for admins.
+func (r *PostgresRepository) List(ctx context.Context) ([]*User, error) {
+	query := `SELECT id, email, COALESCE(name, ''), COALESCE(provider, ''), COALESCE(provider_id, ''), role, status FROM users ORDER BY id`
+
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Provider, &u.ProviderID, &u.Role, &u.Status); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, &u)
+	}
+	return users, rows.Err()
+}
+
+func (r *PostgresRepository) UpdateRole(ctx context.Context, userID int, role Role) error {
+	tag, err := r.db.Exec(ctx, `UPDATE users SET role = $1 WHERE id = $2`, role, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update role for user %d: %w", userID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// UpdateRoleByEmail sets the role of the account with email and returns its
+// ID, or ErrUserNotFound if nobody with that address has logged in yet. It
+// is for cmd/promote, which has no admin to go through /admin.
+func (r *PostgresRepository) UpdateRoleByEmail(ctx context.Context, email string, role Role) (int, error) {
+	var id int
+	err := r.db.QueryRow(ctx, `UPDATE users SET role = $1 WHERE LOWER(email) = LOWER($2) RETURNING id`, role, email).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to update role for %s: %w", email, err)
+	}
+	return id, nil
+}
+
+func (r *PostgresRepository) UpdateStatus(ctx context.Context, userID int, status Status) error {
+	tag, err := r.db.Exec(ctx, `UPDATE users SET status = $1 WHERE id = $2`, status, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update status for user %d: %w", userID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// accountTables hold rows keyed by user_id that are purged with the account.
+var accountTables = []string{
+	"email_summaries",
+	"email_attachments",
+	"email_threads",
+	"refresh_tokens",
+	"sessions",
+	"personal_access_tokens",
+	"auth_codes",
+	"backfill_jobs",
+	"sync_cursors",
+	"gmail_watches",
+	"imap_accounts",
+}
+
+func (r *PostgresRepository) DeleteAccount(ctx context.Context, u *User, grantRevoked bool) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start account deletion: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range accountTables {
+		if _, err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, u.ID); err != nil {
+			return fmt.Errorf("failed to delete %s of user %d: %w", table, u.ID, err)
+		}
+	}
+
+	tag, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, u.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user %d: %w", u.ID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	provider := u.Provider
+	if provider == "" {
+		provider = "google"
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO account_deletions (user_id, email_hash, provider, grant_revoked) VALUES ($1, $2, $3, $4)`,
+		u.ID, emailHash(u.Email), provider, grantRevoked,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record deletion of user %d: %w", u.ID, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit account deletion: %w", err)
+	}
+	return nil
+}
+
+// emailHash lets an auditor confirm that a given address was deleted without
+// the tombstone table keeping a list of former users.
+func emailHash(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// credentialColumns are the columns holding sealed provider credentials,
+// keyed by the user they belong to.
+var credentialColumns = []struct{ table, key, column string }{
+	{"users", "id", "refresh_token"},
+	{"imap_accounts", "user_id", "password"},
+}
+
+// RotateCredentialKeys re-encrypts every stored provider credential that is
+// still plaintext or sealed under an old key. It returns the number of rows
+// rewritten.
+func (r *PostgresRepository) RotateCredentialKeys(ctx context.Context) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start key rotation: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rotated := 0
+	for _, c := range credentialColumns {
+		n, err := r.rotateColumn(ctx, tx, c.table, c.key, c.column)
+		if err != nil {
+			return 0, err
+		}
+		rotated += n
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit key rotation: %w", err)
+	}
+	return rotated, nil
+}
+
+func (r *PostgresRepository) rotateColumn(ctx context.Context, tx pgx.Tx, table, key, column string) (int, error) {
+	rows, err := tx.Query(ctx, `SELECT `+key+`, `+column+` FROM `+table+` WHERE `+column+` IS NOT NULL FOR UPDATE`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load credentials from %s: %w", table, err)
+	}
+
+	updates := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan credentials: %w", err)
+		}
+		if !r.keys.NeedsRotation(stored) {
+			continue
+		}
+
+		plaintext, err := r.keys.Decrypt(stored)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to decrypt %s.%s for user %d: %w", table, column, id, err)
+		}
+		sealed, err := r.keys.Encrypt(plaintext)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		updates[id] = sealed
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read credentials: %w", err)
+	}
+
+	for id, sealed := range updates {
+		if _, err := tx.Exec(ctx, `UPDATE `+table+` SET `+column+` = $1 WHERE `+key+` = $2`, sealed, id); err != nil {
+			return 0, fmt.Errorf("failed to re-encrypt %s.%s for user %d: %w", table, column, id, err)
+		}
+	}
+	return len(updates), nil
+}
+
+// encryptCredential seals value for storage. A missing credential is stored
+// as NULL, so it returns nil for an empty value.
+func (r *PostgresRepository) encryptCredential(value string) (*string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	sealed, err := r.keys.Encrypt(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt credentials: %w", err)
+	}
+	return &sealed, nil
+}
+
+// optional stores an empty value of a nullable column as NULL.
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
 func (r *PostgresRepository) GetSummary(ctx context.Context, gmailID string) (*ai.AIResult, error) {
 	var data []byte
 	query := `SELECT data FROM email_summaries WHERE gmail_id = $1`
@@ -172,3 +513,57 @@ func (r *PostgresRepository) SaveSummary(ctx context.Context, userID int, gmailI
 	}
 	return nil
 }
+
+type PostgresInviteStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresInviteStore(db *pgxpool.Pool) *PostgresInviteStore {
+	return &PostgresInviteStore{db: db}
+}
+
+func (s *PostgresInviteStore) Create(ctx context.Context, invite *Invite) error {
+	query := `INSERT INTO invites (code_hash, email, max_uses, expires_at, created_by)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+		RETURNING id, created_at`
+	err := s.db.QueryRow(ctx, query, invite.CodeHash, invite.Email, invite.MaxUses, invite.ExpiresAt, invite.CreatedBy).
+		Scan(&invite.ID, &invite.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create invite: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresInviteStore) ListActive(ctx context.Context) ([]*Invite, error) {
+	query := `SELECT id, code_hash, COALESCE(email, ''), max_uses, uses, expires_at, created_by, created_at
+		FROM invites
+		WHERE revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW()) AND uses < max_uses
+		ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invites: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []*Invite{}
+	for rows.Next() {
+		var i Invite
+		if err := rows.Scan(&i.ID, &i.CodeHash, &i.Email, &i.MaxUses, &i.Uses, &i.ExpiresAt, &i.CreatedBy, &i.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan invite: %w", err)
+		}
+		invites = append(invites, &i)
+	}
+	return invites, rows.Err()
+}
+
+func (s *PostgresInviteStore) Revoke(ctx context.Context, id int) error {
+	tag, err := s.db.Exec(ctx, `UPDATE invites SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
@@ -2,14 +2,27 @@ package user
 
 import (
 	"context"
+	"errors"
+)
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrProviderMismatch = errors.New("email is registered with another provider")
 )
 
 type Repository interface {
-	FindOrCreateGoogleUser(
+	// FindOrCreateProviderUser returns ErrProviderMismatch if email already
+	// belongs to an account of another provider or another subject, so a
+	// second provider can never take over an existing account. signup only
+	// applies when the account is created: a zero Signup creates nothing and
+	// returns ErrUserNotFound, and a bad invite is ErrInvalidInvite.
+	FindOrCreateProviderUser(
 		ctx context.Context,
+		provider string,
 		email string,
 		name string,
-		googleSub string,
+		subject string,
+		signup Signup,
 	) (*User, error)
 
 	UpdateRefreshToken(
@@ -18,11 +31,33 @@ type Repository interface {
 		refreshToken string,	
 	) error
 
-	FindByRefreshToken(ctx context.Context, token string) (*User, error)
-	
 	ClearRefreshToken(ctx context.Context, userID int) error
 
+	UpdateGrantedScopes(ctx context.Context, userID int, scopes []string) error
+
+	// MarkReauthRequired flags the user's mailbox link as dead until
+	// UpdateRefreshToken stores a fresh grant.
+	MarkReauthRequired(ctx context.Context, userID int) error
+
 	FindByID(ctx context.Context, id string) (*User, error)
 
+	// SaveIMAPAccount links an IMAP mailbox, replacing any earlier one, and
+	// clears ReauthRequired since the credentials are new.
+	SaveIMAPAccount(ctx context.Context, userID int, account *IMAPAccount) error
+
+	DeleteIMAPAccount(ctx context.Context, userID int) error
+
 	Save(ctx context.Context, user *User) error
+
+	List(ctx context.Context) ([]*User, error)
+
+	// UpdateRole returns ErrUserNotFound if there is no such user.
+	UpdateRole(ctx context.Context, userID int, role Role) error
+
+	// UpdateStatus returns ErrUserNotFound if there is no such user.
+	UpdateStatus(ctx context.Context, userID int, status Status) error
+
+	// DeleteAccount removes the user and everything stored for them, and
+	// records a tombstone, in a single transaction.
+	DeleteAccount(ctx context.Context, u *User, grantRevoked bool) error
 }
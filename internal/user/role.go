@@ -0,0 +1,37 @@
+package user
+
+import "errors"
+
+// Role decides what a user may do beyond reading their own mail. Roles are
+// ordered: a coordinator can do everything a student can, and an admin
+// everything a coordinator can.
+type Role string
+
+const (
+	RoleStudent     Role = "student"
+	RoleCoordinator Role = "coordinator"
+	RoleAdmin       Role = "admin"
+)
+
+var ErrInvalidRole = errors.New("invalid role")
+
+var roleRank = map[Role]int{
+	RoleStudent:     1,
+	RoleCoordinator: 2,
+	RoleAdmin:       3,
+}
+
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := roleRank[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
+}
+
+// AtLeast reports whether r grants everything min does. Unknown roles grant
+// nothing.
+func (r Role) AtLeast(min Role) bool {
+	rank, ok := roleRank[r]
+	return ok && rank >= roleRank[min]
+}
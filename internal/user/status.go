@@ -0,0 +1,23 @@
+package user
+
+import "errors"
+
+// Status gates whether a user may sign in at all. Accounts created under the
+// approval sign-up policy start out pending until an admin decides.
+type Status string
+
+const (
+	StatusActive   Status = "active"
+	StatusPending  Status = "pending"
+	StatusRejected Status = "rejected"
+)
+
+var ErrInvalidStatus = errors.New("invalid status")
+
+func ParseStatus(s string) (Status, error) {
+	switch status := Status(s); status {
+	case StatusActive, StatusPending, StatusRejected:
+		return status, nil
+	}
+	return "", ErrInvalidStatus
+}
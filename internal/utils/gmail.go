@@ -1,79 +1,44 @@
 package utils
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
+	"mime"
 	"regexp"
 	"strings"
-	"sync"
 
 	"google.golang.org/api/gmail/v1"
+
+	"github.com/r7rainz/auramail/internal/mailbox"
 )
 
-type EmailMessage struct {
-    ID      string `json:"id"`
-    Subject string `json:"subject"`
-    From    string `json:"from"`
-    Date    string `json:"date"`
-    Body    string `json:"body"`
-    Snippet string `json:"snippet"`
-}
+type EmailMessage = mailbox.Message
 
-func ListPlacementEmails(srv *gmail.Service, query string, maxResults int64) ([]*EmailMessage, error) {
+// ListPlacementEmails fetches the newest messages matching query. Messages
+// that could not be fetched are left out and listed in a
+// *mailbox.DroppedError, which comes back together with the rest.
+func ListPlacementEmails(ctx context.Context, mb mailbox.Mailbox, query string, maxResults int) ([]*EmailMessage, error) {
 	//getting list of ids 
-	res, err := srv.Users.Messages.List("me").Q(query).MaxResults(maxResults).Do()
+	ids, err := mb.Search(ctx, query, maxResults)
 	if err != nil {
 		return nil, err
 	}
 
-	//channels setup ( the queue) - 'jobs' sends IDs to the workers; 'results' collects finished emails
-	jobs := make(chan string, len(res.Messages))
-	results := make(chan *EmailMessage, len(res.Messages))
-
-	var wg sync.WaitGroup
-
-	for range 10 {
-		wg.Go(func() {
-			for id := range jobs {
-				msg, err := srv.Users.Messages.Get("me", id).Format("full").Do()
-				if err != nil {
-					continue
-				}
-
-				email := &EmailMessage{
-					ID: id, 
-					Snippet: msg.Snippet,
-				}
-
-				//header parsing
-				for _, h := range msg.Payload.Headers {
-					if h.Name == "Subject" { email.Subject = h.Value }
-					if h.Name == "From" { email.From = h.Value }
-				}
-
-				email.Body = ParseBody(msg.Payload)
-				results <- email
-			}
-		} )
-	} 
-
-	//Feeding the workers 
-	for _, m := range res.Messages {
-		jobs <- m.Id
-	}
-	close(jobs) //no more ids to send
-
-	//wait and collect results
-	go func()  {
-		wg.Wait()
-		close(results)
-	} ()
+	//fetching them all at once; mailboxes that support it batch the requests
+	emails, errs := mailbox.FetchAll(ctx, mb, ids, 10)
 
 	var finalResult []*EmailMessage
-	for email := range results {
-		finalResult = append(finalResult,email)
+	for i, email := range emails {
+		if errors.Is(errs[i], mailbox.ErrReauthRequired) {
+			return nil, mailbox.ErrReauthRequired
+		}
+		if errs[i] != nil {
+			continue
+		}
+		finalResult = append(finalResult, email)
 	}
-	return finalResult, nil
+	return finalResult, mailbox.Dropped(ids, errs)
 }
 
 //CleanTextForAI
@@ -83,18 +48,40 @@ func CleanTextForAi(input string) string {
 
 	cleaned = strings.TrimSpace(cleaned)
 
-	//limiting to size 2000
+	return truncateForAi(cleaned)
+}
+
+//limiting to size 2000, without cutting a character in half
+func truncateForAi(cleaned string) string {
 	if len(cleaned) > 2000 {
-		return cleaned[:2000] + "... [truncated]"
+		return TruncateRunes(cleaned, 2000) + "... [truncated]"
 	}
 
 	return cleaned
 }
 
+// ParseBody returns the text of the part a mail client would show: the body
+// that is not an attachment, and of the alternatives of a
+// multipart/alternative the last one with any text, which by convention is
+// the richest, usually HTML. HTML is converted by HTMLBody.
 func ParseBody(payload *gmail.MessagePart) string {
-	if payload.MimeType == "text/plain" && payload.Body.Data != "" {
-		data, _ := base64.URLEncoding.DecodeString(payload.Body.Data)
-		return CleanTextForAi(string(data))
+	if payload == nil || payload.Filename != "" {
+		return ""
+	}
+
+	mimeType := strings.ToLower(payload.MimeType)
+	switch {
+	case mimeType == "text/plain":
+		return CleanTextForAi(partText(payload))
+	case mimeType == "text/html":
+		return HTMLBody(partText(payload))
+	case mimeType == "multipart/alternative":
+		for i := len(payload.Parts) - 1; i >= 0; i-- {
+			if result := ParseBody(payload.Parts[i]); result != "" {
+				return result
+			}
+		}
+		return ""
 	}
 
 	for _, part := range payload.Parts {
@@ -108,6 +95,27 @@ func ParseBody(payload *gmail.MessagePart) string {
 
 }
 
+// partText decodes a part's content to UTF-8. Gmail has already undone the
+// Content-Transfer-Encoding, so only the charset is left.
+func partText(payload *gmail.MessagePart) string {
+	if payload.Body == nil || payload.Body.Data == "" {
+		return ""
+	}
+	data, err := DecodeBase64(payload.Body.Data)
+	if err != nil {
+		return ""
+	}
+	var label string
+	for _, h := range payload.Headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			if _, params, err := mime.ParseMediaType(h.Value); err == nil {
+				label = params["charset"]
+			}
+		}
+	}
+	return DecodeCharset(data, label, payload.MimeType)
+}
+
 func FormatForAI(emails []*EmailMessage) string {
 	var builder strings.Builder
 	builder.WriteString("Here are the latest placement emails:\n\n")
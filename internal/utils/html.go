@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockElements start and end on a line of their own.
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Blockquote: true, atom.Center: true,
+	atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true, atom.Footer: true,
+	atom.Form: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true, atom.Li: true,
+	atom.Ol: true, atom.P: true, atom.Pre: true, atom.Section: true, atom.Table: true,
+	atom.Tr: true, atom.Ul: true,
+}
+
+// skippedElements never show up in a mail client.
+var skippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Title: true,
+	atom.Noscript: true, atom.Template: true,
+}
+
+// HTMLToText renders an HTML mail body as text that keeps the layout a
+// student would read: one line per table row with " | " between the cells
+// that have content, "- " or "1. " before list items, and link targets in
+// parentheses after the link text. Scripts, styles and hidden elements are
+// dropped.
+func HTMLToText(src string) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return ""
+	}
+	var t htmlText
+	t.render(doc)
+	return t.b.String()
+}
+
+// HTMLBody converts an HTML body for the summarizer, like CleanTextForAi
+// does for plain text but keeping the lines.
+func HTMLBody(src string) string {
+	return cleanLines(HTMLToText(src))
+}
+
+type listState struct {
+	ordered bool
+	n       int
+}
+
+type htmlText struct {
+	b     strings.Builder
+	lists []listState
+	cells []int // cells seen in each open table row
+	pre   int
+
+	// space and sep are written before the next word, unless a line break
+	// comes first.
+	space bool
+	sep   string
+}
+
+func (t *htmlText) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		t.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			t.render(c)
+		}
+		return
+	}
+
+	if skippedElements[n.DataAtom] || hidden(n) {
+		return
+	}
+	block := blockElements[n.DataAtom]
+	if block {
+		t.newline()
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		t.b.WriteByte('\n')
+		t.space, t.sep = false, ""
+		return
+	case atom.Ul, atom.Ol:
+		t.lists = append(t.lists, listState{ordered: n.DataAtom == atom.Ol})
+		defer func() { t.lists = t.lists[:len(t.lists)-1] }()
+	case atom.Li:
+		t.listMarker()
+	case atom.Tr:
+		t.cells = append(t.cells, 0)
+		defer func() { t.cells = t.cells[:len(t.cells)-1] }()
+	case atom.Td, atom.Th:
+		if k := len(t.cells) - 1; k >= 0 {
+			if t.cells[k] > 0 {
+				t.sep = " | "
+			}
+			t.cells[k]++
+		}
+	case atom.Pre:
+		t.pre++
+		defer func() { t.pre-- }()
+	case atom.A:
+		start := t.b.Len()
+		t.children(n)
+		t.link(attr(n, "href"), t.b.String()[start:])
+		return
+	}
+
+	t.children(n)
+	if block {
+		t.newline()
+	}
+}
+
+func (t *htmlText) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.render(c)
+	}
+}
+
+func (t *htmlText) text(s string) {
+	if t.pre > 0 {
+		t.b.WriteString(s)
+		return
+	}
+	if r, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(r) {
+		t.space = true
+	}
+	for i, w := range strings.Fields(s) {
+		if i > 0 {
+			t.space = true
+		}
+		t.word(w)
+	}
+	if r, _ := utf8.DecodeLastRuneInString(s); unicode.IsSpace(r) {
+		t.space = true
+	}
+}
+
+func (t *htmlText) word(w string) {
+	switch {
+	case t.atLineStart():
+	case t.sep != "":
+		t.b.WriteString(t.sep)
+	case t.space && t.last() != ' ':
+		t.b.WriteByte(' ')
+	}
+	t.space, t.sep = false, ""
+	t.b.WriteString(w)
+}
+
+func (t *htmlText) newline() {
+	if !t.atLineStart() {
+		t.b.WriteByte('\n')
+	}
+	t.space, t.sep = false, ""
+}
+
+func (t *htmlText) listMarker() {
+	if len(t.lists) == 0 {
+		t.b.WriteString("- ")
+		return
+	}
+	l := &t.lists[len(t.lists)-1]
+	t.b.WriteString(strings.Repeat("  ", len(t.lists)-1))
+	if l.ordered {
+		l.n++
+		t.b.WriteString(strconv.Itoa(l.n) + ". ")
+	} else {
+		t.b.WriteString("- ")
+	}
+}
+
+// link adds the target after the link text, unless it says the same thing
+// or is not something a student could open.
+func (t *htmlText) link(href, text string) {
+	href = strings.TrimSpace(href)
+	lower := strings.ToLower(href)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "mailto:") {
+		return
+	}
+	target := href
+	if strings.HasPrefix(lower, "mailto:") {
+		target = href[len("mailto:"):]
+	}
+	if text = strings.TrimSpace(text); text == target || text == href {
+		return
+	}
+	t.space = true
+	t.word("(" + target + ")")
+}
+
+func (t *htmlText) atLineStart() bool {
+	last := t.last()
+	return last == 0 || last == '\n'
+}
+
+func (t *htmlText) last() byte {
+	if t.b.Len() == 0 {
+		return 0
+	}
+	s := t.b.String()
+	return s[len(s)-1]
+}
+
+// hidden reports whether n is styled out of view, as mail templates do with
+// preheader text meant only for the inbox preview.
+func hidden(n *html.Node) bool {
+	if _, ok := attrValue(n, "hidden"); ok {
+		return true
+	}
+	style := strings.ToLower(strings.ReplaceAll(attr(n, "style"), " ", ""))
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden")
+}
+
+func attr(n *html.Node, key string) string {
+	v, _ := attrValue(n, key)
+	return v
+}
+
+func attrValue(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// cleanLines collapses the spacing within each line, drops blank lines
+// beyond one in a row and truncates like CleanTextForAi.
+func cleanLines(input string) string {
+	var lines []string
+	blank := true
+	for line := range strings.Lines(input) {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			if !blank {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+		lines = append(lines, indent+line)
+		blank = false
+	}
+	cleaned := strings.TrimSpace(strings.Join(lines, "\n"))
+	return truncateForAi(cleaned)
+}
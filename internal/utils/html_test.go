@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestHTMLBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "table rows and cells",
+			input: `<table><tr><th>Branch</th><th>CGPA</th><th>CTC</th></tr>
+				<tr><td>CSE</td><td>7.5</td><td>12 LPA</td></tr>
+				<tr><td>ECE</td><td></td><td>10&nbsp;LPA</td></tr></table>`,
+			want: "Branch | CGPA | CTC\nCSE | 7.5 | 12 LPA\nECE | 10 LPA",
+		},
+		{
+			name: "layout tables add no separators",
+			input: `<table><tr><td><table><tr><td></td><td><p>Dear students,</p>
+				<p>The drive is on <b>Friday</b>.</p></td></tr></table></td></tr></table>`,
+			want: "Dear students,\nThe drive is on Friday.",
+		},
+		{
+			name:  "lists",
+			input: `<p>Rounds:</p><ol><li>Online test</li><li>Interview<ul><li>Technical</li><li>HR</li></ul></li></ol>`,
+			want:  "Rounds:\n1. Online test\n2. Interview\n  - Technical\n  - HR",
+		},
+		{
+			name:  "links",
+			input: `Register <a href="https://forms.example/drive">here</a> or write to <a href="mailto:tpo@college.edu">tpo@college.edu</a>.<br><a href="https://x.example"><img src="logo.png"></a>`,
+			want:  "Register here (https://forms.example/drive) or write to tpo@college.edu.\n(https://x.example)",
+		},
+		{
+			name: "hidden and non-visible content",
+			input: `<html><head><title>Mailer</title><style>p{color:red}</style></head><body>
+				<div style="display: none">Preheader text</div><script>track()</script>
+				<p>Visible</p></body></html>`,
+			want: "Visible",
+		},
+		{
+			name:  "line breaks",
+			input: `Venue:<br>Main   Auditorium<br><br><br>Time: 10 AM`,
+			want:  "Venue:\nMain Auditorium\n\nTime: 10 AM",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTMLBody(tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func textPart(mimeType, content string) *gmail.MessagePart {
+	return &gmail.MessagePart{
+		MimeType: mimeType,
+		Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(content))},
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	plain := textPart("text/plain", "Eligibility: see the table")
+	html := textPart("text/html", "<table><tr><td>CSE</td><td>7.5</td></tr></table>")
+	emptyHTML := textPart("text/html", "<div style='display:none'>preheader</div>")
+	attachment := textPart("text/plain", "notes from the attachment")
+	attachment.Filename = "notes.txt"
+
+	tests := []struct {
+		name    string
+		payload *gmail.MessagePart
+		want    string
+	}{
+		{"plain only", plain, "Eligibility: see the table"},
+		{"html only", html, "CSE | 7.5"},
+		{
+			name:    "alternative prefers html",
+			payload: &gmail.MessagePart{MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{plain, html}},
+			want:    "CSE | 7.5",
+		},
+		{
+			name:    "alternative falls back to plain",
+			payload: &gmail.MessagePart{MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{plain, emptyHTML}},
+			want:    "Eligibility: see the table",
+		},
+		{
+			name: "mixed skips attachments",
+			payload: &gmail.MessagePart{MimeType: "multipart/mixed", Parts: []*gmail.MessagePart{
+				attachment,
+				{MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{plain, html}},
+			}},
+			want: "CSE | 7.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseBody(tt.payload); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
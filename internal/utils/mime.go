@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset Lookup knows,
+// not just the UTF-8 and ISO-8859-1 the standard library handles.
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		enc, _ := charset.Lookup(label)
+		if enc == nil {
+			return nil, errors.New("unsupported charset " + label)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// DecodeBase64 decodes base64 in either alphabet, with or without padding
+// and line breaks. Gmail sends unpadded URL-safe base64 but some clients and
+// gateways pad it or use the standard alphabet.
+func DecodeBase64(data string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.Map(base64Rune, data))
+}
+
+// base64Rune maps the URL-safe alphabet onto the standard one and drops
+// padding, line breaks and anything else outside the alphabet, which
+// RFC 2045 says decoders ignore.
+func base64Rune(r rune) rune {
+	switch {
+	case r == '-':
+		return '+'
+	case r == '_':
+		return '/'
+	case r == '+', r == '/', r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		return r
+	}
+	return -1
+}
+
+// base64Filter streams its reader through base64Rune.
+type base64Filter struct {
+	r io.Reader
+}
+
+func (f base64Filter) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			if m := base64Rune(rune(c)); m >= 0 {
+				p[kept] = byte(m)
+				kept++
+			}
+		}
+		// A read that was all line breaks is not the end of the data.
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// DecodeTransfer undoes a Content-Transfer-Encoding. 7bit, 8bit, binary and
+// unknown encodings pass through. Base64 is decoded as leniently as
+// DecodeBase64 does.
+func DecodeTransfer(body io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.RawStdEncoding, base64Filter{body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// DecodeCharset converts the content of a part with the given media type and
+// charset parameter to UTF-8. Without a charset, HTML is sniffed for a <meta>
+// declaration and other text is taken as UTF-8 if it is valid and as
+// Windows-1252, the most common mislabelled charset, otherwise. Bytes that
+// cannot be decoded become U+FFFD, so the result is always valid UTF-8.
+func DecodeCharset(content []byte, label, mediaType string) string {
+	if label == "" && strings.EqualFold(mediaType, "text/html") {
+		enc, _, _ := charset.DetermineEncoding(content, "text/html")
+		if decoded, err := enc.NewDecoder().Bytes(content); err == nil {
+			return strings.ToValidUTF8(string(decoded), "�")
+		}
+	}
+	if label == "" {
+		if utf8.Valid(content) {
+			return string(content)
+		}
+		label = "windows-1252"
+	}
+
+	enc, name := charset.Lookup(label)
+	if enc == nil || name == "utf-8" {
+		return strings.ToValidUTF8(string(content), "�")
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return strings.ToValidUTF8(string(content), "�")
+	}
+	return strings.ToValidUTF8(string(decoded), "�")
+}
+
+// DecodeHeader decodes the RFC 2047 encoded words in a header value, keeping
+// the raw value if that fails.
+func DecodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		decoded = value
+	}
+	return strings.ToValidUTF8(decoded, "�")
+}
+
+// TruncateRunes cuts s to at most n bytes without splitting a rune.
+func TruncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDecodeBase64(t *testing.T) {
+	want := "Venue: Hall ü?>"
+	for name, encoded := range map[string]string{
+		"url-safe unpadded": base64.RawURLEncoding.EncodeToString([]byte(want)),
+		"url-safe padded":   base64.URLEncoding.EncodeToString([]byte(want)),
+		"standard padded":   base64.StdEncoding.EncodeToString([]byte(want)),
+		"with line breaks":  base64.StdEncoding.EncodeToString([]byte(want))[:8] + "\r\n" + base64.StdEncoding.EncodeToString([]byte(want))[8:],
+	} {
+		got, err := DecodeBase64(encoded)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: DecodeBase64(%q) = %q, %v", name, encoded, got, err)
+		}
+	}
+}
+
+func TestDecodeTransferBase64(t *testing.T) {
+	want := "Venue: Hall ü?> on Friday, 10 AM"
+	std := base64.StdEncoding.EncodeToString([]byte(want))
+	for name, encoded := range map[string]string{
+		"padded":            std,
+		"unpadded":          base64.RawStdEncoding.EncodeToString([]byte(want)),
+		"url-safe":          base64.RawURLEncoding.EncodeToString([]byte(want)),
+		"wrapped lines":     std[:16] + "\r\n" + std[16:32] + "\r\n \t" + std[32:],
+		"stray characters":  std[:12] + "*" + std[12:] + "\r\n#",
+		"line breaks first": "\r\n\r\n" + std,
+	} {
+		got, err := io.ReadAll(DecodeTransfer(strings.NewReader(encoded), "Base64"))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: DecodeTransfer(%q) = %q, %v", name, encoded, got, err)
+		}
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		label     string
+		mediaType string
+		want      string
+	}{
+		{"utf-8", "Café", "utf-8", "text/plain", "Café"},
+		{"iso-8859-1", "Caf\xe9", "ISO-8859-1", "text/plain", "Café"},
+		{"windows-1252 quotes", "\x93Offer\x94 \x96 \x80 12L", "windows-1252", "text/plain", "“Offer” – € 12L"},
+		{"unlabelled latin-1", "Caf\xe9", "", "text/plain", "Café"},
+		{"unlabelled utf-8", "Café", "", "text/plain", "Café"},
+		{"html meta", `<meta charset="iso-8859-1"><p>Caf` + "\xe9", "", "text/html", `<meta charset="iso-8859-1"><p>Café`},
+		{"invalid utf-8", "ok\xffok", "utf-8", "text/plain", "ok�ok"},
+		{"unknown charset", "plain", "x-made-up", "text/plain", "plain"},
+	}
+	for _, tt := range tests {
+		if got := DecodeCharset([]byte(tt.content), tt.label, tt.mediaType); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	tests := map[string]string{
+		"=?UTF-8?B?UGxhY2VtZW50IGRyaXZlIOKAkyBDb250b3Nv?=":   "Placement drive – Contoso",
+		"=?ISO-8859-1?Q?Caf=E9_drive?=":                      "Café drive",
+		"=?windows-1252?Q?=93Shortlist=94?= for round 2":     "“Shortlist” for round 2",
+		"=?koi8-r?B?8NLJ18XU?=":                              "Привет",
+		"=?utf-8?q?broken":                                   "=?utf-8?q?broken",
+		"Plain subject":                                      "Plain subject",
+		"=?UTF-8?B?UGxhY2VtZW50?= =?UTF-8?B?IGRyaXZl?= 2026": "Placement drive 2026",
+	}
+	for in, want := range tests {
+		if got := DecodeHeader(in); got != want {
+			t.Errorf("DecodeHeader(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCleanTextForAiKeepsRunesWhole(t *testing.T) {
+	// 1999 bytes of ASCII then a three-byte rune across the 2000 byte mark.
+	input := strings.Repeat("a", 1999) + "€" + strings.Repeat("b", 10)
+	got := CleanTextForAi(input)
+	if !utf8.ValidString(got) {
+		t.Fatalf("truncated text is not valid UTF-8: %q", got[1990:])
+	}
+	if want := strings.Repeat("a", 1999) + "... [truncated]"; got != want {
+		t.Errorf("got ...%q", got[1990:])
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"placement", 100, "placement"},
+		{"placement", 5, "place"},
+		{"caf€ drive", 4, "caf"},
+		{"caf€ drive", 5, "caf"},
+		{"caf€ drive", 6, "caf€"},
+	} {
+		if got := TruncateRunes(tt.in, tt.n); got != tt.want {
+			t.Errorf("TruncateRunes(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func encodedPart(mimeType, contentType, content string) *gmail.MessagePart {
+	p := &gmail.MessagePart{
+		MimeType: mimeType,
+		Body:     &gmail.MessagePartBody{Data: base64.RawURLEncoding.EncodeToString([]byte(content))},
+	}
+	if contentType != "" {
+		p.Headers = []*gmail.MessagePartHeader{{Name: "Content-Type", Value: contentType}}
+	}
+	return p
+}
+
+func TestParseBodyCharsets(t *testing.T) {
+	latin1 := encodedPart("text/plain", `text/plain; charset="iso-8859-1"`, "R\xe9sum\xe9 deadline")
+	if got := ParseBody(latin1); got != "Résumé deadline" {
+		t.Errorf("latin-1 part = %q", got)
+	}
+
+	html := encodedPart("text/html", "text/html; charset=windows-1252", "<p>\x93Eligibility\x94</p>")
+	if got := ParseBody(html); got != "“Eligibility”" {
+		t.Errorf("windows-1252 html = %q", got)
+	}
+}
+
+// FuzzParseBody feeds the shapes mail actually comes in through ParseBody:
+// whatever the bytes, labels and encodings, the body must be valid UTF-8 and
+// within the summarizer's limit.
+func FuzzParseBody(f *testing.F) {
+	f.Add("text/plain", "text/plain; charset=utf-8", []byte("Register by Friday"), false)
+	f.Add("text/plain", `text/plain; charset="ISO-8859-1"`, []byte("Caf\xe9 \xa312"), false)
+	f.Add("text/html", "text/html", []byte(`<meta http-equiv="Content-Type" content="text/html; charset=windows-1252"><table><tr><td>CTC</td><td>\x8012L</td></tr></table>`), true)
+	f.Add("text/html", "text/html; charset=utf-8", []byte("<ul><li>Round 1<li>Round 2</ul><a href='https://x'>apply"), true)
+	f.Add("text/plain", "text/plain; charset=x-unknown", []byte("\xff\xfe\x00s\x00"), false)
+	f.Add("text/plain", "text/plain; charset", []byte(strings.Repeat("€", 700)), true)
+
+	f.Fuzz(func(t *testing.T, mimeType, contentType string, content []byte, alternative bool) {
+		payload := encodedPart(mimeType, contentType, string(content))
+		if alternative {
+			payload = &gmail.MessagePart{MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{
+				encodedPart("text/plain", "text/plain", "fallback"),
+				payload,
+			}}
+		}
+
+		got := ParseBody(payload)
+		if !utf8.ValidString(got) {
+			t.Errorf("ParseBody returned invalid UTF-8 %q", got)
+		}
+		if len(got) > 2000+len("... [truncated]") {
+			t.Errorf("ParseBody returned %d bytes", len(got))
+		}
+	})
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add("=?UTF-8?B?UGxhY2VtZW50IGRyaXZl?=")
+	f.Add("=?iso-8859-1?q?Caf=E9?= <tpo@college.edu>")
+	f.Add("=?gb2312?B?1tDOxA==?=")
+	f.Add("Raw \xe9 bytes")
+	f.Add("=?utf-8?b?invalid base64?=")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		if got := DecodeHeader(value); !utf8.ValidString(got) {
+			t.Errorf("DecodeHeader(%q) = %q, not valid UTF-8", value, got)
+		}
+	})
+}
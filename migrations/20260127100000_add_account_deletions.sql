@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS account_deletions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    email_hash TEXT NOT NULL,       -- sha256 of the lowercased email, never the address itself
+    provider TEXT NOT NULL,
+    grant_revoked BOOLEAN NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS account_deletions;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Set when the provider answers invalid_grant; cleared when the user logs in
+-- again and a fresh refresh token is stored.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reauth_required_at TIMESTAMP WITH TIME ZONE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS reauth_required_at;
+-- +goose StatementEnd
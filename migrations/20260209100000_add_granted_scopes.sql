@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Provider scopes covered by the user's grant, e.g.
+-- https://www.googleapis.com/auth/gmail.modify after an incremental upgrade.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS granted_scopes TEXT[] NOT NULL DEFAULT '{}';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS granted_scopes;
+-- +goose StatementEnd
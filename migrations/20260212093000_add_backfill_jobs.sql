@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS backfill_jobs (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    query TEXT NOT NULL,
+    after_at TIMESTAMP WITH TIME ZONE,   -- date window, NULL means open
+    before_at TIMESTAMP WITH TIME ZONE,
+    page_token TEXT NOT NULL DEFAULT '', -- cursor of the next page to process
+    status TEXT NOT NULL,
+    pages INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    summarized INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    estimate INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_backfill_jobs_user_id ON backfill_jobs(user_id, id DESC);
+CREATE UNIQUE INDEX backfill_jobs_one_running_idx ON backfill_jobs(user_id) WHERE status = 'running';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS backfill_jobs;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS sync_cursors (
+    user_id INTEGER NOT NULL,
+    query TEXT NOT NULL,
+    cursor TEXT NOT NULL,                    -- provider change log position, e.g. Gmail historyId
+    recent_ids TEXT[] NOT NULL DEFAULT '{}', -- messages the last sync returned, newest first
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, query)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS sync_cursors;
+-- +goose StatementEnd
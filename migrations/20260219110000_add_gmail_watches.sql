@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS gmail_watches (
+    user_id INTEGER PRIMARY KEY,
+    email_address TEXT NOT NULL UNIQUE, -- lowercased; push notifications only carry the address
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_gmail_watches_expires_at ON gmail_watches(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS gmail_watches;
+-- +goose StatementEnd
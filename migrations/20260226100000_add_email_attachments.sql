@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS email_attachments (
+    user_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL,
+    position INTEGER NOT NULL,  -- order among the message's readable attachments
+    filename TEXT NOT NULL,
+    mime_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    content BYTEA,              -- NULL if it was too large or failed to download
+    text TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '', -- why no text was extracted, e.g. 'pdf: attachment is encrypted'
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id, position)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS email_attachments;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS email_threads (
+    user_id INTEGER NOT NULL,
+    thread_id TEXT NOT NULL,
+    messages JSONB NOT NULL DEFAULT '[]', -- per-message summaries, oldest first
+    latest_at TIMESTAMP WITH TIME ZONE,   -- date of the newest message
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, thread_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_threads_latest ON email_threads (user_id, latest_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS email_threads;
+-- +goose StatementEnd